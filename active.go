@@ -0,0 +1,148 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// activeStorePrefix prefixes the active sessions in the store
+	activeStorePrefix = "active:"
+)
+
+// activeSession is a session logged in via the proxy, as listed to the admins
+type activeSession struct {
+	// the id of the session at the provider, else the subject
+	Session string `json:"session"`
+	// the subject of the user
+	Subject string `json:"subject"`
+	// the email of the user
+	Email string `json:"email"`
+	// when the session was issued
+	IssuedAt time.Time `json:"issued_at"`
+	// when the session expires, with the refresh token if any, an offline session without a duration never does
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// the address of the client at the login
+	ClientIP string `json:"client_ip"`
+}
+
+// activeSessions records the sessions logged in via the proxy in the store, so the listing covers every instance,
+// keyed by a hash of the session id and held until the session expires or is logged out
+type activeSessions struct {
+	// the store holding the sessions
+	store storage
+	// the listing of the keys in the store
+	lister storageLister
+}
+
+// newActiveSessions creates the registry of the active sessions
+func newActiveSessions(store storage) (*activeSessions, error) {
+	lister, ok := getStorageLister(store)
+	if !ok {
+		return nil, errors.New("the store does not support listing the active sessions")
+	}
+
+	return &activeSessions{store: store, lister: lister}, nil
+}
+
+// getActiveSessionKey returns the key of the session in the store
+func getActiveSessionKey(session string) string {
+	sum := sha256.Sum256([]byte(session))
+
+	return activeStorePrefix + hex.EncodeToString(sum[:])
+}
+
+// add records the session until it expires
+func (r *activeSessions) add(session activeSession, now time.Time) error {
+	encoded, err := json.Marshal(&session)
+	if err != nil {
+		return err
+	}
+	key := getActiveSessionKey(session.Session)
+	if store, ok := getStorageExpiration(r.store); ok && session.ExpiresAt != nil {
+		return store.SetWithExpiration(key, string(encoded), session.ExpiresAt.Sub(now))
+	}
+
+	return r.store.Set(key, string(encoded))
+}
+
+// remove removes the session from the registry
+func (r *activeSessions) remove(session string) error {
+	return r.store.Delete(getActiveSessionKey(session))
+}
+
+// list returns the sessions yet to expire, newest first; the stores without an expiration keep the expired
+// sessions, so they are removed as we come across them
+func (r *activeSessions) list(now time.Time) ([]activeSession, error) {
+	items, err := r.lister.List(activeStorePrefix)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]activeSession, 0, len(items))
+	for key, value := range items {
+		var session activeSession
+		if err := json.Unmarshal([]byte(value), &session); err != nil {
+			log.WithFields(log.Fields{"key": key}).Warnf("ignoring the invalid active session in the store")
+			continue
+		}
+		if session.ExpiresAt != nil && now.After(*session.ExpiresAt) {
+			if err := r.store.Delete(key); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to remove the expired active session")
+			}
+			continue
+		}
+		list = append(list, session)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IssuedAt.After(list[j].IssuedAt) })
+
+	return list, nil
+}
+
+// recordActiveSession records the session of the login, if enabled, a zero expiration being an offline session
+// without a duration; a failure of the store is logged but never fails the login
+func (r *oauthProxy) recordActiveSession(cx *gin.Context, user *userContext, expiration time.Duration) {
+	if r.actives == nil {
+		return
+	}
+	now := time.Now()
+	issuedAt, found, err := user.claims.TimeClaim(claimIssuedAt)
+	if err != nil || !found {
+		issuedAt = now
+	}
+	session := activeSession{
+		Session:  getSessionID(user),
+		Subject:  user.id,
+		Email:    user.email,
+		IssuedAt: issuedAt.UTC(),
+		ClientIP: cx.ClientIP(),
+	}
+	if expiration > 0 {
+		expiresAt := now.Add(expiration).UTC()
+		session.ExpiresAt = &expiresAt
+	}
+	if err := r.actives.add(session, now); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to record the active session")
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActiveSessions(t *testing.T) {
+	store := &fakeStore{items: make(map[string]string)}
+	actives, err := newActiveSessions(store)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	now := time.Now().UTC()
+	expires := now.Add(time.Hour)
+	expired := now.Add(-time.Second)
+	for _, x := range []activeSession{
+		{Session: "older", Subject: "a", IssuedAt: now.Add(-time.Hour), ExpiresAt: &expires},
+		{Session: "newer", Subject: "b", IssuedAt: now, ExpiresAt: &expires},
+		{Session: "offline", Subject: "c", IssuedAt: now.Add(-2 * time.Hour)},
+		{Session: "expired", Subject: "d", IssuedAt: now, ExpiresAt: &expired},
+	} {
+		assert.NoError(t, actives.add(x, now))
+	}
+	store.items["unrelated"] = "value"
+
+	list, err := actives.list(now)
+	assert.NoError(t, err)
+	var sessions []string
+	for _, x := range list {
+		sessions = append(sessions, x.Session)
+	}
+	assert.Equal(t, []string{"newer", "older", "offline"}, sessions)
+	// step: the expired session is removed as it's listed
+	assert.NotContains(t, store.items, getActiveSessionKey("expired"))
+
+	assert.NoError(t, actives.remove("newer"))
+	list, err = actives.list(now)
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+}
+
+func TestActiveSessionsUnsupported(t *testing.T) {
+	_, err := newActiveSessions(&memcachedStore{})
+	assert.Error(t, err)
+}
+
+func TestActiveSessionsHandler(t *testing.T) {
+	defer os.Remove("/tmp/bolt-active")
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableActiveSessions = true
+	cfg.StoreURL = "boltdb:////tmp/bolt-active"
+	cfg.AdminRoles = []string{fakeAdminRole}
+	p, idp, svc := newTestProxyService(cfg)
+	defer p.store.Close()
+	newToken := func(subject string, roles []string) (*userContext, string) {
+		signed, _ := idp.signToken(jose.Claims{
+			"iss":           idp.getLocation(),
+			"aud":           fakeClientID,
+			"sub":           subject,
+			"email":         subject + "@example.com",
+			"session_state": subject + "-session",
+			"iat":           float64(time.Now().Add(-time.Minute).Unix()),
+			"exp":           float64(time.Now().Add(time.Hour).Unix()),
+			"realm_access":  map[string]interface{}{"roles": roles},
+		})
+		user, _ := extractIdentity(*signed)
+		return user, signed.Encode()
+	}
+	_, admin := newToken("admin", []string{fakeAdminRole})
+	user, token := newToken("user", []string{})
+	expires := time.Now().Add(time.Hour).UTC()
+	assert.NoError(t, p.actives.add(activeSession{
+		Session:   getSessionID(user),
+		Subject:   user.id,
+		Email:     user.email,
+		IssuedAt:  time.Now().UTC(),
+		ExpiresAt: &expires,
+		ClientIP:  "10.0.0.1",
+	}, time.Now()))
+
+	request := func(token string) (int, []activeSession) {
+		var list []activeSession
+		req, _ := http.NewRequest(http.MethodGet, svc+oauthURL+adminURL+sessionsURL+activeURL, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		}
+
+		return resp.StatusCode, list
+	}
+	code, _ := request(token)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, list := request(admin)
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, "user-session", list[0].Session)
+		assert.Equal(t, "user", list[0].Subject)
+		assert.Equal(t, "user@example.com", list[0].Email)
+		assert.Equal(t, "10.0.0.1", list[0].ClientIP)
+	}
+
+	// step: the session is removed on logout
+	assert.NoError(t, p.deleteStoredSession(user))
+	code, list = request(admin)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, list)
+}
@@ -0,0 +1,403 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// apiKeyHeader is the header the api keys are presented in
+	apiKeyHeader = "X-API-Key"
+	// apiKeyPrefix prefixes the api keys, so they are recognisable when leaked
+	apiKeyPrefix = "kp_"
+	// apiKeyStorePrefix prefixes the hash of the api keys in the store
+	apiKeyStorePrefix = "api-key:"
+	// serviceAccountTokenMargin is the time before the expiration the service account token is renewed
+	serviceAccountTokenMargin = 30 * time.Second
+	// apiKeyOwnerRecheck is the longest the token of an owner is used before the owner is impersonated again, so a
+	// disabled or removed user loses the access of their keys within the interval
+	apiKeyOwnerRecheck = time.Minute
+	// apiKeyRequestedWithHeader must be sent by a session managing its api keys, a cross site form can't set it
+	apiKeyRequestedWithHeader = "X-Requested-With"
+)
+
+// apiKey is the record of an api key held in the store, the key itself is never stored
+type apiKey struct {
+	// Name is the name given to the key by the owner
+	Name string `json:"name"`
+	// Owner is the subject of the user who minted the key
+	Owner string `json:"owner"`
+	// OwnerName is the username of the owner
+	OwnerName string `json:"owner-name"`
+	// Roles are the roles of the owner when the key was minted, the most the key is granted
+	Roles []string `json:"roles"`
+	// Created is the time the key was minted
+	Created time.Time `json:"created"`
+}
+
+// apiKeyResponse is the response of minting an api key, the only time the key is returned
+type apiKeyResponse struct {
+	Key     string    `json:"key"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// serviceAccountToken holds the access token of the service account of the client, renewing it shortly before
+// it expires, and the tokens of the owners of the api keys it impersonates
+type serviceAccountToken struct {
+	sync.Mutex
+	// the current token and its expiration
+	token   jose.JWT
+	expires time.Time
+	// requests a token via the client credentials grant
+	request func() (jose.JWT, error)
+	// the tokens of the owners the requests of the api keys are made with, keyed by the subject of the owner
+	owners *tokenExchanger
+	// the authentications of the api keys partitioned by result
+	total *prometheus.CounterVec
+}
+
+// newServiceAccountToken creates the service account token source and registers the metrics
+func newServiceAccountToken(request func() (jose.JWT, error), impersonate func(string) (string, time.Duration, error)) *serviceAccountToken {
+	total := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_key_authentications_total",
+			Help: "The authentications of the api keys partitioned by result",
+		},
+		[]string{"result"},
+	)
+
+	return &serviceAccountToken{
+		request: request,
+		owners:  newTokenExchanger(impersonate),
+		total:   prometheus.MustRegisterOrGet(total).(*prometheus.CounterVec),
+	}
+}
+
+// getToken returns the service account token, requesting a new one if expiring
+func (r *serviceAccountToken) getToken() (jose.JWT, error) {
+	r.Lock()
+	defer r.Unlock()
+	if time.Now().Add(serviceAccountTokenMargin).Before(r.expires) {
+		return r.token, nil
+	}
+	token, err := r.request()
+	if err != nil {
+		return jose.JWT{}, err
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return jose.JWT{}, err
+	}
+	expires, found, err := claims.TimeClaim("exp")
+	if err != nil || !found {
+		return jose.JWT{}, errors.New("the service account token has no expiration")
+	}
+	r.token, r.expires = token, expires
+
+	return token, nil
+}
+
+// wipe forgets the service account token, returning it if yet to expire so it can be revoked
+func (r *serviceAccountToken) wipe() (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+	token, valid := r.token.Encode(), time.Now().Before(r.expires)
+	r.token, r.expires = jose.JWT{}, time.Time{}
+
+	return token, valid
+}
+
+// String ensures the token is never printed
+func (r *serviceAccountToken) String() string {
+	return "[redacted]"
+}
+
+// requestServiceAccountToken requests an access token of the client's service account from the provider
+func (r *oauthProxy) requestServiceAccountToken() (jose.JWT, error) {
+	client, err := r.client.OAuthClient()
+	if err != nil {
+		return jose.JWT{}, err
+	}
+	resp, err := client.ClientCredsToken(r.config.Scopes)
+	if err != nil {
+		return jose.JWT{}, err
+	}
+
+	token, err := decryptToken(resp.AccessToken, r.decryptionKey)
+	if err != nil {
+		return jose.JWT{}, err
+	}
+
+	return jose.ParseJWT(token)
+}
+
+// impersonateOwner exchanges the service account token for a token of the owner of an api key, the provider
+// refusing the exchange once the owner is disabled or removed; the token is used for at most apiKeyOwnerRecheck
+func (r *oauthProxy) impersonateOwner(owner string) (string, time.Duration, error) {
+	token, err := r.apiKeys.getToken()
+	if err != nil {
+		return "", 0, err
+	}
+	values := url.Values{}
+	values.Set("grant_type", tokenExchangeGrantType)
+	values.Set("subject_token", token.Encode())
+	values.Set("subject_token_type", accessTokenType)
+	values.Set("requested_token_type", accessTokenType)
+	values.Set("requested_subject", owner)
+	values.Set("audience", r.config.ClientID)
+
+	issued, lifetime, err := r.requestTokenExchange(values)
+	if err != nil {
+		return "", 0, err
+	}
+	if lifetime > apiKeyOwnerRecheck+tokenExchangeMargin {
+		lifetime = apiKeyOwnerRecheck + tokenExchangeMargin
+	}
+
+	return issued, lifetime, nil
+}
+
+// getAPIKeyIdentity returns the identity of the owner of a valid api key, granted the roles the owner held both
+// when the key was minted and now
+func (r *oauthProxy) getAPIKeyIdentity(key string) (*userContext, error) {
+	record, err := r.getAPIKey(key)
+	if err != nil {
+		r.apiKeys.total.WithLabelValues("invalid").Inc()
+		return nil, err
+	}
+	issued, err := r.apiKeys.owners.getToken(record.Owner)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":    err.Error(),
+			"username": record.OwnerName,
+		}).Warnf("unable to impersonate the owner of the api key")
+
+		r.apiKeys.total.WithLabelValues("error").Inc()
+		return nil, ErrInvalidAPIKey
+	}
+	token, err := jose.ParseJWT(issued)
+	if err != nil {
+		r.apiKeys.total.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	user, err := extractIdentity(token)
+	if err != nil {
+		r.apiKeys.total.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	if user.id != record.Owner {
+		r.apiKeys.total.WithLabelValues("error").Inc()
+		return nil, errors.New("the impersonated token is not of the owner of the api key")
+	}
+	// step: the key never gains the roles granted to the owner since it was minted
+	var roles []string
+	for _, x := range user.roles {
+		if containedIn(x, record.Roles) {
+			roles = append(roles, x)
+		}
+	}
+	user.roles = roles
+	user.bearerToken = true
+	user.apiKeyOwner = record.OwnerName
+	user.apiKey = getAPIKeyStoreKey(key)
+	r.apiKeys.total.WithLabelValues("accepted").Inc()
+
+	return user, nil
+}
+
+// getAPIKey retrieves the record of the api key from the store
+func (r *oauthProxy) getAPIKey(key string) (*apiKey, error) {
+	value, err := r.store.Get(getAPIKeyStoreKey(key))
+	if err != nil || value == "" {
+		return nil, ErrInvalidAPIKey
+	}
+	record := &apiKey{}
+	if err := json.Unmarshal([]byte(value), record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+//
+// apiKeyHandler mints an api key for the authenticated user, the key is returned once and only its hash stored
+//
+func (r *oauthProxy) apiKeyHandler(cx *gin.Context) {
+	if r.apiKeys == nil {
+		cx.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+	user, found := r.getAPIKeyUser(cx)
+	if !found {
+		return
+	}
+	if !hasRoles(r.config.APIKeyRoles, user.roles) {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"required":  strings.Join(r.config.APIKeyRoles, ","),
+			"username":  user.name,
+		}).Warnf("access denied, the user is not permitted to mint api keys")
+
+		r.accessForbidden(cx)
+		return
+	}
+
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		cx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(value)
+	record := apiKey{
+		Name:      cx.Request.PostFormValue("name"),
+		Owner:     user.id,
+		OwnerName: user.name,
+		Roles:     user.roles,
+		Created:   time.Now().UTC(),
+	}
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		cx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err := r.store.Set(getAPIKeyStoreKey(key), string(encoded)); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to save the api key in the store")
+
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+		"name":      record.Name,
+		"username":  user.name,
+	}).Infof("minted an api key for user: %s", user.name)
+
+	writeJSON(cx, http.StatusOK, apiKeyResponse{Key: key, Name: record.Name, Created: record.Created})
+}
+
+//
+// apiKeyRevokeHandler revokes an api key of the authenticated user
+//
+func (r *oauthProxy) apiKeyRevokeHandler(cx *gin.Context) {
+	if r.apiKeys == nil {
+		cx.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+	user, found := r.getAPIKeyUser(cx)
+	if !found {
+		return
+	}
+	key := cx.Request.PostFormValue("key")
+	record, err := r.getAPIKey(key)
+	if err != nil {
+		cx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if record.Owner != user.id {
+		r.accessForbidden(cx)
+		return
+	}
+	if err := r.store.Delete(getAPIKeyStoreKey(key)); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to delete the api key from the store")
+
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+		"name":      record.Name,
+		"username":  user.name,
+	}).Infof("revoked an api key of user: %s", user.name)
+
+	cx.AbortWithStatus(http.StatusNoContent)
+}
+
+// getAPIKeyUser returns the verified user managing their api keys, the api keys and service accounts cannot
+// mint keys themselves
+func (r *oauthProxy) getAPIKeyUser(cx *gin.Context) (*userContext, bool) {
+	user, err := r.getIdentity(cx.Request)
+	if err != nil {
+		cx.AbortWithStatus(http.StatusUnauthorized)
+		return nil, false
+	}
+	if !user.opaque {
+		if err := r.verifyJWT(user.token); err != nil {
+			cx.AbortWithStatus(http.StatusUnauthorized)
+			return nil, false
+		}
+	}
+	if user.serviceAccount || user.apiKeyOwner != "" {
+		r.accessForbidden(cx)
+		return nil, false
+	}
+	// step: the browser sends the cookies with any site's requests, so a session must show the request was
+	// made by the proxy's own pages
+	if user.isCookie() && !r.isSameOriginRequest(cx) {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"origin":    cx.Request.Header.Get("Origin"),
+			"username":  user.name,
+		}).Warnf("access denied, the request to manage the api keys is not from the proxy's origin")
+
+		r.accessForbidden(cx)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// isSameOriginRequest checks the request carries the requested with header and an origin of the proxy, which a
+// cross site form or script can't forge
+func (r *oauthProxy) isSameOriginRequest(cx *gin.Context) bool {
+	if cx.Request.Header.Get(apiKeyRequestedWithHeader) == "" {
+		return false
+	}
+	origin, err := url.Parse(cx.Request.Header.Get("Origin"))
+	if err != nil || origin.Host == "" {
+		return false
+	}
+	expected, err := url.Parse(r.getRedirectionBaseURL(cx))
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(origin.Scheme, expected.Scheme) && strings.EqualFold(origin.Host, expected.Host)
+}
+
+// getAPIKeyStoreKey returns the key of the api key in the store, the hash of the key
+func getAPIKeyStoreKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return apiKeyStorePrefix + hex.EncodeToString(sum[:])
+}
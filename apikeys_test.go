@@ -0,0 +1,247 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceAccountTokenRenewal(t *testing.T) {
+	requests := 0
+	expires := time.Now().Add(time.Hour)
+	source := newServiceAccountToken(func() (jose.JWT, error) {
+		requests++
+		return jose.NewJWT(jose.JOSEHeader{"alg": "RS256"}, jose.Claims{"sub": "1", "exp": float64(expires.Unix())})
+	}, nil)
+
+	_, err := source.getToken()
+	assert.NoError(t, err)
+	source.getToken()
+	assert.Equal(t, 1, requests, "the service account token should have been reused")
+
+	// step: the token is renewed within the margin of its expiration
+	expires = time.Now().Add(serviceAccountTokenMargin / 2)
+	source.expires = expires
+	source.getToken()
+	source.getToken()
+	assert.Equal(t, 3, requests)
+}
+
+func TestGetAPIKeyStoreKey(t *testing.T) {
+	key := getAPIKeyStoreKey("kp_test")
+	assert.True(t, strings.HasPrefix(key, apiKeyStorePrefix))
+	assert.NotContains(t, key, "kp_test")
+	assert.Equal(t, key, getAPIKeyStoreKey("kp_test"))
+	assert.NotEqual(t, key, getAPIKeyStoreKey("kp_other"))
+}
+
+func TestAPIKeysDisabled(t *testing.T) {
+	_, _, svc := newTestProxyService(nil)
+	resp, err := resty.New().R().Post(svc + oauthURL + apiKeysURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode())
+}
+
+func TestAPIKeys(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableAPIKeys = true
+	cfg.APIKeyRoles = []string{"api-keys"}
+	cfg.NoRedirects = true
+	proxy, idp, svc := newTestProxyService(cfg)
+	proxy.store = &fakeStore{items: make(map[string]string)}
+	owner := "1e11e539-8256-4b3b-bda8-cc0d56cddb48"
+	idp.setUser(owner, []string{"api-keys", "reports", "billing"})
+	newToken := func(roles []string) string {
+		signed, _ := idp.signToken(jose.Claims{
+			"iss":                idp.getLocation(),
+			"aud":                fakeClientID,
+			"sub":                owner,
+			"preferred_username": "rjayawardene",
+			"email":              "gambol99@gmail.com",
+			"iat":                float64(time.Now().Unix()),
+			"exp":                float64(time.Now().Add(time.Hour).Unix()),
+			"realm_access":       map[string]interface{}{"roles": roles},
+		})
+		return signed.Encode()
+	}
+	signed := newToken([]string{"api-keys", "reports"})
+
+	// step: an anonymous user cannot mint a key
+	resp, err := resty.New().R().Post(svc + oauthURL + apiKeysURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	// step: nor a user without the roles permitted to mint a key
+	resp, err = resty.New().SetAuthToken(newToken([]string{"reports"})).R().Post(svc + oauthURL + apiKeysURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	var minted apiKeyResponse
+	resp, err = resty.New().SetAuthToken(signed).R().
+		SetFormData(map[string]string{"name": "ci"}).
+		SetResult(&minted).
+		Post(svc + oauthURL + apiKeysURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.True(t, strings.HasPrefix(minted.Key, apiKeyPrefix))
+	assert.Equal(t, "ci", minted.Name)
+
+	// step: the requests with the key are made as the owner, with the roles held when the key was minted
+	for i := 0; i < 2; i++ {
+		var response testUpstreamResponse
+		resp, err = resty.New().R().SetHeader(apiKeyHeader, minted.Key).SetResult(&response).Get(svc + fakeAuthAllURL)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.Equal(t, owner, response.Headers.Get("X-Auth-Subject"))
+		assert.Equal(t, "rjayawardene", response.Headers.Get("X-Auth-Api-Key-Owner"))
+		assert.Equal(t, "api-keys,reports", response.Headers.Get("X-Auth-Roles"))
+		assert.Empty(t, response.Headers.Get(apiKeyHeader))
+	}
+	assert.Equal(t, 1, idp.getServiceAccountTokens(), "the service account token should have been reused")
+	assert.Equal(t, 1, idp.getExchanges(), "the token of the owner should have been reused")
+
+	// step: the key loses the roles the owner has lost since
+	idp.setUser(owner, []string{"api-keys"})
+	proxy.apiKeys.owners.wipe()
+	var response testUpstreamResponse
+	resp, err = resty.New().R().SetHeader(apiKeyHeader, minted.Key).SetResult(&response).Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "api-keys", response.Headers.Get("X-Auth-Roles"))
+
+	// step: a key cannot mint another key
+	resp, err = resty.New().R().SetHeader(apiKeyHeader, minted.Key).Post(svc + oauthURL + apiKeysURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	resp, err = resty.New().R().SetHeader(apiKeyHeader, "kp_unknown").Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	// step: the owner revokes the key
+	resp, err = resty.New().SetAuthToken(signed).R().
+		SetFormData(map[string]string{"key": minted.Key}).
+		Post(svc + oauthURL + apiKeysRevokeURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	resp, err = resty.New().R().SetHeader(apiKeyHeader, minted.Key).Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+}
+
+func TestAPIKeysSameOrigin(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableAPIKeys = true
+	cfg.APIKeyRoles = []string{"api-keys"}
+	proxy, idp, svc := newTestProxyService(cfg)
+	proxy.store = &fakeStore{items: make(map[string]string)}
+	token := newTestToken(idp.getLocation())
+	token.setRealmsRoles([]string{"api-keys"})
+	signed, _ := idp.signToken(token.claims)
+
+	cs := []struct {
+		Origin      string
+		RequestedBy string
+		Cookie      bool
+		Code        int
+	}{
+		{Cookie: true, Code: http.StatusForbidden},
+		{Cookie: true, Origin: svc, Code: http.StatusForbidden},
+		{Cookie: true, Origin: "http://evil.com", RequestedBy: "XMLHttpRequest", Code: http.StatusForbidden},
+		{Cookie: true, RequestedBy: "XMLHttpRequest", Code: http.StatusForbidden},
+		{Cookie: true, Origin: svc, RequestedBy: "XMLHttpRequest", Code: http.StatusOK},
+		{Code: http.StatusOK},
+	}
+	for i, c := range cs {
+		client := resty.New()
+		if c.Cookie {
+			client.SetCookie(&http.Cookie{Name: cfg.CookieAccessName, Value: signed.Encode()})
+		} else {
+			client.SetAuthToken(signed.Encode())
+		}
+		request := client.R().SetFormData(map[string]string{"name": "ci"})
+		if c.Origin != "" {
+			request.SetHeader("Origin", c.Origin)
+		}
+		if c.RequestedBy != "" {
+			request.SetHeader(apiKeyRequestedWithHeader, c.RequestedBy)
+		}
+		resp, err := request.Post(svc + oauthURL + apiKeysURL)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.Code, resp.StatusCode(), "case %d", i)
+	}
+}
+
+func TestAPIKeyOwnerDisabled(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableAPIKeys = true
+	cfg.APIKeyRoles = []string{"api-keys"}
+	proxy, idp, svc := newTestProxyService(cfg)
+	store := &fakeStore{items: make(map[string]string)}
+	proxy.store = store
+	owner := "6d1cb8ae-disabled"
+	idp.setUser(owner, []string{"api-keys"})
+	store.Set(getAPIKeyStoreKey("kp_disabled"), `{"name":"ci","owner":"`+owner+`","roles":["api-keys"]}`)
+
+	resp, err := resty.New().R().SetHeader(apiKeyHeader, "kp_disabled").Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	// step: once the owner is disabled at the provider the key is refused
+	idp.setUser(owner, nil)
+	proxy.apiKeys.owners.wipe()
+	resp, err = resty.New().R().SetHeader(apiKeyHeader, "kp_disabled").Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+}
+
+func TestAPIKeyRevokeOwner(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableAPIKeys = true
+	cfg.APIKeyRoles = []string{"api-keys"}
+	proxy, idp, svc := newTestProxyService(cfg)
+	store := &fakeStore{items: make(map[string]string)}
+	proxy.store = store
+	store.Set(getAPIKeyStoreKey("kp_other"), `{"name":"other","owner":"someone-else"}`)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	cs := []struct {
+		Key          string
+		ExpectedCode int
+	}{
+		{Key: "kp_unknown", ExpectedCode: http.StatusNotFound},
+		{Key: "kp_other", ExpectedCode: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		resp, err := resty.New().SetAuthToken(signed.Encode()).R().
+			SetFormData(map[string]string{"key": c.Key}).
+			Post(svc + oauthURL + apiKeysRevokeURL)
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode(), "case %d", i)
+	}
+	assert.Len(t, store.items, 1)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// bcryptHashSize is the length of an encoded hash, i.e. $2b$10$<22 salt><31 hash>
+	bcryptHashSize = 60
+	// bcryptAlphabet is the base64 alphabet of the salt and hash
+	bcryptAlphabet = "./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+var (
+	// errBasicAuthUser indicates the user is not one of the static users permitted on the resource
+	errBasicAuthUser = errors.New("the user is not permitted on the resource")
+	// errBcryptHash indicates the hash is not a bcrypt hash we support
+	errBcryptHash = errors.New("the hash is not a valid bcrypt hash, expected $2a$, $2b$ or $2y$")
+	// errBcryptMismatch indicates the password does not match the hash
+	errBcryptMismatch = errors.New("the password does not match the bcrypt hash")
+)
+
+// isValidBasicAuthUsers checks the static users have a bcrypt hash we can verify
+func isValidBasicAuthUsers(users map[string]string) error {
+	for name, hash := range users {
+		if name == "" {
+			return errors.New("the basic auth users must be named")
+		}
+		if err := isValidBcryptHash(hash); err != nil {
+			return fmt.Errorf("the basic auth user: %s, %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// verifyBasicAuth checks the credentials are those of a static user permitted on the resource
+func (r *oauthProxy) verifyBasicAuth(resource *Resource, username, password string) error {
+	hash, found := r.config.BasicAuthUsers[username]
+	if !found || !containedIn(username, resource.BasicAuth) {
+		return errBasicAuthUser
+	}
+
+	return compareBcryptHash(hash, password)
+}
+
+// isValidBcryptHash checks the hash is a bcrypt hash of the versions generated by htpasswd -B or the like, the
+// package accepting the hashes of any version and the truncated ones
+func isValidBcryptHash(hash string) error {
+	if len(hash) != bcryptHashSize || hash[0] != '$' || hash[1] != '2' || hash[3] != '$' {
+		return errBcryptHash
+	}
+	switch hash[2] {
+	case 'a', 'b', 'y':
+	default:
+		return errBcryptHash
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return errBcryptHash
+	}
+	for _, x := range hash[7:] {
+		if !strings.ContainsRune(bcryptAlphabet, x) {
+			return errBcryptHash
+		}
+	}
+
+	return nil
+}
+
+// compareBcryptHash checks the password matches the bcrypt hash
+func compareBcryptHash(hash, password string) error {
+	if err := isValidBcryptHash(hash); err != nil {
+		return err
+	}
+	switch err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err {
+	case nil:
+		return nil
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return errBcryptMismatch
+	default:
+		return errBcryptHash
+	}
+}
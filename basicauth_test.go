@@ -0,0 +1,120 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsValidBasicAuthUsers(t *testing.T) {
+	cs := []struct {
+		Users map[string]string
+		Ok    bool
+	}{
+		{Ok: true},
+		{Users: map[string]string{"ops": testBcryptHash}, Ok: true},
+		{Users: map[string]string{"ops": "letmein"}},
+		{Users: map[string]string{"": testBcryptHash}},
+	}
+	for i, c := range cs {
+		err := isValidBasicAuthUsers(c.Users)
+		if c.Ok {
+			assert.NoError(t, err, "case %d", i)
+			continue
+		}
+		assert.Error(t, err, "case %d", i)
+	}
+}
+
+func TestBasicAuthResource(t *testing.T) {
+	cs := []struct {
+		Enabled      bool
+		Username     string
+		Password     string
+		ExpectedCode int
+	}{
+		{Enabled: true, Username: "ops", Password: "letmein", ExpectedCode: http.StatusOK},
+		{Enabled: true, Username: "ops", Password: "wrong", ExpectedCode: http.StatusUnauthorized},
+		// step: the user exists but is not permitted on the resource
+		{Enabled: true, Username: "dev", Password: "letmein", ExpectedCode: http.StatusUnauthorized},
+		{Enabled: true, Username: "nobody", Password: "letmein", ExpectedCode: http.StatusUnauthorized},
+		// step: without the credentials the request is authenticated as usual
+		{Enabled: true, ExpectedCode: http.StatusTemporaryRedirect},
+		// step: the static users are ignored unless enabled
+		{Username: "ops", Password: "letmein", ExpectedCode: http.StatusTemporaryRedirect},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.EnableBasicAuth = c.Enabled
+		cfg.BasicAuthUsers = map[string]string{"ops": testBcryptHash, "dev": testBcryptHash}
+		cfg.Resources = []*Resource{{URL: "/admin", Methods: []string{"ANY"}, BasicAuth: []string{"ops"}}}
+		_, _, svc := newTestProxyService(cfg)
+
+		req, _ := http.NewRequest(http.MethodGet, svc+"/admin", nil)
+		if c.Username != "" {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d", i)
+		if resp.StatusCode == http.StatusOK {
+			// step: the password is not forwarded to the upstream
+			var response testUpstreamResponse
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response), "case %d", i)
+			assert.Empty(t, response.Headers.Get("Authorization"), "case %d", i)
+		}
+		resp.Body.Close()
+	}
+}
+
+// testBcryptHash is the hash of letmein at the lowest cost, generated by crypt(3)
+const testBcryptHash = "$2b$04$PYsmdidEJuXToy5KSI1GyeUntms53J8uWjDE.5Hd1iruuqlmmmPui"
+
+func TestCompareBcryptHash(t *testing.T) {
+	cs := []struct {
+		Hash     string
+		Password string
+		Error    error
+	}{
+		{Hash: testBcryptHash, Password: "letmein"},
+		{Hash: "$2b$05$HopKbiEJXNCmxl2d6B.fheiMbbGcmNew7UhEUz/5LeaXJL5NNq7zy", Password: "letmein"},
+		{Hash: "$2b$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", Password: "U*U"},
+		{Hash: "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", Password: "U*U"},
+		{Hash: "$2b$04$abcdefghijklmnopqrstuubyCG3zY1GIXMyxfivm.ClDiInHzxjiq", Password: ""},
+		{Hash: "$2b$04$abcdefghijklmnopqrstuu.gc7UY/21CSNJGJg21jJzx9QiOpJ9bO", Password: strings.Repeat("x", 71)},
+		// step: only the first 72 bytes of the password are used
+		{Hash: "$2b$04$abcdefghijklmnopqrstuubzadhGtS2zEF.gu0yd0opP6cVzb.e0i", Password: strings.Repeat("x", 80)},
+		{Hash: "$2b$04$abcdefghijklmnopqrstuubzadhGtS2zEF.gu0yd0opP6cVzb.e0i", Password: strings.Repeat("x", 72)},
+		{Hash: testBcryptHash, Password: "letmeout", Error: errBcryptMismatch},
+		{Hash: testBcryptHash, Password: "", Error: errBcryptMismatch},
+		{Hash: "$2x$04$PYsmdidEJuXToy5KSI1GyeUntms53J8uWjDE.5Hd1iruuqlmmmPui", Password: "letmein", Error: errBcryptHash},
+		{Hash: "$2b$03$PYsmdidEJuXToy5KSI1GyeUntms53J8uWjDE.5Hd1iruuqlmmmPui", Password: "letmein", Error: errBcryptHash},
+		{Hash: "$2b$04$PYsmdidEJuXToy5KSI1GyeUntms53J8uWjDE.5Hd1iruuqlmmmPu", Password: "letmein", Error: errBcryptHash},
+		{Hash: "$2b$04$PYsmdidEJuXToy5KSI1GyeUntms53J8uWjDE.5Hd1iruuqlmmm!ui", Password: "letmein", Error: errBcryptHash},
+		{Hash: "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", Password: "password", Error: errBcryptHash},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Error, compareBcryptHash(c.Hash, c.Password), "case %d", i)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gambol99/goproxy"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// acceptEncodingHeader is the encodings the client is able to decode
+	acceptEncodingHeader = "Accept-Encoding"
+	// contentEncodingHeader is the encoding of the response body
+	contentEncodingHeader = "Content-Encoding"
+	// brotliEncoding is the content coding of brotli
+	brotliEncoding = "br"
+)
+
+// brotliCompress encodes the data as a brotli stream (rfc 7932) at the default quality, plenty for the pages
+// of the proxy; the writes are to a buffer, so the encoder never fails
+func brotliCompress(data []byte) []byte {
+	var b bytes.Buffer
+	w := brotli.NewWriterLevel(&b, brotli.DefaultCompression)
+	w.Write(data)
+	w.Close()
+
+	return b.Bytes()
+}
+
+// acceptsEncoding checks the Accept-Encoding of the request permits the content coding, either by name or the
+// wildcard, with a non zero quality
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	var wildcard bool
+	for _, value := range req.Header[acceptEncodingHeader] {
+		for _, item := range strings.Split(value, ",") {
+			params := strings.Split(item, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name != encoding && name != "*" {
+				continue
+			}
+			quality := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(strings.ToLower(param), "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						quality = q
+					}
+				}
+			}
+			// step: an explicit coding wins over the wildcard
+			if name == encoding {
+				return quality > 0
+			}
+			wildcard = quality > 0
+		}
+	}
+
+	return wildcard
+}
+
+// pageWriter holds the body of a page rendered by the proxy, so it can be compressed as a whole
+type pageWriter struct {
+	gin.ResponseWriter
+	// the rendered body
+	body bytes.Buffer
+}
+
+// Write holds the response body
+func (r *pageWriter) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+// WriteString holds the response body
+func (r *pageWriter) WriteString(s string) (int, error) {
+	return r.body.WriteString(s)
+}
+
+// renderPage renders a template of the proxy, compressing it with brotli when enabled and the client accepts it
+func (r *oauthProxy) renderPage(cx *gin.Context, code int, name string, model interface{}) {
+	writer := &pageWriter{ResponseWriter: cx.Writer}
+	cx.Writer = writer
+	cx.HTML(code, name, model)
+	cx.Writer = writer.ResponseWriter
+
+	content := writer.body.Bytes()
+	cx.Writer.Header().Add("Vary", acceptEncodingHeader)
+	if r.config.EnableBrotli && acceptsEncoding(cx.Request, brotliEncoding) {
+		content = brotliCompress(content)
+		cx.Writer.Header().Set(contentEncodingHeader, brotliEncoding)
+	}
+	writeBody(cx, code, cx.Writer.Header().Get("Content-Type"), content)
+}
+
+// encodingPassthroughFilter restores the Accept-Encoding of the client ahead of the upstream round trip, which
+// goproxy otherwise removes, leaving the transport to negotiate gzip and decode the response itself. The upstream
+// then picks the encoding the client asked for and the encoded response is passed back untouched
+func encodingPassthroughFilter(proxy *goproxy.ProxyHttpServer) func(*http.Request, *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		encodings, found := req.Header[acceptEncodingHeader]
+		if !found {
+			return req, nil
+		}
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			req.Header[acceptEncodingHeader] = encodings
+			return proxy.Tr.RoundTrip(req)
+		})
+
+		return req, nil
+	}
+}
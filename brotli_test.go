@@ -0,0 +1,158 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrotliCompress(t *testing.T) {
+	page, err := ioutil.ReadFile("templates/sign_in.html.tmpl")
+	if !assert.NoError(t, err) {
+		return
+	}
+	random := make([]byte, 1<<17)
+	rand.Read(random)
+	cs := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("hello world"),
+		page,
+		bytes.Repeat(page, 50),
+		random,
+	}
+	for i, c := range cs {
+		encoded := brotliCompress(c)
+		decoded, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(encoded)))
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, c, decoded, "case %d", i)
+	}
+	// step: the repeated pages are found by the backward references
+	assert.True(t, len(brotliCompress(bytes.Repeat(page, 50))) < len(page), "the pages should compress")
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	cs := []struct {
+		Header   string
+		Expected bool
+	}{
+		{Header: "", Expected: false},
+		{Header: "gzip, deflate", Expected: false},
+		{Header: "gzip, deflate, br", Expected: true},
+		{Header: "BR;q=0.5", Expected: true},
+		{Header: "br;q=0", Expected: false},
+		{Header: "*", Expected: true},
+		{Header: "*;q=0", Expected: false},
+		{Header: "br;q=0, *", Expected: false},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if c.Header != "" {
+			req.Header.Set(acceptEncodingHeader, c.Header)
+		}
+		assert.Equal(t, c.Expected, acceptsEncoding(req, brotliEncoding), "case %d, header: %s", i, c.Header)
+	}
+}
+
+func TestRenderPageBrotli(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.SignInPage = "templates/sign_in.html.tmpl"
+	config.EnableBrotli = true
+	u := newTestServiceWithConfig(config)
+
+	req, _ := http.NewRequest("GET", u+oauthURL+authorizationURL, nil)
+	req.Header.Set(acceptEncodingHeader, "gzip, br")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	content, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, brotliEncoding, resp.Header.Get(contentEncodingHeader))
+	assert.Equal(t, acceptEncodingHeader, resp.Header.Get("Vary"))
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	decoded, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(content)))
+	assert.NoError(t, err)
+	assert.Contains(t, string(decoded), "<html")
+
+	// step: the clients not accepting brotli get the plain page
+	req.Header.Set(acceptEncodingHeader, "gzip")
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	content, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Empty(t, resp.Header.Get(contentEncodingHeader))
+	assert.Contains(t, string(content), "<html")
+}
+
+func TestEncodingPassthrough(t *testing.T) {
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = append(received, req.Header.Get(acceptEncodingHeader))
+		if acceptsEncoding(req, brotliEncoding) {
+			w.Header().Set(contentEncodingHeader, brotliEncoding)
+			w.Write(brotliCompress([]byte("hello world")))
+			return
+		}
+		w.Write([]byte("hello world"))
+	}))
+	defer upstream.Close()
+
+	p := newTestProxyOnlyService()
+	if !assert.NoError(t, p.createUpstreamProxy(nil)) {
+		t.FailNow()
+	}
+	proxy := httptest.NewServer(p.upstream)
+	defer proxy.Close()
+	location, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(location), DisableCompression: true}}
+
+	// step: the encoded response of the upstream is passed back untouched
+	req, _ := http.NewRequest("GET", upstream.URL, nil)
+	req.Header.Set(acceptEncodingHeader, "br")
+	resp, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	content, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, brotliEncoding, resp.Header.Get(contentEncodingHeader))
+	assert.Equal(t, brotliCompress([]byte("hello world")), content)
+
+	// step: the proxy must not negotiate an encoding on behalf of the client
+	req.Header.Del(acceptEncodingHeader)
+	resp, err = client.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	content, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Empty(t, resp.Header.Get(contentEncodingHeader))
+	assert.Equal(t, "hello world", string(content))
+	assert.Equal(t, []string{"br", ""}, received)
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCaptureEvents is the maximum number of events held by a capture
+	maxCaptureEvents = 500
+)
+
+// sensitiveParameters are query parameters which are never recorded in a capture
+var sensitiveParameters = []string{"code", "access_token", "refresh_token", "id_token", "client_secret", "password", "token",
+	"state", "session_state", "nonce"}
+
+// captureTarget defines whom or what we are capturing the auth flows for
+type captureTarget struct {
+	// User is the username or email of the user
+	User string `json:"user,omitempty"`
+	// CorrelationID is the value of the correlation header
+	CorrelationID string `json:"correlation-id,omitempty"`
+}
+
+// claimSummary is a sanitized summary of the claims in a token
+type claimSummary struct {
+	// Subject is the subject of the token
+	Subject string `json:"subject"`
+	// Username is the preferred name of the user
+	Username string `json:"username"`
+	// Audience is the audience of the token
+	Audience string `json:"audience"`
+	// Roles are the roles held by the user
+	Roles []string `json:"roles"`
+	// ExpiresAt is the expiration of the token
+	ExpiresAt time.Time `json:"expires-at"`
+	// Claims are the names of the claims present in the token
+	Claims []string `json:"claims"`
+}
+
+// captureEvent is a single step in the auth flow
+type captureEvent struct {
+	// Time is when the event happened
+	Time time.Time `json:"time"`
+	// Method is the http method of the request
+	Method string `json:"method"`
+	// Path is the path of the request
+	Path string `json:"path"`
+	// Status is the status code of the response
+	Status int `json:"status"`
+	// Location is the sanitized redirect, if any
+	Location string `json:"location,omitempty"`
+	// Errors are any errors encountered handling the request
+	Errors []string `json:"errors,omitempty"`
+	// Claims is a summary of the user claims, if any
+	Claims *claimSummary `json:"claims,omitempty"`
+}
+
+// flowCapture is the debug bundle for a capture target
+type flowCapture struct {
+	// ID is the identifier for the capture
+	ID string `json:"id"`
+	// Target is whom we are capturing
+	Target captureTarget `json:"target"`
+	// Started is when the capture was started
+	Started time.Time `json:"started"`
+	// Events are the recorded events
+	Events []captureEvent `json:"events,omitempty"`
+}
+
+// flowRecorder holds the captures in progress, it's safe to use from multiple goroutines
+type flowRecorder struct {
+	sync.RWMutex
+	// the captures indexed by id
+	captures map[string]*flowCapture
+}
+
+// newFlowRecorder creates a recorder with no captures
+func newFlowRecorder() *flowRecorder {
+	return &flowRecorder{captures: make(map[string]*flowCapture)}
+}
+
+// start begins capturing the auth flows for the target
+func (r *flowRecorder) start(target captureTarget) (*flowCapture, error) {
+	if target.User == "" && target.CorrelationID == "" {
+		return nil, errors.New("you must specify a user or correlation-id to capture")
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	capture := &flowCapture{
+		ID:      hex.EncodeToString(id),
+		Target:  target,
+		Started: time.Now(),
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.captures[capture.ID] = capture
+
+	return capture, nil
+}
+
+// stop removes the capture, returning the bundle
+func (r *flowRecorder) stop(id string) (flowCapture, bool) {
+	r.Lock()
+	defer r.Unlock()
+	capture, found := r.captures[id]
+	if !found {
+		return flowCapture{}, false
+	}
+	delete(r.captures, id)
+
+	return *capture, true
+}
+
+// get returns a copy of the capture
+func (r *flowRecorder) get(id string) (flowCapture, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	capture, found := r.captures[id]
+	if !found {
+		return flowCapture{}, false
+	}
+	bundle := *capture
+	bundle.Events = append([]captureEvent{}, capture.Events...)
+
+	return bundle, true
+}
+
+// list returns the captures in progress, without the events
+func (r *flowRecorder) list() []flowCapture {
+	r.RLock()
+	defer r.RUnlock()
+	list := []flowCapture{}
+	for _, capture := range r.captures {
+		list = append(list, flowCapture{
+			ID:      capture.ID,
+			Target:  capture.Target,
+			Started: capture.Started,
+		})
+	}
+
+	return list
+}
+
+// record adds the event to any capture matching the user or correlation id
+func (r *flowRecorder) record(event captureEvent, user *userContext, correlationID string) {
+	r.Lock()
+	defer r.Unlock()
+	for _, capture := range r.captures {
+		if !capture.matches(user, correlationID) {
+			continue
+		}
+		if len(capture.Events) >= maxCaptureEvents {
+			capture.Events = capture.Events[1:]
+		}
+		capture.Events = append(capture.Events, event)
+	}
+}
+
+// isActive checks if there are any captures in progress
+func (r *flowRecorder) isActive() bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	return len(r.captures) > 0
+}
+
+// matches checks if the request is for the capture target
+func (r *flowCapture) matches(user *userContext, correlationID string) bool {
+	if r.Target.CorrelationID != "" && r.Target.CorrelationID == correlationID {
+		return true
+	}
+	if r.Target.User != "" && user != nil {
+		return r.Target.User == user.name || r.Target.User == user.email
+	}
+
+	return false
+}
+
+// summarizeClaims produces a sanitized summary of the user claims
+func summarizeClaims(user *userContext) *claimSummary {
+	summary := &claimSummary{
+		Subject:   user.id,
+		Username:  user.name,
+		Audience:  user.audience,
+		Roles:     user.roles,
+		ExpiresAt: user.expiresAt,
+	}
+	for name := range user.claims {
+		summary.Claims = append(summary.Claims, name)
+	}
+	sort.Strings(summary.Claims)
+
+	return summary
+}
+
+// sanitizeLocation removes any credentials from a redirection url, the fragment is redacted whole as the
+// implicit and hybrid flows hand back the tokens in it
+func sanitizeLocation(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return ""
+	}
+	query := u.Query()
+	for _, name := range sensitiveParameters {
+		if _, found := query[name]; found {
+			query.Set(name, "redacted")
+		}
+	}
+	u.RawQuery = query.Encode()
+	u.User = nil
+	if u.Fragment != "" {
+		u.Fragment, u.RawFragment = "redacted", ""
+	}
+
+	return u.String()
+}
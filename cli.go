@@ -20,9 +20,12 @@ import (
 	"os"
 	"os/signal"
 	"reflect"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
@@ -37,6 +40,7 @@ func newOauthProxyApp() *cli.App {
 	app.Email = email
 	app.Flags = getCommandLineOptions()
 	app.UsageText = "keycloak-proxy [options]"
+	app.Commands = []cli.Command{getServiceCommand()}
 
 	// step: the standard usage message isn't that helpful
 	app.OnUsageError = func(context *cli.Context, err error, isSubcommand bool) error {
@@ -54,10 +58,11 @@ func newOauthProxyApp() *cli.App {
 			}
 		}
 
-		// step: parse the command line options
+		// step: parse the command line options and environment variables
 		if err := parseCLIOptions(cx, config); err != nil {
 			return printError(err.Error())
 		}
+		sources := getConfigSources(cx, config, os.Args[1:])
 
 		// step: validate the configuration
 		if err := config.isValid(); err != nil {
@@ -69,16 +74,44 @@ func newOauthProxyApp() *cli.App {
 		if err != nil {
 			return printError(err.Error())
 		}
+		// step: log where each of the non-default options came from
+		var names []string
+		for name := range sources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			log.WithFields(log.Fields{
+				"option": name,
+				"source": sources[name],
+			}).Infof("configuration option set from the %s", sources[name])
+		}
 
 		// step: start the service
 		if err := proxy.Run(); err != nil {
 			return printError(err.Error())
 		}
+		// step: tell systemd we are ready, if running as a notify service
+		if err := notifySystemd(systemdReady); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to notify systemd of the readiness")
+		}
+		watchdog := make(chan struct{})
+		startSystemdWatchdog(watchdog)
+		service.started()
 
-		// step: setup the termination signals
+		// step: setup the termination signals, on windows a ctrl+c or ctrl+break arrives as an interrupt and
+		// the stop of the service control manager on the service channel
 		signalChannel := make(chan os.Signal)
 		signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-		<-signalChannel
+		select {
+		case <-signalChannel:
+		case <-service.stop:
+		}
+		notifySystemd(systemdStopping)
+		close(watchdog)
+
+		// step: don't leave the cached tokens valid behind us
+		proxy.revokeCachedTokens(shutdownRevocationTimeout)
 
 		return nil
 	}
@@ -98,10 +131,7 @@ func getCommandLineOptions() []cli.Flag {
 		if !found {
 			continue
 		}
-		envName := field.Tag.Get("env")
-		if envName != "" {
-			envName = envPrefix + envName
-		}
+		envName := getEnvName(field)
 		optName := field.Tag.Get("yaml")
 
 		switch t := field.Type; t.Kind() {
@@ -121,21 +151,31 @@ func getCommandLineOptions() []cli.Flag {
 				EnvVar: envName,
 				Value:  defaultValue,
 			})
+		case reflect.Int:
+			dv := reflect.ValueOf(defaults).Elem().FieldByName(field.Name).Int()
+			flags = append(flags, cli.IntFlag{
+				Name:   optName,
+				Usage:  usage,
+				EnvVar: envName,
+				Value:  int(dv),
+			})
 		case reflect.Slice:
 			fallthrough
 		case reflect.Map:
 			flags = append(flags, cli.StringSliceFlag{
-				Name:  optName,
-				Usage: usage,
+				Name:   optName,
+				Usage:  usage,
+				EnvVar: envName,
 			})
 		case reflect.Int64:
 			switch t.String() {
 			case "time.Duration":
 				dv := reflect.ValueOf(defaults).Elem().FieldByName(field.Name).Int()
 				flags = append(flags, cli.DurationFlag{
-					Name:  optName,
-					Usage: usage,
-					Value: time.Duration(dv),
+					Name:   optName,
+					Usage:  usage,
+					EnvVar: envName,
+					Value:  time.Duration(dv),
 				})
 			default:
 				panic("unknown uint64 type in the Config struct")
@@ -149,69 +189,113 @@ func getCommandLineOptions() []cli.Flag {
 	return flags
 }
 
-// parseCLIOptions parses the command line options and constructs a config object
+// parseCLIOptions parses the command line options and environment variables over the config, the
+// scalars and lists replace the values from the config file, the keypairs are merged and the resources
+// are added to those of the file
 func parseCLIOptions(cx *cli.Context, config *Config) (err error) {
-	// step: we can ignore these options in the Config struct
-	ignoredOptions := []string{"tag-data", "match-claims", "resources", "headers"}
 	// step: iterate the Config and grab command line options via reflection
 	count := reflect.TypeOf(config).Elem().NumField()
 	for i := 0; i < count; i++ {
 		field := reflect.TypeOf(config).Elem().Field(i)
 		name := field.Tag.Get("yaml")
-		if containedIn(name, ignoredOptions) {
+		if _, found := field.Tag.Lookup("usage"); !found || !cx.IsSet(name) {
 			continue
 		}
+		value := reflect.ValueOf(config).Elem().FieldByName(field.Name)
 
-		if cx.IsSet(name) {
-			switch field.Type.Kind() {
-			case reflect.Bool:
-				reflect.ValueOf(config).Elem().FieldByName(field.Name).SetBool(cx.Bool(name))
+		switch field.Type.Kind() {
+		case reflect.Bool:
+			value.SetBool(cx.Bool(name))
+		case reflect.String:
+			value.SetString(cx.String(name))
+		case reflect.Int:
+			value.SetInt(int64(cx.Int(name)))
+		case reflect.Slice:
+			switch field.Type.Elem().Kind() {
 			case reflect.String:
-				reflect.ValueOf(config).Elem().FieldByName(field.Name).SetString(cx.String(name))
-			case reflect.Slice:
+				// step: convert the items of the string kinded lists, i.e. the secrets
+				list := reflect.MakeSlice(field.Type, 0, 0)
 				for _, x := range cx.StringSlice(name) {
-					reflect.Append(reflect.ValueOf(config).Elem().FieldByName(field.Name), reflect.ValueOf(x))
+					list = reflect.Append(list, reflect.ValueOf(x).Convert(field.Type.Elem()))
 				}
-			case reflect.Int64:
-				switch field.Type.String() {
-				case "time.Duration":
-					reflect.ValueOf(config).Elem().FieldByName(field.Name).SetInt(int64(cx.Duration(name)))
-				default:
-					reflect.ValueOf(config).Elem().FieldByName(field.Name).SetInt(cx.Int64(name))
+				value.Set(list)
+			default:
+				// step: the resources are the only non-string list with an option
+				for _, x := range cx.StringSlice(name) {
+					resource, err := newResource().parse(x)
+					if err != nil {
+						return fmt.Errorf("invalid resource %s, %s", x, err)
+					}
+					config.Resources = append(config.Resources, resource)
 				}
 			}
+		case reflect.Map:
+			pairs, err := decodeKeyPairs(cx.StringSlice(name))
+			if err != nil {
+				return fmt.Errorf("invalid option %s, %s", name, err)
+			}
+			if value.IsNil() {
+				value.Set(reflect.ValueOf(make(map[string]string, 0)))
+			}
+			mergeMaps(value.Interface().(map[string]string), pairs)
+		case reflect.Int64:
+			switch field.Type.String() {
+			case "time.Duration":
+				value.SetInt(int64(cx.Duration(name)))
+			default:
+				value.SetInt(cx.Int64(name))
+			}
 		}
 	}
-	if cx.IsSet("tag") {
-		tags, err := decodeKeyPairs(cx.StringSlice("tag"))
-		if err != nil {
-			return err
+
+	return nil
+}
+
+// getConfigSources returns the source, i.e. file, env or flag, of each option which differs from the default
+func getConfigSources(cx *cli.Context, config *Config, args []string) map[string]string {
+	defaults := reflect.ValueOf(newDefaultConfig()).Elem()
+	current := reflect.ValueOf(config).Elem()
+	sources := make(map[string]string, 0)
+	count := current.NumField()
+	for i := 0; i < count; i++ {
+		field := current.Type().Field(i)
+		name := field.Tag.Get("yaml")
+		if name == "" || reflect.DeepEqual(current.Field(i).Interface(), defaults.Field(i).Interface()) {
+			continue
 		}
-		mergeMaps(config.Tags, tags)
-	}
-	if cx.IsSet("match-claims") {
-		claims, err := decodeKeyPairs(cx.StringSlice("match-claims"))
-		if err != nil {
-			return err
+		sources[name] = "file"
+		if _, found := field.Tag.Lookup("usage"); found && cx.IsSet(name) {
+			sources[name] = "env"
+			if isOptionGiven(args, name) {
+				sources[name] = "flag"
+			}
 		}
-		mergeMaps(config.MatchClaims, claims)
 	}
-	if cx.IsSet("headers") {
-		headers, err := decodeKeyPairs(cx.StringSlice("headers"))
-		if err != nil {
-			return err
+
+	return sources
+}
+
+// isOptionGiven checks if the option was given on the command line
+func isOptionGiven(args []string, name string) bool {
+	for _, x := range args {
+		if x == "--" {
+			break
 		}
-		mergeMaps(config.Headers, headers)
-	}
-	if cx.IsSet("resources") {
-		for _, x := range cx.StringSlice("resources") {
-			resource, err := newResource().parse(x)
-			if err != nil {
-				return fmt.Errorf("invalid resource %s, %s", x, err)
-			}
-			config.Resources = append(config.Resources, resource)
+		x = strings.SplitN(strings.TrimLeft(x, "-"), "=", 2)[0]
+		if x == name {
+			return true
 		}
 	}
 
-	return nil
+	return false
+}
+
+// getEnvName returns the environment variable of the option, the env tag or else the option name
+// upper cased, both prefixed with PROXY_
+func getEnvName(field reflect.StructField) string {
+	if name := field.Tag.Get("env"); name != "" {
+		return envPrefix + name
+	}
+
+	return envPrefix + strings.ToUpper(strings.Replace(field.Tag.Get("yaml"), "-", "_", -1))
 }
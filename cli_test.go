@@ -16,8 +16,12 @@ limitations under the License.
 package main
 
 import (
+	"os"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/urfave/cli"
 )
 
@@ -36,3 +40,67 @@ func TestReadOptions(t *testing.T) {
 	}
 	c.Run([]string{""})
 }
+
+func TestParseCLIOptionsPrecedence(t *testing.T) {
+	os.Setenv("PROXY_UPSTREAM_URL", "http://env")
+	os.Setenv("PROXY_SCOPES", "email,groups")
+	os.Setenv("PROXY_OPENID_PROVIDER_TIMEOUT", "7s")
+	defer os.Unsetenv("PROXY_UPSTREAM_URL")
+	defer os.Unsetenv("PROXY_SCOPES")
+	defer os.Unsetenv("PROXY_OPENID_PROVIDER_TIMEOUT")
+
+	// step: the config as read from the file
+	config := newDefaultConfig()
+	config.ClientID = "file"
+	config.Upstream = "http://file"
+	config.Scopes = []string{"file"}
+	config.Tags = map[string]string{"title": "file", "theme": "dark"}
+
+	args := []string{"--upstream-url=http://flag", "--tags", "title=flag"}
+	var sources map[string]string
+	c := cli.NewApp()
+	c.Flags = getCommandLineOptions()
+	c.Action = func(cx *cli.Context) error {
+		assert.NoError(t, parseCLIOptions(cx, config))
+		sources = getConfigSources(cx, config, args)
+		return nil
+	}
+	assert.NoError(t, c.Run(append([]string{"proxy"}, args...)))
+
+	assert.Equal(t, "file", config.ClientID)
+	assert.Equal(t, "http://flag", config.Upstream)
+	assert.Equal(t, []string{"email", "groups"}, config.Scopes)
+	assert.Equal(t, 7*time.Second, config.OpenIDProviderTimeout)
+	assert.Equal(t, map[string]string{"title": "flag", "theme": "dark"}, config.Tags)
+	assert.Equal(t, "file", sources["client-id"])
+	assert.Equal(t, "flag", sources["upstream-url"])
+	assert.Equal(t, "env", sources["scopes"])
+	assert.Equal(t, "env", sources["openid-provider-timeout"])
+	assert.NotContains(t, sources, "listen")
+}
+
+func TestGetEnvName(t *testing.T) {
+	field, _ := reflect.TypeOf(Config{}).FieldByName("Upstream")
+	assert.Equal(t, "PROXY_UPSTREAM_URL", getEnvName(field))
+	field, _ = reflect.TypeOf(Config{}).FieldByName("OpenIDProviderTimeout")
+	assert.Equal(t, "PROXY_OPENID_PROVIDER_TIMEOUT", getEnvName(field))
+}
+
+func TestIsOptionGiven(t *testing.T) {
+	assert.True(t, isOptionGiven([]string{"--listen=:80"}, "listen"))
+	assert.True(t, isOptionGiven([]string{"-listen", ":80"}, "listen"))
+	assert.False(t, isOptionGiven([]string{"--listen-http=:80"}, "listen"))
+	assert.False(t, isOptionGiven([]string{"--", "--listen"}, "listen"))
+}
+
+func TestParseCLIOptionsSecretList(t *testing.T) {
+	config := newDefaultConfig()
+	c := cli.NewApp()
+	c.Flags = getCommandLineOptions()
+	c.Action = func(cx *cli.Context) error {
+		return parseCLIOptions(cx, config)
+	}
+	assert.NoError(t, c.Run([]string{"proxy", "--encryption-keys=new", "--encryption-keys=old", "--scopes=email"}))
+	assert.Equal(t, []Secret{"new", "old"}, config.EncryptionKeys)
+	assert.Equal(t, []string{"email"}, config.Scopes)
+}
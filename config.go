@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
@@ -27,18 +28,43 @@ import (
 // newDefaultConfig returns a initialized config
 func newDefaultConfig() *Config {
 	return &Config{
-		AccessTokenDuration:         time.Duration(720) * time.Hour,
-		Tags:                        make(map[string]string, 0),
-		MatchClaims:                 make(map[string]string, 0),
-		Headers:                     make(map[string]string, 0),
-		UpstreamTimeout:             time.Duration(10) * time.Second,
-		UpstreamKeepaliveTimeout:    time.Duration(10) * time.Second,
-		EnableAuthorizationHeader:   true,
-		CookieAccessName:            "kc-access",
-		CookieRefreshName:           "kc-state",
-		SecureCookie:                true,
-		SkipUpstreamTLSVerify:       true,
-		SkipOpenIDProviderTLSVerify: false,
+		AccessTokenDuration:            time.Duration(720) * time.Hour,
+		ControlPlaneInterval:           time.Duration(60) * time.Second,
+		Tags:                           make(map[string]string, 0),
+		MatchClaims:                    make(map[string]string, 0),
+		FeatureFlags:                   make(map[string]string, 0),
+		MaxVerifyQueue:                 100,
+		IntrospectionCacheTTL:          time.Duration(30) * time.Second,
+		UMACacheTTL:                    time.Duration(30) * time.Second,
+		RevocationQueueSize:            1000,
+		RevocationRetries:              3,
+		OpenIDProviderTimeout:          time.Duration(10) * time.Second,
+		OpenIDProviderRetries:          2,
+		OpenIDProviderBreakerThreshold: 5,
+		OpenIDProviderBreakerCooldown:  time.Duration(30) * time.Second,
+		OpenIDProviderThrottleCooldown: time.Duration(10) * time.Second,
+		RefreshAnomalyWindow:           time.Duration(10) * time.Minute,
+		OpenIDProviderDiscoveryTimeout: time.Duration(5) * time.Minute,
+		OpenIDProviderRefreshInterval:  time.Duration(15) * time.Minute,
+		ClockSkew:                      time.Duration(30) * time.Second,
+		Headers:                        make(map[string]string, 0),
+		TrustedIssuers:                 make(map[string]string, 0),
+		WebhookSecrets:                 make(map[string]string, 0),
+		BasicAuthUsers:                 make(map[string]string, 0),
+		ProbeUserAgents:                []string{"kube-probe/", "ELB-HealthChecker/"},
+		UpstreamTimeout:                time.Duration(10) * time.Second,
+		UpstreamKeepaliveTimeout:       time.Duration(10) * time.Second,
+		UpstreamIdleTimeout:            time.Duration(90) * time.Second,
+		ListenKeepalive:                time.Duration(30) * time.Second,
+		ServerIdleTimeout:              time.Duration(120) * time.Second,
+		EnableAuthorizationHeader:      true,
+		EnableRequestValidation:        true,
+		CookieAccessName:               "kc-access",
+		CookieRefreshName:              "kc-state",
+		CookieRefreshPath:              "/",
+		SecureCookie:                   true,
+		SkipUpstreamTLSVerify:          true,
+		SkipOpenIDProviderTLSVerify:    false,
 	}
 }
 
@@ -65,6 +91,16 @@ func (r *Config) isValid() error {
 	if r.TLSClientCertificate != "" && !fileExists(r.TLSClientCertificate) {
 		return fmt.Errorf("the tls client certificate %s does not exist", r.TLSClientCertificate)
 	}
+	if r.DecryptionKey != "" && !fileExists(r.DecryptionKey) {
+		return fmt.Errorf("the decryption key %s does not exist", r.DecryptionKey)
+	}
+	if r.TLSUpstreamSecretDir != "" {
+		for _, x := range []string{tlsSecretCertificate, tlsSecretPrivateKey} {
+			if !fileExists(filepath.Join(r.TLSUpstreamSecretDir, x)) {
+				return fmt.Errorf("the upstream secret directory %s does not contain a %s", r.TLSUpstreamSecretDir, x)
+			}
+		}
+	}
 
 	if r.EnableForwarding {
 		if r.ClientID == "" {
@@ -85,6 +121,9 @@ func (r *Config) isValid() error {
 		if r.TLSPrivateKey != "" {
 			return errors.New("you don't need to specify the tls-private-key, use tls-ca-key instead")
 		}
+		if len(r.Providers) > 0 {
+			return errors.New("the providers are not supported in forwarding mode")
+		}
 	} else {
 		if r.Upstream == "" {
 			return errors.New("you have not specified an upstream endpoint to proxy to")
@@ -92,6 +131,12 @@ func (r *Config) isValid() error {
 		if _, err := url.Parse(r.Upstream); err != nil {
 			return fmt.Errorf("the upstream endpoint is invalid, %s", err)
 		}
+		if r.EncryptionKey != "" && len(r.EncryptionKeys) > 0 {
+			return errors.New("the encryption-key and encryption-keys options are exclusive, list the key first in the encryption-keys")
+		}
+		if !encryptionKeyIDRegex.MatchString(r.EncryptionKeyID) {
+			return errors.New("the encryption key id may only contain letters, digits, dashes and underscores")
+		}
 		// step: if the skip verification is off, we need the below
 		if !r.SkipTokenVerification {
 			if r.ClientID == "" {
@@ -120,11 +165,15 @@ func (r *Config) isValid() error {
 					return errors.New("the security filter must be switch on for this feature: hostnames")
 				}
 			}
-			if r.EnableRefreshTokens && r.EncryptionKey == "" {
+			if r.EnableRefreshTokens && r.getEncryptionKey() == "" {
 				return errors.New("you have not specified a encryption key for encoding the session state")
 			}
-			if r.EnableRefreshTokens && (len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32) {
-				return fmt.Errorf("the encryption key (%d) must be either 16 or 32 characters for AES-128/AES-256 selection", len(r.EncryptionKey))
+			if r.EnableRefreshTokens {
+				for _, key := range r.getEncryptionKeys() {
+					if len(key) != 16 && len(key) != 32 {
+						return fmt.Errorf("the encryption key (%d) must be either 16 or 32 characters for AES-128/AES-256 selection", len(key))
+					}
+				}
 			}
 			if !r.NoRedirects && r.SecureCookie && r.RedirectionURL != "" && !strings.HasPrefix(r.RedirectionURL, "https") {
 				return errors.New("the cookie is set to secure but your redirection url is non-tls")
@@ -135,11 +184,338 @@ func (r *Config) isValid() error {
 				}
 			}
 		}
-		// check: ensure each of the resource are valid
-		for _, resource := range r.Resources {
-			if err := resource.valid(); err != nil {
+		if r.OAuthURI != "" && (!strings.HasPrefix(r.OAuthURI, "/") || r.OAuthURI == "/") {
+			return errors.New("the oauth uri must start with a / and cannot be the root")
+		}
+		r.OAuthURI = strings.TrimSuffix(r.OAuthURI, "/")
+		if r.CookieRefreshPath != "" && r.CookieRefreshPath != "/" && r.CookieRefreshPath != r.getOAuthURI() {
+			return fmt.Errorf("the cookie refresh path must be / or %s, else the refresh token is never seen", r.getOAuthURI())
+		}
+		// check: a wildcard cookie domain is the parent domain, which the browsers extend to the subdomains
+		if r.CookieDomain != "" {
+			r.CookieDomain = strings.TrimPrefix(r.CookieDomain, "*")
+			if strings.ContainsAny(r.CookieDomain, ":/;, ") || strings.Trim(r.CookieDomain, ".") == "" {
+				return fmt.Errorf("the cookie domain: %s must be a hostname or domain, i.e. .example.com", r.CookieDomain)
+			}
+		}
+		// check: ensure the cookie names are valid and don't clobber each other
+		for _, name := range []string{r.CookieAccessName, r.CookieRefreshName} {
+			if name != "" && !isValidCookieName(name) {
+				return fmt.Errorf("the cookie name: %s contains characters not permitted in a cookie", name)
+			}
+		}
+		if r.CookieAccessName != "" && r.CookieRefreshName != "" {
+			reserved := []string{r.CookieAccessName, r.getStateCookieName(), r.getNonceCookieName(), r.getMobileStateCookieName()}
+			if containedIn(r.CookieRefreshName, reserved) {
+				return fmt.Errorf("the refresh cookie name: %s clashes with the access cookie: %s", r.CookieRefreshName, r.CookieAccessName)
+			}
+		}
+		// check: ensure the endpoint paths are known and unique
+		paths := make(map[string]bool, 0)
+		for name, path := range r.EndpointPaths {
+			if !containedIn(name, endpointNames) {
+				return fmt.Errorf("unknown endpoint: %s, expected one of: %s", name, strings.Join(endpointNames, ","))
+			}
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("the path of the endpoint: %s must start with a /", name)
+			}
+			if paths[path] {
+				return fmt.Errorf("the path: %s is used by more than one endpoint", path)
+			}
+			paths[path] = true
+		}
+		if r.BaseURI != "" {
+			if !strings.HasPrefix(r.BaseURI, "/") {
+				return errors.New("the base uri must start with a /")
+			}
+			r.BaseURI = strings.TrimSuffix(r.BaseURI, "/")
+		}
+		if r.CookiePath != "" {
+			if !strings.HasPrefix(r.CookiePath, "/") {
+				return errors.New("the cookie path must start with a /")
+			}
+			if r.CookiePath != "/" {
+				r.CookiePath = strings.TrimSuffix(r.CookiePath, "/")
+			}
+			if !isPathWithin(r.withOAuthURI(""), r.CookiePath) {
+				return fmt.Errorf("the cookie path: %s must cover the oauth endpoints: %s, else the session is never seen", r.CookiePath, r.withOAuthURI(""))
+			}
+		}
+		if r.UpstreamErrorPage != "" && !r.EnableUpstreamErrorSanitization {
+			return errors.New("the upstream error page requires enable-upstream-error-sanitization")
+		}
+		if r.EnableMaintenanceMode && len(r.AdminRoles) <= 0 {
+			return errors.New("you must specify the admin-roles to enable the maintenance mode")
+		}
+		if r.MaintenancePage != "" && !r.EnableMaintenanceMode {
+			return errors.New("the maintenance page requires enable-maintenance-mode")
+		}
+		if r.EnableFaultInjection && len(r.AdminRoles) <= 0 {
+			return errors.New("you must specify the admin-roles to enable fault injection")
+		}
+		if r.EnableFlowCapture && len(r.AdminRoles) <= 0 {
+			return errors.New("you must specify the admin-roles to enable flow capture")
+		}
+		if r.EnableSessionStats && len(r.AdminRoles) <= 0 {
+			return errors.New("you must specify the admin-roles to enable the session statistics")
+		}
+		if r.EnableSessionRevocation && len(r.AdminRoles) <= 0 {
+			return errors.New("you must specify the admin-roles to enable the session revocation")
+		}
+		if (r.EnableBackchannelLogout || r.EnableSessionRevocation) && r.StoreURL != "" {
+			if u, err := url.Parse(r.StoreURL); err == nil && (u.Scheme == "memcached" || strings.HasSuffix(u.Scheme, "+cluster")) {
+				return errors.New("the revocations remove the sessions listed from the store, which memcached and redis cluster do not support")
+			}
+		}
+		if r.EnableActiveSessions {
+			if len(r.AdminRoles) <= 0 {
+				return errors.New("you must specify the admin-roles to enable the active sessions")
+			}
+			if r.StoreURL == "" {
+				return errors.New("the active sessions are recorded in the store, you must set the store url")
+			}
+			if u, err := url.Parse(r.StoreURL); err == nil && (u.Scheme == "memcached" || strings.HasSuffix(u.Scheme, "+cluster")) {
+				return errors.New("the active sessions are listed from the store, which memcached and redis cluster do not support")
+			}
+		}
+		if r.ControlPlaneURL != "" {
+			if _, err := url.Parse(r.ControlPlaneURL); err != nil {
+				return fmt.Errorf("the control plane url is invalid, error: %s", err)
+			}
+			if r.ControlPlanePublicKey == "" {
+				return errors.New("you must specify the control-plane-public-key to verify the control plane policy")
+			}
+			if !fileExists(r.ControlPlanePublicKey) {
+				return fmt.Errorf("the control plane public key %s does not exist", r.ControlPlanePublicKey)
+			}
+			if r.ControlPlaneInterval <= 0 {
+				return errors.New("the control plane interval must be greater than zero")
+			}
+		}
+		if r.MaxAuthenticationAge < 0 {
+			return errors.New("the max authentication age cannot be negative")
+		}
+		if r.SessionIdleTimeout < 0 {
+			return errors.New("the session idle timeout cannot be negative")
+		}
+		switch r.ExpiredSessionPrompt {
+		case "", "login", "consent", "select_account":
+		default:
+			return errors.New("the expired session prompt must be one of login, consent or select_account")
+		}
+		if r.MaxLoginRedirects < 0 {
+			return errors.New("the max login redirects cannot be negative")
+		}
+		if r.UpstreamIdleTimeout < 0 || r.ServerIdleTimeout < 0 {
+			return errors.New("the upstream and server idle timeouts cannot be negative")
+		}
+		for _, x := range r.SignatureAlgorithms {
+			if _, found := signatureAlgorithms[x]; !found {
+				return fmt.Errorf("the signature algorithm: %s is not supported", x)
+			}
+		}
+		if r.OfflineSessionDuration < 0 {
+			return errors.New("the offline session duration cannot be negative")
+		}
+		if r.ClockSkew < 0 {
+			return errors.New("the clock skew cannot be negative")
+		}
+		for i, name := range r.Middlewares {
+			if !containedIn(name, defaultMiddlewares) {
+				return fmt.Errorf("unknown middleware: %s, expected one of: %s", name, strings.Join(defaultMiddlewares, ","))
+			}
+			if containedIn(name, r.Middlewares[:i]) {
+				return fmt.Errorf("the middleware: %s is listed more than once", name)
+			}
+		}
+		// check: an order which leaves out an enabled middleware would silently switch it off
+		if len(r.Middlewares) > 0 {
+			enabled := r.getEnabledMiddlewares()
+			for _, name := range defaultMiddlewares {
+				if enabled[name] && !containedIn(name, r.Middlewares) {
+					return fmt.Errorf("the middleware: %s is enabled but missing from the middlewares order", name)
+				}
+			}
+		}
+		if err := isValidAuthParams(r.AuthRequestParams); err != nil {
+			return err
+		}
+		for _, name := range r.AuthRequestPassthrough {
+			if err := isValidAuthParams(map[string]string{name: ""}); err != nil {
+				return err
+			}
+		}
+		// check: ensure the providers are valid and unique
+		providers := make(map[string]bool, 0)
+		for _, provider := range r.Providers {
+			if err := provider.isValid(); err != nil {
+				return err
+			}
+			if providers[provider.Name] {
+				return fmt.Errorf("the provider: %s is defined more than once", provider.Name)
+			}
+			providers[provider.Name] = true
+		}
+		// check: ensure the synthetic endpoints are valid, unique and clear of the oauth endpoints
+		endpoints := make(map[string]bool, 0)
+		for _, endpoint := range r.SyntheticEndpoints {
+			if err := endpoint.isValid(); err != nil {
 				return err
 			}
+			if isPathWithin(endpoint.Path, r.withOAuthURI("")) || (r.EnableProfiling && isPathWithin(endpoint.Path, "/debug/pprof")) {
+				return fmt.Errorf("the synthetic endpoint: %s clashes with the endpoints of the proxy", endpoint.Path)
+			}
+			if endpoints[endpoint.Path] {
+				return fmt.Errorf("the synthetic endpoint: %s is defined more than once", endpoint.Path)
+			}
+			endpoints[endpoint.Path] = true
+		}
+		// check: ensure each of the resource are valid
+		resources := append([]*Resource{}, r.Resources...)
+		for _, provider := range r.Providers {
+			resources = append(resources, provider.Resources...)
+		}
+		if err := r.isValidResources(resources); err != nil {
+			return err
+		}
+		for issuer, location := range r.TrustedIssuers {
+			if _, err := url.Parse(issuer); err != nil || issuer == "" {
+				return fmt.Errorf("the trusted issuer: %s is invalid", issuer)
+			}
+			if u, err := url.Parse(location); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("the trusted issuer: %s jwks url: %s is invalid", issuer, location)
+			}
+		}
+		if err := isValidBasicAuthUsers(r.BasicAuthUsers); err != nil {
+			return err
+		}
+		if r.EnableBasicAuth && len(r.BasicAuthUsers) <= 0 {
+			return errors.New("you have enabled the basic auth but have no basic auth users")
+		}
+		if r.SameSiteCookie != "" && !containedIn(strings.ToLower(r.SameSiteCookie), []string{"lax", "strict", "none"}) {
+			return fmt.Errorf("the same site cookie: %s must be Lax, Strict or None", r.SameSiteCookie)
+		}
+		if r.EnableDPoPNonce && !r.EnableDPoP {
+			return errors.New("the dpop nonce requires enable-dpop")
+		}
+		if r.EnableCertificateBoundTokens && (r.TLSCertificate == "" || r.TLSClientCertificate == "") {
+			return errors.New("the certificate bound tokens require the mutual tls of tls-certificate and tls-client-certificate")
+		}
+		if r.MaxHeaderSize < 0 {
+			return errors.New("the max header size cannot be negative")
+		}
+		if r.OpenIDProviderTimeout < 0 || r.OpenIDProviderRetries < 0 || r.OpenIDProviderBreakerThreshold < 0 {
+			return errors.New("the openid provider timeout, retries and breaker threshold cannot be negative")
+		}
+		if r.OpenIDProviderThrottleCooldown < 0 {
+			return errors.New("the openid provider throttle cooldown cannot be negative")
+		}
+		if r.OpenIDProviderDiscoveryTimeout < 0 || r.OpenIDProviderRefreshInterval < 0 {
+			return errors.New("the openid provider discovery timeout and refresh interval cannot be negative")
+		}
+		if r.RevocationQueueSize < 0 || r.RevocationRetries < 0 {
+			return errors.New("the revocation queue size and retries cannot be negative")
+		}
+		if r.MaxVerifyConcurrency < 0 || r.MaxVerifyQueue < 0 {
+			return errors.New("the max verify concurrency and queue cannot be negative")
+		}
+		for _, path := range r.InternalPaths {
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("the internal path: %s must be absolute", path)
+			}
+		}
+		if len(r.InternalPaths) > 0 && r.ListenAdmin == "" {
+			return errors.New("the internal paths are only reachable via the internal listener, you must set the listen-admin")
+		}
+		if r.ListenAdmin != "" && (r.ListenAdmin == r.Listen || r.ListenAdmin == r.ListenHTTP) {
+			return errors.New("the listen-admin must differ from the public listeners")
+		}
+		for _, path := range r.ProbePaths {
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("the probe path: %s must be absolute", path)
+			}
+		}
+		if len(r.ProbePaths) > 0 && len(r.ProbeUserAgents) == 0 {
+			return errors.New("the probe paths require the user agents of the probes")
+		}
+		if r.DailyQuota < 0 || r.MonthlyQuota < 0 {
+			return errors.New("the daily and monthly quotas cannot be negative")
+		}
+		if (r.DailyQuota > 0 || r.MonthlyQuota > 0) && r.StoreURL == "" {
+			return errors.New("the quotas are counted in the store, you must set the store url")
+		}
+		if r.EnableServerSideSessions {
+			if r.StoreURL == "" {
+				return errors.New("the server side sessions are held in the store, you must set the store url")
+			}
+			if len(r.getEncryptionKeys()) == 0 {
+				return errors.New("the server side sessions are encrypted, the encryption key must be 16 or 32 characters")
+			}
+			for _, key := range r.getEncryptionKeys() {
+				if len(key) != 16 && len(key) != 32 {
+					return errors.New("the server side sessions are encrypted, the encryption key must be 16 or 32 characters")
+				}
+			}
+		}
+		if r.RefreshAnomalyThreshold < 0 {
+			return errors.New("the refresh anomaly threshold cannot be negative")
+		}
+		if r.RefreshAnomalyThreshold > 0 {
+			if !r.EnableRefreshTokens || r.StoreURL == "" {
+				return errors.New("the refresh telemetry requires enable-refresh-tokens and is recorded in the store, you must set the store url")
+			}
+			if r.RefreshAnomalyWindow < time.Second {
+				return errors.New("the refresh anomaly window must be at least a second")
+			}
+		}
+		if r.EnableAPIKeys && (r.StoreURL == "" || r.ClientSecret == "") {
+			return errors.New("the api keys require a store and the client secret")
+		}
+		if r.EnableAPIKeys && len(r.APIKeyRoles) <= 0 {
+			return errors.New("the api keys require the roles permitted to mint them, you must set the api key roles")
+		}
+		if r.TokenExchangeAudience != "" && r.ClientSecret == "" {
+			return errors.New("the token exchange requires the client secret")
+		}
+		if r.EnableUMA {
+			if r.ClientID == "" {
+				return errors.New("the authorization services require the client id")
+			}
+			if r.SkipTokenVerification {
+				return errors.New("the authorization services cannot be used with skip-token-verification")
+			}
+			if r.UMACacheTTL < 0 {
+				return errors.New("the uma cache ttl cannot be negative")
+			}
+		}
+		for _, uri := range r.MobileRedirectURIs {
+			if u, err := url.Parse(uri); err != nil || u.Scheme == "" {
+				return fmt.Errorf("the mobile redirect uri: %s must be an absolute uri, i.e. com.example.app:/callback", uri)
+			}
+		}
+		if r.DeviceAuthorizationURL != "" {
+			if _, err := url.Parse(r.DeviceAuthorizationURL); err != nil {
+				return fmt.Errorf("the device authorization url is invalid, error: %s", err)
+			}
+		}
+		if r.EnableTokenIntrospection {
+			if r.ClientSecret == "" {
+				return errors.New("the token introspection requires the client secret")
+			}
+			if r.IntrospectionCacheTTL < 0 {
+				return errors.New("the introspection cache ttl cannot be negative")
+			}
+			if r.IntrospectionURL != "" {
+				if _, err := url.Parse(r.IntrospectionURL); err != nil {
+					return fmt.Errorf("the introspection url is invalid, error: %s", err)
+				}
+			}
+		}
+		// step: validate the feature flags reference a claim and value
+		for feature, flag := range r.FeatureFlags {
+			if items := strings.SplitN(flag, ":", 2); len(items) != 2 || items[0] == "" {
+				return fmt.Errorf("the feature flag: %s should be claim:value", feature)
+			}
 		}
 		// step: validate the claims are validate regex's
 		for k, claim := range r.MatchClaims {
@@ -152,6 +528,53 @@ func (r *Config) isValid() error {
 	return nil
 }
 
+// isValidResources checks the resources are valid and consistent with the rest of the config, the resources of
+// the control plane policies being held to the same checks as those configured
+func (r *Config) isValidResources(resources []*Resource) error {
+	hostnames := append([]string{}, r.Hostnames...)
+	for _, provider := range r.Providers {
+		hostnames = append(hostnames, provider.Hostnames...)
+	}
+	for _, resource := range resources {
+		if err := resource.valid(); err != nil {
+			return err
+		}
+		if strings.HasPrefix(resource.URL, r.withOAuthURI("")) {
+			return fmt.Errorf("the resource: %s is used by the oauth handlers", resource.URL)
+		}
+		// check: ensure the resource hosts are hostnames we respond to
+		for _, host := range resource.Hosts {
+			if !isAllowedHost(host, hostnames) {
+				return fmt.Errorf("the resource: %s host: %s is not one of the hostnames", resource.URL, host)
+			}
+		}
+		// check: the webhook secret must exist
+		if resource.Webhook != "" && r.WebhookSecrets[resource.Webhook] == "" {
+			return fmt.Errorf("the resource: %s webhook: %s has no webhook secret", resource.URL, resource.Webhook)
+		}
+		// check: the token ids are recorded in the store
+		if resource.ReplayProtection && r.StoreURL == "" {
+			return fmt.Errorf("the resource: %s replay protection requires a store-url", resource.URL)
+		}
+		// check: the proofs are only verified when enabled
+		if resource.DPoP && !r.EnableDPoP {
+			return fmt.Errorf("the resource: %s dpop option requires enable-dpop", resource.URL)
+		}
+		// check: the certificate binding is only verified when enabled
+		if resource.CertificateBound && !r.EnableCertificateBoundTokens {
+			return fmt.Errorf("the resource: %s certificate-bound option requires enable-certificate-bound-tokens", resource.URL)
+		}
+		// check: the static users must exist
+		for _, user := range resource.BasicAuth {
+			if _, found := r.BasicAuthUsers[user]; !found {
+				return fmt.Errorf("the resource: %s basic auth user: %s does not exist", resource.URL, user)
+			}
+		}
+	}
+
+	return nil
+}
+
 // hasCustomSignInPage checks if there is a custom sign in  page
 func (r *Config) hasCustomSignInPage() bool {
 	if r.SignInPage != "" {
@@ -161,6 +584,115 @@ func (r *Config) hasCustomSignInPage() bool {
 	return false
 }
 
+// getEncryptionKeys returns the keys decrypting the session state, the first also encrypts it
+func (r *Config) getEncryptionKeys() []string {
+	if len(r.EncryptionKeys) == 0 {
+		if r.EncryptionKey == "" {
+			return nil
+		}
+		return []string{r.EncryptionKey.Value()}
+	}
+	keys := make([]string, len(r.EncryptionKeys))
+	for i, x := range r.EncryptionKeys {
+		keys[i] = x.Value()
+	}
+
+	return keys
+}
+
+// getEncryptionKey returns the key encrypting the session state
+func (r *Config) getEncryptionKey() string {
+	if keys := r.getEncryptionKeys(); len(keys) > 0 {
+		return keys[0]
+	}
+
+	return ""
+}
+
+// getCookieNames returns the access and refresh cookie names for the session
+func (r *Config) getCookieNames(session string) (string, string) {
+	if session == "" {
+		return r.CookieAccessName, r.CookieRefreshName
+	}
+
+	return r.CookieAccessName + "-" + session, r.CookieRefreshName + "-" + session
+}
+
+// getAccessType returns the access type requested of the provider
+func (r *Config) getAccessType() string {
+	if containedIn("offline", r.Scopes) || containedIn("offline_access", r.Scopes) {
+		return "offline"
+	}
+
+	return ""
+}
+
+// getOAuthURI returns the path of the oauth endpoints
+func (r *Config) getOAuthURI() string {
+	return defaultTo(r.OAuthURI, oauthURL)
+}
+
+// getEndpointPath returns the path of the oauth endpoint, relative to the oauth uri
+func (r *Config) getEndpointPath(uri string) string {
+	if path, found := r.EndpointPaths[strings.TrimPrefix(uri, "/")]; found {
+		return path
+	}
+
+	return uri
+}
+
+// withOAuthURI returns the path of the oauth endpoint under the base uri
+func (r *Config) withOAuthURI(uri string) string {
+	return r.BaseURI + r.getOAuthURI() + r.getEndpointPath(uri)
+}
+
+// getNonceCookieName returns the name of the cookie holding the nonce of the login
+func (r *Config) getNonceCookieName() string {
+	return r.CookieAccessName + "-nonce"
+}
+
+// getStateCookieName returns the name of the cookie binding the state of the login to the browser
+func (r *Config) getStateCookieName() string {
+	return r.CookieAccessName + "-state"
+}
+
+// getMobileStateCookieName returns the name of the cookie holding the state of a mobile authorization
+func (r *Config) getMobileStateCookieName() string {
+	return r.CookieAccessName + "-mobile-state"
+}
+
+// getCookiePath returns the path the cookies are scoped to
+func (r *Config) getCookiePath() string {
+	if r.CookiePath != "" {
+		return r.CookiePath
+	}
+
+	return defaultTo(r.BaseURI, "/")
+}
+
+// getRefreshCookiePath returns the path the refresh cookie is scoped to, relative to the base uri
+func (r *Config) getRefreshCookiePath() string {
+	if !r.hasNarrowRefreshCookie() {
+		return r.getCookiePath()
+	}
+
+	return r.BaseURI + r.CookieRefreshPath
+}
+
+// hasNarrowRefreshCookie checks if the refresh cookie is only sent to the oauth handlers
+func (r *Config) hasNarrowRefreshCookie() bool {
+	return defaultTo(r.CookieRefreshPath, "/") != "/"
+}
+
+// hasCustomSignOutPage checks if there is a custom sign out page
+func (r *Config) hasCustomSignOutPage() bool {
+	if r.SignOutPage != "" {
+		return true
+	}
+
+	return false
+}
+
 // hasForbiddenPage checks if there is a custom forbidden page
 func (r *Config) hasCustomForbiddenPage() bool {
 	if r.ForbiddenPage != "" {
@@ -169,3 +701,16 @@ func (r *Config) hasCustomForbiddenPage() bool {
 
 	return false
 }
+
+// getEnabledMiddlewares returns the cross-cutting middlewares switched on by their options
+func (r *Config) getEnabledMiddlewares() map[string]bool {
+	return map[string]bool{
+		"timeout":  r.RequestTimeout > 0,
+		"timing":   r.SlowRequestThreshold > 0 || r.EnableServerTiming,
+		"logging":  r.LogRequests,
+		"metrics":  r.EnableMetrics,
+		"capture":  r.EnableFlowCapture,
+		"security": r.EnableSecurityFilter,
+		"cors":     r.EnableCorsGlobal,
+	}
+}
@@ -16,7 +16,10 @@ limitations under the License.
 package main
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestNewDefaultConfig(t *testing.T) {
@@ -145,3 +148,855 @@ func TestIsConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestIsValidTokenIntrospection(t *testing.T) {
+	cs := []struct {
+		Secret   string
+		CacheTTL time.Duration
+		Ok       bool
+	}{
+		{Secret: fakeSecret, CacheTTL: time.Second, Ok: true},
+		{Secret: fakeSecret, Ok: true},
+		{Secret: fakeSecret, CacheTTL: -time.Second},
+		{CacheTTL: time.Second},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableTokenIntrospection = true
+		cfg.ClientSecret = Secret(c.Secret)
+		cfg.IntrospectionCacheTTL = c.CacheTTL
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidUMA(t *testing.T) {
+	cs := []struct {
+		SkipVerification bool
+		CacheTTL         time.Duration
+		Ok               bool
+	}{
+		{CacheTTL: time.Second, Ok: true},
+		{CacheTTL: -time.Second},
+		{SkipVerification: true},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableUMA = true
+		cfg.SkipTokenVerification = c.SkipVerification
+		cfg.UMACacheTTL = c.CacheTTL
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidResourceHosts(t *testing.T) {
+	cs := []struct {
+		Hostnames []string
+		Providers []*Provider
+		Hosts     []string
+		Ok        bool
+	}{
+		{Ok: true},
+		{Hostnames: []string{"a.example.com"}, Hosts: []string{"a.example.com"}, Ok: true},
+		{Hostnames: []string{"a.example.com"}, Hosts: []string{"A.EXAMPLE.COM"}, Ok: true},
+		{Hostnames: []string{"a.example.com"}, Hosts: []string{"b.example.com"}},
+		{Hosts: []string{"a.example.com"}},
+		{
+			Providers: []*Provider{{Name: "b", DiscoveryURL: "http://127.0.0.1", ClientID: "b", Hostnames: []string{"b.example.com"}}},
+			Hosts:     []string{"b.example.com"},
+			Ok:        true,
+		},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableSecurityFilter = true
+		cfg.Hostnames = c.Hostnames
+		cfg.Providers = c.Providers
+		cfg.Resources = []*Resource{{URL: "/admin", Hosts: c.Hosts}}
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidMobileRedirectURIs(t *testing.T) {
+	cs := []struct {
+		URIs []string
+		Ok   bool
+	}{
+		{URIs: []string{"com.example.app:/callback"}, Ok: true},
+		{URIs: []string{"https://app.example.com/callback"}, Ok: true},
+		{URIs: []string{"/callback"}},
+		{URIs: []string{"%"}},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.MobileRedirectURIs = c.URIs
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidAPIKeys(t *testing.T) {
+	cs := []struct {
+		StoreURL     string
+		ClientSecret string
+		Roles        []string
+		Ok           bool
+	}{
+		{StoreURL: "redis://127.0.0.1", ClientSecret: "secret", Roles: []string{"api-keys"}, Ok: true},
+		{ClientSecret: "secret", Roles: []string{"api-keys"}},
+		{StoreURL: "redis://127.0.0.1", Roles: []string{"api-keys"}},
+		{StoreURL: "redis://127.0.0.1", ClientSecret: "secret"},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableAPIKeys = true
+		cfg.StoreURL = c.StoreURL
+		cfg.ClientSecret = Secret(c.ClientSecret)
+		cfg.APIKeyRoles = c.Roles
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidWebhookSecrets(t *testing.T) {
+	cs := []struct {
+		Secrets map[string]string
+		Webhook string
+		Ok      bool
+	}{
+		{Ok: true},
+		{Secrets: map[string]string{"github": "secret"}, Webhook: "github", Ok: true},
+		{Secrets: map[string]string{"github": "secret"}, Webhook: "stripe"},
+		{Secrets: map[string]string{"github": ""}, Webhook: "github"},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.WebhookSecrets = c.Secrets
+		cfg.Resources = []*Resource{{URL: "/hooks", Webhook: c.Webhook}}
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidQuotas(t *testing.T) {
+	cs := []struct {
+		StoreURL     string
+		DailyQuota   int
+		MonthlyQuota int
+		Ok           bool
+	}{
+		{Ok: true},
+		{StoreURL: "redis://127.0.0.1", DailyQuota: 100, MonthlyQuota: 1000, Ok: true},
+		{StoreURL: "redis://127.0.0.1", MonthlyQuota: 1000, Ok: true},
+		{DailyQuota: 100},
+		{StoreURL: "redis://127.0.0.1", DailyQuota: -1},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.StoreURL = c.StoreURL
+		cfg.DailyQuota = c.DailyQuota
+		cfg.MonthlyQuota = c.MonthlyQuota
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidTokenExchange(t *testing.T) {
+	cs := []struct {
+		ClientSecret string
+		Ok           bool
+	}{
+		{ClientSecret: "secret", Ok: true},
+		{},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.TokenExchangeAudience = "upstream"
+		cfg.ClientSecret = Secret(c.ClientSecret)
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidMiddlewares(t *testing.T) {
+	cs := []struct {
+		Middlewares []string
+		Security    bool
+		Ok          bool
+	}{
+		{Ok: true},
+		{Middlewares: []string{"cors", "security", "timing", "logging"}, Ok: true},
+		{Middlewares: []string{"cors", "security", "logging"}, Security: true, Ok: true},
+		{Middlewares: []string{"unknown"}},
+		{Middlewares: []string{"cors", "cors"}},
+		{Middlewares: []string{"cors", "timing"}},
+		{Middlewares: []string{"cors", "logging"}, Security: true},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableSecurityFilter = c.Security
+		cfg.Middlewares = c.Middlewares
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidEndpointPaths(t *testing.T) {
+	cs := []struct {
+		OAuthURI string
+		Paths    map[string]string
+		Ok       bool
+	}{
+		{Ok: true},
+		{OAuthURI: "/oauth2", Paths: map[string]string{"callback": "/redirect_uri"}, Ok: true},
+		{OAuthURI: "/"},
+		{OAuthURI: "oauth"},
+		{Paths: map[string]string{"unknown": "/a"}},
+		{Paths: map[string]string{"callback": "redirect_uri"}},
+		{Paths: map[string]string{"callback": "/a", "logout": "/a"}},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.OAuthURI = c.OAuthURI
+		cfg.EndpointPaths = c.Paths
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidProbePaths(t *testing.T) {
+	cs := []struct {
+		ProbePaths      []string
+		ProbeUserAgents []string
+		Ok              bool
+	}{
+		{Ok: true},
+		{ProbePaths: []string{"/healthz"}, ProbeUserAgents: []string{"kube-probe/"}, Ok: true},
+		{ProbePaths: []string{"healthz"}, ProbeUserAgents: []string{"kube-probe/"}},
+		{ProbePaths: []string{"/healthz"}},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.ProbePaths = c.ProbePaths
+		cfg.ProbeUserAgents = c.ProbeUserAgents
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidTrustedIssuers(t *testing.T) {
+	cs := []struct {
+		Issuers map[string]string
+		Ok      bool
+	}{
+		{Ok: true},
+		{Issuers: map[string]string{"https://sts.example.com": "https://sts.example.com/jwks"}, Ok: true},
+		{Issuers: map[string]string{"https://sts.example.com": "/jwks"}},
+		{Issuers: map[string]string{"https://sts.example.com": "ftp://sts.example.com/jwks"}},
+		{Issuers: map[string]string{"": "https://sts.example.com/jwks"}},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.TrustedIssuers = c.Issuers
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidIdleTimeouts(t *testing.T) {
+	cs := []struct {
+		UpstreamIdleTimeout time.Duration
+		ServerIdleTimeout   time.Duration
+		Ok                  bool
+	}{
+		{Ok: true},
+		{UpstreamIdleTimeout: 90 * time.Second, ServerIdleTimeout: 120 * time.Second, Ok: true},
+		{UpstreamIdleTimeout: -1},
+		{ServerIdleTimeout: -1},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.UpstreamIdleTimeout = c.UpstreamIdleTimeout
+		cfg.ServerIdleTimeout = c.ServerIdleTimeout
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidSignatureAlgorithms(t *testing.T) {
+	cs := []struct {
+		Algorithms []string
+		Ok         bool
+	}{
+		{Ok: true},
+		{Algorithms: []string{"RS256", "PS256", "ES256", "EdDSA"}, Ok: true},
+		{Algorithms: []string{"HS256"}},
+		{Algorithms: []string{"none"}},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.SignatureAlgorithms = c.Algorithms
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidDecryptionKey(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = "http://127.0.0.1"
+	cfg.DecryptionKey = "/does/not/exist"
+	if err := cfg.isValid(); err == nil {
+		t.Errorf("the config should have errored")
+	}
+	cfg.DecryptionKey = testPrivateKeyFile
+	if err := cfg.isValid(); err != nil {
+		t.Errorf("the config should not have errored, error: %s", err)
+	}
+}
+
+func TestIsValidBasicAuth(t *testing.T) {
+	cs := []struct {
+		Enabled   bool
+		Users     map[string]string
+		Resources []*Resource
+		Ok        bool
+	}{
+		{Ok: true},
+		{Enabled: true, Users: map[string]string{"ops": testBcryptHash}, Ok: true},
+		{
+			Enabled:   true,
+			Users:     map[string]string{"ops": testBcryptHash},
+			Resources: []*Resource{{URL: "/admin", BasicAuth: []string{"ops"}}},
+			Ok:        true,
+		},
+		{Enabled: true},
+		{Users: map[string]string{"ops": "letmein"}},
+		{
+			Users:     map[string]string{"ops": testBcryptHash},
+			Resources: []*Resource{{URL: "/admin", BasicAuth: []string{"dev"}}},
+		},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableBasicAuth = c.Enabled
+		cfg.BasicAuthUsers = c.Users
+		cfg.Resources = c.Resources
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidMaintenanceMode(t *testing.T) {
+	cs := []struct {
+		Enabled    bool
+		AdminRoles []string
+		Page       string
+		Ok         bool
+	}{
+		{Ok: true},
+		{Enabled: true, AdminRoles: []string{"admin"}, Ok: true},
+		{Enabled: true, AdminRoles: []string{"admin"}, Page: "templates/forbidden.html.tmpl", Ok: true},
+		{Enabled: true},
+		{Page: "templates/forbidden.html.tmpl"},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableMaintenanceMode = c.Enabled
+		cfg.AdminRoles = c.AdminRoles
+		cfg.MaintenancePage = c.Page
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidSessionRevocation(t *testing.T) {
+	cs := []struct {
+		AdminRoles []string
+		Ok         bool
+	}{
+		{AdminRoles: []string{"admin"}, Ok: true},
+		{},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableSessionRevocation = true
+		cfg.AdminRoles = c.AdminRoles
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidBackchannelLogoutStore(t *testing.T) {
+	cs := []struct {
+		StoreURL string
+		Ok       bool
+	}{
+		{Ok: true},
+		{StoreURL: "redis://127.0.0.1", Ok: true},
+		{StoreURL: "boltdb:///tmp/tokens", Ok: true},
+		{StoreURL: "memcached://127.0.0.1"},
+		{StoreURL: "redis+cluster://127.0.0.1"},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableBackchannelLogout = true
+		cfg.StoreURL = c.StoreURL
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidExpiredSessions(t *testing.T) {
+	cs := []struct {
+		Prompt    string
+		Redirects int
+		Ok        bool
+	}{
+		{Prompt: "login", Redirects: 5, Ok: true},
+		{Ok: true},
+		{Prompt: "select_account", Ok: true},
+		{Prompt: "none"},
+		{Prompt: "login", Redirects: -1},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.ExpiredSessionPrompt = c.Prompt
+		cfg.MaxLoginRedirects = c.Redirects
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidActiveSessions(t *testing.T) {
+	cs := []struct {
+		AdminRoles []string
+		StoreURL   string
+		Ok         bool
+	}{
+		{AdminRoles: []string{"admin"}, StoreURL: "redis://127.0.0.1", Ok: true},
+		{AdminRoles: []string{"admin"}},
+		{StoreURL: "redis://127.0.0.1"},
+		{AdminRoles: []string{"admin"}, StoreURL: "memcached://127.0.0.1:11211"},
+		{AdminRoles: []string{"admin"}, StoreURL: "redis+cluster://127.0.0.1"},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableActiveSessions = true
+		cfg.AdminRoles = c.AdminRoles
+		cfg.StoreURL = c.StoreURL
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidReplayProtection(t *testing.T) {
+	cs := []struct {
+		StoreURL string
+		Ok       bool
+	}{
+		{StoreURL: "redis://127.0.0.1", Ok: true},
+		{},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.StoreURL = c.StoreURL
+		cfg.Resources = []*Resource{{URL: "/payments", ReplayProtection: true}}
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidDPoP(t *testing.T) {
+	cs := []struct {
+		Enabled   bool
+		Nonce     bool
+		Resources []*Resource
+		Ok        bool
+	}{
+		{Ok: true},
+		{Enabled: true, Nonce: true, Ok: true},
+		{Enabled: true, Resources: []*Resource{{URL: "/api", DPoP: true}}, Ok: true},
+		{Nonce: true},
+		{Resources: []*Resource{{URL: "/api", DPoP: true}}},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableDPoP = c.Enabled
+		cfg.EnableDPoPNonce = c.Nonce
+		cfg.Resources = c.Resources
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidCertificateBoundTokens(t *testing.T) {
+	file, _ := ioutil.TempFile("", "certificate")
+	file.Close()
+	defer os.Remove(file.Name())
+
+	cs := []struct {
+		Enabled   bool
+		MutualTLS bool
+		Resources []*Resource
+		Ok        bool
+	}{
+		{Ok: true},
+		{Enabled: true, MutualTLS: true, Ok: true},
+		{Enabled: true, MutualTLS: true, Resources: []*Resource{{URL: "/api", CertificateBound: true}}, Ok: true},
+		{Enabled: true},
+		{MutualTLS: true, Resources: []*Resource{{URL: "/api", CertificateBound: true}}},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableCertificateBoundTokens = c.Enabled
+		if c.MutualTLS {
+			cfg.TLSCertificate, cfg.TLSPrivateKey, cfg.TLSClientCertificate = file.Name(), file.Name(), file.Name()
+		}
+		cfg.Resources = c.Resources
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidSameSiteCookie(t *testing.T) {
+	cs := []struct {
+		SameSite string
+		Ok       bool
+	}{
+		{Ok: true},
+		{SameSite: "Lax", Ok: true},
+		{SameSite: "strict", Ok: true},
+		{SameSite: "None", Ok: true},
+		{SameSite: "Relaxed"},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.SameSiteCookie = c.SameSite
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidCookieNames(t *testing.T) {
+	cs := []struct {
+		Access  string
+		Refresh string
+		Ok      bool
+	}{
+		{Access: "kc-access", Refresh: "kc-state", Ok: true},
+		{Access: "app-a_access", Refresh: "app-a_refresh", Ok: true},
+		{Access: "kc access", Refresh: "kc-state"},
+		{Access: "kc-access", Refresh: "kc;state"},
+		{Access: "kc-access", Refresh: "kc-access"},
+		{Access: "kc-access", Refresh: "kc-access-state"},
+		{Access: "kc-access", Refresh: "kc-access-nonce"},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.CookieAccessName = c.Access
+		cfg.CookieRefreshName = c.Refresh
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidCookieScope(t *testing.T) {
+	cs := []struct {
+		BaseURI        string
+		CookieDomain   string
+		CookiePath     string
+		ExpectedDomain string
+		ExpectedPath   string
+		Ok             bool
+	}{
+		{Ok: true},
+		{CookieDomain: ".service.gov.uk", ExpectedDomain: ".service.gov.uk", Ok: true},
+		{CookieDomain: "*.service.gov.uk", ExpectedDomain: ".service.gov.uk", Ok: true},
+		{CookieDomain: "https://service.gov.uk"},
+		{CookieDomain: "service.gov.uk:443"},
+		{CookieDomain: "*."},
+		{CookiePath: "/", ExpectedPath: "/", Ok: true},
+		{BaseURI: "/app-a", CookiePath: "/app-a/", ExpectedPath: "/app-a", Ok: true},
+		{BaseURI: "/app-a/sub", CookiePath: "/app-a", ExpectedPath: "/app-a", Ok: true},
+		{CookiePath: "app-a"},
+		{CookiePath: "/app-a"},
+		{BaseURI: "/app-ab", CookiePath: "/app-a"},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.BaseURI = c.BaseURI
+		cfg.CookieDomain = c.CookieDomain
+		cfg.CookiePath = c.CookiePath
+		err := cfg.isValid()
+		if c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+			continue
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+			continue
+		}
+		if c.Ok && (cfg.CookieDomain != c.ExpectedDomain || cfg.CookiePath != c.ExpectedPath) {
+			t.Errorf("case %d, expected the domain: %q and path: %q, got: %q and %q", i, c.ExpectedDomain, c.ExpectedPath, cfg.CookieDomain, cfg.CookiePath)
+		}
+	}
+}
+
+func TestIsValidRefreshAnomaly(t *testing.T) {
+	cs := []struct {
+		Threshold     int
+		Window        time.Duration
+		RefreshTokens bool
+		StoreURL      string
+		Ok            bool
+	}{
+		{Ok: true},
+		{Threshold: 10, Window: time.Minute, RefreshTokens: true, StoreURL: "redis://127.0.0.1", Ok: true},
+		{Threshold: -1},
+		{Threshold: 10, Window: time.Minute, StoreURL: "redis://127.0.0.1"},
+		{Threshold: 10, Window: time.Minute, RefreshTokens: true},
+		{Threshold: 10, RefreshTokens: true, StoreURL: "redis://127.0.0.1"},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.RefreshAnomalyThreshold = c.Threshold
+		cfg.RefreshAnomalyWindow = c.Window
+		cfg.EnableRefreshTokens = c.RefreshTokens
+		cfg.StoreURL = c.StoreURL
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidServerSideSessions(t *testing.T) {
+	cs := []struct {
+		StoreURL      string
+		EncryptionKey string
+		Ok            bool
+	}{
+		{StoreURL: "redis://127.0.0.1", EncryptionKey: "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j", Ok: true},
+		{EncryptionKey: "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"},
+		{StoreURL: "redis://127.0.0.1"},
+		{StoreURL: "redis://127.0.0.1", EncryptionKey: "short"},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableServerSideSessions = true
+		cfg.StoreURL = c.StoreURL
+		cfg.EncryptionKey = Secret(c.EncryptionKey)
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidSessionIdleTimeout(t *testing.T) {
+	cases := []struct {
+		Timeout time.Duration
+		Ok      bool
+	}{
+		{Ok: true},
+		{Timeout: 15 * time.Minute, Ok: true},
+		{Timeout: -time.Minute},
+	}
+	for i, c := range cases {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.SessionIdleTimeout = c.Timeout
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidSyntheticEndpoints(t *testing.T) {
+	cs := []struct {
+		Endpoints []*SyntheticEndpoint
+		Ok        bool
+	}{
+		{Ok: true},
+		{Endpoints: []*SyntheticEndpoint{{Path: "/.well-known/assetlinks.json", Body: "[]"}}, Ok: true},
+		{Endpoints: []*SyntheticEndpoint{{Path: "/a", Body: "[]"}, {Path: "/b", Body: "[]"}}, Ok: true},
+		{Endpoints: []*SyntheticEndpoint{{Path: "/a", Body: "[]"}, {Path: "/a", Body: "{}"}}},
+		{Endpoints: []*SyntheticEndpoint{{Path: "/oauth/health", Body: "[]"}}},
+		{Endpoints: []*SyntheticEndpoint{{Path: "a"}}},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.SyntheticEndpoints = c.Endpoints
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidEncryptionKeys(t *testing.T) {
+	cs := []struct {
+		Key   string
+		Keys  []Secret
+		KeyID string
+		Ok    bool
+	}{
+		{Key: "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j", Ok: true},
+		{Key: "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j", KeyID: "2026-10_a", Ok: true},
+		{Key: "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j", KeyID: "2026.10"},
+		{Keys: []Secret{"AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j", "1234567890123456"}, Ok: true},
+		{Keys: []Secret{"AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j", "short"}},
+		{Key: "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j", Keys: []Secret{"1234567890123456"}},
+		{},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.EnableRefreshTokens = true
+		cfg.EncryptionKey = Secret(c.Key)
+		cfg.EncryptionKeys = c.Keys
+		cfg.EncryptionKeyID = c.KeyID
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
+
+func TestIsValidInternalPaths(t *testing.T) {
+	cs := []struct {
+		ListenAdmin   string
+		InternalPaths []string
+		Ok            bool
+	}{
+		{Ok: true},
+		{ListenAdmin: "127.0.0.1:9090", Ok: true},
+		{ListenAdmin: "127.0.0.1:9090", InternalPaths: []string{"/internal"}, Ok: true},
+		{InternalPaths: []string{"/internal"}},
+		{ListenAdmin: "127.0.0.1:9090", InternalPaths: []string{"internal"}},
+		{ListenAdmin: "127.0.0.1:3000", InternalPaths: []string{"/internal"}},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Upstream = "http://127.0.0.1"
+		cfg.Listen = "127.0.0.1:3000"
+		cfg.ListenAdmin = c.ListenAdmin
+		cfg.InternalPaths = c.InternalPaths
+		if err := cfg.isValid(); c.Ok && err != nil {
+			t.Errorf("case %d, the config should not have errored, error: %s", i, err)
+		} else if !c.Ok && err == nil {
+			t.Errorf("case %d, the config should have errored", i)
+		}
+	}
+}
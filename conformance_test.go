@@ -0,0 +1,121 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the response conformance cases, the responses must never carry a body for a HEAD, 204 or 304, and the
+// Content-Length of a HEAD must be the length the GET would have had
+func TestResponseConformance(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/public/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/public/not-modified":
+			w.Header().Set("ETag", `"1"`)
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("Content-Length", "5")
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.ForbiddenPage = "templates/forbidden.html.tmpl"
+	cfg.Resources = append(cfg.Resources,
+		&Resource{URL: "/public", WhiteListed: true},
+		&Resource{URL: "/forbidden", Methods: []string{"ANY"}, Roles: []string{"no-one-has-this-role"}})
+	cfg.SyntheticEndpoints = []*SyntheticEndpoint{
+		{Path: "/synthetic/json", Body: `{"a": 1}`},
+		{Path: "/synthetic/no-content", Status: http.StatusNoContent},
+	}
+	p, idp, svc := newTestProxyService(cfg)
+	p.endpoint, _ = url.Parse(upstream.URL)
+	if !assert.NoError(t, p.createUpstreamProxy(p.endpoint)) {
+		t.FailNow()
+	}
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	cs := []struct {
+		URI    string
+		Token  bool
+		Status int
+		Empty  bool
+	}{
+		{URI: oauthURL + healthURL, Status: http.StatusOK},
+		{URI: oauthURL + versionURL, Status: http.StatusOK},
+		{URI: oauthURL + tokenURL, Token: true, Status: http.StatusOK},
+		{URI: oauthURL + expiredURL, Token: true, Status: http.StatusOK, Empty: true},
+		{URI: "/synthetic/json", Status: http.StatusOK},
+		{URI: "/synthetic/no-content", Status: http.StatusNoContent, Empty: true},
+		{URI: "/forbidden", Token: true, Status: http.StatusForbidden},
+		{URI: "/public/hello", Status: http.StatusOK},
+		{URI: "/public/no-content", Status: http.StatusNoContent, Empty: true},
+		{URI: "/public/not-modified", Status: http.StatusNotModified, Empty: true},
+	}
+	for i, c := range cs {
+		var length int
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req, _ := http.NewRequest(method, svc+c.URI, nil)
+			if c.Token {
+				req.Header.Set(authorizationHeader, "Bearer "+signed.Encode())
+			}
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if !assert.NoError(t, err, "case %d, method: %s", i, method) {
+				continue
+			}
+			content, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.NoError(t, err, "case %d, method: %s", i, method)
+			assert.Equal(t, c.Status, resp.StatusCode, "case %d, method: %s", i, method)
+
+			switch {
+			case method == http.MethodGet:
+				length = len(content)
+				assert.Equal(t, c.Empty, length == 0, "case %d, body: %q", i, content)
+				if !bodyAllowedForStatus(c.Status) {
+					assert.Empty(t, resp.Header.Get("Content-Length"), "case %d", i)
+				} else if value := resp.Header.Get("Content-Length"); value != "" {
+					assert.Equal(t, strconv.Itoa(length), value, "case %d", i)
+				}
+			default:
+				assert.Empty(t, content, "case %d, a HEAD must not have a body", i)
+				if bodyAllowedForStatus(c.Status) && length > 0 {
+					assert.Equal(t, strconv.Itoa(length), resp.Header.Get("Content-Length"), "case %d", i)
+				}
+			}
+		}
+	}
+}
+
+func TestBodyAllowedForStatus(t *testing.T) {
+	assert.True(t, bodyAllowedForStatus(http.StatusOK))
+	assert.True(t, bodyAllowedForStatus(http.StatusNotFound))
+	assert.False(t, bodyAllowedForStatus(http.StatusContinue))
+	assert.False(t, bodyAllowedForStatus(http.StatusNoContent))
+	assert.False(t, bodyAllowedForStatus(http.StatusNotModified))
+}
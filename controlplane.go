@@ -0,0 +1,231 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// controlPlaneSignatureHeader is the header carrying the signature of the policy
+	controlPlaneSignatureHeader = "X-Signature"
+	// maxControlPlanePolicySize is the maximum size of a policy we will read
+	maxControlPlanePolicySize = 1 << 20
+)
+
+// controlPlanePolicy is the resource and header configuration pulled from the control plane
+type controlPlanePolicy struct {
+	// Version is the version of the policy, each policy must be newer than the one applied
+	Version int64 `json:"version"`
+	// Expires is when the policy lapses, a policy pulled after it is rejected
+	Expires time.Time `json:"expires"`
+	// Resources are the protected resources
+	Resources []*Resource `json:"resources"`
+	// Headers are the custom headers added to the upstream request
+	Headers map[string]string `json:"headers"`
+}
+
+// controlPlane periodically pulls the policy from the control plane, applying it to the proxy
+type controlPlane struct {
+	// the proxy the policy is applied to
+	proxy *oauthProxy
+	// the http client for the control plane
+	client *http.Client
+	// the key verifying the policy signature
+	key *rsa.PublicKey
+	// the etag of the last applied policy
+	etag string
+	// the version of the last applied policy
+	version int64
+	// the digest of the last applied policy
+	digest [sha256.Size]byte
+}
+
+// newControlPlane creates a control plane client, loading the public key used to verify the policy
+func newControlPlane(proxy *oauthProxy) (*controlPlane, error) {
+	content, err := ioutil.ReadFile(proxy.config.ControlPlanePublicKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePublicKey(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return &controlPlane{
+		proxy:  proxy,
+		client: &http.Client{Timeout: 10 * time.Second},
+		key:    key,
+	}, nil
+}
+
+// run polls the control plane on the interval, it never returns
+func (r *controlPlane) run() {
+	log.Infof("pulling the resources and headers from the control plane: %s, interval: %s",
+		r.proxy.config.ControlPlaneURL, r.proxy.config.ControlPlaneInterval)
+
+	for {
+		if err := r.poll(); err != nil {
+			log.WithFields(log.Fields{
+				"url":   r.proxy.config.ControlPlaneURL,
+				"error": err.Error(),
+			}).Errorf("unable to pull the policy from the control plane, retaining the current configuration")
+		}
+		time.Sleep(r.proxy.config.ControlPlaneInterval)
+	}
+}
+
+// poll retrieves the policy from the control plane, applying it if changed and correctly signed
+func (r *controlPlane) poll() error {
+	req, err := http.NewRequest(http.MethodGet, r.proxy.config.ControlPlaneURL, nil)
+	if err != nil {
+		return err
+	}
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("unexpected response from the control plane, status: %d", resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxControlPlanePolicySize))
+	if err != nil {
+		return err
+	}
+	// step: verify the policy was signed by the control plane
+	if err := verifyPolicySignature(r.key, content, resp.Header.Get(controlPlaneSignatureHeader)); err != nil {
+		return err
+	}
+	policy := &controlPlanePolicy{}
+	if err := json.Unmarshal(content, policy); err != nil {
+		return fmt.Errorf("unable to decode the policy, error: %s", err)
+	}
+	// step: a policy signed in the past could otherwise be replayed, rolling back the resources
+	switch {
+	case policy.Version == r.version && sha256.Sum256(content) == r.digest:
+		r.etag = resp.Header.Get("ETag")
+		return nil
+	case policy.Version <= r.version:
+		return fmt.Errorf("the policy version: %d is not newer than the applied version: %d", policy.Version, r.version)
+	case !policy.Expires.IsZero() && time.Now().After(policy.Expires):
+		return fmt.Errorf("the policy version: %d expired on: %s", policy.Version, policy.Expires)
+	}
+	// step: the policy is applied whole or not at all, any invalid resource rejecting it
+	if err := r.proxy.config.isValidResources(policy.Resources); err != nil {
+		return fmt.Errorf("the policy contains an invalid resource, error: %s", err)
+	}
+	r.proxy.setPolicy(policy)
+	r.etag = resp.Header.Get("ETag")
+	r.version, r.digest = policy.Version, sha256.Sum256(content)
+
+	log.WithFields(log.Fields{
+		"etag":      r.etag,
+		"version":   r.version,
+		"resources": len(policy.Resources),
+		"headers":   len(policy.Headers),
+	}).Infof("applied the policy from the control plane")
+
+	return nil
+}
+
+// verifyPolicySignature checks the base64 encoded rsa-sha256 signature of the policy
+func verifyPolicySignature(key *rsa.PublicKey, content []byte, signature string) error {
+	if signature == "" {
+		return errors.New("the policy is not signed")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("the policy signature is not base64 encoded, error: %s", err)
+	}
+	hashed := sha256.Sum256(content)
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], decoded); err != nil {
+		return errors.New("the policy signature is invalid")
+	}
+
+	return nil
+}
+
+// parsePublicKey decodes a pem encoded rsa public key
+func parsePublicKey(content []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("unable to decode the pem encoded public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("the public key must be a rsa key")
+	}
+
+	return rsaKey, nil
+}
+
+// getResources returns the protected resources
+func (r *oauthProxy) getResources() []*Resource {
+	r.policyLock.RLock()
+	defer r.policyLock.RUnlock()
+
+	return r.config.Resources
+}
+
+// getCustomHeaders returns the custom headers added to the upstream request
+func (r *oauthProxy) getCustomHeaders() map[string]string {
+	r.policyLock.RLock()
+	defer r.policyLock.RUnlock()
+
+	return r.config.Headers
+}
+
+// setPolicy replaces the resources and headers given in the policy, these are never modified in
+// place so readers holding the previous values are unaffected
+func (r *oauthProxy) setPolicy(policy *controlPlanePolicy) {
+	r.policyLock.Lock()
+	defer r.policyLock.Unlock()
+
+	if policy.Resources != nil {
+		r.config.Resources = policy.Resources
+	}
+	if policy.Headers != nil {
+		r.config.Headers = policy.Headers
+	}
+}
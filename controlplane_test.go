@@ -0,0 +1,207 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testControlPlanePolicy = `{
+	"version": 1,
+	"resources": [{"uri": "/policy", "roles": ["policy-role"]}],
+	"headers": {"X-Policy": "true"}
+}`
+
+type fakeControlPlane struct {
+	key       *rsa.PrivateKey
+	policy    string
+	signature string
+	requests  int
+	notMod    int
+}
+
+func newFakeControlPlane(t *testing.T) (*fakeControlPlane, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate the key: %s", err)
+	}
+	encoded, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	file, _ := ioutil.TempFile("", "control-plane")
+	pem.Encode(file, &pem.Block{Type: "PUBLIC KEY", Bytes: encoded})
+	file.Close()
+
+	f := &fakeControlPlane{key: key}
+	f.setPolicy(testControlPlanePolicy)
+
+	return f, file.Name()
+}
+
+func (f *fakeControlPlane) setPolicy(policy string) {
+	hashed := sha256.Sum256([]byte(policy))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, hashed[:])
+	f.policy = policy
+	f.signature = base64.StdEncoding.EncodeToString(signature)
+}
+
+func (f *fakeControlPlane) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.requests++
+	hashed := sha256.Sum256([]byte(f.policy))
+	etag := `"` + base64.StdEncoding.EncodeToString(hashed[:8]) + `"`
+	if req.Header.Get("If-None-Match") == etag {
+		f.notMod++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set(controlPlaneSignatureHeader, f.signature)
+	w.Write([]byte(f.policy))
+}
+
+func newTestControlPlane(t *testing.T) (*controlPlane, *fakeControlPlane, func()) {
+	fake, keyfile := newFakeControlPlane(t)
+	server := httptest.NewServer(fake)
+	config := newFakeKeycloakConfig()
+	config.ControlPlaneURL = server.URL
+	config.ControlPlanePublicKey = keyfile
+	cp, err := newControlPlane(&oauthProxy{config: config})
+	if err != nil {
+		t.Fatalf("unable to create the control plane: %s", err)
+	}
+
+	return cp, fake, func() {
+		server.Close()
+		os.Remove(keyfile)
+	}
+}
+
+func TestControlPlanePoll(t *testing.T) {
+	cp, fake, cleanup := newTestControlPlane(t)
+	defer cleanup()
+
+	assert.NoError(t, cp.poll())
+	resources := cp.proxy.getResources()
+	if assert.Len(t, resources, 1) {
+		assert.Equal(t, "/policy", resources[0].URL)
+		assert.Equal(t, []string{"policy-role"}, resources[0].Roles)
+	}
+	assert.Equal(t, "true", cp.proxy.getCustomHeaders()["X-Policy"])
+
+	// step: the policy has not changed
+	assert.NoError(t, cp.poll())
+	assert.Equal(t, 2, fake.requests)
+	assert.Equal(t, 1, fake.notMod)
+
+	// step: the policy has changed, headers absent from the policy are retained
+	fake.setPolicy(`{"version": 2, "resources": [{"uri": "/changed"}]}`)
+	assert.NoError(t, cp.poll())
+	assert.Equal(t, "/changed", cp.proxy.getResources()[0].URL)
+	assert.Equal(t, "true", cp.proxy.getCustomHeaders()["X-Policy"])
+}
+
+func TestControlPlaneBadSignature(t *testing.T) {
+	cp, fake, cleanup := newTestControlPlane(t)
+	defer cleanup()
+	assert.NoError(t, cp.poll())
+
+	fake.signature = fake.signature[:len(fake.signature)-8] + "AAAAAAA="
+	fake.policy = `{"version": 2, "resources": [{"uri": "/"}]}`
+	assert.Error(t, cp.poll())
+	assert.Equal(t, "/policy", cp.proxy.getResources()[0].URL)
+}
+
+func TestControlPlaneInvalidResource(t *testing.T) {
+	cp, fake, cleanup := newTestControlPlane(t)
+	defer cleanup()
+
+	fake.setPolicy(`{"version": 1, "resources": [{"roles": ["no-uri"]}]}`)
+	assert.Error(t, cp.poll())
+}
+
+func TestControlPlaneInconsistentResource(t *testing.T) {
+	cp, fake, cleanup := newTestControlPlane(t)
+	defer cleanup()
+	cp.proxy.config.WebhookSecrets = map[string]string{"github": "secret"}
+	assert.NoError(t, cp.poll())
+
+	// step: the resources are checked against the config, the whole policy rejected by any one
+	policies := []string{
+		`{"version": 2, "resources": [{"uri": "/hooks", "webhook": "github"}, {"uri": "/stripe", "webhook": "stripe"}]}`,
+		`{"version": 2, "resources": [{"uri": "/hooks", "webhook": "github"}, {"uri": "/static", "basic-auth": ["nobody"]}]}`,
+		`{"version": 2, "resources": [{"uri": "/hooks", "webhook": "github"}, {"uri": "/payments", "dpop": true}]}`,
+		`{"version": 2, "resources": [{"uri": "/hooks", "webhook": "github"}, {"uri": "/payments", "replay-protection": true}]}`,
+		`{"version": 2, "resources": [{"uri": "/hooks", "webhook": "github"}, {"uri": "/oauth/login"}]}`,
+	}
+	for i, x := range policies {
+		fake.setPolicy(x)
+		assert.Error(t, cp.poll(), "case %d", i)
+		assert.Equal(t, "/policy", cp.proxy.getResources()[0].URL, "case %d", i)
+	}
+
+	fake.setPolicy(`{"version": 2, "resources": [{"uri": "/hooks", "webhook": "github"}]}`)
+	assert.NoError(t, cp.poll())
+	assert.Equal(t, "/hooks", cp.proxy.getResources()[0].URL)
+}
+
+func TestControlPlaneVersion(t *testing.T) {
+	cp, fake, cleanup := newTestControlPlane(t)
+	defer cleanup()
+	assert.NoError(t, cp.poll())
+
+	// step: the policies no newer than the applied one, expired or without a version are rejected
+	policies := []string{
+		`{"resources": [{"uri": "/unversioned"}]}`,
+		`{"version": 0, "resources": [{"uri": "/older"}]}`,
+		`{"version": 1, "resources": [{"uri": "/same"}]}`,
+		`{"version": 2, "expires": "` + time.Now().Add(-time.Minute).Format(time.RFC3339) + `", "resources": [{"uri": "/expired"}]}`,
+	}
+	for i, x := range policies {
+		fake.setPolicy(x)
+		assert.Error(t, cp.poll(), "case %d", i)
+		assert.Equal(t, "/policy", cp.proxy.getResources()[0].URL, "case %d", i)
+	}
+
+	// step: the applied policy served again, i.e. without an etag, is not an error
+	fake.setPolicy(testControlPlanePolicy)
+	cp.etag = ""
+	assert.NoError(t, cp.poll())
+
+	fake.setPolicy(`{"version": 3, "expires": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `", "resources": [{"uri": "/newer"}]}`)
+	assert.NoError(t, cp.poll())
+	assert.Equal(t, "/newer", cp.proxy.getResources()[0].URL)
+	assert.Equal(t, int64(3), cp.version)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	_, err := parsePublicKey([]byte("not a key"))
+	assert.Error(t, err)
+	content, _ := ioutil.ReadFile("./tests/ca.pem")
+	_, err = parsePublicKey(content)
+	assert.Error(t, err)
+}
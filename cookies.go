@@ -25,6 +25,11 @@ import (
 
 // dropCookie drops a cookie into the response
 func (r *oauthProxy) dropCookie(cx *gin.Context, name, value string, duration time.Duration) {
+	r.dropPathCookie(cx, name, value, r.config.getCookiePath(), duration)
+}
+
+// dropPathCookie drops a cookie scoped to the path into the response
+func (r *oauthProxy) dropPathCookie(cx *gin.Context, name, value, path string, duration time.Duration) {
 	// step: default to the host header, else the config domain
 	domain := strings.Split(cx.Request.Host, ":")[0]
 	if r.config.CookieDomain != "" {
@@ -34,10 +39,15 @@ func (r *oauthProxy) dropCookie(cx *gin.Context, name, value string, duration ti
 		Name:     name,
 		Domain:   domain,
 		HttpOnly: r.config.HTTPOnlyCookie,
-		Path:     "/",
+		Path:     path,
+		SameSite: r.getSameSite(name),
 		Secure:   r.config.SecureCookie,
 		Value:    value,
 	}
+	// step: the browsers reject a cookie with SameSite=None which isn't also secure
+	if cookie.SameSite == http.SameSiteNoneMode {
+		cookie.Secure = true
+	}
 	if duration != 0 {
 		cookie.Expires = time.Now().Add(duration)
 	}
@@ -45,28 +55,53 @@ func (r *oauthProxy) dropCookie(cx *gin.Context, name, value string, duration ti
 	http.SetCookie(cx.Writer, cookie)
 }
 
+// getSameSite returns the SameSite attribute of the cookie, if configured. The state and nonce cookies must be
+// sent on the redirect back from the provider, a cross-site navigation, so they are never more than lax
+func (r *oauthProxy) getSameSite(name string) http.SameSite {
+	var mode http.SameSite
+	switch strings.ToLower(r.config.SameSiteCookie) {
+	case "lax":
+		mode = http.SameSiteLaxMode
+	case "strict":
+		mode = http.SameSiteStrictMode
+		switch name {
+		case r.config.getStateCookieName(), r.config.getNonceCookieName(), r.config.getMobileStateCookieName():
+			mode = http.SameSiteLaxMode
+		}
+	case "none":
+		mode = http.SameSiteNoneMode
+	}
+
+	return mode
+}
+
 // dropAccessTokenCookie drops a access token cookie into the response
 func (r *oauthProxy) dropAccessTokenCookie(cx *gin.Context, value string, duration time.Duration) {
-	r.dropCookie(cx, r.config.CookieAccessName, value, duration)
+	name, _ := r.config.getCookieNames(r.getSessionName(cx.Request))
+	r.dropCookie(cx, name, value, duration)
 }
 
 // dropRefreshTokenCookie drops a refresh token cookie into the response
 func (r *oauthProxy) dropRefreshTokenCookie(cx *gin.Context, value string, duration time.Duration) {
-	r.dropCookie(cx, r.config.CookieRefreshName, value, duration)
+	_, name := r.config.getCookieNames(r.getSessionName(cx.Request))
+	r.dropPathCookie(cx, name, value, r.config.getRefreshCookiePath(), duration)
 }
 
 // clearAllCookies is just a helper function for the below
 func (r *oauthProxy) clearAllCookies(cx *gin.Context) {
 	r.clearAccessTokenCookie(cx)
 	r.clearRefreshTokenCookie(cx)
+	r.clearActivityCookie(cx)
 }
 
 // clearRefreshSessionCookie clears the session cookie
 func (r *oauthProxy) clearRefreshTokenCookie(cx *gin.Context) {
-	r.dropCookie(cx, r.config.CookieRefreshName, "", time.Duration(-10*time.Hour))
+	_, name := r.config.getCookieNames(r.getSessionName(cx.Request))
+	r.dropPathCookie(cx, name, "", r.config.getRefreshCookiePath(), time.Duration(-10*time.Hour))
 }
 
 // clearAccessTokenCookie clears the session cookie
 func (r *oauthProxy) clearAccessTokenCookie(cx *gin.Context) {
-	r.dropCookie(cx, r.config.CookieAccessName, "", time.Duration(-10*time.Hour))
+	name, _ := r.config.getCookieNames(r.getSessionName(cx.Request))
+	r.dropCookie(cx, name, "", time.Duration(-10*time.Hour))
 }
@@ -107,6 +107,33 @@ func TestHTTPOnlyCookie(t *testing.T) {
 		"we have not set the cookie, headers: %v", context.Writer.Header())
 }
 
+func TestSameSiteCookie(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+
+	cs := []struct {
+		SameSite string
+		Secure   bool
+		Name     string
+		Expected string
+	}{
+		{Name: "test-cookie", Expected: "test-cookie=test-value; Path=/; Domain=127.0.0.1"},
+		{SameSite: "Lax", Name: "test-cookie", Expected: "test-cookie=test-value; Path=/; Domain=127.0.0.1; SameSite=Lax"},
+		{SameSite: "strict", Name: "test-cookie", Expected: "test-cookie=test-value; Path=/; Domain=127.0.0.1; SameSite=Strict"},
+		{SameSite: "None", Name: "test-cookie", Expected: "test-cookie=test-value; Path=/; Domain=127.0.0.1; Secure; SameSite=None"},
+		{SameSite: "None", Secure: true, Name: "test-cookie", Expected: "test-cookie=test-value; Path=/; Domain=127.0.0.1; Secure; SameSite=None"},
+		// step: the state of the authorization must be sent on the redirect back from the provider
+		{SameSite: "Strict", Name: p.config.getStateCookieName(), Expected: p.config.getStateCookieName() + "=test-value; Path=/; Domain=127.0.0.1; SameSite=Lax"},
+		{SameSite: "Strict", Name: p.config.getNonceCookieName(), Expected: p.config.getNonceCookieName() + "=test-value; Path=/; Domain=127.0.0.1; SameSite=Lax"},
+	}
+	for i, c := range cs {
+		p.config.SameSiteCookie = c.SameSite
+		p.config.SecureCookie = c.Secure
+		context := newFakeGinContext("GET", "/admin")
+		p.dropCookie(context, c.Name, "test-value", 0)
+		assert.Equal(t, c.Expected, context.Writer.Header().Get("Set-Cookie"), "case %d", i)
+	}
+}
+
 func TestClearAccessTokenCookie(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 	context := newFakeGinContext("GET", "/admin")
@@ -133,3 +160,39 @@ func TestClearAllCookies(t *testing.T) {
 		"kc-access=; Path=/; Domain=127.0.0.1; Expires=",
 		"we have not cleared the, headers: %v", context.Writer.Header())
 }
+
+func TestRefreshCookiePath(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+
+	context := newFakeGinContext("GET", "/admin")
+	p.dropRefreshTokenCookie(context, "test-value", 0)
+	assert.Equal(t, "kc-state=test-value; Path=/; Domain=127.0.0.1", context.Writer.Header().Get("Set-Cookie"))
+
+	context = newFakeGinContext("GET", "/admin")
+	p.config.CookieRefreshPath = oauthURL
+	p.dropRefreshTokenCookie(context, "test-value", 0)
+	assert.Equal(t, "kc-state=test-value; Path=/oauth; Domain=127.0.0.1", context.Writer.Header().Get("Set-Cookie"))
+
+	context = newFakeGinContext("GET", "/admin")
+	p.dropAccessTokenCookie(context, "test-value", 0)
+	assert.Equal(t, "kc-access=test-value; Path=/; Domain=127.0.0.1", context.Writer.Header().Get("Set-Cookie"))
+}
+
+func TestCookiePath(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.BaseURI = "/app-a/sub"
+	p.config.CookiePath = "/app-a"
+
+	context := newFakeGinContext("GET", "/app-a/sub/admin")
+	p.dropAccessTokenCookie(context, "test-value", 0)
+	assert.Equal(t, "kc-access=test-value; Path=/app-a; Domain=127.0.0.1", context.Writer.Header().Get("Set-Cookie"))
+
+	context = newFakeGinContext("GET", "/app-a/sub/admin")
+	p.dropRefreshTokenCookie(context, "test-value", 0)
+	assert.Equal(t, "kc-state=test-value; Path=/app-a; Domain=127.0.0.1", context.Writer.Header().Get("Set-Cookie"))
+
+	context = newFakeGinContext("GET", "/app-a/sub/admin")
+	p.config.CookieDomain = ".service.gov.uk"
+	p.dropAccessTokenCookie(context, "test-value", 0)
+	assert.Equal(t, "kc-access=test-value; Path=/app-a; Domain=service.gov.uk", context.Writer.Header().Get("Set-Cookie"))
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// deviceCodeGrantType is the grant type of the device authorization grant, rfc 8628
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// deviceAuthorizationResponse is the response of the device authorization endpoint
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+}
+
+// deviceErrorResponse is the error of a device token request, i.e. authorization_pending or slow_down
+type deviceErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// devicePollingErrors are the errors of a device token request passed back to the client, so it can
+// continue polling or give up
+var devicePollingErrors = []string{"authorization_pending", "slow_down", "access_denied", "expired_token"}
+
+//
+// deviceAuthorizationHandler starts the device authorization grant, returning the user code and the
+// verification uri the user must visit to authorize the device
+//
+func (r *oauthProxy) deviceAuthorizationHandler(cx *gin.Context) {
+	if !r.config.EnableDeviceHandler {
+		cx.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+
+	values := url.Values{}
+	values.Set("client_id", r.config.ClientID)
+	values.Set("scope", strings.Join(append(r.config.Scopes, oidc.DefaultScope...), " "))
+
+	code, content, err := r.postProviderForm(r.getDeviceAuthorizationURL(), values)
+	if err == nil && code != http.StatusOK {
+		err = fmt.Errorf("invalid response from device authorization, status: %d, response: %s", code, content)
+	}
+	var resp deviceAuthorizationResponse
+	if err == nil {
+		if err = json.Unmarshal(content, &resp); err == nil && resp.DeviceCode == "" {
+			err = errors.New("the device authorization response has no device code")
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"error":     err.Error(),
+		}).Errorf("unable to start the device authorization")
+
+		cx.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+
+	writeJSON(cx, http.StatusOK, resp)
+}
+
+//
+// deviceTokenHandler polls the provider for the tokens of a device authorization, returning the
+// tokens and dropping the session cookies once the user has authorized the device
+//
+func (r *oauthProxy) deviceTokenHandler(cx *gin.Context) {
+	if !r.config.EnableDeviceHandler {
+		cx.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+	deviceCode := cx.Request.PostFormValue("device_code")
+	if deviceCode == "" {
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	values := url.Values{}
+	values.Set("grant_type", deviceCodeGrantType)
+	values.Set("device_code", deviceCode)
+	values.Set("client_id", r.config.ClientID)
+
+	code, content, err := r.postProviderForm(r.getProviderConfig().TokenEndpoint.String(), values)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to request the device token")
+
+		cx.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+	// step: pass back the polling errors, so the client knows to keep polling
+	if code != http.StatusOK {
+		var failure deviceErrorResponse
+		if json.Unmarshal(content, &failure) == nil && containedIn(failure.Error, devicePollingErrors) {
+			writeJSON(cx, http.StatusBadRequest, failure)
+			return
+		}
+		log.WithFields(log.Fields{
+			"status":   code,
+			"response": string(content),
+		}).Errorf("invalid response from the device token request")
+
+		cx.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+
+	var resp tokenResponse
+	if err := json.Unmarshal(content, &resp); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to decode the device token response")
+
+		cx.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+	token, identity, err := parseToken(resp.AccessToken, r.decryptionKey)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to parse the access token of the device")
+
+		cx.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+	if err := r.verifyJWT(token); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to verify the access token of the device")
+
+		r.accessForbidden(cx)
+		return
+	}
+	if user, err := extractIdentity(token); err == nil {
+		r.stats.login(user.id)
+	}
+	if err := r.dropSessionCookies(cx, token, identity, resp.RefreshToken); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to encrypt the refresh token")
+
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(cx, http.StatusOK, resp)
+}
+
+// getDeviceAuthorizationURL returns the device authorization endpoint of the provider
+func (r *oauthProxy) getDeviceAuthorizationURL() string {
+	if r.config.DeviceAuthorizationURL != "" {
+		return r.config.DeviceAuthorizationURL
+	}
+
+	return strings.TrimSuffix(r.getProviderConfig().AuthEndpoint.String(), "/") + "/device"
+}
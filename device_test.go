@@ -0,0 +1,83 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceHandlerDisabled(t *testing.T) {
+	_, _, svc := newTestProxyService(nil)
+	for _, uri := range []string{deviceURL, deviceTokenURL} {
+		resp, err := resty.New().R().Post(svc + oauthURL + uri)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotImplemented, resp.StatusCode())
+	}
+}
+
+func TestDeviceAuthorization(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableDeviceHandler = true
+	_, _, svc := newTestProxyService(cfg)
+
+	var device deviceAuthorizationResponse
+	resp, err := resty.New().R().SetResult(&device).Post(svc + oauthURL + deviceURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, fakeDeviceCode, device.DeviceCode)
+	assert.NotEmpty(t, device.UserCode)
+	assert.NotEmpty(t, device.VerificationURI)
+	assert.Equal(t, 5, device.Interval)
+}
+
+func TestDeviceToken(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableDeviceHandler = true
+	_, _, svc := newTestProxyService(cfg)
+
+	cs := []struct {
+		DeviceCode   string
+		ExpectedCode int
+		ExpectedErr  string
+	}{
+		{ExpectedCode: http.StatusBadRequest},
+		{DeviceCode: fakePendingDeviceCode, ExpectedCode: http.StatusBadRequest, ExpectedErr: "authorization_pending"},
+		{DeviceCode: "unknown", ExpectedCode: http.StatusBadGateway},
+		{DeviceCode: fakeDeviceCode, ExpectedCode: http.StatusOK},
+	}
+	for i, c := range cs {
+		var token tokenResponse
+		var failure deviceErrorResponse
+		resp, err := resty.New().R().
+			SetFormData(map[string]string{"device_code": c.DeviceCode}).
+			SetResult(&token).
+			SetError(&failure).
+			Post(svc + oauthURL + deviceTokenURL)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode(), "case %d", i)
+		assert.Equal(t, c.ExpectedErr, failure.Error, "case %d", i)
+		if c.ExpectedCode == http.StatusOK {
+			assert.NotEmpty(t, token.AccessToken, "case %d", i)
+			assert.NotNil(t, findCookie(cfg.CookieAccessName, resp.Cookies()), "case %d", i)
+		}
+	}
+}
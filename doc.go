@@ -24,9 +24,10 @@ import (
 )
 
 var (
-	release = "v2.0.3"
-	gitsha  = "no gitsha provided"
-	version = release + " (git+sha: " + gitsha + ")"
+	release  = "v2.0.3"
+	gitsha   = "no gitsha provided"
+	compiled = "no build date provided"
+	version  = release + " (git+sha: " + gitsha + ")"
 )
 
 const (
@@ -37,26 +38,88 @@ const (
 	httpSchema  = "http"
 
 	headerUpgrade       = "Upgrade"
+	headerConnection    = "Connection"
 	userContextName     = "identity"
 	authorizationHeader = "Authorization"
 	versionHeader       = "X-Auth-Proxy-Version"
+	jsonContentType     = "application/json; charset=utf-8"
+	textContentType     = "text/plain; charset=utf-8"
+	correlationHeader   = "X-Correlation-Id"
+	authDecisionHeader  = "X-Auth-Decision"
+	serverTimingHeader  = "Server-Timing"
 	envPrefix           = "PROXY_"
+	sealedTextVersion   = "v2"
 
 	oauthURL         = "/oauth"
 	authorizationURL = "/authorize"
 	callbackURL      = "/callback"
 	healthURL        = "/health"
+	versionURL       = "/version"
 	tokenURL         = "/token"
 	expiredURL       = "/expired"
 	logoutURL        = "/logout"
+	backchannelURL   = "/backchannel-logout"
+	frontchannelURL  = "/frontchannel-logout"
 	loginURL         = "/login"
 	metricsURL       = "/metrics"
+	accountURL       = "/account"
+	passwordURL      = "/password"
+	totpURL          = "/totp"
+	reauthURL        = "/reauthenticate"
+	adminURL         = "/admin"
+	faultsURL        = "/faults"
+	maintenanceURL   = "/maintenance"
+	capturesURL      = "/captures"
+	sessionsURL      = "/sessions"
+	activeURL        = "/active"
+	echoURL          = "/echo"
+	featuresURL      = "/features"
+	deviceURL        = "/device"
+	deviceTokenURL   = "/device/token"
+	mobileAuthURL    = "/mobile/authorize"
+	mobileReturnURL  = "/mobile/callback"
+	mobileTokenURL   = "/mobile/token"
+	apiKeysURL       = "/api-keys"
+	apiKeysRevokeURL = "/api-keys/revoke"
+
+	tlsSecretCertificate = "tls.crt"
+	tlsSecretPrivateKey  = "tls.key"
+	tlsSecretCA          = "ca.crt"
 
 	claimPreferredName  = "preferred_username"
 	claimAudience       = "aud"
 	claimResourceAccess = "resource_access"
 	claimRealmAccess    = "realm_access"
 	claimResourceRoles  = "roles"
+	claimSessionID      = "sid"
+	claimSessionState   = "session_state"
+	claimIssuedAt       = "iat"
+	claimAuthTime       = "auth_time"
+	claimEvents         = "events"
+	claimNonce          = "nonce"
+	claimEmail          = "email"
+	claimIssuer         = "iss"
+	claimType           = "typ"
+	claimTokenID        = "jti"
+	claimConfirmation   = "cnf"
+	claimAuthContext    = "acr"
+
+	// the client of a service account token, keycloak uses clientId and rfc 9068 client_id
+	claimClientID         = "client_id"
+	claimKeycloakClientID = "clientId"
+	claimAuthorizedParty  = "azp"
+)
+
+// contextKey is the type of the values the proxy adds to the request context
+type contextKey string
+
+const (
+	// connectionContextKey is the key of the connection the request was read from
+	connectionContextKey contextKey = "connection"
+	// timingsContextKey is the key of the phase timings of the request
+	timingsContextKey contextKey = "timings"
+	// internalContextKey marks the requests received on the internal listener
+	internalContextKey contextKey = "internal"
 )
 
 var (
@@ -68,12 +131,68 @@ var (
 	ErrInvalidSession = errors.New("invalid session identifier")
 	// ErrAccessTokenExpired indicates the access token has expired
 	ErrAccessTokenExpired = errors.New("the access token has expired")
+	// ErrAccessTokenNotYetValid indicates the access token was issued, or is valid from, in the future
+	ErrAccessTokenNotYetValid = errors.New("the access token is not yet valid")
 	// ErrRefreshTokenExpired indicates the refresh token as expired
 	ErrRefreshTokenExpired = errors.New("the refresh token has expired")
 	// ErrNoTokenAudience indicates their is not audience in the token
 	ErrNoTokenAudience = errors.New("the token does not audience in claims")
+	// ErrServiceAccountToken indicates the token of a service account when they are not accepted
+	ErrServiceAccountToken = errors.New("the tokens of service accounts are not accepted")
+	// ErrUnsupportedAlgorithm indicates the token is signed with an algorithm which isn't permitted
+	ErrUnsupportedAlgorithm = errors.New("the signature algorithm of the token is not permitted")
+	// ErrInvalidAudience indicates the token was not issued for any of the accepted audiences
+	ErrInvalidAudience = errors.New("the token was not issued for an accepted audience")
+	// ErrInvalidAuthorizedParty indicates the token was issued to a client not permitted
+	ErrInvalidAuthorizedParty = errors.New("the token was issued to a client not permitted")
+	// ErrFaultInjected indicates the failure was injected by the fault injection
+	ErrFaultInjected = errors.New("the failure was injected by fault injection")
+	// ErrProviderUnavailable indicates the circuit to the token endpoint is open
+	ErrProviderUnavailable = errors.New("the openid provider is unavailable, the circuit is open")
+	// ErrProviderThrottled indicates the token endpoint is rate limiting the requests
+	ErrProviderThrottled = errors.New("the openid provider is rate limiting the requests, backing off")
+	// ErrVerificationOverloaded indicates the token verification queue is full
+	ErrVerificationOverloaded = errors.New("the token verification queue is full")
+	// ErrInvalidAPIKey indicates the api key is unknown or has been revoked
+	ErrInvalidAPIKey = errors.New("the api key is invalid or has been revoked")
+	// ErrTokenInactive indicates the provider reports the token is no longer active
+	ErrTokenInactive = errors.New("the access token is not active at the provider")
 )
 
+// Provider is an additional openid provider, selected by the host or path prefix of the request
+type Provider struct {
+	// Name is the name of the provider
+	Name string `json:"name" yaml:"name"`
+	// DiscoveryURL is the url for the openid configuration of the provider
+	DiscoveryURL string `json:"discovery-url" yaml:"discovery-url"`
+	// ClientID is the client id of the provider
+	ClientID string `json:"client-id" yaml:"client-id"`
+	// ClientSecret is the secret of the provider
+	ClientSecret Secret `json:"client-secret" yaml:"client-secret"`
+	// RedirectionURL is the redirection url, defaults to the host header
+	RedirectionURL string `json:"redirection-url" yaml:"redirection-url"`
+	// Hostnames are the hosts which select the provider
+	Hostnames []string `json:"hostnames" yaml:"hostnames"`
+	// PathPrefix is the path prefix which selects the provider
+	PathPrefix string `json:"path-prefix" yaml:"path-prefix"`
+	// Resources are the resources protected by the provider, defaults to those of the proxy
+	Resources []*Resource `json:"resources" yaml:"resources"`
+}
+
+// SyntheticEndpoint is a static response served by the proxy itself rather than the upstream
+type SyntheticEndpoint struct {
+	// Path is the exact path of the endpoint
+	Path string `json:"path" yaml:"path"`
+	// Status is the status code of the response, defaults to 200, or a 302 for a redirect
+	Status int `json:"status" yaml:"status"`
+	// Body is the body of the response
+	Body string `json:"body" yaml:"body"`
+	// ContentType is the content type of the body, defaults to json
+	ContentType string `json:"content-type" yaml:"content-type"`
+	// Redirect is the location the endpoint redirects to
+	Redirect string `json:"redirect" yaml:"redirect"`
+}
+
 // Resource represents a url resource to protect
 type Resource struct {
 	// URL the url for the resource
@@ -84,6 +203,30 @@ type Resource struct {
 	WhiteListed bool `json:"white-listed" yaml:"white-listed"`
 	// Roles the roles required to access this url
 	Roles []string `json:"roles" yaml:"roles"`
+	// AuthParams are extra query parameters added to the authorization request for this url
+	AuthParams map[string]string `json:"auth-params" yaml:"auth-params"`
+	// MaxUploadSize is the maximum size in bytes of a request body for this url, zero is unlimited
+	MaxUploadSize int64 `json:"max-upload-size" yaml:"max-upload-size"`
+	// Session is the name of a separate session used for this url
+	Session string `json:"session" yaml:"session"`
+	// CaseInsensitive matches the url regardless of case, for upstreams which ignore the case
+	CaseInsensitive bool `json:"case-insensitive" yaml:"case-insensitive"`
+	// IgnoreTrailingSlash matches a url ending in a slash without the slash, i.e. /foo/ matches /foo
+	IgnoreTrailingSlash bool `json:"ignore-trailing-slash" yaml:"ignore-trailing-slash"`
+	// Query are the query parameters the request must have to match, a value of * matches any value
+	Query map[string]string `json:"query" yaml:"query"`
+	// Hosts are the hosts the resource applies to, defaults to all
+	Hosts []string `json:"hosts" yaml:"hosts"`
+	// Webhook is the name of the webhook secret, the requests signed with it are permitted without authentication
+	Webhook string `json:"webhook" yaml:"webhook"`
+	// BasicAuth are the static users permitted in place of the authentication, when enabled
+	BasicAuth []string `json:"basic-auth" yaml:"basic-auth"`
+	// ReplayProtection permits each token once, by the jti, rejecting the replays
+	ReplayProtection bool `json:"replay-protection" yaml:"replay-protection"`
+	// DPoP requires the tokens bound to a key, with a proof of possession of the key
+	DPoP bool `json:"dpop" yaml:"dpop"`
+	// CertificateBound requires the tokens bound to the client certificate of the connection
+	CertificateBound bool `json:"certificate-bound" yaml:"certificate-bound"`
 }
 
 // Cors access controls
@@ -110,24 +253,66 @@ type Config struct {
 	Listen string `json:"listen" yaml:"listen" usage:"the interface the service should be listening on" env:"LISTEN"`
 	// ListenHTTP is the interface to bind the http only service on
 	ListenHTTP string `json:"listen-http" yaml:"listen-http" usage:"interface we should be listening" env:"LISTEN_HTTP"`
+	// ListenAdmin is the interface of the internal listener, the only one reaching the internal paths
+	ListenAdmin string `json:"listen-admin" yaml:"listen-admin" usage:"the interface of the internal listener, the only one able to reach the internal-paths" env:"LISTEN_ADMIN"`
+	// InternalPaths are the path prefixes only reachable via the internal listener
+	InternalPaths []string `json:"internal-paths" yaml:"internal-paths" usage:"list of path prefixes, i.e. /internal, only reachable via the listen-admin interface, the public listeners respond with a 404 whatever the authentication"`
 	// DiscoveryURL is the url for the keycloak server
 	DiscoveryURL string `json:"discovery-url" yaml:"discovery-url" usage:"discovery url to retrieve the openid configuration" env:"DISCOVERY_URL"`
 	// ClientID is the client id
 	ClientID string `json:"client-id" yaml:"client-id" usage:"client id used to authenticate to the oauth service" env:"CLIENT_ID"`
 	// ClientSecret is the secret for AS
-	ClientSecret string `json:"client-secret" yaml:"client-secret" usage:"client secret used to authenticate to the oauth service" env:"CLIENT_SECRET"`
+	ClientSecret Secret `json:"client-secret" yaml:"client-secret" usage:"client secret used to authenticate to the oauth service" env:"CLIENT_SECRET"`
 	// RedirectionURL the redirection url
 	RedirectionURL string `json:"redirection-url" yaml:"redirection-url" usage:"redirection url for the oauth callback url, defaults to host header is absent" env:"REDIRECTION_URL"`
+	// RedirectionHosts is a list of hostnames permitted in the callback url
+	RedirectionHosts []string `json:"redirection-hosts" yaml:"redirection-hosts" usage:"list of hostnames the callback url can be computed from via the host header, others fallback to the redirection-url"`
 	// RevocationEndpoint is the token revocation endpoint to revoke refresh tokens
 	RevocationEndpoint string `json:"revocation-url" yaml:"revocation-url" usage:"url for the revocation endpoint to revoke refresh token" env:"REVOCATION_URL"`
+	// RevocationQueueSize is the maximum number of revocations waiting to be sent to the provider
+	RevocationQueueSize int `json:"revocation-queue-size" yaml:"revocation-queue-size" usage:"the maximum number of logout revocations waiting to be sent to the provider"`
+	// RevocationRetries is the number of retries of a failed revocation
+	RevocationRetries int `json:"revocation-retries" yaml:"revocation-retries" usage:"the number of retries of a failed logout revocation"`
 	// SkipOpenIDProviderTLSVerify skips the tls verification for openid provider communication
 	SkipOpenIDProviderTLSVerify bool `json:"skip-openid-provider-tls-verify" yaml:"skip-openid-provider-tls-verify" usage:"skip the verification of any TLS communication with the openid provider"`
+	// OpenIDProviderTimeout is the timeout of the requests to the openid provider
+	OpenIDProviderTimeout time.Duration `json:"openid-provider-timeout" yaml:"openid-provider-timeout" usage:"the timeout of the requests to the openid provider, including the token exchange and refresh"`
+	// OpenIDProviderRetries is the number of retries of the idempotent requests to the openid provider
+	OpenIDProviderRetries int `json:"openid-provider-retries" yaml:"openid-provider-retries" usage:"the number of retries, with jittered backoff, of the idempotent requests to the openid provider"`
+	// OpenIDProviderBreakerThreshold is the consecutive token endpoint failures which open the circuit
+	OpenIDProviderBreakerThreshold int `json:"openid-provider-breaker-threshold" yaml:"openid-provider-breaker-threshold" usage:"the consecutive failures of the token endpoint which open the circuit, zero disables the breaker"`
+	// OpenIDProviderBreakerCooldown is how long the circuit stays open
+	OpenIDProviderBreakerCooldown time.Duration `json:"openid-provider-breaker-cooldown" yaml:"openid-provider-breaker-cooldown" usage:"how long the circuit to the token endpoint stays open before trying again"`
+	// OpenIDProviderThrottleCooldown is how long we back off a rate limiting token endpoint
+	OpenIDProviderThrottleCooldown time.Duration `json:"openid-provider-throttle-cooldown" yaml:"openid-provider-throttle-cooldown" usage:"how long the token endpoint is left alone when it rate limits the requests without a Retry-After, zero disables the backoff"`
+	// OpenIDProviderDiscoveryTimeout is how long we retry the discovery of the provider at startup
+	OpenIDProviderDiscoveryTimeout time.Duration `json:"openid-provider-discovery-timeout" yaml:"openid-provider-discovery-timeout" usage:"how long to retry the discovery of the openid provider at startup, with backoff, before giving up"`
+	// OpenIDProviderRefreshInterval is the interval the discovery document is refreshed
+	OpenIDProviderRefreshInterval time.Duration `json:"openid-provider-refresh-interval" yaml:"openid-provider-refresh-interval" usage:"the interval the discovery document of the openid provider is refreshed, picking up changes to the endpoints, zero disables"`
 	// Scopes is a list of scope we should request
 	Scopes []string `json:"scopes" yaml:"scopes" usage:"list of scopes requested when authenticating the user"`
+	// OAuthURI is the path of the oauth endpoints
+	OAuthURI string `json:"oauth-uri" yaml:"oauth-uri" usage:"the path of the oauth endpoints, defaults to /oauth"`
+	// EndpointPaths overrides the paths of the oauth endpoints, keyed by the endpoint name
+	EndpointPaths map[string]string `json:"endpoint-paths" yaml:"endpoint-paths" usage:"override the path of an oauth endpoint, relative to the oauth-uri, e.g. callback=/redirect_uri"`
+	// BaseURI is the path the proxy is mounted under
+	BaseURI string `json:"base-uri" yaml:"base-uri" usage:"the path the proxy is mounted under, e.g. /myapp, prefixing the oauth endpoints, redirects and cookie paths"`
 	// Upstream is the upstream endpoint i.e whom were proxying to
 	Upstream string `json:"upstream-url" yaml:"upstream-url" usage:"url for the upstream endpoint you wish to proxy" env:"UPSTREAM_URL"`
+	// Providers are the additional openid providers selected by host or path prefix
+	Providers []*Provider `json:"providers" yaml:"providers"`
+	// SyntheticEndpoints are the static responses served by the proxy, without authentication
+	SyntheticEndpoints []*SyntheticEndpoint `json:"synthetic-endpoints" yaml:"synthetic-endpoints"`
 	// Resources is a list of protected resources
 	Resources []*Resource `json:"resources" yaml:"resources" usage:"list of resources 'uri=/admin|methods=GET,PUT|roles=role1,role2'"`
+	// AdminRoles are the roles required to access the admin endpoints
+	AdminRoles []string `json:"admin-roles" yaml:"admin-roles" usage:"list of roles required to access the admin endpoints under /oauth/admin, enables /oauth/admin/echo"`
+	// Middlewares is the order of the cross-cutting middlewares, every enabled middleware must be listed
+	Middlewares []string `json:"middlewares" yaml:"middlewares" usage:"the order of the middlewares, every enabled middleware must be listed: timeout, timing, logging, metrics, capture, security and cors"`
+	// AuthRequestParams are extra query parameters added to the authorization request
+	AuthRequestParams map[string]string `json:"auth-request-params" yaml:"auth-request-params" usage:"extra query parameters added to the authorization request, e.g. kc_idp_hint=google, kc_action=UPDATE_PASSWORD"`
+	// AuthRequestPassthrough are the query parameters of /oauth/authorize passed on to the authorization request
+	AuthRequestPassthrough []string `json:"auth-request-passthrough" yaml:"auth-request-passthrough" usage:"query parameters of the authorize endpoint passed on to the authorization request, e.g. kc_idp_hint"`
 	// Headers permits adding customs headers across the board
 	Headers map[string]string `json:"headers" yaml:"headers" usage:"custom headers to the upstream request, key=value"`
 
@@ -137,10 +322,58 @@ type Config struct {
 	EnableForwarding bool `json:"enable-forwarding" yaml:"enable-forwarding" usage:"enables the forwarding proxy mode, signing outbound request"`
 	// EnableSecurityFilter enabled the security handler
 	EnableSecurityFilter bool `json:"enable-security-filter" yaml:"enable-security-filter" usage:"enables the security filter handler"`
+	// OfflineSessionDuration is the lifetime of the cookies of a session with an offline refresh token
+	OfflineSessionDuration time.Duration `json:"offline-session-duration" yaml:"offline-session-duration" usage:"the lifetime of the cookies of the sessions with an offline refresh token (the offline_access scope), zero limits them to the browser session"`
 	// EnableRefreshTokens indicate's you wish to ignore using refresh tokens and re-auth on expiration of access token
 	EnableRefreshTokens bool `json:"enable-refresh-tokens" yaml:"enable-refresh-tokens" usage:"nables the handling of the refresh tokens" env:"ENABLE_SECURITY_FILTER"`
+	// EnableServerSideSessions indicates the tokens of the sessions are held in the store
+	EnableServerSideSessions bool `json:"enable-server-side-sessions" yaml:"enable-server-side-sessions" usage:"hold the tokens of the browser sessions encrypted in the store, the cookie carrying only a random session id, requires a store and the encryption key"`
+	// RefreshAnomalyThreshold is the refreshes of a session in the window beyond which it's reported
+	RefreshAnomalyThreshold int `json:"refresh-anomaly-threshold" yaml:"refresh-anomaly-threshold" usage:"the refreshes of a session permitted in the refresh anomaly window before it's reported as refreshing anomalously, counted in the store, zero disables the refresh telemetry"`
+	// RefreshAnomalyWindow is the window the refreshes of a session are counted over
+	RefreshAnomalyWindow time.Duration `json:"refresh-anomaly-window" yaml:"refresh-anomaly-window" usage:"the window the refreshes of a session are counted over"`
+	// EnableServiceAccounts indicates we accept the tokens issued by the client credentials grant
+	EnableServiceAccounts bool `json:"enable-service-accounts" yaml:"enable-service-accounts" usage:"accept the tokens of service accounts, issued by the client_credentials grant, using the client id as the username"`
+	// EnableAPIKeys indicates the users can mint api keys, exchanged for a token of the user who minted the key
+	EnableAPIKeys bool `json:"enable-api-keys" yaml:"enable-api-keys" usage:"permit the users to mint api keys, held hashed in the store, the requests with a key are made as the user who minted it, impersonated via the token exchange"`
+	// APIKeyRoles are the roles required to mint an api key
+	APIKeyRoles []string `json:"api-key-roles" yaml:"api-key-roles" usage:"list of roles a user requires to mint an api key"`
 	// EnableLoginHandler indicates we want the login handler enabled
 	EnableLoginHandler bool `json:"enable-login-handler" yaml:"enable-login-handler" usage:"enables the handling of the refresh tokens" env:"ENABLE_LOGIN_HANDLER"`
+	// EnableDeviceHandler indicates we want the device authorization handlers enabled
+	EnableDeviceHandler bool `json:"enable-device-handler" yaml:"enable-device-handler" usage:"enables the device authorization grant handlers, permitting the command line clients to login without a browser redirect"`
+	// DeviceAuthorizationURL is the device authorization endpoint of the provider
+	DeviceAuthorizationURL string `json:"device-authorization-url" yaml:"device-authorization-url" usage:"the device authorization endpoint, defaults to the authorization endpoint of the provider suffixed with /device"`
+	// MobileRedirectURIs are the redirect uris of the native mobile apps using the mobile endpoints
+	MobileRedirectURIs []string `json:"mobile-redirect-uris" yaml:"mobile-redirect-uris" usage:"the custom scheme redirect uris of the native mobile apps permitted to login via the /oauth/mobile endpoints, enabling the endpoints"`
+	// EnableBackchannelLogout indicates we accept the logout tokens from the provider
+	EnableBackchannelLogout bool `json:"enable-backchannel-logout" yaml:"enable-backchannel-logout" usage:"enables the openid back-channel logout endpoint, revoking the sessions logged out by the provider"`
+	// EnableFrontchannelLogout indicates we clear the session when the provider embeds the logout endpoint
+	EnableFrontchannelLogout bool `json:"enable-frontchannel-logout" yaml:"enable-frontchannel-logout" usage:"enables the openid front-channel logout endpoint, clearing the session of the browser when embedded by the provider"`
+	// ProbePaths are the health check paths of the upstream passed through for the probes
+	ProbePaths []string `json:"probe-paths" yaml:"probe-paths" usage:"the health check paths of the upstream, the requests of the probe user agents to them are passed through without authentication"`
+	// ProbeUserAgents are the user agent prefixes of the health check probes
+	ProbeUserAgents []string `json:"probe-user-agents" yaml:"probe-user-agents" usage:"the prefixes of the user agents of the health check probes permitted on the probe paths"`
+	// TrustedIssuers are the issuers, other than the provider, whose tokens are accepted, keyed to their jwks url
+	TrustedIssuers map[string]string `json:"trusted-issuers" yaml:"trusted-issuers" usage:"the issuers other than the provider whose bearer tokens are accepted, issuer=jwks url, i.e. a second realm or an internal sts"`
+	// WebhookSecrets are the secrets verifying the signatures of the webhooks, keyed by name
+	WebhookSecrets map[string]string `json:"webhook-secrets" yaml:"webhook-secrets" usage:"the secrets verifying the hmac signatures of the webhooks, name=secret, the signed requests to a resource with the webhook option skip the authentication"`
+	// EnableBasicAuth permits the static users on the resources, a break glass for when the provider is down
+	EnableBasicAuth bool `json:"enable-basic-auth" yaml:"enable-basic-auth" usage:"permits the static basic auth users on the resources with the basic-auth option, bypassing the provider, i.e. for maintenance when it is down"`
+	// BasicAuthUsers are the bcrypt hashes of the static users, keyed by name
+	BasicAuthUsers map[string]string `json:"basic-auth-users" yaml:"basic-auth-users" usage:"the static basic auth users, user=bcrypt hash, permitted on the resources naming them in the basic-auth option when enabled"`
+	// EnableDPoP accepts the sender constrained tokens, verifying the proof of possession of the bound tokens
+	EnableDPoP bool `json:"enable-dpop" yaml:"enable-dpop" usage:"accepts the dpop sender constrained tokens, rfc 9449, verifying the proof of possession of the tokens bound to a key, required on the resources with the dpop option"`
+	// EnableDPoPNonce requires a nonce issued by the proxy in the proofs
+	EnableDPoPNonce bool `json:"enable-dpop-nonce" yaml:"enable-dpop-nonce" usage:"requires a nonce issued by the proxy in the dpop proofs, rotated every five minutes, limiting the window a captured proof is usable"`
+	// EnableCertificateBoundTokens verifies the tokens bound to a client certificate against the certificate of the connection
+	EnableCertificateBoundTokens bool `json:"enable-certificate-bound-tokens" yaml:"enable-certificate-bound-tokens" usage:"verifies the x5t#S256 confirmation of the certificate bound tokens, rfc 8705, against the client certificate of the connection, required on the resources with the certificate-bound option, requires the mutual tls of --tls-client-certificate"`
+	// Audiences are the audiences accepted in the tokens, in place of the client id
+	Audiences []string `json:"audiences" yaml:"audiences" usage:"the audiences accepted in the aud claim of the tokens, one of which must be present, defaults to the client id"`
+	// AuthorizedParties are the clients permitted in the azp claim of the tokens
+	AuthorizedParties []string `json:"authorized-parties" yaml:"authorized-parties" usage:"the clients permitted in the azp claim of the tokens, the token is rejected if issued to any other client"`
+	// TokenExchangeAudience is the audience the access token is exchanged for before forwarding
+	TokenExchangeAudience string `json:"token-exchange-audience" yaml:"token-exchange-audience" usage:"exchange the access token for a token of the audience, rfc 8693, forwarding it to the upstream in place of the user token"`
 	// EnableAuthorizationHeader indicates we should pass the authorization header
 	EnableAuthorizationHeader bool `json:"enable-authorization-header" yaml:"enable-authorization-header" usage:"adds the authorization header to the proxy request"`
 	// EnableHTTPSRedirect indicate we should redirection http -> https
@@ -149,6 +382,28 @@ type Config struct {
 	EnableProfiling bool `json:"enable-profiling" yaml:"enable-profiling" usage:"switching on the golang profiling via pprof on /debug/pprof, /debug/pprof/heap etc"`
 	// EnableMetrics indicates if the metrics is enabled
 	EnableMetrics bool `json:"enable-metrics" yaml:"enable-metrics" usage:"enable the prometheus metrics collector on /oauth/metrics"`
+	// EnableALBHeaders adds the aws application load balancer oidc headers to the upstream request
+	EnableALBHeaders bool `json:"enable-alb-headers" yaml:"enable-alb-headers" usage:"adds the aws alb compatible X-Amzn-Oidc-Data, X-Amzn-Oidc-Identity and X-Amzn-Oidc-Accesstoken headers"`
+	// EnableOAuth2ProxyHeaders adds the oauth2-proxy compatible headers to the upstream request
+	EnableOAuth2ProxyHeaders bool `json:"enable-oauth2-proxy-headers" yaml:"enable-oauth2-proxy-headers" usage:"adds the oauth2-proxy compatible X-Forwarded-User, X-Forwarded-Email, X-Forwarded-Preferred-Username and X-Forwarded-Access-Token headers"`
+	// EnableAuthDecisionHeader adds the snapshot of the authorization decision to the upstream request
+	EnableAuthDecisionHeader bool `json:"enable-auth-decision-header" yaml:"enable-auth-decision-header" usage:"adds the X-Auth-Decision header, a compact json of the matched resource, the required roles satisfied and the acr of the token, for the upstream to log"`
+	// EnableUpstreamErrorSanitization replaces the bodies of the upstream server errors
+	EnableUpstreamErrorSanitization bool `json:"enable-upstream-error-sanitization" yaml:"enable-upstream-error-sanitization" usage:"replace the body of upstream 5xx responses, logging the original, to prevent leaking internal details"`
+	// EnableBrotli indicates we compress the pages rendered by the proxy with brotli
+	EnableBrotli bool `json:"enable-brotli" yaml:"enable-brotli" usage:"compress the sign in, sign out and forbidden pages rendered by the proxy with brotli when the client accepts it, the upstream responses are always passed through as encoded by the upstream"`
+	// EnableSessionStats enables the anonymized session statistics
+	EnableSessionStats bool `json:"enable-session-stats" yaml:"enable-session-stats" usage:"enables the anonymized session statistics via /oauth/admin/sessions and the metrics, requires admin-roles"`
+	// EnableFlowCapture enables the capturing of auth flows for debugging
+	EnableFlowCapture bool `json:"enable-flow-capture" yaml:"enable-flow-capture" usage:"enables the capture of sanitized auth flows per user or correlation id via /oauth/admin/captures, requires admin-roles"`
+	// EnableSessionRevocation enables the admin endpoint revoking the sessions of a user
+	EnableSessionRevocation bool `json:"enable-session-revocation" yaml:"enable-session-revocation" usage:"enables the DELETE /oauth/admin/sessions/{id} endpoint, revoking the session with the id or every session of the subject or email, requires admin-roles"`
+	// EnableActiveSessions enables the admin endpoint listing the active sessions
+	EnableActiveSessions bool `json:"enable-active-sessions" yaml:"enable-active-sessions" usage:"enables the listing of the active sessions, recorded in the store at login, via /oauth/admin/sessions/active, requires admin-roles and a redis, etcd or boltdb store"`
+	// EnableMaintenanceMode enables the maintenance mode admin endpoint
+	EnableMaintenanceMode bool `json:"enable-maintenance-mode" yaml:"enable-maintenance-mode" usage:"enables the maintenance mode admin endpoint on /oauth/admin/maintenance, serving a 503 for all but the white-listed resources while on, requires admin-roles"`
+	// EnableFaultInjection enables the fault injection admin endpoint
+	EnableFaultInjection bool `json:"enable-fault-injection" yaml:"enable-fault-injection" usage:"TESTING ONLY; enables the fault injection admin endpoint on /oauth/admin/faults, requires admin-roles"`
 	// EnableBrowserXSSFilter indicates you want the filter on
 	EnableBrowserXSSFilter bool `json:"filter-browser-xss" yaml:"filter-browser-xss" usage:"enable the adds the X-XSS-Protection header with mode=block"`
 	// EnableContentNoSniff indicates you want the filter on
@@ -160,23 +415,45 @@ type Config struct {
 	// LocalhostMetrics indicated the metrics can only be consume via localhost
 	LocalhostMetrics bool `json:"localhost-metrics" yaml:"localhost-metrics" usage:"enforces the metrics page can only been requested from 127.0.0.1"`
 
+	// DecryptionKey is the path to the private key the encrypted tokens are decrypted with
+	DecryptionKey string `json:"decryption-key" yaml:"decryption-key" usage:"the path to the pem encoded rsa private key decrypting the encrypted (jwe) id and access tokens of the provider"`
+	// SignatureAlgorithms are the signature algorithms of the tokens permitted
+	SignatureAlgorithms []string `json:"signature-algorithms" yaml:"signature-algorithms" usage:"the signature algorithms permitted for the tokens, i.e. RS256, PS256, ES256 or EdDSA, defaults to all those supported"`
+	// ClockSkew is the tolerance of the exp, iat and nbf claims for the drift of the clocks
+	ClockSkew time.Duration `json:"clock-skew" yaml:"clock-skew" usage:"the tolerance applied to the exp, iat and nbf claims of the tokens for the drift between our clock and the provider"`
+	// MaxAuthenticationAge is the maximum time since the user entered their credentials
+	MaxAuthenticationAge time.Duration `json:"max-authentication-age" yaml:"max-authentication-age" usage:"the maximum age of the login, taken from the auth_time claim, before the user must re-authenticate"`
+	// ExpiredSessionPrompt is the prompt of the authorization request when the session has expired with no refresh token
+	ExpiredSessionPrompt string `json:"expired-session-prompt" yaml:"expired-session-prompt" usage:"the prompt of the authorization request when the access token has expired and there's no refresh token, login making the user re-enter their credentials, empty to reuse the session of the provider"`
+	// MaxLoginRedirects is the repeated redirects for authorization of a url permitted without an authenticated request, before it's a loop
+	MaxLoginRedirects int `json:"max-login-redirects" yaml:"max-login-redirects" usage:"the repeated redirects for authorization of the same url permitted within five minutes without an authenticated request, beyond which the redirect loop is broken with a 401, zero disables"`
+	// SessionIdleTimeout is the duration of inactivity after which a browser session is terminated
+	SessionIdleTimeout time.Duration `json:"session-idle-timeout" yaml:"session-idle-timeout" usage:"terminate the browser sessions idle for longer than the duration, regardless of the token lifetimes, zero disables"`
 	// AccessTokenDuration is default duration applied to the access token cookie
 	AccessTokenDuration time.Duration `json:"access-token-duration" yaml:"access-token-duration" usage:"fallback cookie duration for the access token when using refresh tokens"`
 	// CookieDomain is a list of domains the cookie is available to
-	CookieDomain string `json:"cookie-domain" yaml:"cookie-domain" usage:"domain the access cookie is available to, defaults host header"`
+	CookieDomain string `json:"cookie-domain" yaml:"cookie-domain" usage:"domain the access cookie is available to, i.e. .example.com or *.example.com covering the subdomains, defaults host header"`
+	// CookiePath is the path the cookies are scoped to
+	CookiePath string `json:"cookie-path" yaml:"cookie-path" usage:"path the access and refresh cookies are scoped to, which must cover the oauth endpoints, defaults to the base uri or /"`
 	// CookieAccessName is the name of the access cookie holding the access token
 	CookieAccessName string `json:"cookie-access-name" yaml:"cookie-access-name" usage:"name of the cookie use to hold the access token"`
 	// CookieRefreshName is the name of the refresh cookie
 	CookieRefreshName string `json:"cookie-refresh-name" yaml:"cookie-refresh-name" usage:"name of the cookie used to hold the encrypted refresh token"`
+	// CookieRefreshPath is the path the refresh cookie is scoped to
+	CookieRefreshPath string `json:"cookie-refresh-path" yaml:"cookie-refresh-path" usage:"path the refresh cookie is scoped to, i.e. /oauth stops it being sent on every proxied request"`
 	// SecureCookie enforces the cookie as secure
 	SecureCookie bool `json:"secure-cookie" yaml:"secure-cookie" usage:"enforces the cookie to be secure"`
 	// HTTPOnlyCookie enforces the cookie as http only
 	HTTPOnlyCookie bool `json:"http-only-cookie" yaml:"http-only-cookie" usage:"enforces the cookie is in http only mode"`
+	// SameSiteCookie is the SameSite attribute of the cookies
+	SameSiteCookie string `json:"same-site-cookie" yaml:"same-site-cookie" usage:"the SameSite attribute of the cookies, Lax, Strict or None, where None also makes them secure, defaults to none set"`
 
 	// MatchClaims is a series of checks, the claims in the token must match those here
 	MatchClaims map[string]string `json:"match-claims" yaml:"match-claims" usage:"keypair values for matching access token claims e.g. aud=myapp, iss=http://example.*"`
 	// AddClaims is a series of claims that should be added to the auth headers
 	AddClaims []string `json:"add-claims" yaml:"add-claims" usage:"extra claims from the token and inject into headers, e.g given_name -> X-Auth-Given-Name"`
+	// FeatureFlags maps a feature to the claim:value enabling it
+	FeatureFlags map[string]string `json:"feature-flags" yaml:"feature-flags" usage:"keypair values enabling a feature header from a claim, e.g beta=groups:beta -> X-Feature-Beta: true"`
 
 	// TLSCertificate is the location for a tls certificate
 	TLSCertificate string `json:"tls-cert" yaml:"tls-cert" usage:"path to ths TLS certificate"`
@@ -188,6 +465,8 @@ type Config struct {
 	TLSCaPrivateKey string `json:"tls-ca-key" yaml:"tls-ca-key" usage:"path the ca private key, used by the forward signing proxy"`
 	// TLSClientCertificate is path to a client certificate to use for outbound connections
 	TLSClientCertificate string `json:"tls-client-certificate" yaml:"tls-client-certificate" usage:"path to the client certificate for outbound connections in reverse and forwarding proxy modes"`
+	// TLSUpstreamSecretDir is a directory holding the client certificate used for upstream mutual tls
+	TLSUpstreamSecretDir string `json:"tls-upstream-secret-dir" yaml:"tls-upstream-secret-dir" usage:"path to a directory (i.e. a mounted kubernetes secret) containing tls.crt, tls.key and optionally ca.crt for upstream mutual tls, reloaded on change"`
 	// SkipUpstreamTLSVerify skips the verification of any upstream tls
 	SkipUpstreamTLSVerify bool `json:"skip-upstream-tls-verify" yaml:"skip-upstream-tls-verify" usage:"skip the verification of any upstream TLS"`
 
@@ -208,9 +487,15 @@ type Config struct {
 	Hostnames []string `json:"hostnames" yaml:"hostnames" usage:"list of hostnames the service will respond to"`
 
 	// Store is a url for a store resource, used to hold the refresh tokens
-	StoreURL string `json:"store-url" yaml:"store-url" usage:"url for the storage subsystem, e.g redis://127.0.0.1:6379, file:///etc/tokens.file"`
+	StoreURL string `json:"store-url" yaml:"store-url" usage:"url for the storage subsystem, e.g redis://127.0.0.1:6379, rediss://, redis+sentinel://host:26379,host:26379/master, redis+cluster://host:6379,host:6379, memcached://host:11211,host:11211, etcd://host:2379,host:2379, etcds:// or boltdb:///etc/tokens.file, with the query options db, prefix and ca-certificate for redis, prefix, ttl and timeout for memcached and prefix, ca-certificate and timeout for etcd"`
 	// EncryptionKey is the encryption key used to encrypt the refresh token
-	EncryptionKey string `json:"encryption-key" yaml:"encryption-key" usage:"encryption key used to encryption the session state" env:"ENCRYPTION_KEY"`
+	EncryptionKey Secret `json:"encryption-key" yaml:"encryption-key" usage:"encryption key used to encryption the session state" env:"ENCRYPTION_KEY"`
+	// EncryptionKeyID is the public id of the encryption key carried by the session state
+	EncryptionKeyID string `json:"encryption-key-id" yaml:"encryption-key-id" usage:"an id of the key encrypting the session state, carried by the values to name the key which sealed them, i.e. the date of the rotation; never derived from the key"`
+	// EnableLegacyDecryption permits the session state encrypted by the legacy unauthenticated format
+	EnableLegacyDecryption bool `json:"enable-legacy-decryption" yaml:"enable-legacy-decryption" usage:"permit decrypting the session state encrypted by the legacy unauthenticated aes-cfb format, switch off once the sessions have been re-encrypted"`
+	// EncryptionKeys are the keys of the session state, the first encrypts and all are tried to decrypt
+	EncryptionKeys []Secret `json:"encryption-keys" yaml:"encryption-keys" usage:"list of encryption keys used in place of the encryption-key, the first encrypts the session state and all are tried to decrypt it, permitting the rotation of the key"`
 
 	// LogRequests indicates if we should log all the requests
 	LogRequests bool `json:"log-requests" yaml:"log-requests" usage:"enable http logging of the requests"`
@@ -220,12 +505,54 @@ type Config struct {
 	NoRedirects bool `json:"no-redirects" yaml:"no-redirects" usage:"do not have back redirects when no authentication is present, 401 them"`
 	// SkipTokenVerification tells the service to skipp verifying the access token - for testing purposes
 	SkipTokenVerification bool `json:"skip-token-verification" yaml:"skip-token-verification" usage:"TESTING ONLY; bypass token verification, only expiration and roles enforced"`
+	// RequestTimeout is the deadline applied to handling a request
+	RequestTimeout time.Duration `json:"request-timeout" yaml:"request-timeout" usage:"deadline for handling a request, including verification, refresh, store and upstream calls, cancelled on client disconnect"`
+	// ControlPlaneURL is the url the resources and headers are pulled from
+	ControlPlaneURL string `json:"control-plane-url" yaml:"control-plane-url" usage:"url to periodically pull the resources and headers from, the response must be signed with the control-plane-public-key"`
+	// ControlPlaneInterval is the interval between pulls of the control plane
+	ControlPlaneInterval time.Duration `json:"control-plane-interval" yaml:"control-plane-interval" usage:"the interval between pulling the policy from the control plane"`
+	// ControlPlanePublicKey is the path to the key verifying the control plane policy
+	ControlPlanePublicKey string `json:"control-plane-public-key" yaml:"control-plane-public-key" usage:"path to the pem encoded rsa public key verifying the X-Signature of the control plane policy"`
+	// EnableRequestValidation rejects requests with an ambiguous framing
+	EnableRequestValidation bool `json:"enable-request-validation" yaml:"enable-request-validation" usage:"rejects requests with conflicting transfer-encoding and content-length, obsolete line folding or abnormal request targets"`
+	// SlowRequestThreshold is the duration above which a request is logged with its phase timings
+	SlowRequestThreshold time.Duration `json:"slow-request-threshold" yaml:"slow-request-threshold" usage:"log the requests taking longer than the threshold with the auth, refresh, store and upstream timings"`
+	// EnableServerTiming indicates we add the Server-Timing header to the responses, for debugging
+	EnableServerTiming bool `json:"enable-server-timing" yaml:"enable-server-timing" usage:"add a Server-Timing header with the auth, refresh, store and upstream timings to the responses, for debugging only"`
+	// MaxVerifyConcurrency is the maximum number of token verifications run at once
+	MaxVerifyConcurrency int `json:"max-verify-concurrency" yaml:"max-verify-concurrency" usage:"the maximum number of concurrent token signature verifications, zero is unlimited"`
+	// MaxVerifyQueue is the maximum number of token verifications waiting to run
+	MaxVerifyQueue int `json:"max-verify-queue" yaml:"max-verify-queue" usage:"the maximum number of token verifications waiting when at the max-verify-concurrency, beyond which requests are rejected with a 503"`
+	// DailyQuota is the number of requests permitted per user or api key a day
+	DailyQuota int `json:"daily-quota" yaml:"daily-quota" usage:"the requests permitted per user or api key a day (utc), counted in the store, beyond which requests are rejected with a 429, zero is unlimited"`
+	// MonthlyQuota is the number of requests permitted per user or api key a month
+	MonthlyQuota int `json:"monthly-quota" yaml:"monthly-quota" usage:"the requests permitted per user or api key a calendar month (utc), counted in the store, beyond which requests are rejected with a 429, zero is unlimited"`
+	// EnableTokenIntrospection indicates the access tokens are validated at the introspection endpoint
+	EnableTokenIntrospection bool `json:"enable-token-introspection" yaml:"enable-token-introspection" usage:"validate the access tokens at the provider introspection endpoint, honouring revoked sessions before the token expires and accepting opaque bearer tokens"`
+	// TokenRevocationURL is the token revocation endpoint of the provider
+	TokenRevocationURL string `json:"token-revocation-url" yaml:"token-revocation-url" usage:"the token revocation endpoint the offline tokens are revoked at on logout, and the cached service account and exchanged tokens on shutdown, defaults to the token endpoint of the provider with /token replaced by /revoke"`
+	// IntrospectionURL is the introspection endpoint of the provider
+	IntrospectionURL string `json:"introspection-url" yaml:"introspection-url" usage:"the token introspection endpoint, defaults to the token endpoint of the provider suffixed with /introspect"`
+	// IntrospectionCacheTTL is the duration the result of an introspection is cached
+	IntrospectionCacheTTL time.Duration `json:"introspection-cache-ttl" yaml:"introspection-cache-ttl" usage:"the duration the result of a token introspection is cached, bounding how long a revoked token is honoured"`
+	// EnableUMA indicates the permissions are decided by the authorization services of the provider
+	EnableUMA bool `json:"enable-uma" yaml:"enable-uma" usage:"enforce the permissions of the keycloak authorization services (uma 2.0) for the path and method, in place of the resource roles"`
+	// UMACacheTTL is the duration an authorization decision is cached
+	UMACacheTTL time.Duration `json:"uma-cache-ttl" yaml:"uma-cache-ttl" usage:"the duration an authorization services decision is cached for the token, path and method"`
+	// MaxHeaderSize is the maximum size of the inbound request headers
+	MaxHeaderSize int `json:"max-header-size" yaml:"max-header-size" usage:"the maximum size in bytes of the inbound request headers, zero uses the default of 1MB"`
 	// UpstreamKeepalives specifies whether we use keepalives on the upstream
 	UpstreamKeepalives bool `json:"upstream-keepalives" yaml:"upstream-keepalives" usage:"enables or disables the keepalive connections for upstream endpoint"`
 	// UpstreamTimeout is the maximum amount of time a dial will wait for a connect to complete
 	UpstreamTimeout time.Duration `json:"upstream-timeout" yaml:"upstream-timeout" usage:"maximum amount of time a dial will wait for a connect to complete"`
 	// UpstreamKeepaliveTimeout
 	UpstreamKeepaliveTimeout time.Duration `json:"upstream-keepalive-timeout" yaml:"upstream-keepalive-timeout" usage:"specifies the keep-alive period for an active network connection"`
+	// UpstreamIdleTimeout is how long an idle keepalive connection to the upstream is kept open
+	UpstreamIdleTimeout time.Duration `json:"upstream-idle-timeout" yaml:"upstream-idle-timeout" usage:"the maximum time an idle keepalive connection to the upstream is kept open, zero means no limit"`
+	// ListenKeepalive is the tcp keepalive period of the client connections
+	ListenKeepalive time.Duration `json:"listen-keepalive" yaml:"listen-keepalive" usage:"the tcp keepalive period of the client connections, keeping them open through nat devices, zero uses the default of 15s and negative disables"`
+	// ServerIdleTimeout is how long an idle keepalive connection of a client is kept open
+	ServerIdleTimeout time.Duration `json:"server-idle-timeout" yaml:"server-idle-timeout" usage:"the maximum time an idle keepalive connection of a client is kept open, zero means no limit"`
 	// Verbose switches on debug logging
 	Verbose bool `json:"verbose" yaml:"verbose" usage:"switch on debug / verbose logging"`
 	// EnableProxyProtocol controls the proxy protocol
@@ -233,6 +560,12 @@ type Config struct {
 
 	// SignInPage is the relative url for the sign in page
 	SignInPage string `json:"sign-in-page" yaml:"sign-in-page" usage:"path to custom template displayed for signin"`
+	// UpstreamErrorPage is the template displayed in place of a sanitized upstream error
+	UpstreamErrorPage string `json:"upstream-error-page" yaml:"upstream-error-page" usage:"path to custom template replacing the body of upstream 5xx responses, requires enable-upstream-error-sanitization"`
+	// SignOutPage is the template displayed after a logout
+	SignOutPage string `json:"sign-out-page" yaml:"sign-out-page" usage:"path to custom template displayed after logout when no redirect is given"`
+	// MaintenancePage is the template displayed while in maintenance mode
+	MaintenancePage string `json:"maintenance-page" yaml:"maintenance-page" usage:"path to custom template displayed with the 503 while in maintenance mode, requires enable-maintenance-mode"`
 	// ForbiddenPage is a access forbidden page
 	ForbiddenPage string `json:"forbidden-page" yaml:"forbidden-page" usage:"path to custom template used for access forbidden"`
 	// Tags is passed to the templates
@@ -241,7 +574,7 @@ type Config struct {
 	// ForwardingUsername is the username to login to the oauth service
 	ForwardingUsername string `json:"forwarding-username" yaml:"forwarding-username" usage:"username to use when logging into the openid provider"`
 	// ForwardingPassword is the password to use for the above
-	ForwardingPassword string `json:"forwarding-password" yaml:"forwarding-password" usage:"password to use when logging into the openid provider"`
+	ForwardingPassword Secret `json:"forwarding-password" yaml:"forwarding-password" usage:"password to use when logging into the openid provider"`
 	// ForwardingDomains is a collection of domains to signs
 	ForwardingDomains []string `json:"forwarding-domains" yaml:"forwarding-domains" usage:"list of domains which should be signed; everything else is relayed unsigned"`
 }
@@ -280,12 +613,26 @@ type userContext struct {
 	roles []string
 	// the audience for the token
 	audience string
+	// the audiences of the token, the aud claim may be a list
+	audiences []string
 	// the access token itself
 	token jose.JWT
 	// the claims associated to the token
 	claims jose.Claims
 	// whether the context is from a session cookie or authorization header
 	bearerToken bool
+	// whether the token is opaque, with the claims taken from the introspection endpoint
+	opaque bool
+	// the opaque access token as given
+	opaqueToken Secret
+	// whether the token was issued to a client by the client credentials grant
+	serviceAccount bool
+	// the owner of the api key the request was made with
+	apiKeyOwner string
+	// the store key of the api key the request was made with
+	apiKey string
+	// the id of the server side session, if the tokens are held in the store
+	serverSession string
 }
 
 // tokenResponse
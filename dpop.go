@@ -0,0 +1,351 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// dpopHeader is the header carrying the proof of possession, rfc 9449
+	dpopHeader = "DPoP"
+	// dpopNonceHeader is the header carrying the nonce the client must use in the proofs
+	dpopNonceHeader = "DPoP-Nonce"
+	// dpopProofType is the type of the proof jwt
+	dpopProofType = "dpop+jwt"
+	// dpopProofLifetime is how long after it is issued a proof is accepted
+	dpopProofLifetime = time.Minute
+	// dpopNonceLifetime is how often the nonces are rotated, the previous nonce is accepted until the next rotation
+	dpopNonceLifetime = 5 * time.Minute
+)
+
+var (
+	// errDPoPNonce indicates the proof has no nonce or a stale one
+	errDPoPNonce = errors.New("the proof requires a nonce issued by the server")
+)
+
+// dpopProof is a verified proof of possession of the key an access token is bound to
+type dpopProof struct {
+	// the id of the proof
+	id string
+	// the jwk thumbprint of the key signing the proof
+	thumbprint string
+	// the nonce in the proof, if any
+	nonce string
+}
+
+// verifyDPoPProof verifies the signature of the proof by the embedded key, that it is bound to the request and the
+// access token, and was issued within the lifetime of a proof
+func verifyDPoPProof(proof, method, target, token string, skew time.Duration, now time.Time) (*dpopProof, error) {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the proof is not a jws")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("the proof header is not base64url encoded")
+	}
+	// step: the jose header of the vendored library can't hold the jwk, so we decode it ourselves
+	header := struct {
+		Type      string          `json:"typ"`
+		Algorithm string          `json:"alg"`
+		Key       json.RawMessage `json:"jwk"`
+	}{}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, errors.New("the proof header is invalid")
+	}
+	if header.Type != dpopProofType {
+		return nil, fmt.Errorf("the proof type: %s is not %s", header.Type, dpopProofType)
+	}
+	// step: only the asymmetric algorithms, the key is in the proof so a mac or none would prove nothing
+	if _, found := signatureAlgorithms[header.Algorithm]; !found {
+		return nil, fmt.Errorf("unsupported algorithm: %s", header.Algorithm)
+	}
+	if len(header.Key) == 0 {
+		return nil, errors.New("the proof has no jwk")
+	}
+	jwk := providerKey{}
+	private := struct {
+		D string `json:"d"`
+	}{}
+	if err := json.Unmarshal(header.Key, &jwk); err != nil {
+		return nil, errors.New("the jwk of the proof is invalid")
+	}
+	if err := json.Unmarshal(header.Key, &private); err != nil || private.D != "" {
+		return nil, errors.New("the jwk of the proof must be a public key")
+	}
+	key, found, err := jwk.publicKey()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("unsupported key type: %s", jwk.Type)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("the proof signature is not base64url encoded")
+	}
+	if err := verifySignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("the proof claims are not base64url encoded")
+	}
+	claims := jose.Claims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("the proof claims are invalid")
+	}
+	id, _, _ := claims.StringClaim(claimTokenID)
+	if id == "" {
+		return nil, errors.New("the proof has no jti")
+	}
+	if htm, _, _ := claims.StringClaim("htm"); htm != method {
+		return nil, fmt.Errorf("the proof method: %s does not match the request", htm)
+	}
+	if htu, _, _ := claims.StringClaim("htu"); !isSameDPoPTarget(htu, target) {
+		return nil, fmt.Errorf("the proof url: %s does not match the request", htu)
+	}
+	issued, found, err := claims.TimeClaim(claimIssuedAt)
+	if err != nil || !found {
+		return nil, errors.New("the proof has no iat")
+	}
+	if issued.After(now.Add(skew)) || issued.Before(now.Add(-dpopProofLifetime-skew)) {
+		return nil, errors.New("the proof has expired or is not yet valid")
+	}
+	// step: the proof is bound to the access token by its hash
+	sum := sha256.Sum256([]byte(token))
+	ath, _, _ := claims.StringClaim("ath")
+	if subtle.ConstantTimeCompare([]byte(ath), []byte(base64.RawURLEncoding.EncodeToString(sum[:]))) != 1 {
+		return nil, errors.New("the proof is not bound to the access token")
+	}
+	thumbprint, err := getJWKThumbprint(jwk)
+	if err != nil {
+		return nil, err
+	}
+	nonce, _, _ := claims.StringClaim("nonce")
+
+	return &dpopProof{id: id, thumbprint: thumbprint, nonce: nonce}, nil
+}
+
+// getJWKThumbprint returns the sha-256 thumbprint of the key, rfc 7638, the required members in lexicographic order
+func getJWKThumbprint(key providerKey) (string, error) {
+	var members map[string]string
+	switch key.Type {
+	case "RSA":
+		members = map[string]string{"e": key.E, "kty": key.Type, "n": key.N}
+	case "EC":
+		members = map[string]string{"crv": key.Curve, "kty": key.Type, "x": key.X, "y": key.Y}
+	case "OKP":
+		members = map[string]string{"crv": key.Curve, "kty": key.Type, "x": key.X}
+	default:
+		return "", fmt.Errorf("unsupported key type: %s", key.Type)
+	}
+	var names []string
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fields []string
+	for _, name := range names {
+		value, _ := json.Marshal(members[name])
+		fields = append(fields, fmt.Sprintf(`"%s":%s`, name, value))
+	}
+	sum := sha256.Sum256([]byte("{" + strings.Join(fields, ",") + "}"))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// isSameDPoPTarget checks the htu of the proof is the url of the request, ignoring the query and fragment, the case
+// of the scheme and host and the default ports
+func isSameDPoPTarget(htu, target string) bool {
+	normalize := func(location string) (string, bool) {
+		u, err := url.Parse(location)
+		if err != nil || u.Host == "" {
+			return "", false
+		}
+		scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+		if h, port, err := net.SplitHostPort(host); err == nil {
+			if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+				host = h
+			}
+		}
+		path := u.EscapedPath()
+		if path == "" {
+			path = "/"
+		}
+
+		return scheme + "://" + host + path, true
+	}
+	a, ok := normalize(htu)
+	if !ok {
+		return false
+	}
+	b, ok := normalize(target)
+
+	return ok && a == b
+}
+
+// getDPoPThumbprint returns the thumbprint of the key the access token is bound to, if any
+func getDPoPThumbprint(claims jose.Claims) string {
+	if confirmation, found := claims[claimConfirmation].(map[string]interface{}); found {
+		if thumbprint, found := confirmation["jkt"].(string); found {
+			return thumbprint
+		}
+	}
+
+	return ""
+}
+
+// getDPoPNonce returns the nonce of the rotation period, a mac of the period so any instance sharing the
+// encryption key or client secret can verify it without a store
+func (r *oauthProxy) getDPoPNonce(period int64) string {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(period))
+	mac := hmac.New(sha256.New, r.stateKey)
+	mac.Write([]byte("dpop-nonce:"))
+	mac.Write(data)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// isValidDPoPNonce checks the nonce is the one of the current or previous rotation period
+func (r *oauthProxy) isValidDPoPNonce(nonce string, now time.Time) bool {
+	period := now.Unix() / int64(dpopNonceLifetime/time.Second)
+	for _, p := range []int64{period, period - 1} {
+		if hmac.Equal([]byte(nonce), []byte(r.getDPoPNonce(p))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dpopChallenge rejects the request with a dpop challenge, telling the client the algorithms we accept
+func (r *oauthProxy) dpopChallenge(cx *gin.Context, code, description string) {
+	var algorithms []string
+	for name := range signatureAlgorithms {
+		algorithms = append(algorithms, name)
+	}
+	sort.Strings(algorithms)
+	cx.Header("WWW-Authenticate", fmt.Sprintf(`DPoP algs="%s", error="%s", error_description="%s"`,
+		strings.Join(algorithms, " "), code, description))
+	cx.AbortWithStatus(http.StatusUnauthorized)
+}
+
+// dpopMiddleware verifies the proof of possession of the sender constrained tokens, rejecting a token bound to a key
+// without a proof signed by the key, and requiring the bound tokens on the resources with the dpop option
+func (r *oauthProxy) dpopMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if cx.IsAborted() || !r.config.EnableDPoP {
+			return
+		}
+		v, found := cx.Get(cxEnforce)
+		if !found {
+			return
+		}
+		resource := v.(*Resource)
+		user := cx.MustGet(userContextName).(*userContext)
+		fields := log.Fields{
+			"client_ip": cx.ClientIP(),
+			"resource":  cx.Request.URL.Path,
+			"username":  user.name,
+		}
+
+		// step: a bound token must be presented with the dpop scheme, and the dpop scheme only with a bound token
+		authorization := cx.Request.Header.Get(authorizationHeader)
+		scheme := strings.EqualFold(strings.SplitN(authorization, " ", 2)[0], dpopHeader)
+		thumbprint := getDPoPThumbprint(user.claims)
+		switch {
+		case thumbprint == "" && resource.DPoP:
+			log.WithFields(fields).Warnf("rejecting the request, the resource requires a dpop bound token")
+			r.dpopChallenge(cx, "invalid_token", "the resource requires a dpop bound token")
+			return
+		case thumbprint == "" && !scheme:
+			return
+		case thumbprint == "" || !scheme || !user.isBearer():
+			log.WithFields(fields).Warnf("rejecting the request, the dpop bound token was not presented with the dpop scheme")
+			r.dpopChallenge(cx, "invalid_token", "the token must be presented with the dpop scheme")
+			return
+		}
+
+		now := time.Now()
+		if r.config.EnableDPoPNonce {
+			cx.Header(dpopNonceHeader, r.getDPoPNonce(now.Unix()/int64(dpopNonceLifetime/time.Second)))
+		}
+		// step: a request must carry a single proof
+		proofs := cx.Request.Header[http.CanonicalHeaderKey(dpopHeader)]
+		if len(proofs) != 1 {
+			log.WithFields(fields).Warnf("rejecting the request, the request has no dpop proof")
+			r.dpopChallenge(cx, "invalid_dpop_proof", "the request requires a single dpop proof")
+			return
+		}
+		token, _ := getTokenInBearer(cx.Request)
+		proof, err := verifyDPoPProof(proofs[0], cx.Request.Method, r.getRedirectionBaseURL(cx)+cx.Request.URL.Path,
+			token, r.config.ClockSkew, now)
+		if err == nil && proof.thumbprint != thumbprint {
+			err = errors.New("the proof is not signed by the key the token is bound to")
+		}
+		if err == nil && r.config.EnableDPoPNonce && !r.isValidDPoPNonce(proof.nonce, now) {
+			err = errDPoPNonce
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+			log.WithFields(fields).Warnf("rejecting the request, the dpop proof is invalid")
+			if err == errDPoPNonce {
+				r.dpopChallenge(cx, "use_dpop_nonce", err.Error())
+				return
+			}
+			r.dpopChallenge(cx, "invalid_dpop_proof", "the dpop proof is invalid")
+			return
+		}
+
+		// step: the proofs are single use when we have a store to record them in
+		if r.replays != nil {
+			replayed, err := r.replays.seen(dpopHeader+":"+thumbprint, proof.id, dpopProofLifetime+2*r.config.ClockSkew)
+			if err != nil {
+				fields["error"] = err.Error()
+				log.WithFields(fields).Errorf("rejecting the request, unable to record the jti of the dpop proof")
+
+				cx.AbortWithStatus(http.StatusServiceUnavailable)
+				return
+			}
+			if replayed {
+				log.WithFields(fields).Warnf("rejecting the request, the dpop proof has already been used")
+				r.dpopChallenge(cx, "invalid_dpop_proof", "the dpop proof has already been used")
+				return
+			}
+		}
+	}
+}
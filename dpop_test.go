@@ -0,0 +1,290 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDPoPKey is the key of a client signing the dpop proofs
+type fakeDPoPKey struct {
+	key *ecdsa.PrivateKey
+	jwk providerKey
+}
+
+func newFakeDPoPKey() *fakeDPoPKey {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	return &fakeDPoPKey{
+		key: key,
+		jwk: providerKey{
+			Type:  "EC",
+			Curve: "P-256",
+			X:     base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y:     base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		},
+	}
+}
+
+func (r *fakeDPoPKey) thumbprint() string {
+	thumbprint, _ := getJWKThumbprint(r.jwk)
+	return thumbprint
+}
+
+// sign signs the claims with the header, which defaults to a dpop proof header with the public key
+func (r *fakeDPoPKey) sign(header map[string]interface{}, claims jose.Claims) string {
+	if header == nil {
+		header = map[string]interface{}{"typ": dpopProofType, "alg": "ES256", "jwk": r.jwk}
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	data := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	hash := sha256.Sum256([]byte(data))
+	sr, ss, _ := ecdsa.Sign(rand.Reader, r.key, hash[:])
+	signature := append(sr.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+
+	return data + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (r *fakeDPoPKey) claims(method, target, token string) jose.Claims {
+	sum := sha256.Sum256([]byte(token))
+	return jose.Claims{
+		"jti": getRandomString(12),
+		"htm": method,
+		"htu": target,
+		"iat": float64(time.Now().Unix()),
+		"ath": base64.RawURLEncoding.EncodeToString(sum[:]),
+	}
+}
+
+func (r *fakeDPoPKey) proof(method, target, token string) string {
+	return r.sign(nil, r.claims(method, target, token))
+}
+
+func TestGetJWKThumbprint(t *testing.T) {
+	// step: the example of rfc 7638
+	thumbprint, err := getJWKThumbprint(providerKey{
+		Type: "RSA",
+		E:    "AQAB",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3" +
+			"oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZH" +
+			"zu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8a" +
+			"wapJzKnqDKgw",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint)
+	_, err = getJWKThumbprint(providerKey{Type: "oct"})
+	assert.Error(t, err)
+}
+
+func TestIsSameDPoPTarget(t *testing.T) {
+	cs := []struct {
+		HTU    string
+		Target string
+		Ok     bool
+	}{
+		{HTU: "https://api.example.com/orders", Target: "https://api.example.com/orders", Ok: true},
+		{HTU: "https://API.example.com/orders?page=2#top", Target: "https://api.example.com/orders", Ok: true},
+		{HTU: "https://api.example.com:443/orders", Target: "https://api.example.com/orders", Ok: true},
+		{HTU: "http://api.example.com/orders", Target: "https://api.example.com/orders"},
+		{HTU: "https://api.example.com:8443/orders", Target: "https://api.example.com/orders"},
+		{HTU: "https://api.example.com/orders/1", Target: "https://api.example.com/orders"},
+		{HTU: "/orders", Target: "https://api.example.com/orders"},
+		{Target: "https://api.example.com/orders"},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Ok, isSameDPoPTarget(c.HTU, c.Target), "case %d", i)
+	}
+}
+
+func TestVerifyDPoPProof(t *testing.T) {
+	key := newFakeDPoPKey()
+	target := "https://api.example.com/orders"
+	valid := func() jose.Claims { return key.claims("POST", target, "token") }
+	tampered := key.proof("POST", target, "token")
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+	private := map[string]interface{}{"kty": "EC", "crv": "P-256", "x": key.jwk.X, "y": key.jwk.Y, "d": "c2VjcmV0"}
+
+	cs := []struct {
+		Proof string
+		Ok    bool
+	}{
+		{Proof: key.proof("POST", target, "token"), Ok: true},
+		{Proof: key.proof("POST", target+"?page=2", "token"), Ok: true},
+		{Proof: key.proof("GET", target, "token")},
+		{Proof: key.proof("POST", "https://api.example.com/payments", "token")},
+		{Proof: key.proof("POST", target, "other")},
+		{Proof: tampered},
+		{Proof: "not.a.proof"},
+		{Proof: key.sign(map[string]interface{}{"typ": "JWT", "alg": "ES256", "jwk": key.jwk}, valid())},
+		{Proof: key.sign(map[string]interface{}{"typ": dpopProofType, "alg": "HS256", "jwk": key.jwk}, valid())},
+		{Proof: key.sign(map[string]interface{}{"typ": dpopProofType, "alg": "none", "jwk": key.jwk}, valid())},
+		{Proof: key.sign(map[string]interface{}{"typ": dpopProofType, "alg": "ES256"}, valid())},
+		{Proof: key.sign(map[string]interface{}{"typ": dpopProofType, "alg": "ES256", "jwk": private}, valid())},
+		{Proof: key.sign(nil, func() jose.Claims { c := valid(); delete(c, "jti"); return c }())},
+		{Proof: key.sign(nil, func() jose.Claims { c := valid(); delete(c, "iat"); return c }())},
+		{Proof: key.sign(nil, func() jose.Claims {
+			c := valid()
+			c["iat"] = float64(time.Now().Add(-5 * time.Minute).Unix())
+			return c
+		}())},
+		{Proof: key.sign(nil, func() jose.Claims {
+			c := valid()
+			c["iat"] = float64(time.Now().Add(5 * time.Minute).Unix())
+			return c
+		}())},
+	}
+	for i, c := range cs {
+		proof, err := verifyDPoPProof(c.Proof, "POST", target, "token", time.Second, time.Now())
+		if !c.Ok {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, key.thumbprint(), proof.thumbprint, "case %d", i)
+		}
+	}
+}
+
+func TestDPoPNonce(t *testing.T) {
+	proxy := &oauthProxy{stateKey: []byte("an encryption key of the proxy!!")}
+	now := time.Now()
+	period := now.Unix() / int64(dpopNonceLifetime/time.Second)
+	assert.True(t, proxy.isValidDPoPNonce(proxy.getDPoPNonce(period), now))
+	assert.True(t, proxy.isValidDPoPNonce(proxy.getDPoPNonce(period-1), now))
+	assert.False(t, proxy.isValidDPoPNonce(proxy.getDPoPNonce(period-2), now))
+	assert.False(t, proxy.isValidDPoPNonce("", now))
+	// step: the nonces are bound to the key
+	other := &oauthProxy{stateKey: []byte("another encryption key")}
+	assert.False(t, proxy.isValidDPoPNonce(other.getDPoPNonce(period), now))
+}
+
+func TestDPoPMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableDPoP = true
+	cfg.Resources = append([]*Resource{{URL: "/api", Methods: []string{"ANY"}, DPoP: true}}, cfg.Resources...)
+	proxy, idp, svc := newTestProxyService(cfg)
+	proxy.replays, _ = newReplayGuard(&fakeStore{items: make(map[string]string)})
+
+	key, other := newFakeDPoPKey(), newFakeDPoPKey()
+	getToken := func(thumbprint string) string {
+		claims := jose.Claims{}
+		for k, v := range newTestToken(idp.getLocation()).claims {
+			claims[k] = v
+		}
+		if thumbprint != "" {
+			claims["cnf"] = map[string]interface{}{"jkt": thumbprint}
+		}
+		signed, _ := idp.signToken(claims)
+		return signed.Encode()
+	}
+	bound, unbound := getToken(key.thumbprint()), getToken("")
+	replayed := key.proof("GET", svc+"/api", bound)
+
+	cs := []struct {
+		Scheme       string
+		Token        string
+		Proof        string
+		URI          string
+		ExpectedCode int
+		ExpectedErr  string
+	}{
+		{Scheme: "DPoP", Token: bound, Proof: replayed, URI: "/api", ExpectedCode: http.StatusOK},
+		{Scheme: "DPoP", Token: bound, Proof: replayed, URI: "/api", ExpectedCode: http.StatusUnauthorized, ExpectedErr: "invalid_dpop_proof"},
+		{Scheme: "DPoP", Token: bound, Proof: key.proof("GET", svc+fakeAuthAllURL, bound), URI: fakeAuthAllURL, ExpectedCode: http.StatusOK},
+		{Scheme: "DPoP", Token: bound, Proof: key.proof("POST", svc+"/api", bound), URI: "/api", ExpectedCode: http.StatusUnauthorized, ExpectedErr: "invalid_dpop_proof"},
+		{Scheme: "DPoP", Token: bound, Proof: other.proof("GET", svc+"/api", bound), URI: "/api", ExpectedCode: http.StatusUnauthorized, ExpectedErr: "invalid_dpop_proof"},
+		{Scheme: "DPoP", Token: bound, URI: "/api", ExpectedCode: http.StatusUnauthorized, ExpectedErr: "invalid_dpop_proof"},
+		// step: the bound tokens aren't usable as bearer tokens on any resource
+		{Scheme: "Bearer", Token: bound, Proof: key.proof("GET", svc+"/api", bound), URI: "/api", ExpectedCode: http.StatusUnauthorized, ExpectedErr: "invalid_token"},
+		{Scheme: "Bearer", Token: bound, URI: fakeAuthAllURL, ExpectedCode: http.StatusUnauthorized, ExpectedErr: "invalid_token"},
+		// step: the unbound tokens are only usable as bearer tokens, and not on the dpop resources
+		{Scheme: "Bearer", Token: unbound, URI: "/api", ExpectedCode: http.StatusUnauthorized, ExpectedErr: "invalid_token"},
+		{Scheme: "DPoP", Token: unbound, Proof: key.proof("GET", svc+fakeAuthAllURL, unbound), URI: fakeAuthAllURL, ExpectedCode: http.StatusUnauthorized, ExpectedErr: "invalid_token"},
+		{Scheme: "Bearer", Token: unbound, URI: fakeAuthAllURL, ExpectedCode: http.StatusOK},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest(http.MethodGet, svc+c.URI, nil)
+		req.Header.Set(authorizationHeader, c.Scheme+" "+c.Token)
+		if c.Proof != "" {
+			req.Header.Set(dpopHeader, c.Proof)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d", i)
+		if c.ExpectedErr != "" {
+			assert.Contains(t, resp.Header.Get("WWW-Authenticate"), `error="`+c.ExpectedErr+`"`, "case %d", i)
+		}
+	}
+}
+
+func TestDPoPMiddlewareNonce(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableDPoP = true
+	cfg.EnableDPoPNonce = true
+	_, idp, svc := newTestProxyService(cfg)
+
+	key := newFakeDPoPKey()
+	claims := jose.Claims{}
+	for k, v := range newTestToken(idp.getLocation()).claims {
+		claims[k] = v
+	}
+	claims["cnf"] = map[string]interface{}{"jkt": key.thumbprint()}
+	signed, _ := idp.signToken(claims)
+	token := signed.Encode()
+
+	request := func(nonce string) *http.Response {
+		proof := key.claims("GET", svc+fakeAuthAllURL, token)
+		if nonce != "" {
+			proof["nonce"] = nonce
+		}
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL, nil)
+		req.Header.Set(authorizationHeader, "DPoP "+token)
+		req.Header.Set(dpopHeader, key.sign(nil, proof))
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// step: the first proof has no nonce, the client retries with the one issued
+	resp := request("")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.True(t, strings.Contains(resp.Header.Get("WWW-Authenticate"), `error="use_dpop_nonce"`))
+	nonce := resp.Header.Get(dpopNonceHeader)
+	assert.NotEmpty(t, nonce)
+	resp = request(nonce)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, nonce, resp.Header.Get(dpopNonceHeader))
+	assert.Equal(t, http.StatusUnauthorized, request("bm90IGEgbm9uY2U").StatusCode)
+}
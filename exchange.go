@@ -0,0 +1,202 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// tokenExchangeGrantType is the grant type of a token exchange, RFC 8693
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// accessTokenType identifies an access token in a token exchange
+	accessTokenType = "urn:ietf:params:oauth:token-type:access_token"
+	// tokenExchangeMargin is the time before expiration an exchanged token is no longer used
+	tokenExchangeMargin = 10 * time.Second
+	// tokenExchangeCacheSweep is the number of cached tokens above which the expired ones are removed
+	tokenExchangeCacheSweep = 10000
+)
+
+// exchangedToken is a cached token of the upstream audience
+type exchangedToken struct {
+	// the exchanged access token, held as bytes so it can be wiped
+	token []byte
+	// the time the token is no longer used
+	expires time.Time
+}
+
+// tokenExchanger exchanges the access tokens of the users for tokens of the upstream audience, caching
+// the tokens until they expire; it's safe to use from multiple goroutines
+type tokenExchanger struct {
+	sync.RWMutex
+	// the exchanged tokens keyed by the hash of the access token
+	cache map[[sha256.Size]byte]*exchangedToken
+	// exchanges the token at the provider, returning the token and its lifetime
+	exchange func(token string) (string, time.Duration, error)
+	// the exchanges partitioned by result
+	total *prometheus.CounterVec
+}
+
+// newTokenExchanger creates the exchanger and registers the metrics
+func newTokenExchanger(exchange func(string) (string, time.Duration, error)) *tokenExchanger {
+	total := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "token_exchanges_total",
+			Help: "The access token exchanges partitioned by result",
+		},
+		[]string{"result"},
+	)
+
+	return &tokenExchanger{
+		cache:    make(map[[sha256.Size]byte]*exchangedToken),
+		exchange: exchange,
+		total:    prometheus.MustRegisterOrGet(total).(*prometheus.CounterVec),
+	}
+}
+
+// getToken returns the token of the upstream audience for the access token
+func (r *tokenExchanger) getToken(token string) (string, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	r.RLock()
+	exchanged, found := r.cache[key]
+	r.RUnlock()
+	if found && now.Before(exchanged.expires) {
+		r.total.WithLabelValues("cached").Inc()
+		return string(exchanged.token), nil
+	}
+
+	issued, lifetime, err := r.exchange(token)
+	if err != nil {
+		r.total.WithLabelValues("error").Inc()
+		return "", err
+	}
+	r.total.WithLabelValues("exchanged").Inc()
+
+	r.Lock()
+	defer r.Unlock()
+	r.cache[key] = &exchangedToken{token: []byte(issued), expires: now.Add(lifetime - tokenExchangeMargin)}
+	if len(r.cache) > tokenExchangeCacheSweep {
+		for k, v := range r.cache {
+			if now.After(v.expires) {
+				v.wipe()
+				delete(r.cache, k)
+			}
+		}
+	}
+
+	return issued, nil
+}
+
+// wipe empties the cache, returning the tokens yet to expire so they can be revoked
+func (r *tokenExchanger) wipe() []string {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	var tokens []string
+	for _, v := range r.cache {
+		if now.Before(v.expires) {
+			tokens = append(tokens, string(v.token))
+		}
+		v.wipe()
+	}
+	r.cache = make(map[[sha256.Size]byte]*exchangedToken)
+
+	return tokens
+}
+
+// wipe overwrites the token in memory
+func (r *exchangedToken) wipe() {
+	for i := range r.token {
+		r.token[i] = 0
+	}
+	r.token = nil
+}
+
+// String ensures the token is never printed
+func (r *exchangedToken) String() string {
+	return "[redacted]"
+}
+
+// getUpstreamToken returns the access token forwarded to the upstream, exchanged for the upstream audience
+// when enabled
+func (r *oauthProxy) getUpstreamToken(user *userContext) (string, error) {
+	if r.exchanger == nil {
+		return user.getAccessToken(), nil
+	}
+
+	return r.exchanger.getToken(user.getAccessToken())
+}
+
+// exchangeToken exchanges the access token for a token of the upstream audience at the token endpoint
+func (r *oauthProxy) exchangeToken(token string) (string, time.Duration, error) {
+	values := url.Values{}
+	values.Set("grant_type", tokenExchangeGrantType)
+	values.Set("subject_token", token)
+	values.Set("subject_token_type", accessTokenType)
+	values.Set("requested_token_type", accessTokenType)
+	values.Set("audience", r.config.TokenExchangeAudience)
+
+	return r.requestTokenExchange(values)
+}
+
+// requestTokenExchange posts the token exchange to the token endpoint, returning the issued token and its lifetime
+func (r *oauthProxy) requestTokenExchange(values url.Values) (string, time.Duration, error) {
+	request, err := http.NewRequest(http.MethodPost, r.getProviderConfig().TokenEndpoint.String(), strings.NewReader(values.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	request.SetBasicAuth(url.QueryEscape(r.config.ClientID), url.QueryEscape(r.config.ClientSecret.Value()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := r.idpClient.Do(request)
+	if err != nil {
+		return "", 0, err
+	}
+	defer response.Body.Close()
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("invalid response from token exchange, status: %d, response: %s", response.StatusCode, content)
+	}
+
+	var exchanged struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(content, &exchanged); err != nil {
+		return "", 0, err
+	}
+	if exchanged.AccessToken == "" {
+		return "", 0, errors.New("the token exchange response has no access token")
+	}
+
+	return exchanged.AccessToken, time.Duration(exchanged.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenExchangerCache(t *testing.T) {
+	calls := 0
+	exchanger := newTokenExchanger(func(token string) (string, time.Duration, error) {
+		calls++
+		switch token {
+		case "error":
+			return "", 0, errors.New("exchange denied")
+		case "short":
+			return "exchanged-" + token, time.Second, nil
+		}
+		return "exchanged-" + token, time.Hour, nil
+	})
+
+	token, err := exchanger.getToken("user")
+	assert.NoError(t, err)
+	assert.Equal(t, "exchanged-user", token)
+	exchanger.getToken("user")
+	assert.Equal(t, 1, calls, "the exchanged token should have been cached")
+
+	// step: the token is not used within the margin of its expiration
+	exchanger.getToken("short")
+	exchanger.getToken("short")
+	assert.Equal(t, 3, calls)
+
+	_, err = exchanger.getToken("error")
+	assert.Error(t, err)
+	exchanger.getToken("error")
+	assert.Equal(t, 5, calls)
+}
+
+func TestTokenExchange(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.TokenExchangeAudience = "upstream"
+	_, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	for i := 0; i < 2; i++ {
+		var response testUpstreamResponse
+		resp, err := resty.New().SetAuthToken(signed.Encode()).R().SetResult(&response).Get(svc + fakeAuthAllURL)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+		forwarded := strings.TrimPrefix(response.Headers.Get("Authorization"), "Bearer ")
+		assert.NotEqual(t, signed.Encode(), forwarded)
+		assert.Equal(t, forwarded, response.Headers.Get("X-Auth-Token"))
+		exchanged, err := jose.ParseJWT(forwarded)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		claims, _ := exchanged.Claims()
+		assert.Equal(t, "upstream", claims["aud"])
+	}
+	assert.Equal(t, 1, idp.getExchanges(), "the exchanged token should have been cached")
+}
+
+func TestTokenExchangeDenied(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.TokenExchangeAudience = "not-permitted"
+	_, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	resp, err := resty.New().SetAuthToken(signed.Encode()).R().Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+}
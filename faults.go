@@ -0,0 +1,105 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// faultSettings are the faults which are currently being injected
+type faultSettings struct {
+	// Delay is the latency in milliseconds added to the requests
+	Delay int `json:"delay-ms"`
+	// Percentage is the percentage of requests which are delayed
+	Percentage int `json:"percentage"`
+	// FailRefresh causes the refreshing of access tokens to fail
+	FailRefresh bool `json:"fail-refresh"`
+	// DropStoreWrites silently discards the writes to the store
+	DropStoreWrites bool `json:"drop-store-writes"`
+}
+
+// isValid validates the fault settings
+func (r faultSettings) isValid() error {
+	if r.Delay < 0 {
+		return errors.New("the delay cannot be negative")
+	}
+	if r.Percentage < 0 || r.Percentage > 100 {
+		return errors.New("the percentage must be between 0 and 100")
+	}
+
+	return nil
+}
+
+// faultInjector holds the faults being injected, it's safe to use from multiple goroutines
+type faultInjector struct {
+	sync.RWMutex
+	// the current settings
+	settings faultSettings
+}
+
+// newFaultInjector creates a fault injector with no faults
+func newFaultInjector() *faultInjector {
+	return &faultInjector{}
+}
+
+// get returns the current fault settings
+func (r *faultInjector) get() faultSettings {
+	if r == nil {
+		return faultSettings{}
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.settings
+}
+
+// set updates the fault settings
+func (r *faultInjector) set(settings faultSettings) error {
+	if err := settings.isValid(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.settings = settings
+
+	return nil
+}
+
+// requestDelay returns the delay to apply to a request, if any
+func (r *faultInjector) requestDelay() time.Duration {
+	settings := r.get()
+	if settings.Delay <= 0 || settings.Percentage <= 0 {
+		return 0
+	}
+	if rand.Intn(100) >= settings.Percentage {
+		return 0
+	}
+
+	return time.Duration(settings.Delay) * time.Millisecond
+}
+
+// failRefresh checks if the refreshing of tokens should fail
+func (r *faultInjector) failRefresh() bool {
+	return r.get().FailRefresh
+}
+
+// dropStoreWrites checks if writes to the store should be discarded
+func (r *faultInjector) dropStoreWrites() bool {
+	return r.get().DropStoreWrites
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultInjectorDisabled(t *testing.T) {
+	var faults *faultInjector
+	assert.Equal(t, time.Duration(0), faults.requestDelay())
+	assert.False(t, faults.failRefresh())
+	assert.False(t, faults.dropStoreWrites())
+}
+
+func TestFaultInjectorSettings(t *testing.T) {
+	faults := newFaultInjector()
+	assert.Error(t, faults.set(faultSettings{Percentage: 101}))
+	assert.Error(t, faults.set(faultSettings{Delay: -1}))
+	assert.NoError(t, faults.set(faultSettings{
+		Delay:           10,
+		Percentage:      100,
+		FailRefresh:     true,
+		DropStoreWrites: true,
+	}))
+	assert.Equal(t, 10*time.Millisecond, faults.requestDelay())
+	assert.True(t, faults.failRefresh())
+	assert.True(t, faults.dropStoreWrites())
+
+	assert.NoError(t, faults.set(faultSettings{Delay: 10}))
+	assert.Equal(t, time.Duration(0), faults.requestDelay())
+}
+
+func TestFaultInjectionMiddlewareClientGone(t *testing.T) {
+	proxy := &oauthProxy{faults: newFaultInjector()}
+	assert.NoError(t, proxy.faults.set(faultSettings{Delay: 10000, Percentage: 100}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cx := &gin.Context{Request: httptest.NewRequest("GET", "/test", nil).WithContext(ctx)}
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	// step: the delay is cut short once the client has gone away
+	start := time.Now()
+	proxy.faultInjectionMiddleware()(cx)
+	assert.True(t, time.Since(start) < time.Second, "the delay should end with the request")
+	assert.True(t, cx.IsAborted())
+}
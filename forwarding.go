@@ -36,6 +36,7 @@ func (r *oauthProxy) reverseProxyMiddleware() gin.HandlerFunc {
 		// step: is this connection upgrading?
 		if isUpgradedConnection(cx.Request) {
 			log.Debugf("upgrading the connnection to %s", cx.Request.Header.Get(headerUpgrade))
+			skipRequestValidation(cx.Request)
 			if err := tryUpdateConnection(cx, r.endpoint); err != nil {
 				log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to upgrade the connection")
 				cx.AbortWithStatus(http.StatusInternalServerError)
@@ -94,7 +95,7 @@ func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
 				}).Infof("requesting access token for user")
 
 				// step: login into the service
-				resp, err := client.UserCredsToken(r.config.ForwardingUsername, r.config.ForwardingPassword)
+				resp, err := client.UserCredsToken(r.config.ForwardingUsername, r.config.ForwardingPassword.Value())
 				if err != nil {
 					log.WithFields(log.Fields{
 						"error": err.Error(),
@@ -106,7 +107,7 @@ func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
 				}
 
 				// step: parse the token
-				token, identity, err := parseToken(resp.AccessToken)
+				token, identity, err := parseToken(resp.AccessToken, r.decryptionKey)
 				if err != nil {
 					log.WithFields(log.Fields{
 						"error": err.Error(),
@@ -146,7 +147,15 @@ func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
 					}).Infof("attempting to refresh the access token")
 
 					// step: attempt to refresh the access
-					token, expiration, err := getRefreshedToken(r.client, state.refresh)
+					token, refresh, expiration, err := getRefreshedToken(r.client, state.refresh, r.decryptionKey)
+					if wait := r.getProviderThrottle(); err != nil && err != ErrRefreshTokenExpired && wait > 0 {
+						log.WithFields(log.Fields{
+							"retry_after": wait.String(),
+						}).Warnf("the provider is rate limiting the requests, holding off the refresh")
+
+						<-time.After(wait)
+						continue
+					}
 					if err != nil {
 						state.login = true
 						switch err {
@@ -165,6 +174,7 @@ func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
 
 					// step: update the state
 					state.token = token
+					state.refresh = refresh
 					state.expiration = expiration
 					state.wait = true
 					state.login = false
@@ -16,44 +16,60 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
+	"os"
 	"path"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
 	"github.com/coreos/go-oidc/oauth2"
+	"github.com/coreos/go-oidc/oidc"
 	"github.com/gin-gonic/gin"
 )
 
 // getRedirectionURL returns the redirectionURL for the oauth flow
 func (r *oauthProxy) getRedirectionURL(cx *gin.Context) string {
+	return r.getRedirectionBaseURL(cx) + r.config.withOAuthURI(callbackURL)
+}
+
+// getRedirectionBaseURL returns the scheme and host the provider redirects the user back to
+func (r *oauthProxy) getRedirectionBaseURL(cx *gin.Context) string {
+	// need to determine the scheme, cx.Request.URL.Scheme doesn't have it, best way is to default
+	// and then check for TLS
+	scheme := "http"
+	if cx.Request.TLS != nil {
+		scheme = "https"
+	}
+	scheme = defaultTo(cx.Request.Header.Get("X-Forwarded-Proto"), scheme)
+	// @QUESTION: should I use the X-Forwarded-<header>?? ..
+	host := defaultTo(cx.Request.Header.Get("X-Forwarded-Host"), cx.Request.Host)
+
 	var redirect string
-	switch r.config.RedirectionURL {
-	case "":
-		// need to determine the scheme, cx.Request.URL.Scheme doesn't have it, best way is to default
-		// and then check for TLS
-		scheme := "http"
-		if cx.Request.TLS != nil {
-			scheme = "https"
+	switch {
+	case len(r.config.RedirectionHosts) > 0:
+		// step: only hosts in the allowlist are used, else we fallback to the redirection url
+		redirect = r.config.RedirectionURL
+		if isAllowedHost(host, r.config.RedirectionHosts) {
+			redirect = fmt.Sprintf("%s://%s", scheme, host)
+		} else if redirect == "" {
+			redirect = fmt.Sprintf("%s://%s", scheme, r.config.RedirectionHosts[0])
 		}
-		// @QUESTION: should I use the X-Forwarded-<header>?? ..
-		redirect = fmt.Sprintf("%s://%s",
-			defaultTo(cx.Request.Header.Get("X-Forwarded-Proto"), scheme),
-			defaultTo(cx.Request.Header.Get("X-Forwarded-Host"), cx.Request.Host))
+	case r.config.RedirectionURL == "":
+		redirect = fmt.Sprintf("%s://%s", scheme, host)
 	default:
 		redirect = r.config.RedirectionURL
 	}
 
-	return fmt.Sprintf("%s/oauth/callback", redirect)
+	return redirect
 }
 
 // oauthAuthorizationHandler is responsible for performing the redirection to oauth provider
@@ -63,6 +79,11 @@ func (r *oauthProxy) oauthAuthorizationHandler(cx *gin.Context) {
 		cx.AbortWithStatus(http.StatusNotAcceptable)
 		return
 	}
+	// step: if the refresh cookie is scoped to the oauth handlers, we can only refresh the session here
+	if r.config.hasNarrowRefreshCookie() && r.refreshSessionFromCookie(cx) {
+		r.redirectToURL(sanitizeRedirect(getRequestState(cx)), cx)
+		return
+	}
 	// step: create a oauth client
 	client, err := r.getOAuthClient(r.getRedirectionURL(cx))
 	if err != nil {
@@ -75,12 +96,24 @@ func (r *oauthProxy) oauthAuthorizationHandler(cx *gin.Context) {
 	}
 
 	// step: set the access type of the session
-	var accessType string
-	if containedIn("offline", r.config.Scopes) {
-		accessType = "offline"
+	accessType := r.config.getAccessType()
+
+	// step: add any custom parameters to the authorization request, the passthrough ones taking precedence
+	redirect := getRequestState(cx)
+	params := mergeMaps(r.getAuthorizationParams(cx.Request.Host, redirect), r.getPassthroughParams(cx))
+	// step: the expired and idle sessions are redirected with the prompt, any other prompt is left to the passthrough
+	if prompt := cx.Query("prompt"); prompt != "" && (prompt == "login" || prompt == r.config.ExpiredSessionPrompt) {
+		params["prompt"] = prompt
 	}
+	authURL, err := r.newAuthorizationURL(cx, client, redirect, params)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("failed to generate the state for authorization")
 
-	authURL := client.AuthCodeURL(cx.Query("state"), accessType, "")
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
 
 	log.WithFields(log.Fields{
 		"client_ip":   cx.ClientIP(),
@@ -94,10 +127,101 @@ func (r *oauthProxy) oauthAuthorizationHandler(cx *gin.Context) {
 		model := make(map[string]string, 0)
 		model["redirect"] = authURL
 
-		cx.HTML(http.StatusOK, path.Base(r.config.SignInPage), mergeMaps(model, r.config.Tags))
+		r.renderPage(cx, http.StatusOK, path.Base(r.config.SignInPage), r.getTemplateModel(model))
+		return
+	}
+
+	r.redirectToURL(authURL, cx)
+}
+
+// accountHandler is responsible for redirecting the user into the provider's account console
+func (r *oauthProxy) accountHandler(cx *gin.Context) {
+	provider := r.getProviderConfig()
+	if provider.Issuer == nil {
+		cx.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+	// step: the account console links back to the application via the referrer
+	referrer := defaultTo(cx.Query("redirect"), "/")
+	if strings.HasPrefix(referrer, "/") {
+		referrer = strings.TrimSuffix(r.getRedirectionURL(cx), r.config.withOAuthURI(callbackURL)) + referrer
+	}
+	accountURL := fmt.Sprintf("%s/account?referrer=%s&referrer_uri=%s",
+		strings.TrimSuffix(provider.Issuer.String(), "/"), url.QueryEscape(r.config.ClientID), url.QueryEscape(referrer))
+
+	r.redirectToURL(accountURL, cx)
+}
+
+// requiredActionHandler is responsible for sending the user through a provider required action, i.e.
+// updating their password, before returning them to the application
+func (r *oauthProxy) requiredActionHandler(action string) gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if r.config.SkipTokenVerification {
+			cx.AbortWithStatus(http.StatusNotAcceptable)
+			return
+		}
+		client, err := r.getOAuthClient(r.getRedirectionURL(cx))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("failed to retrieve the oauth client for the required action")
+
+			cx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		authURL, err := r.newAuthorizationURL(cx, client, defaultTo(cx.Query("redirect"), "/"),
+			map[string]string{"kc_action": action})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("failed to generate the state for the required action")
+
+			cx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"action":    action,
+			"client_ip": cx.ClientIP(),
+		}).Debugf("redirecting the user to perform a required action")
+
+		r.redirectToURL(authURL, cx)
+	}
+}
+
+// reauthenticateHandler forces the user to re-enter their credentials, even with a single sign-on session
+// at the provider, returning them to the redirect; useful ahead of sensitive operations
+func (r *oauthProxy) reauthenticateHandler(cx *gin.Context) {
+	if r.config.SkipTokenVerification {
+		cx.AbortWithStatus(http.StatusNotAcceptable)
+		return
+	}
+	client, err := r.getOAuthClient(r.getRedirectionURL(cx))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("failed to retrieve the oauth client for re-authentication")
+
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	redirect := defaultTo(cx.Query("redirect"), "/")
+	// step: the prompt and max age make the provider ignore the existing session
+	params := mergeMaps(r.getAuthorizationParams(cx.Request.Host, redirect), map[string]string{"prompt": "login", "max_age": "0"})
+	authURL, err := r.newAuthorizationURL(cx, client, redirect, params)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("failed to generate the state for re-authentication")
+
+		cx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+	}).Debugf("redirecting the user to re-authenticate")
+
 	r.redirectToURL(authURL, cx)
 }
 
@@ -114,6 +238,18 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 		cx.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
+	// step: ensure the callback belongs to a login started by this browser
+	redirect, err := r.verifyState(cx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"error":     err.Error(),
+		}).Errorf("unable to verify the state of the callback")
+
+		cx.Error(err)
+		r.accessForbidden(cx)
+		return
+	}
 
 	// step: create a oauth client
 	client, err := r.getOAuthClient(r.getRedirectionURL(cx))
@@ -129,12 +265,13 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 	if err != nil {
 		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to exchange code for access token")
 
+		cx.Error(err)
 		r.accessForbidden(cx)
 		return
 	}
 
 	// step: parse decode the identity token
-	token, identity, err := parseToken(resp.IDToken)
+	token, identity, err := parseToken(resp.IDToken, r.decryptionKey)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to parse id token for identity")
 
@@ -143,21 +280,39 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 	}
 
 	// step: verify the token is valid
-	if err = verifyToken(r.client, token); err != nil {
+	if err = r.verifyJWT(token); err != nil {
 		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to verify the id token")
 
+		cx.Error(err)
+		r.accessForbidden(cx)
+		return
+	}
+
+	// step: ensure the id token was issued for the login started by this browser
+	if err = r.verifyNonce(cx, token); err != nil {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"error":     err.Error(),
+		}).Errorf("unable to verify the nonce of the id token")
+
+		cx.Error(err)
 		r.accessForbidden(cx)
 		return
 	}
 
 	// step: attempt to decode the access token else we default to the id token
-	access, id, err := parseToken(resp.AccessToken)
+	access, id, err := parseToken(resp.AccessToken, r.decryptionKey)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to parse the access token, using id token only")
 	} else {
 		token = access
 		identity = id
 	}
+	// step: inject the user into the context
+	if user, err := extractIdentity(token); err == nil {
+		cx.Set(userContextName, user)
+		r.stats.login(user.id)
+	}
 
 	log.WithFields(log.Fields{
 		"email":    identity.Email,
@@ -165,53 +320,73 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 		"duration": identity.ExpiresAt.Sub(time.Now()).String(),
 	}).Infof("issuing access token for user, email: %s", identity.Email)
 
-	// step: does the response has a refresh token and we are NOT ignore refresh tokens?
-	if r.config.EnableRefreshTokens && resp.RefreshToken != "" {
-		// step: encrypt the refresh token
-		encrypted, err := encodeText(resp.RefreshToken, r.config.EncryptionKey)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to encrypt the refresh token")
+	if err := r.dropSessionCookies(cx, token, identity, resp.RefreshToken); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to encrypt the refresh token")
 
-			cx.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
 
-		// drop in the access token - cookie expiration = access token
-		r.dropAccessTokenCookie(cx, token.Encode(), r.getAccessCookieExpiration(token, resp.RefreshToken))
+	r.redirectToURL(redirect, cx)
+}
 
-		switch r.useStore() {
-		case true:
-			if err := r.StoreRefreshToken(token, encrypted); err != nil {
-				log.WithFields(log.Fields{"error": err.Error()}).Warnf("failed to save the refresh token in the store")
-			}
-		default:
-			// notes: not all idp refresh tokens are readable, google for example, so we attempt to decode into
-			// a jwt and if possible extract the expiration, else we default to 10 days
-			if _, ident, err := parseToken(resp.RefreshToken); err != nil {
-				r.dropRefreshTokenCookie(cx, encrypted, time.Duration(240)*time.Hour)
-			} else {
-				r.dropRefreshTokenCookie(cx, encrypted, ident.ExpiresAt.Sub(time.Now()))
+// dropSessionCookies drops the access token and, if enabled, the refresh token cookies of a login
+func (r *oauthProxy) dropSessionCookies(cx *gin.Context, token jose.JWT, identity *oidc.Identity, refreshToken string) error {
+	r.dropActivityCookie(cx, identity.ID, time.Now())
+
+	// step: are we listing the active sessions to the admins?
+	if r.actives != nil {
+		if user, err := extractIdentity(token); err == nil {
+			expiration := identity.ExpiresAt.Sub(time.Now())
+			if r.config.EnableRefreshTokens && refreshToken != "" {
+				expiration = r.getRefreshCookieExpiration(refreshToken)
 			}
+			r.recordActiveSession(cx, user, expiration)
 		}
-	} else {
-		r.dropAccessTokenCookie(cx, token.Encode(), identity.ExpiresAt.Sub(time.Now()))
 	}
 
-	// step: decode the state variable
-	state := "/"
-	if cx.Request.URL.Query().Get("state") != "" {
-		decoded, err := base64.StdEncoding.DecodeString(cx.Request.URL.Query().Get("state"))
+	// step: with server side sessions the tokens are held in the store and the cookie carries the id
+	if r.config.EnableServerSideSessions {
+		expiration := identity.ExpiresAt.Sub(time.Now())
+		if !r.config.EnableRefreshTokens {
+			refreshToken = ""
+		}
+		if refreshToken != "" {
+			expiration = r.getRefreshCookieExpiration(refreshToken)
+		}
+		id, err := r.createServerSession(token, refreshToken, expiration)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"state": cx.Request.URL.Query().Get("state"),
-				"error": err.Error(),
-			}).Warnf("unable to decode the state parameter")
-		} else {
-			state = string(decoded)
+			return err
 		}
+		r.dropAccessTokenCookie(cx, id, expiration)
+		return nil
+	}
+
+	// step: does the response has a refresh token and we are NOT ignore refresh tokens?
+	if !r.config.EnableRefreshTokens || refreshToken == "" {
+		r.dropAccessTokenCookie(cx, token.Encode(), identity.ExpiresAt.Sub(time.Now()))
+		return nil
+	}
+
+	// step: encrypt the refresh token
+	encrypted, err := r.encryptSessionState(refreshToken)
+	if err != nil {
+		return err
 	}
 
-	r.redirectToURL(state, cx)
+	// drop in the access token - cookie expiration = access token
+	r.dropAccessTokenCookie(cx, token.Encode(), r.getAccessCookieExpiration(token, refreshToken))
+
+	switch r.useStore() {
+	case true:
+		if err := r.StoreRefreshToken(token, encrypted, r.getRefreshCookieExpiration(refreshToken)); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("failed to save the refresh token in the store")
+		}
+	default:
+		r.dropRefreshTokenCookie(cx, encrypted, r.getRefreshCookieExpiration(refreshToken))
+	}
+
+	return nil
 }
 
 // loginHandler provide's a generic endpoint for clients to perform a user_credentials login to the provider
@@ -244,14 +419,16 @@ func (r *oauthProxy) loginHandler(cx *gin.Context) {
 		}
 
 		// step: parse the token
-		_, identity, err := parseToken(token.AccessToken)
+		_, identity, err := parseToken(token.AccessToken, r.decryptionKey)
 		if err != nil {
 			return "unable to decode the access token", http.StatusNotImplemented, err
 		}
 
 		r.dropAccessTokenCookie(cx, token.AccessToken, identity.ExpiresAt.Sub(time.Now()))
+		r.dropActivityCookie(cx, identity.ID, time.Now())
+		r.stats.login(identity.ID)
 
-		cx.JSON(http.StatusOK, tokenResponse{
+		writeJSON(cx, http.StatusOK, tokenResponse{
 			IDToken:      token.IDToken,
 			AccessToken:  token.AccessToken,
 			RefreshToken: token.RefreshToken,
@@ -276,10 +453,13 @@ func (r *oauthProxy) loginHandler(cx *gin.Context) {
 //  - if it's just a access token, the cookie is deleted
 //  - if the user has a refresh token, the token is invalidated by the provider
 //  - optionally, the user can be redirected by to a url
+//  - a local logout (local=true) only clears the proxy session, leaving the provider session intact
 //
 func (r *oauthProxy) logoutHandler(cx *gin.Context) {
 	// the user can specify a url to redirect the back
 	redirectURL := cx.Request.URL.Query().Get("redirect")
+	// the user can choose to remain signed into the provider
+	localLogout, _ := strconv.ParseBool(cx.Request.URL.Query().Get("local"))
 
 	// step: drop the access token
 	user, err := r.getIdentity(cx.Request)
@@ -294,11 +474,12 @@ func (r *oauthProxy) logoutHandler(cx *gin.Context) {
 		identityToken = refresh
 	}
 	r.clearAllCookies(cx)
+	r.stats.logout(user.sessionStarted())
 
 	// step: check if the user has a state session and if so, revoke it
 	if r.useStore() {
 		go func() {
-			if err := r.DeleteRefreshToken(user.token); err != nil {
+			if err := r.deleteStoredSession(user); err != nil {
 				log.WithFields(log.Fields{
 					"error": err.Error(),
 				}).Errorf("unable to remove the refresh token from store")
@@ -307,58 +488,18 @@ func (r *oauthProxy) logoutHandler(cx *gin.Context) {
 	}
 
 	// step: get the revocation endpoint from either the idp and or the user config
-	revocationURL := defaultTo(r.config.RevocationEndpoint, r.idp.EndSessionEndpoint.String())
-
-	// step: do we have a revocation endpoint?
-	if revocationURL != "" {
-		client, err := r.client.OAuthClient()
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to retrieve the openid client")
-
-			cx.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
+	revocationURL := defaultTo(r.config.RevocationEndpoint, r.getProviderConfig().EndSessionEndpoint.String())
 
-		// step: add the authentication headers
-		// @TODO need to add the authenticated request to go-oidc
-		encodedID := url.QueryEscape(r.config.ClientID)
-		encodedSecret := url.QueryEscape(r.config.ClientSecret)
-
-		// step: construct the url for revocation
-		request, err := http.NewRequest(http.MethodPost, revocationURL,
-			bytes.NewBufferString(fmt.Sprintf("refresh_token=%s", identityToken)))
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to construct the revocation request")
-
-			cx.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-
-		// step: add the authentication headers and content-type
-		request.SetBasicAuth(encodedID, encodedSecret)
-		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-		// step: attempt to make the
-		response, err := client.HttpClient().Do(request)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to post to revocation endpoint")
-
-			return
-		}
-
-		// step: add a log for debugging
-		switch response.StatusCode {
-		case http.StatusNoContent:
-			log.WithFields(log.Fields{
-				"user": user.email,
-			}).Infof("successfully logged out of the endpoint")
-		default:
-			content, _ := ioutil.ReadAll(response.Body)
-			log.WithFields(log.Fields{
-				"status":   response.StatusCode,
-				"response": fmt.Sprintf("%s", content),
-			}).Errorf("invalid response from revocation endpoint")
-		}
+	// step: do we have a revocation endpoint? an offline token outlives the provider session, so it's
+	// always revoked
+	offline := isOfflineToken(identityToken)
+	if localLogout && !offline {
+		log.WithFields(log.Fields{
+			"user": user.email,
+		}).Infof("local logout requested, leaving the provider session intact")
+	} else if revocationURL != "" || offline {
+		// step: revoke the token in the background, rather than holding up the logout
+		r.revoker.add(identityToken, user.email)
 	}
 
 	// step: should we redirect the user
@@ -367,6 +508,15 @@ func (r *oauthProxy) logoutHandler(cx *gin.Context) {
 		return
 	}
 
+	// step: if we have a custom sign out page, lets display that
+	if r.config.hasCustomSignOutPage() {
+		model := make(map[string]string, 0)
+		model["redirect"] = r.config.withOAuthURI(authorizationURL)
+
+		r.renderPage(cx, http.StatusOK, path.Base(r.config.SignOutPage), r.getTemplateModel(model))
+		return
+	}
+
 	cx.AbortWithStatus(http.StatusOK)
 }
 
@@ -401,14 +551,179 @@ func (r *oauthProxy) tokenHandler(cx *gin.Context) {
 	}
 
 	// step: write the json content
-	cx.Writer.Header().Set("Content-Type", "application/json")
-	cx.String(http.StatusOK, fmt.Sprintf("%s", user.token.Payload))
+	writeResponse(cx, http.StatusOK, jsonContentType, user.token.Payload)
 }
 
 // healthHandler is a health check handler for the service
 func (r *oauthProxy) healthHandler(cx *gin.Context) {
 	cx.Writer.Header().Set(versionHeader, version)
-	cx.String(http.StatusOK, "OK\n")
+	writeResponse(cx, http.StatusOK, textContentType, []byte("OK\n"))
+}
+
+// versionHandler reports the build of the proxy, the endpoint is unauthenticated so the features and runtime
+// are left to the admin endpoint
+func (r *oauthProxy) versionHandler(cx *gin.Context) {
+	cx.Writer.Header().Set(versionHeader, version)
+	writeJSON(cx, http.StatusOK, gin.H{
+		"release":  release,
+		"gitsha":   gitsha,
+		"compiled": compiled,
+	})
+}
+
+// featuresHandler reports the build information and enabled features to the admins, permitting tooling to
+// inventory the deployed proxies
+func (r *oauthProxy) featuresHandler(cx *gin.Context) {
+	store := "cookie"
+	if r.useStore() {
+		if u, err := url.Parse(r.config.StoreURL); err == nil {
+			store = u.Scheme
+		}
+	}
+
+	cx.Writer.Header().Set(versionHeader, version)
+	writeJSON(cx, http.StatusOK, gin.H{
+		"release":    release,
+		"gitsha":     gitsha,
+		"compiled":   compiled,
+		"go-version": runtime.Version(),
+		"features": gin.H{
+			"store":                       store,
+			"tls":                         r.config.TLSCertificate != "",
+			"forwarding":                  r.config.EnableForwarding,
+			"refresh-tokens":              r.config.EnableRefreshTokens,
+			"login-handler":               r.config.EnableLoginHandler,
+			"backchannel-logout":          r.config.EnableBackchannelLogout,
+			"frontchannel-logout":         r.config.EnableFrontchannelLogout,
+			"metrics":                     r.config.EnableMetrics,
+			"profiling":                   r.config.EnableProfiling,
+			"proxy-protocol":              r.config.EnableProxyProtocol,
+			"fault-injection":             r.config.EnableFaultInjection,
+			"flow-capture":                r.config.EnableFlowCapture,
+			"session-stats":               r.config.EnableSessionStats,
+			"token-introspection":         r.config.EnableTokenIntrospection,
+			"uma":                         r.config.EnableUMA,
+			"token-exchange":              r.config.TokenExchangeAudience != "",
+			"device-handler":              r.config.EnableDeviceHandler,
+			"service-accounts":            r.config.EnableServiceAccounts,
+			"mobile-handlers":             len(r.config.MobileRedirectURIs) > 0,
+			"api-keys":                    r.config.EnableAPIKeys,
+			"quotas":                      r.config.DailyQuota > 0 || r.config.MonthlyQuota > 0,
+			"upstream-error-sanitization": r.config.EnableUpstreamErrorSanitization,
+			"request-timeout":             r.config.RequestTimeout.String(),
+			"max-verify-concurrency":      r.config.MaxVerifyConcurrency,
+		},
+	})
+}
+
+// backchannelLogoutHandler accepts the logout tokens posted by the provider, revoking the sessions
+// logged out; the cookies and store entries are removed on the next request of the session
+func (r *oauthProxy) backchannelLogoutHandler(cx *gin.Context) {
+	if !r.config.EnableBackchannelLogout {
+		cx.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+	cx.Writer.Header().Set("Cache-Control", "no-store")
+
+	token, err := jose.ParseJWT(cx.Request.PostFormValue("logout_token"))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to parse the logout token")
+
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	err = r.verifier.verify(cx.Request.Context(), func() error {
+		return r.verifyJWT(token)
+	})
+	if err == ErrVerificationOverloaded {
+		cx.Header("Retry-After", "1")
+		cx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("the logout token failed verification")
+
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	logout, err := parseLogoutToken(token)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("invalid logout token")
+
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if err := r.revocations.revoke(logout); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to revoke the session in the store")
+
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"session": logout.sessionID,
+		"subject": logout.subject,
+	}).Infof("session logged out by the provider")
+
+	cx.Status(http.StatusOK)
+}
+
+// frontchannelLogoutHandler is embedded by the provider in an iframe when the user signs out of the realm,
+// clearing the cookies and store entry of the browser session
+func (r *oauthProxy) frontchannelLogoutHandler(cx *gin.Context) {
+	if !r.config.EnableFrontchannelLogout {
+		cx.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+	// step: the page is framed by the provider, so we can't deny the framing
+	cx.Writer.Header().Del("X-Frame-Options")
+	provider := r.getProviderConfig()
+	if provider.Issuer != nil {
+		cx.Writer.Header().Set("Content-Security-Policy",
+			fmt.Sprintf("frame-ancestors %s://%s", provider.Issuer.Scheme, provider.Issuer.Host))
+	}
+	cx.Writer.Header().Set("Cache-Control", "no-store")
+
+	// step: the issuer and session, if given, must match those of the session
+	issuer := cx.Request.URL.Query().Get("iss")
+	if issuer != "" && (provider.Issuer == nil || issuer != provider.Issuer.String()) {
+		log.WithFields(log.Fields{"issuer": issuer}).Warnf("front-channel logout from an unknown issuer")
+
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	user, err := r.getIdentity(cx.Request)
+	if err != nil || user.isBearer() {
+		cx.Status(http.StatusOK)
+		return
+	}
+	if sid := cx.Request.URL.Query().Get("sid"); sid != "" {
+		sessionID, _, _ := user.claims.StringClaim(claimSessionID)
+		sessionState, _, _ := user.claims.StringClaim(claimSessionState)
+		if sid != sessionID && sid != sessionState {
+			log.WithFields(log.Fields{"sid": sid}).Warnf("front-channel logout for another session, ignoring")
+
+			cx.Status(http.StatusOK)
+			return
+		}
+	}
+	r.clearAllCookies(cx)
+	if r.useStore() {
+		go func() {
+			if err := r.deleteStoredSession(user); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Errorf("unable to remove the refresh token from store")
+			}
+		}()
+	}
+
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+		"user":      user.email,
+	}).Infof("session logged out via the front-channel")
+
+	cx.Status(http.StatusOK)
 }
 
 // debugHandler is responsible for providing the pprof
@@ -426,7 +741,10 @@ func (r *oauthProxy) debugHandler(cx *gin.Context) {
 		case "threadcreate":
 			pprof.Handler(name).ServeHTTP(cx.Writer, cx.Request)
 		case "cmdline":
-			pprof.Cmdline(cx.Writer, cx.Request)
+			// step: the command line may carry the secrets
+			cx.Writer.Header().Set("X-Content-Type-Options", "nosniff")
+			cx.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(cx.Writer, strings.Join(redactCommandLine(os.Args), "\x00"))
 		case "profile":
 			pprof.Profile(cx.Writer, cx.Request)
 		case "trace":
@@ -460,15 +778,234 @@ func (r *oauthProxy) metricsHandler(cx *gin.Context) {
 	r.prometheusHandler.ServeHTTP(cx.Writer, cx.Request)
 }
 
+// faultsHandler is responsible for viewing and changing the injected faults
+func (r *oauthProxy) faultsHandler(cx *gin.Context) {
+	switch cx.Request.Method {
+	case http.MethodPut:
+		var settings faultSettings
+		if err := cx.BindJSON(&settings); err != nil {
+			return
+		}
+		if err := r.faults.set(settings); err != nil {
+			cx.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+	case http.MethodDelete:
+		r.faults.set(faultSettings{})
+	}
+	settings := r.faults.get()
+
+	log.WithFields(log.Fields{
+		"delay_ms":          settings.Delay,
+		"percentage":        settings.Percentage,
+		"fail_refresh":      settings.FailRefresh,
+		"drop_store_writes": settings.DropStoreWrites,
+	}).Infof("fault injection settings")
+
+	writeJSON(cx, http.StatusOK, settings)
+}
+
+// maintenanceHandler is responsible for putting the proxy into and out of maintenance mode
+func (r *oauthProxy) maintenanceHandler(cx *gin.Context) {
+	switch cx.Request.Method {
+	case http.MethodPut:
+		var settings maintenanceSettings
+		if err := cx.BindJSON(&settings); err != nil {
+			return
+		}
+		if err := r.maintenance.set(settings); err != nil {
+			cx.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+	case http.MethodDelete:
+		r.maintenance.set(maintenanceSettings{})
+	}
+	settings := r.maintenance.get()
+
+	if cx.Request.Method != http.MethodGet {
+		log.WithFields(log.Fields{
+			"email":       cx.MustGet(userContextName).(*userContext).email,
+			"enabled":     settings.Enabled,
+			"message":     settings.Message,
+			"retry_after": settings.RetryAfter,
+		}).Warnf("the maintenance mode has been changed")
+	}
+
+	writeJSON(cx, http.StatusOK, settings)
+}
+
+// capturesHandler is responsible for listing and starting the auth flow captures
+func (r *oauthProxy) capturesHandler(cx *gin.Context) {
+	if cx.Request.Method == http.MethodPost {
+		var target captureTarget
+		if err := cx.BindJSON(&target); err != nil {
+			return
+		}
+		capture, err := r.recorder.start(target)
+		if err != nil {
+			cx.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"id":             capture.ID,
+			"user":           target.User,
+			"correlation_id": target.CorrelationID,
+		}).Infof("starting the capture of auth flows")
+
+		writeJSON(cx, http.StatusCreated, capture)
+		return
+	}
+
+	writeJSON(cx, http.StatusOK, r.recorder.list())
+}
+
+// captureHandler is responsible for retrieving and stopping a auth flow capture
+func (r *oauthProxy) captureHandler(cx *gin.Context) {
+	var capture flowCapture
+	var found bool
+	switch cx.Request.Method {
+	case http.MethodDelete:
+		capture, found = r.recorder.stop(cx.Param("id"))
+	default:
+		capture, found = r.recorder.get(cx.Param("id"))
+	}
+	if !found {
+		cx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(cx, http.StatusOK, capture)
+}
+
+// sessionsHandler is responsible for returning the session statistics
+func (r *oauthProxy) sessionsHandler(cx *gin.Context) {
+	writeJSON(cx, http.StatusOK, r.stats.hours())
+}
+
+// revokeSessionHandler revokes the session with the id, else the sessions of the subject or email, refusing the
+// access tokens issued before now and removing the refresh tokens and server side sessions from the store
+func (r *oauthProxy) revokeSessionHandler(cx *gin.Context) {
+	identity := cx.Param("id")
+	if err := r.revocations.revokeIdentity(identity, time.Now()); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to revoke the session in the store")
+
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"email":    cx.MustGet(userContextName).(*userContext).email,
+		"identity": identity,
+	}).Warnf("the session has been revoked by an admin")
+
+	cx.Status(http.StatusNoContent)
+}
+
+// activeSessionsHandler is responsible for listing the active sessions in the store
+func (r *oauthProxy) activeSessionsHandler(cx *gin.Context) {
+	sessions, err := r.actives.list(time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to list the active sessions")
+
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(cx, http.StatusOK, sessions)
+}
+
+// refreshSessionFromCookie attempts to refresh the access token using the refresh token cookie
+func (r *oauthProxy) refreshSessionFromCookie(cx *gin.Context) bool {
+	if !r.config.EnableRefreshTokens || r.useStore() {
+		return false
+	}
+	user, err := r.getIdentity(cx.Request)
+	if err != nil {
+		return false
+	}
+	encrypted, err := r.getRefreshTokenFromCookie(cx.Request)
+	if err != nil {
+		return false
+	}
+	refresh, err := r.decryptSessionState(encrypted)
+	if err != nil {
+		return false
+	}
+	token, rotated, _, err := getRefreshedToken(r.client, refresh, r.decryptionKey)
+	if err == nil && r.faults.failRefresh() {
+		err = ErrFaultInjected
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"email": user.email,
+			"error": err.Error(),
+		}).Warnf("unable to refresh the access token from the refresh cookie")
+
+		return false
+	}
+	if encrypted, err = r.encryptSessionState(rotated); err != nil {
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+		"email":     user.email,
+	}).Infof("refreshed the access token from the refresh cookie")
+	r.recordRefresh(user, cx.ClientIP(), r.getRefreshCookieExpiration(rotated))
+
+	r.dropAccessTokenCookie(cx, token.Encode(), r.getAccessCookieExpiration(token, rotated))
+	// step: the provider may have rotated the refresh token, in which case the old one is no longer usable
+	if rotated != refresh {
+		r.dropRefreshTokenCookie(cx, encrypted, r.getRefreshCookieExpiration(rotated))
+	}
+
+	return true
+}
+
+// echoHandler displays the request the upstream would receive for the current session
+func (r *oauthProxy) echoHandler(cx *gin.Context) {
+	// step: run the headers middleware against the request, as the upstream proxy would
+	r.headersMiddleware(r.config.AddClaims)(cx)
+
+	upstream := *r.endpoint
+	upstream.Path = cx.Request.URL.Path
+
+	writeJSON(cx, http.StatusOK, gin.H{
+		"method":   cx.Request.Method,
+		"upstream": upstream.String(),
+		"host":     r.endpoint.Host,
+		"headers":  cx.Request.Header,
+	})
+}
+
 // retrieveRefreshToken retrieves the refresh token from store or cookie
 func (r *oauthProxy) retrieveRefreshToken(req *http.Request, user *userContext) (string, error) {
 	var token string
 	var err error
 
+	// step: the refresh token of a server side session is held with the access token
+	if user.serverSession != "" {
+		session, err := r.getServerSession(user.serverSession)
+		if err != nil {
+			return "", err
+		}
+		if session.RefreshToken == "" {
+			return "", ErrNoSessionStateFound
+		}
+		return session.RefreshToken, nil
+	}
+
 	// step: get the refresh token from the store or cookie
 	switch r.useStore() {
 	case true:
-		token, err = r.GetRefreshToken(user.token)
+		start := time.Now()
+		err = withContext(req.Context(), func() error {
+			var err error
+			token, err = r.GetRefreshToken(user.token)
+			return err
+		})
+		getTimings(req).observe(phaseStore, start)
 	default:
 		token, err = r.getRefreshTokenFromCookie(req)
 	}
@@ -476,5 +1013,5 @@ func (r *oauthProxy) retrieveRefreshToken(req *http.Request, user *userContext)
 		return "", err
 	}
 
-	return decodeText(token, r.config.EncryptionKey)
+	return r.decryptSessionState(token)
 }
@@ -19,9 +19,12 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/coreos/go-oidc/jose"
 	"github.com/go-resty/resty"
 	"github.com/stretchr/testify/assert"
 )
@@ -214,6 +217,11 @@ func TestTokenHandler(t *testing.T) {
 		resp, err := client.R().Get(requrl)
 		assert.NoError(t, err)
 		assert.Equal(t, c.Expected, resp.StatusCode())
+		if c.Expected == http.StatusOK {
+			assert.Equal(t, jsonContentType, resp.Header().Get("Content-Type"))
+			assert.Equal(t, "nosniff", resp.Header().Get("X-Content-Type-Options"))
+			assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+		}
 	}
 }
 
@@ -263,7 +271,11 @@ func TestAuthorizationURL(t *testing.T) {
 		},
 		{
 			URL:          "/admin/../",
-			ExpectedURL:  "/oauth/authorize?state=L2FkbWluLy4uLw==",
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			URL:          "//admin",
+			ExpectedURL:  "/oauth/authorize?state=L2FkbWlu",
 			ExpectedCode: http.StatusTemporaryRedirect,
 		},
 		{
@@ -313,6 +325,7 @@ func TestCallbackURL(t *testing.T) {
 		if !assert.NotEmpty(t, openIDURL, "case %d, the open id redirection url is empty", i) {
 			continue
 		}
+		cookies := resp.Cookies()
 		req, _ = http.NewRequest("GET", openIDURL, nil)
 		resp, err = http.DefaultTransport.RoundTrip(req)
 		if !assert.NoError(t, err, "case %d, should not have failed calling the opend id url", i) {
@@ -322,8 +335,11 @@ func TestCallbackURL(t *testing.T) {
 		if !assert.NotEmpty(t, callbackURL, "case %d, should have received a callback url", i) {
 			continue
 		}
-		// step: call the callback url
+		// step: call the callback url with the nonce cookie
 		req, _ = http.NewRequest("GET", callbackURL, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
 		resp, err = http.DefaultTransport.RoundTrip(req)
 		if !assert.NoError(t, err, "case %d, unable to call the callback url", i) {
 			continue
@@ -333,10 +349,358 @@ func TestCallbackURL(t *testing.T) {
 	}
 }
 
+func TestCallbackNonce(t *testing.T) {
+	_, _, u := newTestProxyService(nil)
+
+	cs := []struct {
+		Cookie       *http.Cookie
+		ExpectedCode int
+	}{
+		{
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			Cookie:       &http.Cookie{Name: "kc-access-nonce", Value: "bad"},
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+	for i, x := range cs {
+		req, _ := http.NewRequest("GET", u+oauthURL+authorizationURL, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		var nonce *http.Cookie
+		for _, c := range resp.Cookies() {
+			if c.Name == "kc-access-nonce" {
+				nonce = c
+			}
+		}
+		if !assert.NotNil(t, nonce, "case %d, no nonce cookie", i) {
+			continue
+		}
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, hashNonce(nonce.Value), location.Query().Get("nonce"), "case %d", i)
+
+		req, _ = http.NewRequest("GET", location.String(), nil)
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		req, _ = http.NewRequest("GET", resp.Header.Get("Location"), nil)
+		if x.Cookie != nil {
+			req.AddCookie(x.Cookie)
+		}
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, x.ExpectedCode, resp.StatusCode, "case %d", i)
+	}
+}
+
 func TestHealthHandler(t *testing.T) {
 	svc := newTestService()
 	resp, err := resty.DefaultClient.R().Get(svc + oauthURL + healthURL)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode())
 	assert.Equal(t, version, resp.Header().Get(versionHeader))
+	assert.Equal(t, textContentType, resp.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", resp.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+}
+
+func TestVersionHandler(t *testing.T) {
+	svc := newTestService()
+	var info map[string]interface{}
+	resp, err := resty.DefaultClient.R().SetResult(&info).Get(svc + oauthURL + versionURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, release, info["release"])
+	assert.NotContains(t, info, "go-version")
+	assert.NotContains(t, info, "features")
+}
+
+func TestFeaturesHandler(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.AdminRoles = []string{fakeAdminRole}
+	_, idp, svc := newTestProxyService(config)
+	requrl := svc + oauthURL + adminURL + featuresURL
+
+	resp, err := resty.New().R().Get(requrl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	token := newTestToken(idp.getLocation())
+	token.setRealmsRoles([]string{fakeTestRole})
+	signed, _ := idp.signToken(token.claims)
+	resp, err = resty.New().SetAuthToken(signed.Encode()).R().Get(requrl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	token.setRealmsRoles([]string{fakeAdminRole})
+	signed, _ = idp.signToken(token.claims)
+	var info struct {
+		Release   string                 `json:"release"`
+		GoVersion string                 `json:"go-version"`
+		Features  map[string]interface{} `json:"features"`
+	}
+	resp, err = resty.New().SetAuthToken(signed.Encode()).R().SetResult(&info).Get(requrl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, release, info.Release)
+	assert.Equal(t, runtime.Version(), info.GoVersion)
+	assert.Equal(t, "cookie", info.Features["store"])
+	assert.Equal(t, false, info.Features["forwarding"])
+}
+
+func TestFaultsHandler(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableFaultInjection = true
+	config.AdminRoles = []string{fakeAdminRole}
+	p, idp, svc := newTestProxyService(config)
+	requrl := svc + oauthURL + adminURL + faultsURL
+
+	resp, err := resty.New().R().Get(requrl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	token := newTestToken(idp.getLocation())
+	token.setRealmsRoles([]string{fakeTestRole})
+	signed, _ := idp.signToken(token.claims)
+	resp, err = resty.New().SetAuthToken(signed.Encode()).R().Get(requrl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	token.setRealmsRoles([]string{fakeAdminRole})
+	signed, _ = idp.signToken(token.claims)
+	client := resty.New().SetAuthToken(signed.Encode())
+	resp, err = client.R().SetBody(`{"percentage": 200}`).Put(requrl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+	resp, err = client.R().SetBody(`{"fail-refresh": true, "drop-store-writes": true}`).Put(requrl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.True(t, p.faults.failRefresh())
+	assert.True(t, p.faults.dropStoreWrites())
+
+	resp, err = client.R().Delete(requrl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.False(t, p.faults.failRefresh())
+}
+
+func TestLogoutHandlerLocal(t *testing.T) {
+	p, _, u := newTestProxyService(nil)
+	// step: point the revocation at a dead endpoint, a local logout should never call it
+	p.config.RevocationEndpoint = "http://127.0.0.1:1/revoke"
+	token, err := makeTestOauthLogin(u + "/admin")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	client := resty.New().SetRedirectPolicy(resty.NoRedirectPolicy()).SetAuthToken(token)
+
+	resp, _ := client.R().Get(u + oauthURL + logoutURL + "?local=true&redirect=/signed-out")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	assert.Equal(t, "/signed-out", resp.Header().Get("Location"))
+
+	// step: the revocation happens in the background, so the logout no longer fails on it
+	resp, _ = client.R().Get(u + oauthURL + logoutURL + "?redirect=/signed-out")
+	assert.Equal(t, "/signed-out", resp.Header().Get("Location"))
+}
+
+func TestLogoutHandlerSignOutPage(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.SignOutPage = "templates/sign_out.html.tmpl"
+	u := newTestServiceWithConfig(config)
+	token, err := makeTestOauthLogin(u + "/admin")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	resp, err := resty.New().SetAuthToken(token).R().Get(u + oauthURL + logoutURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Contains(t, string(resp.Body()), "You have been signed out")
+	assert.Contains(t, string(resp.Body()), oauthURL+authorizationURL)
+}
+
+func TestAccountHandler(t *testing.T) {
+	_, idp, u := newTestProxyService(nil)
+	client := resty.New().SetRedirectPolicy(resty.NoRedirectPolicy())
+
+	resp, _ := client.R().Get(u + oauthURL + accountURL + "?redirect=/admin")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	location := resp.Header().Get("Location")
+	assert.True(t, strings.HasPrefix(location, idp.getLocation()+"/account?"), "location: %s", location)
+	assert.Contains(t, location, "referrer="+fakeClientID)
+	assert.Contains(t, location, "referrer_uri="+url.QueryEscape(u+"/admin"))
+}
+
+func TestRequiredActionHandler(t *testing.T) {
+	p, _, u := newTestProxyService(nil)
+	client := resty.New().SetRedirectPolicy(resty.NoRedirectPolicy())
+
+	resp, _ := client.R().Get(u + oauthURL + passwordURL + "?redirect=/admin")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	assert.Contains(t, resp.Header().Get("Location"), "kc_action=UPDATE_PASSWORD")
+	assert.Equal(t, "/admin", getTestStateRedirect(p, resp.RawResponse))
+
+	resp, _ = client.R().Get(u + oauthURL + totpURL)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	assert.Contains(t, resp.Header().Get("Location"), "kc_action=CONFIGURE_TOTP")
+}
+
+func TestReauthenticateHandler(t *testing.T) {
+	p, _, u := newTestProxyService(nil)
+	p.config.AuthRequestParams = map[string]string{"kc_idp_hint": "google"}
+	client := resty.New().SetRedirectPolicy(resty.NoRedirectPolicy())
+
+	resp, _ := client.R().Get(u + oauthURL + reauthURL + "?redirect=/admin")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	location := resp.Header().Get("Location")
+	assert.Contains(t, location, "prompt=login")
+	assert.Contains(t, location, "max_age=0")
+	assert.Contains(t, location, "kc_idp_hint=google")
+	assert.Equal(t, "/admin", getTestStateRedirect(p, resp.RawResponse))
+}
+
+func TestEchoHandler(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.AdminRoles = []string{fakeAdminRole}
+	config.Headers = map[string]string{"X-Custom": "value"}
+	_, idp, svc := newTestProxyService(config)
+
+	token := newTestToken(idp.getLocation())
+	token.setRealmsRoles([]string{fakeAdminRole})
+	signed, _ := idp.signToken(token.claims)
+
+	var echo struct {
+		Upstream string              `json:"upstream"`
+		Headers  map[string][]string `json:"headers"`
+	}
+	resp, err := resty.New().SetAuthToken(signed.Encode()).R().SetResult(&echo).Get(svc + oauthURL + adminURL + echoURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, []string{"value"}, echo.Headers["X-Custom"])
+	assert.Equal(t, []string{"rjayawardene"}, echo.Headers["X-Auth-Username"])
+	assert.Equal(t, []string{fakeAdminRole}, echo.Headers["X-Auth-Roles"])
+}
+
+func TestGetRedirectionURL(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	cs := []struct {
+		Host     string
+		URL      string
+		Hosts    []string
+		Expected string
+	}{
+		{
+			Host:     "127.0.0.1",
+			Expected: "http://127.0.0.1/oauth/callback",
+		},
+		{
+			Host:     "127.0.0.1",
+			URL:      "https://app.example.com",
+			Expected: "https://app.example.com/oauth/callback",
+		},
+		{
+			Host:     "other.example.com",
+			URL:      "https://app.example.com",
+			Hosts:    []string{"app.example.com", "other.example.com"},
+			Expected: "http://other.example.com/oauth/callback",
+		},
+		{
+			Host:     "evil.com",
+			URL:      "https://app.example.com",
+			Hosts:    []string{"app.example.com", "other.example.com"},
+			Expected: "https://app.example.com/oauth/callback",
+		},
+		{
+			Host:     "evil.com",
+			Hosts:    []string{"app.example.com"},
+			Expected: "http://app.example.com/oauth/callback",
+		},
+	}
+	for i, c := range cs {
+		p.config.RedirectionURL = c.URL
+		p.config.RedirectionHosts = c.Hosts
+		cx := newFakeGinContext("GET", "/admin")
+		cx.Request.Host = c.Host
+		assert.Equal(t, c.Expected, p.getRedirectionURL(cx), "case %d", i)
+	}
+}
+
+// getTestStateRedirect returns the redirect held in the state cookie of the authorization response
+func getTestStateRedirect(p *oauthProxy, resp *http.Response) string {
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return ""
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/?state="+location.Query().Get("state"), nil)
+	for _, c := range resp.Cookies() {
+		req.AddCookie(c)
+	}
+	state, redirect, err := p.getStateCookie(req)
+	if err != nil || state != location.Query().Get("state") {
+		return ""
+	}
+
+	return redirect
+}
+
+func TestOfflineSessionCookies(t *testing.T) {
+	p, idp, _ := newTestProxyService(nil)
+	p.config.EnableRefreshTokens = true
+	access, _ := idp.signToken(newTestToken(idp.getLocation()).claims)
+	_, identity, _ := parseToken(access.Encode(), nil)
+	offline, _ := idp.signToken(jose.Claims{"typ": "Offline", "sub": "1e11e539-8256-4b3b-bda8-cc0d56cddb48"})
+
+	cs := []struct {
+		Duration time.Duration
+		Expires  bool
+	}{
+		{Duration: 0},
+		{Duration: 720 * time.Hour, Expires: true},
+	}
+	for i, c := range cs {
+		p.config.OfflineSessionDuration = c.Duration
+		context := newFakeGinContext("GET", "/oauth/callback")
+		if !assert.NoError(t, p.dropSessionCookies(context, *access, identity, offline.Encode()), "case %d", i) {
+			continue
+		}
+		cookies := context.Writer.Header()["Set-Cookie"]
+		if !assert.Len(t, cookies, 2, "case %d", i) {
+			continue
+		}
+		for _, x := range cookies {
+			assert.Equal(t, c.Expires, strings.Contains(x, "Expires="), "case %d, cookie: %s", i, x)
+		}
+	}
+}
+
+func TestLogoutHandlerOfflineToken(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	_, idp, u := newTestProxyService(cfg)
+	access, _ := idp.signToken(newTestToken(idp.getLocation()).claims)
+	offline, _ := idp.signToken(jose.Claims{"typ": "Offline", "sub": "1e11e539-8256-4b3b-bda8-cc0d56cddb48"})
+	encrypted, _ := encodeText(offline.Encode(), cfg.EncryptionKey.Value(), "")
+
+	// step: even a local logout revokes the offline token
+	resp, err := resty.New().SetRedirectPolicy(resty.NoRedirectPolicy()).SetAuthToken(access.Encode()).
+		SetCookie(&http.Cookie{Name: cfg.CookieRefreshName, Value: encrypted}).R().
+		Get(u + oauthURL + logoutURL + "?local=true")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	for i := 0; i < 100 && len(idp.getRevoked()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{offline.Encode()}, idp.getRevoked())
 }
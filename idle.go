@@ -0,0 +1,89 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idleActivityResolution is the fraction of the idle timeout the activity cookie may lag behind the requests,
+// saving a Set-Cookie on every request
+const idleActivityResolution = 10
+
+// getActivityCookieName returns the name of the cookie holding the last activity of the session
+func (r *oauthProxy) getActivityCookieName(req *http.Request) string {
+	name, _ := r.config.getCookieNames(r.getSessionName(req))
+
+	return name + "-activity"
+}
+
+// dropActivityCookie records the activity of the session in a cookie signed and bound to the user. The cookie
+// expires with the idle timeout, so the browser drops it from an idle session
+func (r *oauthProxy) dropActivityCookie(cx *gin.Context, id string, now time.Time) {
+	if r.config.SessionIdleTimeout <= 0 {
+		return
+	}
+	value := r.signState(strconv.FormatInt(now.Unix(), 10), id)
+
+	r.dropCookie(cx, r.getActivityCookieName(cx.Request), value, r.config.SessionIdleTimeout)
+}
+
+// clearActivityCookie clears the activity cookie of the session
+func (r *oauthProxy) clearActivityCookie(cx *gin.Context) {
+	if r.config.SessionIdleTimeout <= 0 {
+		return
+	}
+	r.dropCookie(cx, r.getActivityCookieName(cx.Request), "", time.Duration(-10*time.Hour))
+}
+
+// getLastActivity returns the last activity of the session recorded in the activity cookie
+func (r *oauthProxy) getLastActivity(req *http.Request, id string) (time.Time, error) {
+	value, owner, err := r.getSignedStateCookie(req, r.getActivityCookieName(req))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if owner != id {
+		return time.Time{}, errors.New("the activity cookie belongs to another user")
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(seconds, 0), nil
+}
+
+// isIdleSession checks if the session has been idle longer than the idle timeout, else records the activity
+func (r *oauthProxy) isIdleSession(cx *gin.Context, user *userContext) bool {
+	if r.config.SessionIdleTimeout <= 0 || user.isBearer() {
+		return false
+	}
+	now := time.Now()
+	last, err := r.getLastActivity(cx.Request, user.id)
+	if err != nil || now.Sub(last) > r.config.SessionIdleTimeout {
+		return true
+	}
+	if now.Sub(last) > r.config.SessionIdleTimeout/idleActivityResolution {
+		r.dropActivityCookie(cx, user.id, now)
+	}
+
+	return false
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionIdleTimeoutLogin(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.SessionIdleTimeout = time.Hour
+	px, _, svc := newTestProxyService(cfg)
+	resp, err := makeTestCodeFlowLogin(svc + fakeAuthAllURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var found bool
+	for _, x := range resp.Cookies() {
+		if x.Name == px.config.CookieAccessName+"-activity" {
+			found = true
+			assert.NotEmpty(t, x.Value)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), x.Expires, time.Minute)
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.SessionIdleTimeout = time.Hour
+	px, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	access, _ := idp.signToken(token.claims)
+	user, _, _ := token.claims.StringClaim("sub")
+	activity := px.config.CookieAccessName + "-activity"
+	signed := func(at time.Time, id string) string {
+		return px.signState(strconv.FormatInt(at.Unix(), 10), id)
+	}
+
+	cases := []struct {
+		Activity string
+		Status   int
+		Touched  bool
+	}{
+		{Status: http.StatusTemporaryRedirect},
+		{Activity: "junk", Status: http.StatusTemporaryRedirect},
+		{Activity: signed(time.Now(), user), Status: http.StatusOK},
+		{Activity: signed(time.Now().Add(-30*time.Minute), user), Status: http.StatusOK, Touched: true},
+		{Activity: signed(time.Now().Add(-2*time.Hour), user), Status: http.StatusTemporaryRedirect},
+		{Activity: signed(time.Now(), "another"), Status: http.StatusTemporaryRedirect},
+	}
+	for i, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL, nil)
+		req.AddCookie(&http.Cookie{Name: px.config.CookieAccessName, Value: access.Encode()})
+		if c.Activity != "" {
+			req.AddCookie(&http.Cookie{Name: activity, Value: c.Activity})
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.Status, resp.StatusCode, "case %d", i)
+		// step: the user has to sign in again, rather than being handed back the session of the provider
+		if c.Status == http.StatusTemporaryRedirect {
+			assert.Contains(t, resp.Header.Get("Location"), "prompt=login", "case %d", i)
+		}
+		var touched bool
+		for _, x := range resp.Cookies() {
+			if x.Name == activity && x.Value != "" {
+				touched = true
+			}
+		}
+		assert.Equal(t, c.Touched, touched, "case %d", i)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// withInternalConnection adds the connection to the request context, marking it as read from the internal listener
+func withInternalConnection(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(withConnection(ctx, conn), internalContextKey, true)
+}
+
+// isInternalRequest checks if the request was received on the internal listener
+func isInternalRequest(req *http.Request) bool {
+	internal, _ := req.Context().Value(internalContextKey).(bool)
+
+	return internal
+}
+
+// isInternalPath checks if the path is one only reachable via the internal listener, the comparison ignores the
+// case as some upstreams do
+func (r *oauthProxy) isInternalPath(path string) bool {
+	for _, x := range r.config.InternalPaths {
+		if isPathWithin(strings.ToLower(path), strings.ToLower(x)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// internalPathsMiddleware hides the internal paths on the public listeners, whatever the authentication
+func (r *oauthProxy) internalPathsMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if isInternalRequest(cx.Request) || !r.isInternalPath(cx.Request.URL.Path) {
+			return
+		}
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"path":      cx.Request.URL.Path,
+		}).Warnf("blocked a request for an internal path on the public listener")
+
+		cx.AbortWithStatus(http.StatusNotFound)
+	}
+}
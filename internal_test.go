@@ -0,0 +1,65 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInternalPaths(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.ListenAdmin = "127.0.0.1:0"
+	cfg.InternalPaths = []string{fakeTestWhitelistedURL + "/internal", fakeAuthAllURL + "/internal"}
+	px, idp, svc := newTestProxyService(cfg)
+	internal := httptest.NewUnstartedServer(px.router)
+	internal.Config.ConnContext = withInternalConnection
+	internal.Start()
+	defer internal.Close()
+	token, _ := idp.signToken(newTestToken(idp.getLocation()).claims)
+
+	cs := []struct {
+		Location string
+		Path     string
+		Token    bool
+		Expected int
+	}{
+		{Location: svc, Path: fakeTestWhitelistedURL, Expected: http.StatusOK},
+		{Location: svc, Path: fakeTestWhitelistedURL + "/internal/metrics", Expected: http.StatusNotFound},
+		{Location: svc, Path: fakeTestWhitelistedURL + "/Internal/metrics", Expected: http.StatusNotFound},
+		{Location: svc, Path: fakeTestWhitelistedURL + "//internal/../internal/metrics", Expected: http.StatusNotFound},
+		{Location: svc, Path: fakeTestWhitelistedURL + "/internals", Expected: http.StatusOK},
+		{Location: svc, Path: fakeAuthAllURL + "/internal", Token: true, Expected: http.StatusNotFound},
+		{Location: internal.URL, Path: fakeTestWhitelistedURL + "/internal/metrics", Expected: http.StatusOK},
+		{Location: internal.URL, Path: fakeAuthAllURL + "/internal", Token: true, Expected: http.StatusOK},
+		{Location: internal.URL, Path: fakeAuthAllURL + "/internal", Expected: http.StatusTemporaryRedirect},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest(http.MethodGet, c.Location+c.Path, nil)
+		if c.Token {
+			req.Header.Set(authorizationHeader, "Bearer "+token.Encode())
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.Expected, resp.StatusCode, "case %d", i)
+	}
+}
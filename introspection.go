@@ -0,0 +1,195 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// introspectionCacheSweep is the number of cached results above which the expired ones are removed
+	introspectionCacheSweep = 10000
+)
+
+// introspectionResult is the cached result of an introspection
+type introspectionResult struct {
+	// the claims of the token, nil when the token is inactive
+	claims jose.Claims
+	// the time the result expires from the cache
+	expires time.Time
+}
+
+// tokenIntrospector validates the access tokens at the introspection endpoint of the provider, RFC 7662,
+// caching the results; it's safe to use from multiple goroutines
+type tokenIntrospector struct {
+	sync.RWMutex
+	// the results keyed by the hash of the token
+	cache map[[sha256.Size]byte]*introspectionResult
+	// the duration a result is cached
+	ttl time.Duration
+	// calls the introspection endpoint
+	introspect func(token string) (jose.Claims, error)
+	// the introspections partitioned by result
+	total *prometheus.CounterVec
+}
+
+// newTokenIntrospector creates the introspector and registers the metrics
+func newTokenIntrospector(ttl time.Duration, introspect func(string) (jose.Claims, error)) *tokenIntrospector {
+	total := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "token_introspections_total",
+			Help: "The access token introspections partitioned by result",
+		},
+		[]string{"result"},
+	)
+
+	return &tokenIntrospector{
+		cache:      make(map[[sha256.Size]byte]*introspectionResult),
+		ttl:        ttl,
+		introspect: introspect,
+		total:      prometheus.MustRegisterOrGet(total).(*prometheus.CounterVec),
+	}
+}
+
+// getClaims returns the claims of the token if active at the provider, else nil
+func (r *tokenIntrospector) getClaims(token string) (jose.Claims, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	r.RLock()
+	result, found := r.cache[key]
+	r.RUnlock()
+	if found && now.Before(result.expires) {
+		r.total.WithLabelValues("cached").Inc()
+		return result.claims, nil
+	}
+
+	claims, err := r.introspect(token)
+	if err != nil {
+		r.total.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	result = &introspectionResult{claims: claims, expires: now.Add(r.ttl)}
+	if claims == nil {
+		r.total.WithLabelValues("inactive").Inc()
+	} else {
+		r.total.WithLabelValues("active").Inc()
+		// step: never cache the result beyond the expiration of the token
+		if expires, found, err := claims.TimeClaim("exp"); err == nil && found && expires.Before(result.expires) {
+			result.expires = expires
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.cache[key] = result
+	if len(r.cache) > introspectionCacheSweep {
+		for k, v := range r.cache {
+			if now.After(v.expires) {
+				delete(r.cache, k)
+			}
+		}
+	}
+
+	return claims, nil
+}
+
+// isActive checks the token is active at the provider
+func (r *tokenIntrospector) isActive(token string) (bool, error) {
+	claims, err := r.getClaims(token)
+	if err != nil {
+		return false, err
+	}
+
+	return claims != nil, nil
+}
+
+// verifyActive checks the access token of the user is still active at the provider, when enabled
+func (r *oauthProxy) verifyActive(user *userContext) error {
+	if r.introspector == nil {
+		return nil
+	}
+	// step: the provider knows nothing of the tokens of the trusted issuers
+	if _, keys := r.getTrustedIssuer(user.claims); keys != nil {
+		return nil
+	}
+	active, err := r.introspector.isActive(user.token.Encode())
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrTokenInactive
+	}
+
+	return nil
+}
+
+// introspectToken calls the introspection endpoint, returning the claims of an active token, else nil
+func (r *oauthProxy) introspectToken(token string) (jose.Claims, error) {
+	values := url.Values{}
+	values.Set("token", token)
+	values.Set("token_type_hint", "access_token")
+
+	request, err := http.NewRequest(http.MethodPost, r.getIntrospectionURL(), strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.SetBasicAuth(url.QueryEscape(r.config.ClientID), url.QueryEscape(r.config.ClientSecret.Value()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := r.idpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid response from introspection endpoint, status: %d, response: %s", response.StatusCode, content)
+	}
+
+	var claims jose.Claims
+	if err := json.Unmarshal(content, &claims); err != nil {
+		return nil, err
+	}
+	if active, ok := claims["active"].(bool); !ok || !active {
+		return nil, nil
+	}
+
+	return claims, nil
+}
+
+// getIntrospectionURL returns the introspection endpoint, defaulting to the token endpoint layout of keycloak
+func (r *oauthProxy) getIntrospectionURL() string {
+	if r.config.IntrospectionURL != "" {
+		return r.config.IntrospectionURL
+	}
+
+	return strings.TrimSuffix(r.getProviderConfig().TokenEndpoint.String(), "/") + "/introspect"
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenIntrospectorCache(t *testing.T) {
+	calls := 0
+	introspector := newTokenIntrospector(time.Hour, func(token string) (jose.Claims, error) {
+		calls++
+		switch token {
+		case "active":
+			return jose.Claims{"sub": "test", "exp": float64(time.Now().Add(time.Hour).Unix())}, nil
+		case "expiring":
+			return jose.Claims{"sub": "test", "exp": float64(time.Now().Add(-time.Second).Unix())}, nil
+		case "error":
+			return nil, errors.New("provider down")
+		}
+		return nil, nil
+	})
+
+	active, err := introspector.isActive("active")
+	assert.NoError(t, err)
+	assert.True(t, active)
+	active, err = introspector.isActive("active")
+	assert.NoError(t, err)
+	assert.True(t, active)
+	assert.Equal(t, 1, calls, "the result should have been cached")
+
+	active, err = introspector.isActive("inactive")
+	assert.NoError(t, err)
+	assert.False(t, active)
+	introspector.isActive("inactive")
+	assert.Equal(t, 2, calls, "the inactive result should have been cached")
+
+	// step: the result is never cached beyond the expiration of the token
+	introspector.isActive("expiring")
+	introspector.isActive("expiring")
+	assert.Equal(t, 4, calls)
+
+	// step: the errors are not cached
+	_, err = introspector.isActive("error")
+	assert.Error(t, err)
+	introspector.isActive("error")
+	assert.Equal(t, 6, calls)
+}
+
+func TestTokenIntrospection(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableTokenIntrospection = true
+	cfg.IntrospectionCacheTTL = time.Minute
+	cfg.NoRedirects = true
+	_, idp, svc := newTestProxyService(cfg)
+
+	token := newTestToken(idp.getLocation())
+	signed, err := idp.signToken(token.claims)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	resp, err := resty.New().SetAuthToken(signed.Encode()).R().Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, 1, idp.getIntrospections())
+
+	// step: the session is revoked at the provider, but the cached result is still used
+	idp.setIntrospection(signed.Encode(), nil)
+	resp, err = resty.New().SetAuthToken(signed.Encode()).R().Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, 1, idp.getIntrospections())
+}
+
+func TestTokenIntrospectionRevoked(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableTokenIntrospection = true
+	cfg.NoRedirects = true
+	_, idp, svc := newTestProxyService(cfg)
+
+	token := newTestToken(idp.getLocation())
+	signed, err := idp.signToken(token.claims)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	idp.setIntrospection(signed.Encode(), nil)
+
+	resp, err := resty.New().SetAuthToken(signed.Encode()).R().Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+}
+
+func TestTokenIntrospectionOpaque(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableTokenIntrospection = true
+	cfg.NoRedirects = true
+	_, idp, svc := newTestProxyService(cfg)
+
+	claims := jose.Claims{}
+	for k, v := range newTestToken(idp.getLocation()).claims {
+		claims[k] = v
+	}
+	idp.setIntrospection("opaque-active", claims)
+	idp.setIntrospection("opaque-inactive", nil)
+
+	cs := []struct {
+		Token        string
+		ExpectedCode int
+	}{
+		{Token: "opaque-active", ExpectedCode: http.StatusOK},
+		{Token: "opaque-inactive", ExpectedCode: http.StatusUnauthorized},
+		{Token: "opaque-unknown", ExpectedCode: http.StatusUnauthorized},
+	}
+	for i, c := range cs {
+		resp, err := resty.New().SetAuthToken(c.Token).R().Get(svc + fakeAuthAllURL)
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode(), "case %d", i)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	// errEncryptedToken indicates an encrypted token when we have no key to decrypt it
+	errEncryptedToken = errors.New("the token is encrypted and no decryption key has been configured")
+	// errDecryptToken indicates the encrypted token could not be decrypted
+	errDecryptToken = errors.New("unable to decrypt the token")
+)
+
+// contentEncryptions are the content encryption algorithms of the encrypted tokens, by the size of the key
+var contentEncryptions = map[string]struct {
+	// the size of the content encryption key
+	size int
+	// the hash of the hmac, nil for aes-gcm
+	hash func() hash.Hash
+}{
+	"A128GCM":       {size: 16},
+	"A192GCM":       {size: 24},
+	"A256GCM":       {size: 32},
+	"A128CBC-HS256": {size: 32, hash: sha256.New},
+	"A192CBC-HS384": {size: 48, hash: sha512.New384},
+	"A256CBC-HS512": {size: 64, hash: sha512.New},
+}
+
+// loadDecryptionKey reads the pem encoded rsa private key, pkcs1 or pkcs8, the tokens are decrypted with
+func loadDecryptionKey(filename string) (*rsa.PrivateKey, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("the decryption key %s is not pem encoded", filename)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the decryption key %s is not a rsa private key", filename)
+	}
+
+	return key, nil
+}
+
+// decryptToken returns the signed token nested in a compact encrypted token, rfc 7516, or the token as is
+// when it isn't encrypted
+func decryptToken(token string, key *rsa.PrivateKey) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return token, nil
+	}
+	if key == nil {
+		return "", errEncryptedToken
+	}
+	var decoded [5][]byte
+	for i, x := range parts {
+		content, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(x, "="))
+		if err != nil {
+			return "", errDecryptToken
+		}
+		decoded[i] = content
+	}
+	var header struct {
+		Algorithm  string `json:"alg"`
+		Encryption string `json:"enc"`
+		Zip        string `json:"zip"`
+	}
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		return "", errDecryptToken
+	}
+	encryption, found := contentEncryptions[header.Encryption]
+	if !found || header.Zip != "" {
+		return "", fmt.Errorf("unsupported token encryption: %s", header.Encryption)
+	}
+
+	// step: decrypt the content encryption key
+	var cek []byte
+	var err error
+	switch header.Algorithm {
+	case "RSA-OAEP":
+		cek, err = rsa.DecryptOAEP(sha1.New(), nil, key, decoded[1], nil)
+	case "RSA-OAEP-256":
+		cek, err = rsa.DecryptOAEP(sha256.New(), nil, key, decoded[1], nil)
+	case "RSA1_5":
+		// step: a random key on a padding error, so the failure is only seen in the content, rfc 7516 11.5
+		cek = make([]byte, encryption.size)
+		if _, err = rand.Read(cek); err == nil {
+			err = rsa.DecryptPKCS1v15SessionKey(nil, key, decoded[1], cek)
+		}
+	default:
+		return "", fmt.Errorf("unsupported token key encryption: %s", header.Algorithm)
+	}
+	if err != nil || len(cek) != encryption.size {
+		return "", errDecryptToken
+	}
+
+	// step: the additional authenticated data is the encoded header
+	aad := []byte(parts[0])
+	iv, ciphertext, tag := decoded[2], decoded[3], decoded[4]
+	var plaintext []byte
+	if encryption.hash == nil {
+		plaintext, err = decryptGCM(cek, aad, iv, ciphertext, tag)
+	} else {
+		plaintext, err = decryptCBCHMAC(encryption.hash, cek, aad, iv, ciphertext, tag)
+	}
+	if err != nil {
+		return "", errDecryptToken
+	}
+	if len(strings.Split(string(plaintext), ".")) != 3 {
+		return "", errors.New("the encrypted token does not contain a signed token")
+	}
+
+	return string(plaintext), nil
+}
+
+// decryptGCM decrypts and authenticates the content with aes-gcm
+func decryptGCM(key, aad, iv, ciphertext, tag []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != gcm.NonceSize() || len(tag) != gcm.Overhead() {
+		return nil, errDecryptToken
+	}
+
+	return gcm.Open(nil, iv, append(append([]byte{}, ciphertext...), tag...), aad)
+}
+
+// decryptCBCHMAC authenticates the content with the hmac and decrypts it with aes-cbc, rfc 7518 5.2
+func decryptCBCHMAC(h func() hash.Hash, key, aad, iv, ciphertext, tag []byte) ([]byte, error) {
+	macKey, encKey := key[:len(key)/2], key[len(key)/2:]
+	al := make([]byte, 8)
+	binary.BigEndian.PutUint64(al, uint64(len(aad))*8)
+
+	mac := hmac.New(h, macKey)
+	mac.Write(aad)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	mac.Write(al)
+	expected := mac.Sum(nil)[:len(macKey)]
+	if subtle.ConstantTimeCompare(expected, tag) != 1 {
+		return nil, errDecryptToken
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize || len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errDecryptToken
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	// step: remove the pkcs7 padding
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errDecryptToken
+	}
+	for _, x := range plaintext[len(plaintext)-padding:] {
+		if int(x) != padding {
+			return nil, errDecryptToken
+		}
+	}
+
+	return plaintext[:len(plaintext)-padding], nil
+}
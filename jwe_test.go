@@ -0,0 +1,170 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encryptToken wraps the token in a compact jwe for the public key
+func encryptToken(token, alg, enc string, key *rsa.PublicKey) (string, error) {
+	encryption := contentEncryptions[enc]
+	cek := make([]byte, encryption.size)
+	rand.Read(cek)
+	var ek []byte
+	var err error
+	switch alg {
+	case "RSA-OAEP":
+		ek, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, key, cek, nil)
+	case "RSA-OAEP-256":
+		ek, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, key, cek, nil)
+	default:
+		ek, err = rsa.EncryptPKCS1v15(rand.Reader, key, cek)
+	}
+	if err != nil {
+		return "", err
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	header := encode([]byte(fmt.Sprintf(`{"alg":"%s","enc":"%s","cty":"JWT"}`, alg, enc)))
+
+	var iv, ciphertext, tag []byte
+	if encryption.hash == nil {
+		block, _ := aes.NewCipher(cek)
+		gcm, _ := cipher.NewGCM(block)
+		iv = make([]byte, gcm.NonceSize())
+		rand.Read(iv)
+		sealed := gcm.Seal(nil, iv, []byte(token), []byte(header))
+		ciphertext, tag = sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+	} else {
+		macKey, encKey := cek[:len(cek)/2], cek[len(cek)/2:]
+		padding := aes.BlockSize - len(token)%aes.BlockSize
+		plaintext := append([]byte(token), []byte(strings.Repeat(string(rune(padding)), padding))...)
+		iv = make([]byte, aes.BlockSize)
+		rand.Read(iv)
+		block, _ := aes.NewCipher(encKey)
+		ciphertext = make([]byte, len(plaintext))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+		al := make([]byte, 8)
+		binary.BigEndian.PutUint64(al, uint64(len(header))*8)
+		mac := hmac.New(encryption.hash, macKey)
+		mac.Write([]byte(header))
+		mac.Write(iv)
+		mac.Write(ciphertext)
+		mac.Write(al)
+		tag = mac.Sum(nil)[:len(macKey)]
+	}
+
+	return strings.Join([]string{header, encode(ek), encode(iv), encode(ciphertext), encode(tag)}, "."), nil
+}
+
+func TestDecryptToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		return
+	}
+	jwt := newTestToken("https://keycloak.example.com").getToken()
+	token := jwt.Encode()
+	cs := []struct {
+		Algorithm  string
+		Encryption string
+	}{
+		{Algorithm: "RSA-OAEP", Encryption: "A128CBC-HS256"},
+		{Algorithm: "RSA-OAEP", Encryption: "A256CBC-HS512"},
+		{Algorithm: "RSA-OAEP-256", Encryption: "A192CBC-HS384"},
+		{Algorithm: "RSA-OAEP-256", Encryption: "A256GCM"},
+		{Algorithm: "RSA1_5", Encryption: "A128GCM"},
+	}
+	for i, c := range cs {
+		encrypted, err := encryptToken(token, c.Algorithm, c.Encryption, &key.PublicKey)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		decrypted, err := decryptToken(encrypted, key)
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, token, decrypted, "case %d", i)
+
+		// step: a tampered token should fail
+		parts := strings.Split(encrypted, ".")
+		parts[3] = base64.RawURLEncoding.EncodeToString(append([]byte{0xff}, []byte(parts[3])[1:]...))
+		_, err = decryptToken(strings.Join(parts, "."), key)
+		assert.Error(t, err, "case %d", i)
+		// step: without the key the token is rejected
+		_, err = decryptToken(encrypted, nil)
+		assert.Equal(t, errEncryptedToken, err, "case %d", i)
+	}
+
+	// step: a signed token is passed through
+	decrypted, err := decryptToken(token, key)
+	assert.NoError(t, err)
+	assert.Equal(t, token, decrypted)
+}
+
+func TestEncryptedTokenAccess(t *testing.T) {
+	block, _ := pem.Decode([]byte(fakePrivateKey))
+	key, _ := x509.ParsePKCS1PrivateKey(block.Bytes)
+	file, err := ioutil.TempFile("", "decryption-key")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(file.Name())
+	pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: mustMarshalPKCS8(t, key)})
+	file.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.DecryptionKey = file.Name()
+	_, idp, svc := newTestProxyService(cfg)
+	signed, _ := idp.signToken(newTestToken(idp.getLocation()).claims)
+	encrypted, err := encryptToken(signed.Encode(), "RSA-OAEP", "A128CBC-HS256", &key.PublicKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL, nil)
+	req.Header.Set("Authorization", "Bearer "+encrypted)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func mustMarshalPKCS8(t *testing.T, key *rsa.PrivateKey) []byte {
+	encoded, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal the private key, error: %s", err)
+	}
+
+	return encoded
+}
@@ -0,0 +1,491 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// keySyncInterval is the minimum time between the syncs of the provider keys
+	keySyncInterval = 10 * time.Second
+	// keyCacheDuration is how long the provider keys are cached when the provider sends no cache headers
+	keyCacheDuration = time.Hour
+)
+
+// signatureAlgorithms are the signature algorithms verified by the provider keys
+var signatureAlgorithms = map[string]struct {
+	// the hash of the signed data, zero for eddsa
+	hash crypto.Hash
+	// the curve of the key, empty for rsa
+	curve string
+	// whether the rsa signature uses the pss padding
+	pss bool
+}{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"PS256": {hash: crypto.SHA256, pss: true},
+	"PS384": {hash: crypto.SHA384, pss: true},
+	"PS512": {hash: crypto.SHA512, pss: true},
+	"ES256": {hash: crypto.SHA256, curve: "P-256"},
+	"ES384": {hash: crypto.SHA384, curve: "P-384"},
+	"ES512": {hash: crypto.SHA512, curve: "P-521"},
+	"EdDSA": {curve: "Ed25519"},
+}
+
+// providerKey is a rsa, ec or okp json web key
+type providerKey struct {
+	ID    string `json:"kid"`
+	Type  string `json:"kty"`
+	Use   string `json:"use"`
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+	N     string `json:"n"`
+	E     string `json:"e"`
+}
+
+// publicKey decodes the public key, returning false for the key types we don't handle
+func (r providerKey) publicKey() (crypto.PublicKey, bool, error) {
+	// step: the encryption keys are published alongside the signing keys
+	if r.Use != "" && r.Use != "sig" {
+		return nil, false, nil
+	}
+	switch r.Type {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.N, "="))
+		if err != nil {
+			return nil, false, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.E, "="))
+		if err != nil {
+			return nil, false, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, false, errors.New("invalid rsa public key")
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, true, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch r.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, false, fmt.Errorf("unsupported curve: %s", r.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.X, "="))
+		if err != nil {
+			return nil, false, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.Y, "="))
+		if err != nil {
+			return nil, false, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, false, errors.New("the point is not on the curve")
+		}
+
+		return key, true, nil
+	case "OKP":
+		if r.Curve != "Ed25519" {
+			return nil, false, fmt.Errorf("unsupported curve: %s", r.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.X, "="))
+		if err != nil {
+			return nil, false, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, false, errors.New("invalid ed25519 public key size")
+		}
+
+		return ed25519.PublicKey(x), true, nil
+	}
+
+	return nil, false, nil
+}
+
+// providerKeys is a cache of the jwks of the provider, honouring the cache headers of the provider and
+// refreshing on an unknown key id, so a realm key rotation is picked up without a restart. It's safe to
+// use from multiple goroutines
+type providerKeys struct {
+	sync.RWMutex
+	// the client used to retrieve the keys
+	client *http.Client
+	// the location of the provider keys
+	location string
+	// the keys indexed by key id
+	keys map[string]crypto.PublicKey
+	// when the keys were last synced
+	synced time.Time
+	// when the cached keys expire
+	expires time.Time
+	// the syncs of the keys partitioned by result
+	total *prometheus.CounterVec
+}
+
+// newProviderKeys creates a key set retrieved from the location and registers the metrics
+func newProviderKeys(client *http.Client, location string) *providerKeys {
+	total := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "provider_key_syncs_total",
+			Help: "The syncs of the provider keys partitioned by result",
+		},
+		[]string{"result"},
+	)
+
+	return &providerKeys{
+		client:   client,
+		location: location,
+		keys:     make(map[string]crypto.PublicKey),
+		total:    prometheus.MustRegisterOrGet(total).(*prometheus.CounterVec),
+	}
+}
+
+// setLocation changes the location of the keys, i.e. on a refresh of the provider configuration
+func (r *providerKeys) setLocation(location string) {
+	r.Lock()
+	defer r.Unlock()
+	r.location = location
+}
+
+// get returns the key, syncing the keys from the provider if unknown or the cache has expired; the
+// expired keys are used until the provider can be reached
+func (r *providerKeys) get(id string) (crypto.PublicKey, error) {
+	r.RLock()
+	key, found := r.keys[id]
+	expired := time.Now().After(r.expires)
+	r.RUnlock()
+	if found && !expired {
+		return key, nil
+	}
+	if err := r.sync(); err != nil {
+		if found {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to refresh the provider keys, using the cached keys")
+			return key, nil
+		}
+		return nil, err
+	}
+	r.RLock()
+	defer r.RUnlock()
+	if key, found := r.keys[id]; found {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("no provider key found with id: %s", id)
+}
+
+// sync retrieves the keys from the provider, at most once per sync interval
+func (r *providerKeys) sync() error {
+	r.Lock()
+	defer r.Unlock()
+	if time.Since(r.synced) < keySyncInterval {
+		return nil
+	}
+	r.synced = time.Now()
+
+	resp, err := r.client.Get(r.location)
+	if err != nil {
+		r.total.WithLabelValues("error").Inc()
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.total.WithLabelValues("error").Inc()
+		return fmt.Errorf("unable to retrieve the provider keys, status: %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []providerKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		r.total.WithLabelValues("error").Inc()
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		key, found, err := k.publicKey()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+				"kid":   k.ID,
+			}).Warnf("ignoring the invalid provider key")
+			continue
+		}
+		if found {
+			keys[k.ID] = key
+		}
+	}
+	r.keys = keys
+	r.expires = time.Now().Add(getCacheDuration(resp.Header))
+	r.total.WithLabelValues("synced").Inc()
+
+	log.WithFields(log.Fields{
+		"keys":    len(keys),
+		"expires": r.expires.Format(time.RFC3339),
+	}).Debugf("synced the provider keys")
+
+	return nil
+}
+
+// getCacheDuration returns how long the response can be cached, from the max-age of the cache-control
+// header or else the expires header
+func getCacheDuration(header http.Header) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			if age, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && age >= 0 {
+				return time.Duration(age) * time.Second
+			}
+		}
+	}
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		if duration := time.Until(expires); duration > 0 {
+			return duration
+		}
+		return 0
+	}
+
+	return keyCacheDuration
+}
+
+// verify checks the signature of the token against the provider keys
+func (r *providerKeys) verify(token jose.JWT) error {
+	id, found := token.KeyID()
+	if !found {
+		return errors.New("the token has no key id")
+	}
+	key, err := r.get(id)
+	if err != nil {
+		return err
+	}
+
+	return verifySignature(token.Header[jose.HeaderKeyAlgorithm], key, []byte(token.Data()), token.Signature)
+}
+
+// verifySignature checks the rsa, ecdsa or eddsa signature of the data
+func verifySignature(algorithm string, key crypto.PublicKey, data, signature []byte) error {
+	alg, found := signatureAlgorithms[algorithm]
+	if !found {
+		return fmt.Errorf("unsupported algorithm: %s", algorithm)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg.curve != "" {
+			return errors.New("the key does not match the algorithm")
+		}
+		h := alg.hash.New()
+		h.Write(data)
+		if alg.pss {
+			// step: jws pss signatures use a salt the size of the hash, rfc 7518
+			options := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: alg.hash}
+			if err := rsa.VerifyPSS(key, alg.hash, h.Sum(nil), signature, options); err != nil {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+		if err := rsa.VerifyPKCS1v15(key, alg.hash, h.Sum(nil), signature); err != nil {
+			return errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().Name != alg.curve {
+			return errors.New("the key does not match the algorithm")
+		}
+		// step: the signature is the r and s values, each the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature size")
+		}
+		h := alg.hash.New()
+		h.Write(data)
+		if !ecdsa.Verify(key, h.Sum(nil), new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])) {
+			return errors.New("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if alg.curve != "Ed25519" {
+			return errors.New("the key does not match the algorithm")
+		}
+		if !ed25519.Verify(key, data, signature) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+
+	return nil
+}
+
+// verifyJWT verifies the claims of the token and its signature against the provider keys, or the keys
+// of a trusted issuer, falling back to the openid client when we have no keys endpoint
+func (r *oauthProxy) verifyJWT(token jose.JWT) error {
+	claims, err := token.Claims()
+	if err != nil {
+		return err
+	}
+	if !r.isAcceptedAlgorithm(token.Header[jose.HeaderKeyAlgorithm]) {
+		return ErrUnsupportedAlgorithm
+	}
+	audience, err := r.getAcceptedAudience(claims)
+	if err != nil {
+		return err
+	}
+	if err := r.verifyAuthorizedParty(claims); err != nil {
+		return err
+	}
+	issuer, keys := r.getTrustedIssuer(claims)
+	if keys == nil {
+		if r.keys == nil {
+			return verifyToken(r.client, token)
+		}
+		issuer, keys = r.getProviderConfig().Issuer.String(), r.keys
+	}
+	if err := verifyClaims(claims, issuer, audience, r.config.ClockSkew, time.Now()); err != nil {
+		return err
+	}
+
+	return keys.verify(token)
+}
+
+// verifyClaims checks the issuer and audience of the token, and its exp, iat and nbf claims within the
+// skew of the clock
+func verifyClaims(claims jose.Claims, issuer, audience string, skew time.Duration, now time.Time) error {
+	expires, found, err := claims.TimeClaim("exp")
+	if err != nil || !found {
+		return errors.New("missing claim: 'exp'")
+	}
+	if now.After(expires.Add(skew)) {
+		return ErrAccessTokenExpired
+	}
+	issuedAt, found, err := claims.TimeClaim(claimIssuedAt)
+	if err != nil || !found {
+		return errors.New("missing claim: 'iat'")
+	}
+	if issuedAt.After(now.Add(skew)) {
+		return ErrAccessTokenNotYetValid
+	}
+	if notBefore, found, err := claims.TimeClaim("nbf"); err != nil {
+		return err
+	} else if found && notBefore.After(now.Add(skew)) {
+		return ErrAccessTokenNotYetValid
+	}
+	iss, found, err := claims.StringClaim(claimIssuer)
+	if err != nil || !found {
+		return errors.New("missing claim: 'iss'")
+	}
+	if strings.TrimSuffix(iss, "/") != strings.TrimSuffix(issuer, "/") {
+		return fmt.Errorf("invalid claim value: 'iss', expected: %s, found: %s", issuer, iss)
+	}
+	if !containedIn(audience, getAudiences(claims)) {
+		return ErrInvalidAudience
+	}
+
+	return nil
+}
+
+// isAcceptedAlgorithm checks the signature algorithm of the token is permitted, any we can verify when
+// no algorithms are configured
+func (r *oauthProxy) isAcceptedAlgorithm(algorithm string) bool {
+	if len(r.config.SignatureAlgorithms) == 0 {
+		_, found := signatureAlgorithms[algorithm]
+		return found
+	}
+
+	return containedIn(algorithm, r.config.SignatureAlgorithms)
+}
+
+// getTrustedIssuer returns the issuer of the token and its keys if it's one of the trusted issuers,
+// other than the provider
+func (r *oauthProxy) getTrustedIssuer(claims jose.Claims) (string, *providerKeys) {
+	if len(r.issuers) == 0 {
+		return "", nil
+	}
+	issuer, found, err := claims.StringClaim(claimIssuer)
+	if err != nil || !found {
+		return "", nil
+	}
+
+	return issuer, r.issuers[issuer]
+}
+
+// getAcceptedAudience returns the first of the accepted audiences present in the token, the client id
+// when no audiences are configured
+func (r *oauthProxy) getAcceptedAudience(claims jose.Claims) (string, error) {
+	if len(r.config.Audiences) == 0 {
+		return r.config.ClientID, nil
+	}
+	audiences := getAudiences(claims)
+	for _, x := range r.config.Audiences {
+		if containedIn(x, audiences) {
+			return x, nil
+		}
+	}
+
+	return "", ErrInvalidAudience
+}
+
+// isAcceptedAudience checks the token was issued for us, or for one of the accepted audiences
+func (r *oauthProxy) isAcceptedAudience(user *userContext) bool {
+	if len(r.config.Audiences) == 0 {
+		return r.config.ClientID == "" || user.isAudience(r.config.ClientID)
+	}
+	for _, x := range r.config.Audiences {
+		if user.isAudience(x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyAuthorizedParty checks the client the token was issued to is permitted, if configured
+func (r *oauthProxy) verifyAuthorizedParty(claims jose.Claims) error {
+	if len(r.config.AuthorizedParties) == 0 {
+		return nil
+	}
+	azp, found, err := claims.StringClaim(claimAuthorizedParty)
+	if err != nil || !found || !containedIn(azp, r.config.AuthorizedParties) {
+		return ErrInvalidAuthorizedParty
+	}
+
+	return nil
+}
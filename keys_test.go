@@ -0,0 +1,258 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderKeys(t *testing.T) {
+	idp := newFakeOAuthServer()
+	keys := newProviderKeys(http.DefaultClient, idp.getLocation()+"/protocol/openid-connect/certs")
+	_, err := keys.get("test-ec-kid")
+	assert.NoError(t, err)
+	_, err = keys.get("test-ed-kid")
+	assert.NoError(t, err)
+	_, err = keys.get("test-kid")
+	assert.NoError(t, err)
+	_, err = keys.get("unknown-kid")
+	assert.Error(t, err)
+
+	// step: the rsa signed tokens are verified against the keys
+	token, _ := idp.signToken(newTestToken(idp.getLocation()).claims)
+	assert.NoError(t, keys.verify(*token))
+	token.Header["alg"] = "ES256"
+	assert.Error(t, keys.verify(*token))
+}
+
+func TestProviderKeysRateLimit(t *testing.T) {
+	idp := newFakeOAuthServer()
+	keys := newProviderKeys(http.DefaultClient, idp.getLocation()+"/protocol/openid-connect/certs")
+	for i := 0; i < 3; i++ {
+		_, err := keys.get("unknown-kid")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 1, idp.getKeyRequests(), "the syncs should have been rate limited")
+	_, err := keys.get("test-kid")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, idp.getKeyRequests())
+}
+
+func TestProviderKeysCacheExpiry(t *testing.T) {
+	idp := newFakeOAuthServer()
+	idp.keysCacheControl = "public, max-age=60"
+	keys := newProviderKeys(http.DefaultClient, idp.getLocation()+"/protocol/openid-connect/certs")
+	_, err := keys.get("test-kid")
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), keys.expires, 5*time.Second)
+
+	// step: the expired keys are refreshed
+	keys.expires = time.Now().Add(-time.Second)
+	keys.synced = time.Now().Add(-keySyncInterval)
+	_, err = keys.get("test-kid")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, idp.getKeyRequests())
+
+	// step: the expired keys are used while the provider is unavailable
+	keys.expires = time.Now().Add(-time.Second)
+	keys.synced = time.Now().Add(-keySyncInterval)
+	keys.location = idp.getLocation() + "/missing"
+	_, err = keys.get("test-kid")
+	assert.NoError(t, err)
+}
+
+func TestGetCacheDuration(t *testing.T) {
+	cs := []struct {
+		Header   http.Header
+		Expected time.Duration
+	}{
+		{Header: http.Header{}, Expected: keyCacheDuration},
+		{Header: http.Header{"Cache-Control": {"max-age=300"}}, Expected: 5 * time.Minute},
+		{Header: http.Header{"Cache-Control": {"public, Max-Age=60"}}, Expected: time.Minute},
+		{Header: http.Header{"Cache-Control": {"no-cache"}}, Expected: 0},
+		{Header: http.Header{"Cache-Control": {"no-store, max-age=60"}}, Expected: 0},
+		{Header: http.Header{"Expires": {"Thu, 01 Jan 1970 00:00:00 GMT"}}, Expected: 0},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, getCacheDuration(c.Header), "case %d", i)
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	now := time.Now()
+	issuer := "https://keycloak.example.com/auth/realms/test"
+	cs := []struct {
+		Claims   jose.Claims
+		Skew     time.Duration
+		Expected error
+	}{
+		{},
+		{Claims: jose.Claims{"exp": now.Add(-10 * time.Second).Unix()}, Expected: ErrAccessTokenExpired},
+		{Claims: jose.Claims{"exp": now.Add(-10 * time.Second).Unix()}, Skew: 30 * time.Second},
+		{Claims: jose.Claims{"exp": now.Add(-time.Minute).Unix()}, Skew: 30 * time.Second, Expected: ErrAccessTokenExpired},
+		{Claims: jose.Claims{"iat": now.Add(10 * time.Second).Unix()}, Expected: ErrAccessTokenNotYetValid},
+		{Claims: jose.Claims{"iat": now.Add(10 * time.Second).Unix()}, Skew: 30 * time.Second},
+		{Claims: jose.Claims{"nbf": now.Add(10 * time.Second).Unix()}, Expected: ErrAccessTokenNotYetValid},
+		{Claims: jose.Claims{"nbf": now.Add(10 * time.Second).Unix()}, Skew: 30 * time.Second},
+		{Claims: jose.Claims{"nbf": now.Add(time.Minute).Unix()}, Skew: 30 * time.Second, Expected: ErrAccessTokenNotYetValid},
+		{Claims: jose.Claims{"aud": "other"}, Expected: ErrInvalidAudience},
+	}
+	for i, c := range cs {
+		claims := jose.Claims{
+			"aud": "test",
+			"exp": now.Add(time.Hour).Unix(),
+			"iat": now.Unix(),
+			"iss": issuer,
+		}
+		for k, v := range c.Claims {
+			claims[k] = v
+		}
+		assert.Equal(t, c.Expected, verifyClaims(claims, issuer, "test", c.Skew, now), "case %d", i)
+	}
+}
+
+func TestProviderKeyRotation(t *testing.T) {
+	proxy, idp, svc := newTestProxyService(nil)
+	makeRequest := func() int {
+		token, _ := idp.signToken(newTestToken(idp.getLocation()).claims)
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL+"/test", nil)
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, makeRequest())
+
+	// step: the realm key is rotated, the unknown key id refreshes the keys
+	if !assert.NoError(t, idp.rotateKey("test-kid-rotated")) {
+		return
+	}
+	proxy.keys.synced = time.Now().Add(-keySyncInterval)
+	assert.Equal(t, http.StatusOK, makeRequest())
+	_, found := proxy.keys.keys["test-kid"]
+	assert.False(t, found, "the rotated key should have been dropped")
+}
+
+func TestVerifyEllipticToken(t *testing.T) {
+	idp := newFakeOAuthServer()
+	keys := newProviderKeys(http.DefaultClient, idp.getLocation()+"/protocol/openid-connect/certs")
+	claims := newTestToken(idp.getLocation()).claims
+	for _, alg := range []string{"ES256", "EdDSA"} {
+		token, err := idp.signEllipticToken(alg, claims)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.NoError(t, keys.verify(*token), "alg: %s", alg)
+		// step: a tampered signature should fail
+		token.Signature[0] ^= 0xff
+		assert.Error(t, keys.verify(*token), "alg: %s", alg)
+	}
+
+	// step: the algorithm must match the key
+	token, _ := idp.signEllipticToken("ES256", claims)
+	token.Header["alg"] = "EdDSA"
+	assert.Error(t, keys.verify(*token))
+	token.Header["alg"] = "ES384"
+	assert.Error(t, keys.verify(*token))
+}
+
+func TestVerifyPSSToken(t *testing.T) {
+	idp := newFakeOAuthServer()
+	keys := newProviderKeys(http.DefaultClient, idp.getLocation()+"/protocol/openid-connect/certs")
+	claims := newTestToken(idp.getLocation()).claims
+	for _, alg := range []string{"PS256", "PS384", "PS512"} {
+		token, err := idp.signPSSToken(alg, claims)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.NoError(t, keys.verify(*token), "alg: %s", alg)
+		// step: the pss signature is not a pkcs1 v1.5 signature
+		token.Header["alg"] = "RS" + alg[2:]
+		assert.Error(t, keys.verify(*token), "alg: %s", alg)
+	}
+}
+
+func TestSignatureAlgorithms(t *testing.T) {
+	cs := []struct {
+		Algorithms   []string
+		Algorithm    string
+		ExpectedCode int
+	}{
+		{Algorithm: "RS256", ExpectedCode: http.StatusOK},
+		{Algorithm: "PS256", ExpectedCode: http.StatusOK},
+		{Algorithm: "ES256", ExpectedCode: http.StatusOK},
+		{Algorithms: []string{"ES256"}, Algorithm: "ES256", ExpectedCode: http.StatusOK},
+		{Algorithms: []string{"ES256"}, Algorithm: "RS256", ExpectedCode: http.StatusForbidden},
+		{Algorithms: []string{"RS256", "PS256"}, Algorithm: "PS256", ExpectedCode: http.StatusOK},
+		{Algorithms: []string{"RS256"}, Algorithm: "EdDSA", ExpectedCode: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.SignatureAlgorithms = c.Algorithms
+		_, idp, svc := newTestProxyService(cfg)
+		claims := newTestToken(idp.getLocation()).claims
+		var signed *jose.JWT
+		switch c.Algorithm {
+		case "RS256":
+			signed, _ = idp.signToken(claims)
+		case "PS256":
+			signed, _ = idp.signPSSToken(c.Algorithm, claims)
+		default:
+			signed, _ = idp.signEllipticToken(c.Algorithm, claims)
+		}
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL, nil)
+		req.Header.Set("Authorization", "Bearer "+signed.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d", i)
+	}
+}
+
+func TestEllipticTokenAccess(t *testing.T) {
+	_, idp, svc := newTestProxyService(nil)
+	for _, alg := range []string{"ES256", "EdDSA"} {
+		token := newTestToken(idp.getLocation())
+		signed, _ := idp.signEllipticToken(alg, token.claims)
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL+"/test", nil)
+		req.Header.Set("Authorization", "Bearer "+signed.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "alg: %s", alg)
+		}
+
+		// step: an expired token should be treated the same as rsa
+		token.setExpiration(time.Now().Add(-time.Hour))
+		signed, _ = idp.signEllipticToken(alg, token.claims)
+		req.Header.Set("Authorization", "Bearer "+signed.Encode())
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "alg: %s", alg)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// listenerMetrics are the connection and tls handshake metrics for the listeners
+type listenerMetrics struct {
+	// the connections currently open
+	open *prometheus.GaugeVec
+	// the connections accepted
+	accepted *prometheus.CounterVec
+	// the failed tls handshakes
+	handshakeErrors *prometheus.CounterVec
+	// the negotiated tls versions and ciphers
+	handshakes *prometheus.CounterVec
+}
+
+// newListenerMetrics creates or retrieves the registered listener metrics
+func newListenerMetrics() *listenerMetrics {
+	open := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "listener_open_connections",
+			Help: "The connections currently open partitioned by listener",
+		},
+		[]string{"listener"},
+	)
+	accepted := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "listener_accepted_connections_total",
+			Help: "The connections accepted partitioned by listener",
+		},
+		[]string{"listener"},
+	)
+	handshakeErrors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "listener_tls_handshake_errors_total",
+			Help: "The failed tls handshakes partitioned by listener and reason",
+		},
+		[]string{"listener", "reason"},
+	)
+	handshakes := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "listener_tls_handshakes_total",
+			Help: "The completed tls handshakes partitioned by listener, version and cipher",
+		},
+		[]string{"listener", "version", "cipher"},
+	)
+
+	return &listenerMetrics{
+		open:            prometheus.MustRegisterOrGet(open).(*prometheus.GaugeVec),
+		accepted:        prometheus.MustRegisterOrGet(accepted).(*prometheus.CounterVec),
+		handshakeErrors: prometheus.MustRegisterOrGet(handshakeErrors).(*prometheus.CounterVec),
+		handshakes:      prometheus.MustRegisterOrGet(handshakes).(*prometheus.CounterVec),
+	}
+}
+
+// metricsListener records the connections accepted by the listener
+type metricsListener struct {
+	net.Listener
+	// the name of the listener
+	name string
+	// the metrics for the listener
+	metrics *listenerMetrics
+}
+
+// newMetricsListener wraps the listener, recording the accepted and open connections
+func newMetricsListener(listener net.Listener, name string) net.Listener {
+	return &metricsListener{
+		Listener: listener,
+		name:     name,
+		metrics:  newListenerMetrics(),
+	}
+}
+
+// Accept waits for and returns the next connection
+func (r *metricsListener) Accept() (net.Conn, error) {
+	conn, err := r.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	r.metrics.accepted.WithLabelValues(r.name).Inc()
+	r.metrics.open.WithLabelValues(r.name).Inc()
+
+	return &metricsConn{Conn: conn, closed: func() {
+		r.metrics.open.WithLabelValues(r.name).Dec()
+	}}, nil
+}
+
+// metricsConn calls closed once when the connection is closed
+type metricsConn struct {
+	net.Conn
+	// ensure we only decrement once
+	once sync.Once
+	// the method called on close
+	closed func()
+}
+
+// Close closes the connection
+func (r *metricsConn) Close() error {
+	r.once.Do(r.closed)
+
+	return r.Conn.Close()
+}
+
+// tlsMetricsListener is a tls listener recording the outcome of the handshakes
+type tlsMetricsListener struct {
+	net.Listener
+	// the name of the listener
+	name string
+	// the tls configuration
+	config *tls.Config
+	// the metrics for the listener
+	metrics *listenerMetrics
+}
+
+// newTLSMetricsListener creates a tls listener recording the handshake errors and negotiated versions and ciphers
+func newTLSMetricsListener(listener net.Listener, name string, config *tls.Config) net.Listener {
+	return &tlsMetricsListener{
+		Listener: listener,
+		name:     name,
+		config:   config,
+		metrics:  newListenerMetrics(),
+	}
+}
+
+// Accept waits for and returns the next connection
+func (r *tlsMetricsListener) Accept() (net.Conn, error) {
+	conn, err := r.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tlsMetricsConn{Conn: tls.Server(conn, r.config), listener: r}, nil
+}
+
+// tlsMetricsConn is a tls connection recording the outcome of the handshake; the http server
+// performs the handshake via HandshakeContext
+type tlsMetricsConn struct {
+	*tls.Conn
+	// the listener which accepted the connection
+	listener *tlsMetricsListener
+}
+
+// HandshakeContext runs the tls handshake and records the outcome
+func (r *tlsMetricsConn) HandshakeContext(ctx context.Context) error {
+	if err := r.Conn.HandshakeContext(ctx); err != nil {
+		r.listener.metrics.handshakeErrors.WithLabelValues(r.listener.name, handshakeErrorReason(err)).Inc()
+		return err
+	}
+	state := r.Conn.ConnectionState()
+	r.listener.metrics.handshakes.WithLabelValues(r.listener.name,
+		tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)).Inc()
+
+	return nil
+}
+
+// handshakeErrorReason reduces a handshake error to a reason with a bounded cardinality
+func handshakeErrorReason(err error) string {
+	if _, ok := err.(tls.RecordHeaderError); ok {
+		return "not_tls"
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return "timeout"
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "eof"
+	}
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "remote error"):
+		return "remote_alert"
+	case strings.Contains(message, "version"):
+		return "unsupported_version"
+	case strings.Contains(message, "cipher suite"):
+		return "no_shared_cipher"
+	case strings.Contains(message, "certificate"):
+		return "bad_certificate"
+	case strings.Contains(message, "connection reset"):
+		return "connection_reset"
+	}
+
+	return "other"
+}
+
+// tlsVersionName returns a name for the tls version
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+
+	return fmt.Sprintf("0x%04x", version)
+}
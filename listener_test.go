@@ -0,0 +1,120 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func getMetricValue(t *testing.T, metric prometheus.Metric) float64 {
+	m := &dto.Metric{}
+	if !assert.NoError(t, metric.Write(m)) {
+		return 0
+	}
+	if m.Gauge != nil {
+		return m.Gauge.GetValue()
+	}
+
+	return m.Counter.GetValue()
+}
+
+func TestMetricsListener(t *testing.T) {
+	listener, err := createHTTPListener(listenerConfig{
+		listen:      "127.0.0.1:0",
+		certificate: testCertificateFile,
+		privateKey:  testPrivateKeyFile,
+		metrics:     true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	name := "127.0.0.1:0"
+	metrics := newListenerMetrics()
+	metrics.accepted.Reset()
+	metrics.handshakeErrors.Reset()
+	metrics.handshakes.Reset()
+
+	handshakes := make(chan error)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			err = conn.(*tlsMetricsConn).HandshakeContext(context.Background())
+			conn.Close()
+			handshakes <- err
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	state := conn.ConnectionState()
+	conn.Close()
+	assert.NoError(t, <-handshakes)
+
+	plain, err := net.Dial("tcp", listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer plain.Close()
+	_, err = plain.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	assert.NoError(t, err)
+	assert.Error(t, <-handshakes)
+
+	assert.Equal(t, float64(2), getMetricValue(t, metrics.accepted.WithLabelValues(name)))
+	assert.Equal(t, float64(0), getMetricValue(t, metrics.open.WithLabelValues(name)))
+	assert.Equal(t, float64(1), getMetricValue(t, metrics.handshakeErrors.WithLabelValues(name, "not_tls")))
+	assert.Equal(t, float64(1), getMetricValue(t, metrics.handshakes.WithLabelValues(name,
+		tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))))
+}
+
+func TestHandshakeErrorReason(t *testing.T) {
+	cs := []struct {
+		Error    error
+		Expected string
+	}{
+		{Error: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, Expected: "not_tls"},
+		{Error: io.EOF, Expected: "eof"},
+		{Error: errors.New("tls: client offered only unsupported versions: [301]"), Expected: "unsupported_version"},
+		{Error: errors.New("tls: no cipher suite supported by both client and server"), Expected: "no_shared_cipher"},
+		{Error: errors.New("tls: failed to verify certificate"), Expected: "bad_certificate"},
+		{Error: &net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")}, Expected: "remote_alert"},
+		{Error: errors.New("unknown"), Expected: "other"},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, handshakeErrorReason(c.Error), "case %d, error: %s", i, c.Error)
+	}
+}
+
+func TestTLSVersionName(t *testing.T) {
+	assert.Equal(t, "TLS1.0", tlsVersionName(tls.VersionTLS10))
+	assert.Equal(t, "TLS1.2", tlsVersionName(tls.VersionTLS12))
+	assert.Equal(t, "TLS1.3", tlsVersionName(tls.VersionTLS13))
+	assert.Equal(t, "0x0300", tlsVersionName(0x0300))
+}
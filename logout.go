@@ -0,0 +1,340 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+)
+
+const (
+	// backchannelLogoutEvent is the event a logout token must carry
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	// revocationRetention is how long a revocation is held, it must outlive any access token
+	// issued to the revoked session
+	revocationRetention = 12 * time.Hour
+	// revokedSessionPrefix prefixes the revoked sessions in the store
+	revokedSessionPrefix = "revoked-session:"
+	// revokedSubjectPrefix prefixes the revoked subjects in the store
+	revokedSubjectPrefix = "revoked-subject:"
+	// sessionIndexPrefix prefixes the keys of the tokens in the store, indexed by the session, subject and email
+	sessionIndexPrefix = "session-index:"
+	// revocationMissTTL is how long an identity not revoked in the store is taken as such, sparing the store a lookup
+	// on every request; a revocation made by another instance is honoured here within it
+	revocationMissTTL = 10 * time.Second
+	// revocationMissesPrune is the number of cached misses at which the expired ones are pruned
+	revocationMissesPrune = 4096
+)
+
+// logoutToken is a validated back-channel logout token
+type logoutToken struct {
+	// the session id, if any
+	sessionID string
+	// the subject, if any
+	subject string
+	// when the token was issued
+	issuedAt time.Time
+}
+
+// parseLogoutToken validates the claims of a logout token, the signature, issuer, audience and expiry
+// are checked by the token verification
+func parseLogoutToken(token jose.JWT) (*logoutToken, error) {
+	claims, err := token.Claims()
+	if err != nil {
+		return nil, err
+	}
+	events, found := claims[claimEvents].(map[string]interface{})
+	if !found {
+		return nil, errors.New("the logout token has no events claim")
+	}
+	if _, found := events[backchannelLogoutEvent]; !found {
+		return nil, errors.New("the logout token does not contain the back-channel logout event")
+	}
+	if _, found := claims[claimNonce]; found {
+		return nil, errors.New("the logout token must not contain a nonce")
+	}
+	sessionID, _, _ := claims.StringClaim(claimSessionID)
+	subject, _, _ := claims.StringClaim("sub")
+	if sessionID == "" && subject == "" {
+		return nil, errors.New("the logout token must contain either a sid or sub claim")
+	}
+	issuedAt, found, err := claims.TimeClaim(claimIssuedAt)
+	if err != nil || !found {
+		return nil, errors.New("the logout token has no issued at claim")
+	}
+
+	return &logoutToken{sessionID: sessionID, subject: subject, issuedAt: issuedAt}, nil
+}
+
+// sessionRevocations are the sessions logged out via the back-channel or revoked by an admin, it's safe to use
+// from multiple goroutines and a nil revocations never revokes
+type sessionRevocations struct {
+	sync.RWMutex
+	// the time the sessions were logged out, keyed by session id
+	sessions map[string]time.Time
+	// the time the subjects were logged out of all sessions, keyed by subject or email, taken from the
+	// logout token so it's comparable to the issued at of the access tokens
+	subjects map[string]time.Time
+	// the store the revocations are shared through, if any
+	store storage
+	// the listing of the tokens held in the store for a revoked session
+	lister storageLister
+	// the identities found not revoked in the store and until when, keyed by the store key
+	misses map[string]time.Time
+}
+
+// newSessionRevocations creates an empty set of revocations
+func newSessionRevocations() *sessionRevocations {
+	return &sessionRevocations{
+		sessions: make(map[string]time.Time),
+		subjects: make(map[string]time.Time),
+		misses:   make(map[string]time.Time),
+	}
+}
+
+// share records the revocations in the store, so they're honoured by every instance and outlive a restart, and
+// removes the tokens held in the store for the sessions revoked
+func (r *sessionRevocations) share(store storage) error {
+	lister, ok := getStorageLister(store)
+	if !ok {
+		return errors.New("the store does not support listing the sessions of a revoked user")
+	}
+	r.store, r.lister = store, lister
+
+	return nil
+}
+
+// revoke records the logout, the session is revoked when given, otherwise every session of the subject; the
+// tokens of the sessions are removed from the store
+func (r *sessionRevocations) revoke(token *logoutToken) error {
+	prefix, identity := revokedSubjectPrefix, token.subject
+	if token.sessionID != "" {
+		prefix, identity = revokedSessionPrefix, token.sessionID
+	}
+	r.Lock()
+	if token.sessionID != "" {
+		r.sessions[token.sessionID] = token.issuedAt
+	} else {
+		r.subjects[token.subject] = token.issuedAt
+	}
+	delete(r.misses, getRevocationStoreKey(prefix, identity))
+	r.expire()
+	r.Unlock()
+
+	if err := r.persist(prefix, identity, token.issuedAt); err != nil {
+		return err
+	}
+
+	return r.removeSessions(identity)
+}
+
+// revokeIdentity revokes the session with the id, else the sessions of the subject or email issued before now, and
+// removes their tokens from the store; the admins only have the one identifier to go on, which is never ambiguous as
+// the keycloak ids are uuids
+func (r *sessionRevocations) revokeIdentity(identity string, now time.Time) error {
+	r.Lock()
+	r.sessions[identity] = now
+	r.subjects[identity] = now
+	delete(r.misses, getRevocationStoreKey(revokedSessionPrefix, identity))
+	delete(r.misses, getRevocationStoreKey(revokedSubjectPrefix, identity))
+	r.expire()
+	r.Unlock()
+
+	for _, prefix := range []string{revokedSessionPrefix, revokedSubjectPrefix} {
+		if err := r.persist(prefix, identity, now); err != nil {
+			return err
+		}
+	}
+
+	return r.removeSessions(identity)
+}
+
+// expire removes the revocations older than the retention and the misses which have lapsed, the lock must be held
+func (r *sessionRevocations) expire() {
+	for _, revoked := range []map[string]time.Time{r.sessions, r.subjects} {
+		for key, at := range revoked {
+			if time.Since(at) > revocationRetention {
+				delete(revoked, key)
+			}
+		}
+	}
+	now := time.Now()
+	for key, until := range r.misses {
+		if now.After(until) {
+			delete(r.misses, key)
+		}
+	}
+}
+
+// isRevoked checks if the session of the user has been logged out
+func (r *sessionRevocations) isRevoked(user *userContext) bool {
+	if r == nil {
+		return false
+	}
+	for _, claim := range []string{claimSessionState, claimSessionID} {
+		if sessionID, found, _ := user.claims.StringClaim(claim); found {
+			if _, found := r.getRevocation(r.sessions, revokedSessionPrefix, sessionID); found {
+				return true
+			}
+		}
+	}
+	// step: a subject logout only revokes the tokens issued before it
+	for _, subject := range []string{user.id, user.email} {
+		if subject == "" {
+			continue
+		}
+		if at, found := r.getRevocation(r.subjects, revokedSubjectPrefix, subject); found {
+			issuedAt, found, err := user.claims.TimeClaim(claimIssuedAt)
+			if err != nil || !found || issuedAt.Before(at) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// getRevocation returns the time of the revocation, held in memory or else found in the store; an identity not
+// found in the store is remembered as such for a short while, and a failure of the store is logged and taken as no
+// revocation, the tokens of the session having been removed from the store
+func (r *sessionRevocations) getRevocation(revoked map[string]time.Time, prefix, identity string) (time.Time, bool) {
+	key := getRevocationStoreKey(prefix, identity)
+	r.RLock()
+	at, found := revoked[identity]
+	until, missed := r.misses[key]
+	r.RUnlock()
+	if found || r.store == nil {
+		return at, found
+	}
+	if missed && time.Now().Before(until) {
+		return time.Time{}, false
+	}
+	value, err := r.store.Get(key)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to retrieve the revocation from the store")
+		return time.Time{}, false
+	}
+	if value == "" {
+		r.Lock()
+		if len(r.misses) >= revocationMissesPrune {
+			r.expire()
+		}
+		r.misses[key] = time.Now().Add(revocationMissTTL)
+		r.Unlock()
+
+		return time.Time{}, false
+	}
+	if at, err = time.Parse(time.RFC3339Nano, value); err != nil {
+		return time.Time{}, false
+	}
+	r.Lock()
+	revoked[identity] = at
+	r.Unlock()
+
+	return at, true
+}
+
+// persist records the revocation in the store until the retention has passed
+func (r *sessionRevocations) persist(prefix, identity string, at time.Time) error {
+	if r.store == nil {
+		return nil
+	}
+	key, value := getRevocationStoreKey(prefix, identity), at.UTC().Format(time.RFC3339Nano)
+	if store, ok := getStorageExpiration(r.store); ok {
+		return store.SetWithExpiration(key, value, revocationRetention)
+	}
+
+	return r.store.Set(key, value)
+}
+
+// index records the key of the tokens held in the store against the session, subject and email of the user, so
+// a revocation of any of them removes the tokens
+func (r *sessionRevocations) index(user *userContext, key string, expiration time.Duration) error {
+	if r == nil || r.lister == nil {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	for _, identity := range getRevocableIdentities(user) {
+		entry := getSessionIndexPrefix(identity) + hex.EncodeToString(sum[:])
+		if store, ok := getStorageExpiration(r.store); ok && expiration > 0 {
+			if err := store.SetWithExpiration(entry, key, expiration); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.store.Set(entry, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeSessions removes the tokens held in the store for the session, subject or email
+func (r *sessionRevocations) removeSessions(identity string) error {
+	if r.lister == nil {
+		return nil
+	}
+	items, err := r.lister.List(getSessionIndexPrefix(identity))
+	if err != nil {
+		return err
+	}
+	for entry, key := range items {
+		if err := r.store.Delete(key); err != nil {
+			return err
+		}
+		if err := r.store.Delete(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getRevocableIdentities returns the session ids, subject and email the user's sessions can be revoked by
+func getRevocableIdentities(user *userContext) []string {
+	var list []string
+	for _, claim := range []string{claimSessionState, claimSessionID} {
+		if sessionID, found, _ := user.claims.StringClaim(claim); found && sessionID != "" && !containedIn(sessionID, list) {
+			list = append(list, sessionID)
+		}
+	}
+	for _, x := range []string{user.id, user.email} {
+		if x != "" && !containedIn(x, list) {
+			list = append(list, x)
+		}
+	}
+
+	return list
+}
+
+// getRevocationStoreKey returns the key of the revocation in the store
+func getRevocationStoreKey(prefix, identity string) string {
+	sum := sha256.Sum256([]byte(identity))
+	return prefix + hex.EncodeToString(sum[:])
+}
+
+// getSessionIndexPrefix returns the prefix of the index of the tokens held in the store for the identity
+func getSessionIndexPrefix(identity string) string {
+	sum := sha256.Sum256([]byte(identity))
+	return sessionIndexPrefix + hex.EncodeToString(sum[:]) + ":"
+}
@@ -0,0 +1,410 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLogoutClaims(issuer string) jose.Claims {
+	return jose.Claims{
+		"iss":    issuer,
+		"aud":    fakeClientID,
+		"sub":    "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"sid":    "98f4c3d2-1b8c-4932-b8c4-92ec0ea7e195",
+		"iat":    float64(time.Now().Unix()),
+		"exp":    float64(time.Now().Add(time.Minute).Unix()),
+		"jti":    "0e4b5ef1-4b8c-4e32-a2c9-5b5b1d6e5c11",
+		"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+	}
+}
+
+func TestParseLogoutToken(t *testing.T) {
+	cs := []struct {
+		Claims jose.Claims
+		Remove string
+		Ok     bool
+	}{
+		{Ok: true},
+		{Claims: jose.Claims{"events": map[string]interface{}{"other": true}}},
+		{Claims: jose.Claims{"nonce": "a"}},
+		{Remove: "events"},
+		{Remove: "iat"},
+		{Remove: "sid", Ok: true},
+	}
+	for i, c := range cs {
+		claims := newTestLogoutClaims("test")
+		for k, v := range c.Claims {
+			claims.Add(k, v)
+		}
+		delete(claims, c.Remove)
+		token, _ := jose.NewJWT(jose.JOSEHeader{"alg": "RS256"}, claims)
+		logout, err := parseLogoutToken(token)
+		if !c.Ok {
+			assert.Error(t, err, "case %d, should have failed", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, claims["sub"], logout.subject, "case %d", i)
+		}
+	}
+
+	claims := newTestLogoutClaims("test")
+	delete(claims, "sid")
+	delete(claims, "sub")
+	token, _ := jose.NewJWT(jose.JOSEHeader{"alg": "RS256"}, claims)
+	_, err := parseLogoutToken(token)
+	assert.Error(t, err)
+}
+
+func TestSessionRevocations(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	newUser := func(claims jose.Claims) *userContext {
+		return &userContext{id: "sub", claims: claims}
+	}
+	var empty *sessionRevocations
+	assert.False(t, empty.isRevoked(newUser(jose.Claims{"sid": "a"})))
+
+	revocations := newSessionRevocations()
+	revocations.revoke(&logoutToken{sessionID: "a", subject: "sub", issuedAt: now})
+	assert.True(t, revocations.isRevoked(newUser(jose.Claims{"session_state": "a"})))
+	assert.True(t, revocations.isRevoked(newUser(jose.Claims{"sid": "a"})))
+	assert.False(t, revocations.isRevoked(newUser(jose.Claims{"sid": "b"})))
+
+	revocations.revoke(&logoutToken{subject: "sub", issuedAt: now})
+	assert.True(t, revocations.isRevoked(newUser(jose.Claims{"sid": "b", "iat": float64(now.Add(-time.Minute).Unix())})))
+	assert.False(t, revocations.isRevoked(newUser(jose.Claims{"sid": "b", "iat": float64(now.Add(time.Minute).Unix())})))
+
+	// step: an admin revokes by the session id, subject or email
+	revocations = newSessionRevocations()
+	revocations.revokeIdentity("c", now)
+	revocations.revokeIdentity("user@example.com", now)
+	assert.True(t, revocations.isRevoked(newUser(jose.Claims{"sid": "c", "iat": float64(now.Add(time.Minute).Unix())})))
+	assert.False(t, revocations.isRevoked(newUser(jose.Claims{"sid": "d", "iat": float64(now.Add(-time.Minute).Unix())})))
+	user := newUser(jose.Claims{"sid": "d", "iat": float64(now.Add(-time.Minute).Unix())})
+	user.email = "user@example.com"
+	assert.True(t, revocations.isRevoked(user))
+
+	// step: check the old revocations are expired
+	revocations.revoke(&logoutToken{sessionID: "old", issuedAt: now.Add(-2 * revocationRetention)})
+	assert.False(t, revocations.isRevoked(newUser(jose.Claims{"sid": "old", "iat": float64(now.Add(time.Minute).Unix())})))
+}
+
+func TestBackchannelLogoutHandler(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableBackchannelLogout = true
+	_, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	request := func() int {
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL+"/test", nil)
+		req.Header.Set("Authorization", "Bearer "+signed.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+	logout := func(token string) int {
+		resp, err := http.PostForm(svc+oauthURL+backchannelURL, url.Values{"logout_token": {token}})
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, request())
+
+	// step: an unsigned or invalid token should be rejected
+	unsigned, _ := jose.NewJWT(jose.JOSEHeader{"alg": "RS256"}, newTestLogoutClaims(idp.getLocation()))
+	assert.Equal(t, http.StatusBadRequest, logout(unsigned.Encode()))
+	assert.Equal(t, http.StatusBadRequest, logout("not a token"))
+	assert.Equal(t, http.StatusOK, request())
+
+	logoutToken, _ := idp.signToken(newTestLogoutClaims(idp.getLocation()))
+	assert.Equal(t, http.StatusOK, logout(logoutToken.Encode()))
+	assert.Equal(t, http.StatusTemporaryRedirect, request())
+}
+
+func TestBackchannelLogoutHandlerStore(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableBackchannelLogout = true
+	proxy, idp, svc := newTestProxyService(cfg)
+	store := &fakeStore{items: make(map[string]string)}
+	proxy.store = store
+	assert.NoError(t, proxy.revocations.share(store))
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+	assert.NoError(t, proxy.StoreRefreshToken(*signed, "refresh", time.Hour))
+
+	logoutToken, _ := idp.signToken(newTestLogoutClaims(idp.getLocation()))
+	resp, err := http.PostForm(svc+oauthURL+backchannelURL, url.Values{"logout_token": {logoutToken.Encode()}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// step: the refresh token is removed from the store and the revocation seen by the other instances
+	_, err = proxy.GetRefreshToken(*signed)
+	assert.Error(t, err)
+	other := newSessionRevocations()
+	assert.NoError(t, other.share(store))
+	user, err := extractIdentity(*signed)
+	if assert.NoError(t, err) {
+		assert.True(t, other.isRevoked(user))
+	}
+}
+
+func TestRevokeSessionHandler(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableSessionRevocation = true
+	cfg.AdminRoles = []string{fakeAdminRole}
+	_, idp, svc := newTestProxyService(cfg)
+	newToken := func(subject, email string, roles []string) string {
+		signed, _ := idp.signToken(jose.Claims{
+			"iss":          idp.getLocation(),
+			"aud":          fakeClientID,
+			"sub":          subject,
+			"email":        email,
+			"iat":          float64(time.Now().Add(-time.Minute).Unix()),
+			"exp":          float64(time.Now().Add(time.Hour).Unix()),
+			"realm_access": map[string]interface{}{"roles": roles},
+		})
+		return signed.Encode()
+	}
+	admin := newToken("7d0f2a4e-5e5c-4f57-9d0e-8e2c1b3a4f60", "admin@example.com", []string{fakeAdminRole})
+	user := newToken("1e11e539-8256-4b3b-bda8-cc0d56cddb48", "user@example.com", []string{})
+
+	request := func(method, location, token string) int {
+		req, _ := http.NewRequest(method, svc+location, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+	revokeURL := oauthURL + adminURL + sessionsURL + "/user@example.com"
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, fakeAuthAllURL+"/test", user))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodDelete, revokeURL, user))
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, fakeAuthAllURL+"/test", user))
+
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, revokeURL, admin))
+	assert.Equal(t, http.StatusTemporaryRedirect, request(http.MethodGet, fakeAuthAllURL+"/test", user))
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, fakeAuthAllURL+"/test", admin))
+}
+
+func TestRevokeSessionHandlerStore(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableSessionRevocation = true
+	cfg.AdminRoles = []string{fakeAdminRole}
+	proxy, idp, svc := newTestProxyService(cfg)
+	store := &fakeStore{items: make(map[string]string)}
+	proxy.store = store
+	assert.NoError(t, proxy.revocations.share(store))
+	newToken := func(subject, email string, roles []string) *jose.JWT {
+		signed, _ := idp.signToken(jose.Claims{
+			"iss":           idp.getLocation(),
+			"aud":           fakeClientID,
+			"sub":           subject,
+			"email":         email,
+			"session_state": subject + "-session",
+			"iat":           float64(time.Now().Add(-time.Minute).Unix()),
+			"exp":           float64(time.Now().Add(time.Hour).Unix()),
+			"realm_access":  map[string]interface{}{"roles": roles},
+		})
+		return signed
+	}
+	admin := newToken("7d0f2a4e-5e5c-4f57-9d0e-8e2c1b3a4f60", "admin@example.com", []string{fakeAdminRole})
+	user := newToken("1e11e539-8256-4b3b-bda8-cc0d56cddb48", "user@example.com", []string{})
+	assert.NoError(t, proxy.StoreRefreshToken(*user, "refresh", time.Hour))
+	session, err := proxy.createServerSession(*user, "refresh", time.Hour)
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.StoreRefreshToken(*admin, "refresh", time.Hour))
+
+	req, _ := http.NewRequest(http.MethodDelete, svc+oauthURL+adminURL+sessionsURL+"/user@example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+admin.Encode())
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// step: the tokens of the user are removed from the store, those of the others kept
+	_, err = proxy.GetRefreshToken(*user)
+	assert.Error(t, err)
+	_, err = proxy.getServerSession(session)
+	assert.Error(t, err)
+	_, err = proxy.GetRefreshToken(*admin)
+	assert.NoError(t, err)
+
+	// step: the revocation is seen by the other instances sharing the store
+	other := newSessionRevocations()
+	assert.NoError(t, other.share(store))
+	revoked, _ := extractIdentity(*user)
+	assert.True(t, other.isRevoked(revoked))
+	kept, _ := extractIdentity(*admin)
+	assert.False(t, other.isRevoked(kept))
+}
+
+func TestBackchannelLogoutHandlerDisabled(t *testing.T) {
+	_, _, svc := newTestProxyService(nil)
+	resp, err := http.PostForm(svc+oauthURL+backchannelURL, url.Values{"logout_token": {"a"}})
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+	}
+}
+
+func TestFrontchannelLogoutHandler(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableFrontchannelLogout = true
+	cfg.EnableFrameDeny = true
+	cfg.EnableSecurityFilter = true
+	_, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	cs := []struct {
+		Query   string
+		Cookie  bool
+		Code    int
+		Cleared bool
+	}{
+		{Code: http.StatusOK},
+		{Cookie: true, Code: http.StatusOK, Cleared: true},
+		{Query: "?sid=98f4c3d2-1b8c-4932-b8c4-92ec0ea7e195&iss=" + url.QueryEscape(idp.getLocation()), Cookie: true, Code: http.StatusOK, Cleared: true},
+		{Query: "?sid=another", Cookie: true, Code: http.StatusOK},
+		{Query: "?iss=http://another", Cookie: true, Code: http.StatusBadRequest},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest(http.MethodGet, svc+oauthURL+frontchannelURL+c.Query, nil)
+		if c.Cookie {
+			req.AddCookie(&http.Cookie{Name: cfg.CookieAccessName, Value: signed.Encode()})
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.Code, resp.StatusCode, "case %d", i)
+		assert.Empty(t, resp.Header.Get("X-Frame-Options"), "case %d", i)
+		var cleared bool
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == cfg.CookieAccessName && cookie.Expires.Before(time.Now()) {
+				cleared = true
+			}
+		}
+		assert.Equal(t, c.Cleared, cleared, "case %d", i)
+	}
+}
+
+// countingStore counts the retrievals from the store, which like the real stores hands back an empty value for a
+// missing key
+type countingStore struct {
+	*fakeStore
+	gets int32
+}
+
+func (r *countingStore) Get(key string) (string, error) {
+	atomic.AddInt32(&r.gets, 1)
+	r.RLock()
+	defer r.RUnlock()
+	return r.items[key], nil
+}
+
+func (r *countingStore) getCount() int {
+	return int(atomic.LoadInt32(&r.gets))
+}
+
+func TestSessionRevocationsMisses(t *testing.T) {
+	store := &countingStore{fakeStore: &fakeStore{items: make(map[string]string)}}
+	revocations := newSessionRevocations()
+	assert.NoError(t, revocations.share(store))
+	user := &userContext{id: "sub", email: "user@example.com", claims: jose.Claims{"sid": "a"}}
+
+	// step: the misses are remembered, sparing the store a lookup on every request
+	assert.False(t, revocations.isRevoked(user))
+	assert.Equal(t, 3, store.getCount())
+	assert.False(t, revocations.isRevoked(user))
+	assert.Equal(t, 3, store.getCount())
+
+	// step: a revocation by another instance is honoured once the misses have lapsed
+	other := newSessionRevocations()
+	assert.NoError(t, other.share(store))
+	assert.NoError(t, other.revokeIdentity("a", time.Now()))
+	assert.False(t, revocations.isRevoked(user))
+	revocations.Lock()
+	for key := range revocations.misses {
+		revocations.misses[key] = time.Now().Add(-time.Second)
+	}
+	revocations.Unlock()
+	assert.True(t, revocations.isRevoked(user))
+
+	// step: a revocation made here is honoured there and then
+	revocations = newSessionRevocations()
+	assert.NoError(t, revocations.share(store))
+	user.claims = jose.Claims{"sid": "b", "iat": float64(time.Now().Add(-time.Minute).Unix())}
+	assert.False(t, revocations.isRevoked(user))
+	assert.NoError(t, revocations.revokeIdentity("user@example.com", time.Now()))
+	assert.True(t, revocations.isRevoked(user))
+}
+
+func TestRevocationAfterVerification(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableBackchannelLogout = true
+	proxy, idp, svc := newTestProxyService(cfg)
+	store := &countingStore{fakeStore: &fakeStore{items: make(map[string]string)}}
+	assert.NoError(t, proxy.revocations.share(store))
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+	forged := token.getToken()
+
+	request := func(token string) int {
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL+"/test", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// step: the claims of a token failing the verification are never looked up
+	assert.Equal(t, http.StatusForbidden, request(forged.Encode()))
+	assert.Equal(t, 0, store.getCount())
+
+	assert.Equal(t, http.StatusOK, request(signed.Encode()))
+	lookups := store.getCount()
+	assert.NotZero(t, lookups)
+	assert.Equal(t, http.StatusOK, request(signed.Encode()))
+	assert.Equal(t, lookups, store.getCount())
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// defaultMaintenanceBody is used when no custom maintenance page or message is given
+	defaultMaintenanceBody = "the service is down for maintenance, please try again later\n"
+)
+
+// maintenanceSettings are the settings of the maintenance mode
+type maintenanceSettings struct {
+	// Enabled indicates the proxy is in maintenance mode
+	Enabled bool `json:"enabled"`
+	// Message is displayed to the users while in maintenance
+	Message string `json:"message,omitempty"`
+	// RetryAfter is the seconds the clients are told to retry after, zero omits the header
+	RetryAfter int `json:"retry-after,omitempty"`
+	// Since is when the maintenance mode was enabled
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// isValid validates the maintenance settings
+func (r maintenanceSettings) isValid() error {
+	if r.RetryAfter < 0 {
+		return errors.New("the retry-after cannot be negative")
+	}
+
+	return nil
+}
+
+// maintenanceMode holds the maintenance mode of the proxy, it's safe to use from multiple goroutines
+type maintenanceMode struct {
+	sync.RWMutex
+	// the current settings
+	settings maintenanceSettings
+	// the custom maintenance page, if any
+	page *template.Template
+}
+
+// newMaintenanceMode creates the maintenance mode, disabled, loading the custom page if given
+func newMaintenanceMode(page string) (*maintenanceMode, error) {
+	mode := &maintenanceMode{}
+	if page != "" {
+		log.Debugf("loading the custom maintenance page: %s", page)
+		tmpl, err := template.ParseFiles(page)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the maintenance page, error: %s", err)
+		}
+		mode.page = tmpl
+	}
+
+	return mode, nil
+}
+
+// get returns the current maintenance settings
+func (r *maintenanceMode) get() maintenanceSettings {
+	if r == nil {
+		return maintenanceSettings{}
+	}
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.settings
+}
+
+// set updates the maintenance settings, keeping the time it was enabled
+func (r *maintenanceMode) set(settings maintenanceSettings) error {
+	if err := settings.isValid(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	settings.Since = nil
+	if settings.Enabled {
+		since := time.Now()
+		if r.settings.Enabled {
+			since = *r.settings.Since
+		}
+		settings.Since = &since
+	}
+	r.settings = settings
+
+	return nil
+}
+
+// isEnabled checks if the proxy is in maintenance mode
+func (r *maintenanceMode) isEnabled() bool {
+	return r.get().Enabled
+}
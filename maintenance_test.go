@@ -0,0 +1,115 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceModeSettings(t *testing.T) {
+	var disabled *maintenanceMode
+	assert.False(t, disabled.isEnabled())
+
+	mode, err := newMaintenanceMode("")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Error(t, mode.set(maintenanceSettings{Enabled: true, RetryAfter: -1}))
+	assert.False(t, mode.isEnabled())
+
+	assert.NoError(t, mode.set(maintenanceSettings{Enabled: true}))
+	assert.True(t, mode.isEnabled())
+	since := mode.get().Since
+	if !assert.NotNil(t, since) {
+		t.FailNow()
+	}
+	// step: updating the message keeps the time the maintenance started
+	assert.NoError(t, mode.set(maintenanceSettings{Enabled: true, Message: "upgrading the database"}))
+	assert.Equal(t, *since, *mode.get().Since)
+
+	assert.NoError(t, mode.set(maintenanceSettings{}))
+	assert.False(t, mode.isEnabled())
+	assert.Nil(t, mode.get().Since)
+
+	_, err = newMaintenanceMode("/does/not/exist")
+	assert.Error(t, err)
+}
+
+func TestMaintenanceHandler(t *testing.T) {
+	page, err := ioutil.TempFile("", "maintenance-page")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.Remove(page.Name())
+	page.WriteString(`<p>{{ .message }}</p>`)
+	page.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableMaintenanceMode = true
+	cfg.MaintenancePage = page.Name()
+	cfg.AdminRoles = []string{fakeAdminRole}
+	p, idp, svc := newTestProxyService(cfg)
+	requrl := svc + oauthURL + adminURL + maintenanceURL
+
+	token := newTestToken(idp.getLocation())
+	token.setRealmsRoles([]string{fakeAdminRole})
+	signed, _ := idp.signToken(token.claims)
+	client := resty.New().SetAuthToken(signed.Encode())
+
+	resp, err := resty.New().R().SetBody(`{"enabled": true}`).Put(requrl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+	assert.False(t, p.maintenance.isEnabled())
+
+	resp, err = client.R().SetBody(`{"enabled": true, "retry-after": -1}`).Put(requrl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+	resp, err = client.R().SetBody(`{"enabled": true, "message": "back at noon", "retry-after": 3600}`).Put(requrl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.True(t, p.maintenance.isEnabled())
+
+	resp, err = client.R().Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode())
+	assert.Equal(t, "3600", resp.Header().Get("Retry-After"))
+	assert.Equal(t, "<p>back at noon</p>", string(resp.Body()))
+
+	// step: the white-listed resources and the oauth endpoints are still served
+	resp, err = client.R().Get(svc + fakeTestWhitelistedURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	resp, err = client.R().Get(svc + oauthURL + healthURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	resp, err = client.R().Delete(requrl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.False(t, p.maintenance.isEnabled())
+
+	resp, err = client.R().Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+}
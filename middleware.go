@@ -16,8 +16,15 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"net/http"
 	"regexp"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,8 +38,94 @@ import (
 const (
 	// cxEnforce is the tag name for a request requiring
 	cxEnforce = "Enforcing"
+	// cxProbe is the tag name for a health check probe passed through to the upstream
+	cxProbe = "Probe"
 )
 
+// recoveryMiddleware recovers from any panics in the handlers, logging the stack along with the request
+// and user and returning a clean 500 carrying a reference to the log entry
+func (r *oauthProxy) recoveryMiddleware() gin.HandlerFunc {
+	panics := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "http_request_panics_total",
+			Help: "The number of panics recovered while handling requests",
+		},
+	)
+	panics = prometheus.MustRegisterOrGet(panics).(prometheus.Counter)
+
+	return func(cx *gin.Context) {
+		defer func() {
+			if err := recover(); err != nil {
+				panics.Inc()
+				// step: use the correlation id if given, else generate one for the user to quote
+				id := cx.Request.Header.Get(correlationHeader)
+				if id == "" {
+					b := make([]byte, 8)
+					rand.Read(b)
+					id = hex.EncodeToString(b)
+				}
+				fields := log.Fields{
+					"error":      fmt.Sprintf("%v", err),
+					"request_id": id,
+					"client_ip":  cx.ClientIP(),
+					"method":     cx.Request.Method,
+					"path":       cx.Request.URL.Path,
+					"stack":      string(debug.Stack()),
+				}
+				if v, found := cx.Get(userContextName); found {
+					fields["username"] = v.(*userContext).name
+				}
+				log.WithFields(fields).Errorf("recovered from a panic handling the request")
+
+				if !cx.Writer.Written() {
+					cx.String(http.StatusInternalServerError, "an internal error occurred handling the request, reference: %s\n", id)
+				}
+				cx.Abort()
+			}
+		}()
+
+		cx.Next()
+	}
+}
+
+// hopByHopMiddleware removes the hop-by-hop headers from the request; this must run before the
+// identity headers are added, else a client could list them in the Connection header to have them
+// removed before reaching the upstream
+func (r *oauthProxy) hopByHopMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		stripHopByHopHeaders(cx.Request.Header)
+	}
+}
+
+// normalizeMiddleware normalizes the path of the request before the resources are matched, so a dot segment or
+// duplicate slash can't be used to step around a protected resource; the upstream receives the normalized path,
+// ensuring it serves the resource we matched. The paths needing no normalization are passed on untouched, keeping
+// their encoding, i.e. an %2F in a segment, and the paths encoded twice are refused rather than guessed at
+func (r *oauthProxy) normalizeMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if isDoubleEncoded(cx.Request.URL.Path) {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"path":      cx.Request.URL.EscapedPath(),
+			}).Warnf("refusing the request, the path has been encoded twice")
+
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if normalized := normalizePath(cx.Request.URL.Path); normalized != cx.Request.URL.Path {
+			log.WithFields(log.Fields{
+				"client_ip":  cx.ClientIP(),
+				"normalized": normalized,
+				"path":       cx.Request.URL.Path,
+			}).Debugf("normalized the path of the request")
+
+			cx.Request.URL.Path = normalized
+			cx.Request.URL.RawPath = ""
+			cx.Request.RequestURI = cx.Request.URL.RequestURI()
+		}
+	}
+}
+
 // loggingMiddleware is a custom http logger
 func (r *oauthProxy) loggingMiddleware() gin.HandlerFunc {
 	return func(cx *gin.Context) {
@@ -53,7 +146,7 @@ func (r *oauthProxy) loggingMiddleware() gin.HandlerFunc {
 
 // metricsMiddleware is responsible for collecting metrics
 func (r *oauthProxy) metricsMiddleware() gin.HandlerFunc {
-	log.Infof("enabled the service metrics middleware, available on %s%s", oauthURL, metricsURL)
+	log.Infof("enabled the service metrics middleware, available on %s", r.config.withOAuthURI(metricsURL))
 
 	statusMetrics := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -63,32 +156,203 @@ func (r *oauthProxy) metricsMiddleware() gin.HandlerFunc {
 		[]string{"code", "method"},
 	)
 
+	probeMetrics := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_probe_request_total",
+			Help: "The health check probes passed through to the upstream partitioned by status code and path",
+		},
+		[]string{"code", "path"},
+	)
+
 	// step: register the metric with prometheus
-	prometheus.MustRegisterOrGet(statusMetrics)
+	statusMetrics = prometheus.MustRegisterOrGet(statusMetrics).(*prometheus.CounterVec)
+	probeMetrics = prometheus.MustRegisterOrGet(probeMetrics).(*prometheus.CounterVec)
 
 	return func(cx *gin.Context) {
 		// step: permit to next stage
 		cx.Next()
-		// step: update the metrics
+		// step: update the metrics, the probes are counted separately so they don't skew the requests
+		if _, found := cx.Get(cxProbe); found {
+			probeMetrics.WithLabelValues(fmt.Sprintf("%d", cx.Writer.Status()), cx.Request.URL.Path).Inc()
+			return
+		}
 		statusMetrics.WithLabelValues(fmt.Sprintf("%d", cx.Writer.Status()), cx.Request.Method).Inc()
 	}
 }
 
+// requestTimeoutMiddleware applies a deadline to the request, propagated to the verification, refresh,
+// store and upstream calls
+func (r *oauthProxy) requestTimeoutMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		ctx, cancel := context.WithTimeout(cx.Request.Context(), r.config.RequestTimeout)
+		defer cancel()
+		cx.Request = cx.Request.WithContext(ctx)
+
+		cx.Next()
+	}
+}
+
+// timingMiddleware records the phase timings of the request, logging those slower than the threshold and
+// adding the Server-Timing header when enabled
+func (r *oauthProxy) timingMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		start := time.Now()
+		timings := newRequestTimings()
+		cx.Request = withTimings(cx.Request, timings)
+		if r.config.EnableServerTiming {
+			cx.Writer = &serverTimingWriter{ResponseWriter: cx.Writer, start: start, timings: timings}
+		}
+
+		cx.Next()
+
+		total := time.Since(start)
+		// step: gin writes the headers of an empty response after the handlers
+		if r.config.EnableServerTiming && !cx.Writer.Written() {
+			cx.Writer.Header().Set(serverTimingHeader, timings.serverTiming(total))
+		}
+		if r.config.SlowRequestThreshold <= 0 || total < r.config.SlowRequestThreshold {
+			return
+		}
+		fields := log.Fields{
+			"client_ip": cx.ClientIP(),
+			"method":    cx.Request.Method,
+			"path":      cx.Request.URL.Path,
+			"status":    cx.Writer.Status(),
+			phaseTotal:  total.String(),
+		}
+		for _, phase := range timingPhases {
+			if duration, found := timings.get(phase); found {
+				fields[phase] = duration.String()
+			}
+		}
+		if v, found := cx.Get(userContextName); found {
+			fields["username"] = v.(*userContext).name
+		}
+		log.WithFields(fields).Warnf("slow request, exceeded the threshold of %s", r.config.SlowRequestThreshold)
+	}
+}
+
+// captureMiddleware records the auth flows for any captures in progress
+func (r *oauthProxy) captureMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		cx.Next()
+		// step: quick check to see if we are capturing anything
+		if !r.recorder.isActive() || strings.HasPrefix(cx.Request.URL.Path, r.config.withOAuthURI(adminURL)) {
+			return
+		}
+		event := captureEvent{
+			Time:   time.Now(),
+			Method: cx.Request.Method,
+			Path:   cx.Request.URL.Path,
+			Status: cx.Writer.Status(),
+		}
+		if location := cx.Writer.Header().Get("Location"); location != "" {
+			event.Location = sanitizeLocation(location)
+		}
+		for _, err := range cx.Errors {
+			event.Errors = append(event.Errors, err.Error())
+		}
+		var user *userContext
+		if v, found := cx.Get(userContextName); found {
+			user = v.(*userContext)
+			event.Claims = summarizeClaims(user)
+		}
+
+		r.recorder.record(event, user, cx.Request.Header.Get(correlationHeader))
+	}
+}
+
 // entrypointMiddleware checks to see if the request requires authentication
 func (r *oauthProxy) entrypointMiddleware() gin.HandlerFunc {
+	webhooks := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_requests_total",
+			Help: "The signed webhook requests partitioned by webhook and result",
+		},
+		[]string{"webhook", "result"},
+	)
+	webhooks = prometheus.MustRegisterOrGet(webhooks).(*prometheus.CounterVec)
+	basicAuth := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "basic_auth_requests_total",
+			Help: "The requests of the static basic auth users partitioned by user and result",
+		},
+		[]string{"user", "result"},
+	)
+	basicAuth = prometheus.MustRegisterOrGet(basicAuth).(*prometheus.CounterVec)
+
 	return func(cx *gin.Context) {
 		// step: we can skip if under oauth prefix
-		if strings.HasPrefix(cx.Request.URL.Path, oauthURL) {
+		if strings.HasPrefix(cx.Request.URL.Path, r.config.withOAuthURI("")) {
+			return
+		}
+		// step: the health check probes of the upstream are passed straight through
+		if r.isProbeRequest(cx.Request) {
+			cx.Set(cxProbe, true)
 			return
 		}
 
 		// step: check if authentication is required - gin doesn't support wildcard url
 		// so we have to use prefixes
-		for _, resource := range r.config.Resources {
-			if strings.HasPrefix(cx.Request.URL.Path, resource.URL) {
+		for _, resource := range r.getResources() {
+			if resource.matches(cx.Request.Host, cx.Request.URL.Path, cx.Request.URL.Query()) {
 				if resource.WhiteListed {
 					break
 				}
+				// step: a signed webhook is permitted in place of the authentication
+				if resource.Webhook != "" && hasWebhookSignature(cx.Request) && isWebhookRequest(resource, cx.Request) {
+					secret := []byte(r.config.WebhookSecrets[resource.Webhook])
+					err := verifyWebhookSignature(cx.Request, secret, resource.MaxUploadSize)
+					if err == nil {
+						err = r.checkWebhookReplay(cx.Request)
+					}
+					if err != nil {
+						log.WithFields(log.Fields{
+							"client_ip": cx.ClientIP(),
+							"error":     err.Error(),
+							"webhook":   resource.Webhook,
+						}).Warnf("rejecting the webhook, unable to verify the signature")
+
+						webhooks.WithLabelValues(resource.Webhook, "rejected").Inc()
+						if err == errUploadTooLarge {
+							cx.AbortWithStatus(http.StatusRequestEntityTooLarge)
+							return
+						}
+						cx.AbortWithStatus(http.StatusUnauthorized)
+						return
+					}
+					webhooks.WithLabelValues(resource.Webhook, "verified").Inc()
+					break
+				}
+				// step: the static users are permitted in place of the authentication, when enabled
+				if r.config.EnableBasicAuth && len(resource.BasicAuth) > 0 {
+					if username, password, found := cx.Request.BasicAuth(); found {
+						fields := log.Fields{
+							"client_ip": cx.ClientIP(),
+							"method":    cx.Request.Method,
+							"path":      cx.Request.URL.Path,
+							"username":  username,
+						}
+						if err := r.verifyBasicAuth(resource, username, password); err != nil {
+							fields["error"] = err.Error()
+							log.WithFields(fields).Warnf("rejecting the static basic auth user")
+
+							// step: the unknown users are not recorded, the label would be unbounded
+							if _, known := r.config.BasicAuthUsers[username]; !known {
+								username = "unknown"
+							}
+							basicAuth.WithLabelValues(username, "rejected").Inc()
+							cx.AbortWithStatus(http.StatusUnauthorized)
+							return
+						}
+						log.WithFields(fields).Warnf("permitting the static basic auth user, bypassing the authentication")
+
+						basicAuth.WithLabelValues(username, "permitted").Inc()
+						// step: the password is not for the upstream
+						cx.Request.Header.Del(authorizationHeader)
+						break
+					}
+				}
 				// step: inject the resource into the context, saves us from doing this again
 				if containedIn("ANY", resource.Methods) || containedIn(cx.Request.Method, resource.Methods) {
 					cx.Set(cxEnforce, resource)
@@ -121,6 +385,11 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 				"error": err.Error(),
 			}).Errorf("no session found in request, redirecting for authorization")
 
+			// step: there is no point redirecting the clients of the api keys
+			if err == ErrInvalidAPIKey {
+				cx.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
 			r.redirectToAuthorization(cx)
 			return
 		}
@@ -128,6 +397,40 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 		// step: inject the user into the context
 		cx.Set(userContextName, user)
 
+		// step: has the session been idle for longer than permitted?
+		if r.isIdleSession(cx, user) {
+			log.WithFields(log.Fields{
+				"client_ip": clientIP,
+				"username":  user.name,
+			}).Warnf("the session has exceeded the idle timeout, redirecting for authorization")
+
+			r.clearAllCookies(cx)
+			if r.useStore() {
+				go func() {
+					if err := r.deleteStoredSession(user); err != nil {
+						log.WithFields(log.Fields{
+							"error": err.Error(),
+						}).Errorf("unable to remove the refresh token from store")
+					}
+				}()
+			}
+			// step: the user must sign in again, else the provider hands back its session silently
+			r.redirectToAuthorizationWithPrompt(cx, "login")
+			return
+		}
+
+		// step: is the login older than permitted?
+		if r.config.MaxAuthenticationAge > 0 && time.Since(user.sessionStarted()) > r.config.MaxAuthenticationAge {
+			log.WithFields(log.Fields{
+				"client_ip":  clientIP,
+				"username":   user.name,
+				"started_on": user.sessionStarted().String(),
+			}).Warnf("the login has exceeded the max authentication age, redirecting for re-authentication")
+
+			r.redirectToReauthentication(cx)
+			return
+		}
+
 		// step: skipif we are running skip-token-verification
 		if r.config.SkipTokenVerification {
 			log.Warnf("skip token verification enabled, skipping verification process - FOR TESTING ONLY")
@@ -140,12 +443,48 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 				}).Errorf("the session has expired and verification switch off")
 
 				r.redirectToAuthorization(cx)
+				return
 			}
+			// step: nothing is verified here, but the revocations are honoured all the same
+			r.rejectRevokedSession(cx, user)
 
 			return
 		}
 
-		if err := verifyToken(r.client, user.token); err != nil {
+		// step: verify the token, giving up if the client goes away or the request deadline expires; an opaque
+		// token has already been validated by the introspection
+		verifyStart := time.Now()
+		err = r.verifier.verify(cx.Request.Context(), func() error {
+			if user.opaque {
+				return nil
+			}
+			return r.verifyJWT(user.token)
+		})
+		// step: check the session hasn't been revoked at the provider since the token was issued
+		if err == nil && !user.opaque {
+			err = r.verifyActive(user)
+		}
+		getTimings(cx.Request).observe(phaseAuth, verifyStart)
+		if err == ErrVerificationOverloaded {
+			log.WithFields(log.Fields{
+				"client_ip": clientIP,
+			}).Warnf("rejecting the request, the token verification queue is full")
+
+			cx.Header("Retry-After", "1")
+			cx.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+		if err == ErrTokenInactive {
+			log.WithFields(log.Fields{
+				"client_ip": clientIP,
+				"username":  user.name,
+			}).Warnf("the access token is no longer active at the provider")
+
+			r.clearAllCookies(cx)
+			r.redirectToAuthorization(cx)
+			return
+		}
+		if err != nil {
 			// step: if the error post verification is anything other than a token expired error
 			// we immediately throw an access forbidden - as there is something messed up in the token
 			if err != ErrAccessTokenExpired {
@@ -166,7 +505,7 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 					"client_ip":  clientIP,
 				}).Errorf("session expired and access token refreshing is disabled")
 
-				r.redirectToAuthorization(cx)
+				r.redirectToLogin(cx)
 				return
 			}
 
@@ -184,12 +523,34 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 					"client_ip": clientIP,
 				}).Errorf("unable to find a refresh token for user")
 
-				r.redirectToAuthorization(cx)
+				r.redirectToLogin(cx)
 				return
 			}
 
-			// attempt to refresh the access token
-			token, _, err := getRefreshedToken(r.client, refresh)
+			// attempt to refresh the access token; the refresh is seen through even if the client goes away, as
+			// the provider may have rotated the refresh token, which is persisted below else the session is lost
+			refreshStart := time.Now()
+			token, rotated, _, err := getRefreshedToken(r.client, refresh, r.decryptionKey)
+			getTimings(cx.Request).observe(phaseRefresh, refreshStart)
+			if err == nil && r.faults.failRefresh() {
+				err = ErrFaultInjected
+			}
+			// step: the provider is rate limiting the refreshes, rather than sending the user to login, which
+			// only adds to the load, we ask the client to come back once it has cooled down
+			if err != nil && err != ErrRefreshTokenExpired {
+				if wait := r.getProviderThrottle(); wait > 0 {
+					log.WithFields(log.Fields{
+						"client_ip":   clientIP,
+						"email":       user.email,
+						"retry_after": wait.String(),
+					}).Warnf("unable to refresh the access token, the provider is rate limiting the requests")
+
+					r.stats.refreshFailed()
+					cx.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+					cx.AbortWithStatus(http.StatusServiceUnavailable)
+					return
+				}
+			}
 			if err != nil {
 				switch err {
 				case ErrRefreshTokenExpired:
@@ -202,34 +563,63 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 				default:
 					log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to refresh the access token")
 				}
+				r.stats.refreshFailed()
+				cx.Error(err)
 
 				r.redirectToAuthorization(cx)
 				return
 			}
 
-			// get the expiration of the new access token
-			expiresIn := r.getAccessCookieExpiration(token, refresh)
+			// step: the provider may have rotated the refresh token, in which case we must keep the new one, the
+			// old one is no longer usable and the next refresh would fail
+			encrypted, err := r.encryptSessionState(rotated)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to encrypt the refresh token")
 
-			log.WithFields(log.Fields{
-				"client_ip":   clientIP,
-				"cookie_name": r.config.CookieAccessName,
-				"email":       user.email,
-				"expires_in":  expiresIn.String(),
-			}).Infof("injecting the refreshed access token cookie")
+				r.redirectToAuthorization(cx)
+				return
+			}
 
-			// step: inject the refreshed access token
-			r.dropAccessTokenCookie(cx, token.Encode(), expiresIn)
+			r.recordRefresh(user, clientIP, r.getRefreshCookieExpiration(rotated))
 
-			if r.useStore() {
-				go func(old, new jose.JWT, state string) {
-					if err := r.DeleteRefreshToken(old); err != nil {
-						log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to remove old token")
-					}
-					if err := r.StoreRefreshToken(new, state); err != nil {
-						log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to store refresh token")
-						return
+			// step: a server side session is updated in place, the cookie carrying the id is unchanged
+			if user.serverSession != "" {
+				if err := r.updateServerSession(user.serverSession, token, rotated, r.getRefreshCookieExpiration(rotated)); err != nil {
+					log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to update the server side session")
+
+					r.redirectToAuthorization(cx)
+					return
+				}
+			} else {
+				// get the expiration of the new access token
+				expiresIn := r.getAccessCookieExpiration(token, rotated)
+
+				log.WithFields(log.Fields{
+					"client_ip":  clientIP,
+					"session":    r.getSessionName(cx.Request),
+					"email":      user.email,
+					"expires_in": expiresIn.String(),
+				}).Infof("injecting the refreshed access token cookie")
+
+				// step: inject the refreshed access token
+				r.dropAccessTokenCookie(cx, token.Encode(), expiresIn)
+
+				switch r.useStore() {
+				case true:
+					go func(old, new jose.JWT, state string, expiration time.Duration) {
+						if err := r.DeleteRefreshToken(old); err != nil {
+							log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to remove old token")
+						}
+						if err := r.StoreRefreshToken(new, state, expiration); err != nil {
+							log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to store refresh token")
+							return
+						}
+					}(user.token, token, encrypted, r.getRefreshCookieExpiration(rotated))
+				default:
+					if rotated != refresh {
+						r.dropRefreshTokenCookie(cx, encrypted, r.getRefreshCookieExpiration(rotated))
 					}
-				}(user.token, token, refresh)
+				}
 			}
 
 			// step: update the with the new access token
@@ -238,11 +628,44 @@ func (r *oauthProxy) authenticationMiddleware() gin.HandlerFunc {
 			// step: inject the user into the context
 			cx.Set(userContextName, user)
 		}
+		// step: has the session been logged out by the provider? the token is checked only once verified, so
+		// the claims looked up in the store are those of the provider
+		if r.rejectRevokedSession(cx, user) {
+			return
+		}
+		// step: the login has worked, so any redirects counted were not a loop
+		r.clearLoginRedirects(cx)
 
 		cx.Next()
 	}
 }
 
+// rejectRevokedSession clears the cookies and stored session of a session logged out by the provider or revoked,
+// and redirects the user for authorization
+func (r *oauthProxy) rejectRevokedSession(cx *gin.Context, user *userContext) bool {
+	if !r.revocations.isRevoked(user) {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+		"username":  user.name,
+	}).Warnf("the session has been logged out by the provider or revoked")
+
+	r.clearAllCookies(cx)
+	if r.useStore() {
+		go func() {
+			if err := r.deleteStoredSession(user); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Errorf("unable to remove the refresh token from store")
+			}
+		}()
+	}
+	r.redirectToAuthorization(cx)
+
+	return true
+}
+
 // admissionMiddleware is responsible checking the access token against the protected resource
 func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 	// step: compile the regex's for the claims
@@ -260,8 +683,8 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 		resource := cx.MustGet(cxEnforce).(*Resource)
 		user := cx.MustGet(userContextName).(*userContext)
 
-		// step: check the audience for the token is us
-		if r.config.ClientID != "" && !user.isAudience(r.config.ClientID) {
+		// step: check the audience for the token is us, or one of the accepted audiences
+		if !r.isAcceptedAudience(user) {
 			log.WithFields(log.Fields{
 				"email":      user.email,
 				"expired_on": user.expiresAt.String(),
@@ -272,9 +695,42 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 			r.accessForbidden(cx)
 			return
 		}
+		// step: check the token was issued to a permitted client
+		if err := r.verifyAuthorizedParty(user.claims); err != nil {
+			log.WithFields(log.Fields{
+				"email":    user.email,
+				"required": strings.Join(r.config.AuthorizedParties, ","),
+			}).Warnf("access token was issued to a client not permitted")
+
+			r.accessForbidden(cx)
+			return
+		}
+
+		// step: the authorization services decide the permissions in place of the roles
+		if r.authorizer != nil {
+			granted, err := r.authorizer.isGranted(user, cx.Request.URL.Path, cx.Request.Method)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"email":    user.email,
+					"error":    err.Error(),
+					"resource": resource.URL,
+				}).Errorf("unable to retrieve the authorization decision from the provider")
+
+				r.accessForbidden(cx)
+				return
+			}
+			if !granted {
+				log.WithFields(log.Fields{
+					"access": "denied",
+					"email":  user.email,
+					"method": cx.Request.Method,
+					"path":   cx.Request.URL.Path,
+				}).Warnf("access denied, the permission was not granted by the authorization services")
 
-		// step: we need to check the roles
-		if roles := len(resource.Roles); roles > 0 {
+				r.accessForbidden(cx)
+				return
+			}
+		} else if roles := len(resource.Roles); roles > 0 {
 			if !hasRoles(resource.Roles, user.roles) {
 				log.WithFields(log.Fields{
 					"access":   "denied",
@@ -341,6 +797,110 @@ func (r *oauthProxy) admissionMiddleware() gin.HandlerFunc {
 	}
 }
 
+// adminMiddleware restricts the admin endpoints to users holding the admin roles
+func (r *oauthProxy) adminMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		user, err := r.getIdentity(cx.Request)
+		if err != nil {
+			cx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if r.config.SkipTokenVerification {
+			err = nil
+			if user.isExpired() {
+				err = ErrAccessTokenExpired
+			}
+		} else {
+			err = r.verifyJWT(user.token)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"error":     err.Error(),
+			}).Warnf("access token for the admin endpoint failed verification")
+
+			cx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if !hasRoles(r.config.AdminRoles, user.roles) {
+			log.WithFields(log.Fields{
+				"access":   "denied",
+				"email":    user.email,
+				"resource": cx.Request.URL.Path,
+				"required": strings.Join(r.config.AdminRoles, ","),
+			}).Warnf("access denied to the admin endpoint, invalid roles")
+
+			cx.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		cx.Set(userContextName, user)
+	}
+}
+
+// maintenanceMiddleware serves the maintenance page in place of all but the white-listed resources while in maintenance
+func (r *oauthProxy) maintenanceMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if !r.maintenance.isEnabled() || strings.HasPrefix(cx.Request.URL.Path, r.config.withOAuthURI("")) {
+			return
+		}
+		// step: the health check probes and white-listed resources are still passed on
+		if r.isProbeRequest(cx.Request) {
+			return
+		}
+		for _, resource := range r.getResources() {
+			if resource.matches(cx.Request.Host, cx.Request.URL.Path, cx.Request.URL.Query()) {
+				if resource.WhiteListed {
+					return
+				}
+				break
+			}
+		}
+		settings := r.maintenance.get()
+		if settings.RetryAfter > 0 {
+			cx.Header("Retry-After", strconv.Itoa(settings.RetryAfter))
+		}
+
+		// step: render the maintenance page, else the message
+		if r.maintenance.page != nil {
+			body := &bytes.Buffer{}
+			model := r.getTemplateModel(map[string]string{"message": settings.Message})
+			err := r.maintenance.page.Execute(body, model)
+			if err == nil {
+				writeResponse(cx, http.StatusServiceUnavailable, "text/html; charset=utf-8", body.Bytes())
+				cx.Abort()
+				return
+			}
+			log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to render the maintenance page")
+		}
+		message := defaultMaintenanceBody
+		if settings.Message != "" {
+			message = settings.Message + "\n"
+		}
+		writeResponse(cx, http.StatusServiceUnavailable, "text/plain; charset=utf-8", []byte(message))
+		cx.Abort()
+	}
+}
+
+// faultInjectionMiddleware delays a percentage of the requests when requested
+func (r *oauthProxy) faultInjectionMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if delay := r.faults.requestDelay(); delay > 0 {
+			log.WithFields(log.Fields{
+				"delay": delay.String(),
+				"path":  cx.Request.URL.Path,
+			}).Debugf("delaying the request, fault injected")
+
+			// step: the client may give up on the delayed request, there's no one to answer then
+			select {
+			case <-cx.Request.Context().Done():
+				cx.Abort()
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
 // corsMiddleware injects the CORS headers, if set, for request made to /oauth
 func (r *oauthProxy) corsMiddleware(c Cors) gin.HandlerFunc {
 	return func(cx *gin.Context) {
@@ -365,37 +925,94 @@ func (r *oauthProxy) corsMiddleware(c Cors) gin.HandlerFunc {
 	}
 }
 
-//
 // headersMiddleware is responsible for add the authentication headers for the upstream
-//
 func (r *oauthProxy) headersMiddleware(custom []string) gin.HandlerFunc {
 	// step: we don't wanna do this every time, quicker to perform once
 	customClaims := make(map[string]string)
 	for _, x := range custom {
 		customClaims[x] = fmt.Sprintf("X-Auth-%s", toHeader(x))
 	}
+	// step: the feature flag headers and the claim=value they are enabled by
+	featureFlags := make(map[string][]string)
+	for feature, x := range r.config.FeatureFlags {
+		featureFlags[fmt.Sprintf("X-Feature-%s", toHeader(feature))] = strings.SplitN(x, ":", 2)
+	}
 
 	return func(cx *gin.Context) {
+		// step: the decision is ours to make, never the client's
+		if r.config.EnableAuthDecisionHeader {
+			cx.Request.Header.Del(authDecisionHeader)
+		}
 		// step: add any custom headers to the request
-		for k, v := range r.config.Headers {
+		for k, v := range r.getCustomHeaders() {
 			cx.Request.Header.Set(k, v)
 		}
+		// step: add the provider urls, saving the upstream hardcoding the realm
+		if url, found := r.getProviderURLs()["account_url"]; found {
+			cx.Request.Header.Set("X-Auth-Account-Url", url)
+		}
+		if url, found := r.getProviderURLs()["logout_url"]; found {
+			cx.Request.Header.Set("X-Auth-Logout-Url", url)
+		}
+
+		// step: set the feature flags, overwriting any supplied by the client
+		for header, flag := range featureFlags {
+			enabled := false
+			if user, found := cx.Get(userContextName); found {
+				enabled = hasClaimValue(user.(*userContext).claims, flag[0], flag[1])
+			}
+			cx.Request.Header.Set(header, strconv.FormatBool(enabled))
+		}
 
 		// step: retrieve the user context if any
 		if user, found := cx.Get(userContextName); found {
 			id := user.(*userContext)
+			// step: the upstream receives the token of its audience when exchanging
+			token, err := r.getUpstreamToken(id)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"email": id.email,
+					"error": err.Error(),
+				}).Errorf("unable to exchange the access token for the upstream")
+
+				r.accessForbidden(cx)
+				return
+			}
 
 			cx.Request.Header.Set("X-Auth-Userid", id.name)
 			cx.Request.Header.Set("X-Auth-Subject", id.id)
 			cx.Request.Header.Set("X-Auth-Username", id.name)
 			cx.Request.Header.Set("X-Auth-Email", id.email)
 			cx.Request.Header.Set("X-Auth-ExpiresIn", id.expiresAt.String())
-			cx.Request.Header.Set("X-Auth-Token", id.token.Encode())
+			cx.Request.Header.Set("X-Auth-Token", token)
 			cx.Request.Header.Set("X-Auth-Roles", strings.Join(id.roles, ","))
+			if r.config.EnableAPIKeys {
+				cx.Request.Header.Set("X-Auth-Api-Key-Owner", id.apiKeyOwner)
+			}
 
 			// step: add the authorization header if requested
 			if r.config.EnableAuthorizationHeader {
-				cx.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", id.token.Encode()))
+				cx.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+			}
+			// step: add the aws alb compatible headers if requested; note the data header carries the token
+			// signed by the provider, not the load balancer
+			if r.config.EnableALBHeaders {
+				cx.Request.Header.Set("X-Amzn-Oidc-Accesstoken", token)
+				cx.Request.Header.Set("X-Amzn-Oidc-Identity", id.id)
+				cx.Request.Header.Set("X-Amzn-Oidc-Data", token)
+			}
+			// step: add the oauth2-proxy compatible headers if requested
+			if r.config.EnableOAuth2ProxyHeaders {
+				cx.Request.Header.Set("X-Forwarded-User", id.id)
+				cx.Request.Header.Set("X-Forwarded-Email", id.email)
+				cx.Request.Header.Set("X-Forwarded-Preferred-Username", id.preferredName)
+				cx.Request.Header.Set("X-Forwarded-Access-Token", token)
+			}
+			// step: add the snapshot of the authorization decision if requested
+			if r.config.EnableAuthDecisionHeader {
+				if resource, found := cx.Get(cxEnforce); found {
+					cx.Request.Header.Set(authDecisionHeader, getAuthDecision(resource.(*Resource), id))
+				}
 			}
 
 			// step: inject any custom claims
@@ -406,6 +1023,11 @@ func (r *oauthProxy) headersMiddleware(custom []string) gin.HandlerFunc {
 			}
 		}
 
+		// step: the api key is never passed on to the upstream
+		if r.config.EnableAPIKeys {
+			cx.Request.Header.Del(apiKeyHeader)
+		}
+
 		cx.Request.Header.Add("X-Forwarded-For", cx.Request.RemoteAddr)
 		cx.Request.Header.Set("X-Forwarded-Host", cx.Request.Host)
 		cx.Request.Header.Set("X-Forwarded-Proto", cx.Request.Header.Get("X-Forwarded-Proto"))
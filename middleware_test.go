@@ -16,12 +16,17 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/coreos/go-oidc/jose"
+	"github.com/gin-gonic/gin"
 	"github.com/go-resty/resty"
 	"github.com/stretchr/testify/assert"
 )
@@ -176,12 +181,12 @@ func TestRolePermissionsMiddleware(t *testing.T) {
 			HasToken:  true,
 			Expects:   http.StatusForbidden,
 		},
-		{ // strange url, token, role
+		{ // strange url, token, role - the path is normalized to the admin resource
 			URI:       "/test/../admin",
 			Redirects: false,
 			HasToken:  true,
 			Roles:     []string{fakeAdminRole},
-			Expects:   http.StatusForbidden,
+			Expects:   http.StatusOK,
 		},
 		{ // strange url, token, wrong roles
 			URI:       "/test/.." + fakeTestAdminRolesURL,
@@ -543,3 +548,579 @@ func TestRolesAdmissionHandlerClaims(t *testing.T) {
 		}
 	}
 }
+
+func TestALBHeaders(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableALBHeaders = true
+	_, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	var response testUpstreamResponse
+	resp, err := resty.New().SetAuthToken(signed.Encode()).R().SetResult(&response).Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, signed.Encode(), response.Headers.Get("X-Amzn-Oidc-Data"))
+	assert.Equal(t, signed.Encode(), response.Headers.Get("X-Amzn-Oidc-Accesstoken"))
+	assert.Equal(t, "1e11e539-8256-4b3b-bda8-cc0d56cddb48", response.Headers.Get("X-Amzn-Oidc-Identity"))
+}
+
+func TestOAuth2ProxyHeaders(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableOAuth2ProxyHeaders = true
+	_, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	var response testUpstreamResponse
+	resp, err := resty.New().SetAuthToken(signed.Encode()).R().SetResult(&response).Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "1e11e539-8256-4b3b-bda8-cc0d56cddb48", response.Headers.Get("X-Forwarded-User"))
+	assert.Equal(t, "gambol99@gmail.com", response.Headers.Get("X-Forwarded-Email"))
+	assert.Equal(t, "rjayawardene", response.Headers.Get("X-Forwarded-Preferred-Username"))
+	assert.Equal(t, signed.Encode(), response.Headers.Get("X-Forwarded-Access-Token"))
+}
+
+func TestAuthDecisionHeader(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableAuthDecisionHeader = true
+	cfg.Resources = append([]*Resource{{URL: "/vpn", Methods: []string{"ANY"}, Roles: []string{"vpn-user", "dsp-dev-vpn"}}},
+		cfg.Resources...)
+	_, idp, svc := newTestProxyService(cfg)
+	claims := jose.Claims{}
+	for k, v := range newTestToken(idp.getLocation()).claims {
+		claims[k] = v
+	}
+	claims["acr"] = "gold"
+	claims["realm_access"] = map[string]interface{}{"roles": []string{"dsp-dev-vpn", "vpn-user", "dsp-prod-vpn"}}
+	signed, _ := idp.signToken(claims)
+
+	cs := []struct {
+		URI      string
+		Expected string
+	}{
+		{URI: "/vpn", Expected: `{"resource":"/vpn","roles":["vpn-user","dsp-dev-vpn"],"acr":"gold"}`},
+		{URI: fakeAuthAllURL, Expected: `{"resource":"` + fakeAuthAllURL + `","roles":[],"acr":"gold"}`},
+		// step: the header supplied by the client is removed
+		{URI: fakeTestWhitelistedURL},
+	}
+	for i, c := range cs {
+		var response testUpstreamResponse
+		resp, err := resty.New().SetAuthToken(signed.Encode()).R().SetResult(&response).
+			SetHeader(authDecisionHeader, `{"resource":"/","roles":["admin"]}`).Get(svc + c.URI)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode(), "case %d", i)
+		assert.Equal(t, c.Expected, response.Headers.Get(authDecisionHeader), "case %d", i)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	proxy, _, _ := newTestProxyService(nil)
+	engine := gin.New()
+	engine.Use(proxy.recoveryMiddleware())
+	engine.GET("/panic", func(cx *gin.Context) {
+		cx.Set(userContextName, &userContext{name: "test"})
+		panic("something bad happened")
+	})
+
+	req, _ := http.NewRequest("GET", "/panic", nil)
+	req.Header.Set(correlationHeader, "test-id")
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "reference: test-id")
+	assert.NotContains(t, recorder.Body.String(), "something bad happened")
+}
+
+func TestFeatureFlagHeaders(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.FeatureFlags = map[string]string{"beta": "groups:beta", "staff": "groups:staff"}
+	_, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	token.claims.Add("groups", []string{"beta", "users"})
+	signed, _ := idp.signToken(token.claims)
+
+	var response testUpstreamResponse
+	resp, err := resty.New().SetAuthToken(signed.Encode()).R().
+		SetHeader("X-Feature-Staff", "true").
+		SetResult(&response).Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "true", response.Headers.Get("X-Feature-Beta"))
+	assert.Equal(t, "false", response.Headers.Get("X-Feature-Staff"))
+}
+
+func TestHopByHopHeadersRemoved(t *testing.T) {
+	_, idp, svc := newTestProxyService(nil)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	var response testUpstreamResponse
+	resp, err := resty.New().SetAuthToken(signed.Encode()).R().
+		SetHeader("Connection", "X-Auth-Email, X-Auth-Roles").
+		SetHeader("Proxy-Authorization", "Basic dGVzdA==").
+		SetResult(&response).Get(svc + fakeAuthAllURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "gambol99@gmail.com", response.Headers.Get("X-Auth-Email"))
+	assert.Empty(t, response.Headers.Get("Proxy-Authorization"))
+}
+
+func TestPathNormalization(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{URL: "/public", WhiteListed: true, Methods: []string{"ANY"}},
+		{URL: fakeAdminRoleURL, Methods: []string{"ANY"}, Roles: []string{fakeAdminRole}},
+	}
+	_, _, svc := newTestProxyService(cfg)
+
+	cs := []struct {
+		URI          string
+		ExpectedPath string
+		ExpectedCode int
+	}{
+		{URI: "/public/page", ExpectedPath: "/public/page", ExpectedCode: http.StatusOK},
+		{URI: "/admin/%2e%2e/public", ExpectedPath: "/public", ExpectedCode: http.StatusOK},
+		{URI: "//admin", ExpectedCode: http.StatusUnauthorized},
+		{URI: "/public/../admin", ExpectedCode: http.StatusUnauthorized},
+		{URI: "/public/%2e%2e/admin", ExpectedCode: http.StatusUnauthorized},
+		{URI: "/public/%2E%2E/admin", ExpectedCode: http.StatusUnauthorized},
+		{URI: "/public/%252e%252e/admin", ExpectedCode: http.StatusBadRequest},
+		{URI: "/public/%252Fadmin", ExpectedCode: http.StatusBadRequest},
+		// step: the paths needing no normalization reach the upstream as they were sent
+		{URI: "/public/a%2Fb", ExpectedPath: "/public/a%2Fb", ExpectedCode: http.StatusOK},
+		{URI: "/public/100%25", ExpectedPath: "/public/100%25", ExpectedCode: http.StatusOK},
+		{URI: "/public/..%2fadmin", ExpectedCode: http.StatusUnauthorized},
+		{URI: "/public/.%2e//admin/", ExpectedCode: http.StatusUnauthorized},
+	}
+	for i, c := range cs {
+		// step: use the transport directly, as the client would clean the path
+		req, _ := http.NewRequest(http.MethodGet, svc+c.URI, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d, uri: %s", i, c.URI)
+		if c.ExpectedPath != "" {
+			var response testUpstreamResponse
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response), "case %d", i)
+			assert.Equal(t, c.ExpectedPath, response.URI, "case %d, uri: %s", i, c.URI)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestCaseInsensitiveResources(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{URL: "/admin/", Methods: []string{"ANY"}, CaseInsensitive: true, IgnoreTrailingSlash: true},
+	}
+	_, _, svc := newTestProxyService(cfg)
+
+	for i, uri := range []string{"/admin", "/admin/", "/ADMIN", "/Admin/users"} {
+		resp, err := resty.New().R().Get(svc + uri)
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode(), "case %d, uri: %s", i, uri)
+	}
+	resp, err := resty.New().R().Get(svc + "/public")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+}
+
+func TestQueryResources(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{URL: "/export", Methods: []string{"ANY"}, Query: map[string]string{"format": "full"}, Roles: []string{"reporting-admin"}},
+		{URL: "/export", Methods: []string{"ANY"}},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	cs := []struct {
+		URI          string
+		ExpectedCode int
+	}{
+		{URI: "/export", ExpectedCode: http.StatusOK},
+		{URI: "/export?format=summary", ExpectedCode: http.StatusOK},
+		{URI: "/export?format=full", ExpectedCode: http.StatusForbidden},
+		{URI: "/export?page=2&format=full", ExpectedCode: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		resp, err := resty.New().SetAuthToken(signed.Encode()).R().Get(svc + c.URI)
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode(), "case %d, uri: %s", i, c.URI)
+	}
+}
+
+func TestHostResources(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{URL: "/admin", Methods: []string{"ANY"}, Hosts: []string{"a.example.com"}, Roles: []string{"tenant-a-admin"}},
+		{URL: "/admin", Methods: []string{"ANY"}},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	cs := []struct {
+		Host         string
+		ExpectedCode int
+	}{
+		{Host: "b.example.com", ExpectedCode: http.StatusOK},
+		{Host: "a.example.com", ExpectedCode: http.StatusForbidden},
+		{Host: "a.example.com:443", ExpectedCode: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest(http.MethodGet, svc+"/admin", nil)
+		req.Host = c.Host
+		req.Header.Set("Authorization", "Bearer "+signed.Encode())
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d, host: %s", i, c.Host)
+	}
+}
+
+func TestServiceAccounts(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		cfg := newFakeKeycloakConfig()
+		cfg.NoRedirects = true
+		cfg.EnableServiceAccounts = enabled
+		cfg.Resources = []*Resource{{URL: "/reports", Methods: []string{"ANY"}, Roles: []string{"reporting"}}}
+		_, idp, svc := newTestProxyService(cfg)
+		signed, err := idp.signToken(jose.Claims{
+			"iss":          idp.getLocation(),
+			"aud":          []string{"account", fakeClientID},
+			"sub":          "8c1f7e6a",
+			"exp":          float64(time.Now().Add(time.Hour).Unix()),
+			"iat":          float64(time.Now().Unix()),
+			"clientId":     "batch",
+			"azp":          "batch",
+			"realm_access": map[string]interface{}{"roles": []string{"reporting"}},
+		})
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		var response testUpstreamResponse
+		resp, err := resty.New().SetAuthToken(signed.Encode()).R().SetResult(&response).Get(svc + "/reports")
+		assert.NoError(t, err)
+		if !enabled {
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+			continue
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.Equal(t, "batch", response.Headers.Get("X-Auth-Username"))
+		assert.Equal(t, "8c1f7e6a", response.Headers.Get("X-Auth-Subject"))
+	}
+}
+
+func TestMiddlewaresOption(t *testing.T) {
+	cs := []struct {
+		Middlewares []string
+		Security    bool
+		FrameDeny   bool
+	}{
+		{Security: true, FrameDeny: true},
+		{Middlewares: []string{"cors", "security", "logging"}, Security: true, FrameDeny: true},
+		{Middlewares: []string{"cors", "logging"}},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.EnableCorsGlobal = true
+		cfg.CorsOrigins = []string{"*"}
+		cfg.EnableSecurityFilter = c.Security
+		cfg.EnableFrameDeny = true
+		cfg.Middlewares = c.Middlewares
+		_, _, svc := newTestProxyService(cfg)
+
+		resp, err := http.Get(svc + oauthURL + healthURL)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"), "case %d", i)
+		assert.Equal(t, c.FrameDeny, resp.Header.Get("X-Frame-Options") != "", "case %d", i)
+	}
+}
+
+func TestMaxAuthenticationAge(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.MaxAuthenticationAge = time.Hour
+	_, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+
+	cs := []struct {
+		AuthTime time.Time
+		Code     int
+	}{
+		{AuthTime: time.Now().Add(-time.Minute), Code: http.StatusOK},
+		{AuthTime: time.Now().Add(-2 * time.Hour), Code: http.StatusTemporaryRedirect},
+	}
+	for i, c := range cs {
+		// step: copy the claims, the defaults are shared by the tests
+		claims := jose.Claims{}
+		for k, v := range token.claims {
+			claims[k] = v
+		}
+		claims["auth_time"] = float64(c.AuthTime.Unix())
+		signed, _ := idp.signToken(claims)
+
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL+"/test", nil)
+		req.Header.Set("Authorization", "Bearer "+signed.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.Code, resp.StatusCode, "case %d", i)
+		if c.Code == http.StatusTemporaryRedirect {
+			assert.Equal(t, oauthURL+reauthURL+"?redirect="+url.QueryEscape(fakeAuthAllURL+"/test"), resp.Header.Get("Location"), "case %d", i)
+		}
+	}
+	assert.Equal(t, "3600", (&oauthProxy{config: cfg}).getAuthorizationParams("", "/")["max_age"])
+}
+
+func TestAudienceValidation(t *testing.T) {
+	cs := []struct {
+		Audiences         []string
+		AuthorizedParties []string
+		Claims            jose.Claims
+		ExpectedCode      int
+	}{
+		{ExpectedCode: http.StatusOK},
+		{Claims: jose.Claims{"aud": "other"}, ExpectedCode: http.StatusForbidden},
+		{Claims: jose.Claims{"aud": []string{"account", fakeClientID}}, ExpectedCode: http.StatusOK},
+		{Audiences: []string{"api", "reports"}, Claims: jose.Claims{"aud": []string{"account", "reports"}}, ExpectedCode: http.StatusOK},
+		{Audiences: []string{"api"}, Claims: jose.Claims{"aud": "api"}, ExpectedCode: http.StatusOK},
+		{Audiences: []string{"api"}, ExpectedCode: http.StatusForbidden},
+		{AuthorizedParties: []string{"web"}, ExpectedCode: http.StatusForbidden},
+		{AuthorizedParties: []string{"web"}, Claims: jose.Claims{"azp": "web"}, ExpectedCode: http.StatusOK},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.Audiences = c.Audiences
+		cfg.AuthorizedParties = c.AuthorizedParties
+		_, idp, svc := newTestProxyService(cfg)
+		claims := jose.Claims{}
+		for k, v := range newTestToken(idp.getLocation()).claims {
+			claims[k] = v
+		}
+		for k, v := range c.Claims {
+			claims[k] = v
+		}
+		signed, _ := idp.signToken(claims)
+		resp, err := resty.New().SetAuthToken(signed.Encode()).R().Get(svc + fakeAuthAllURL)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode(), "case %d", i)
+	}
+}
+
+func TestProbePassthrough(t *testing.T) {
+	probe := fakeAuthAllURL + "/healthz"
+	cs := []struct {
+		URI          string
+		UserAgent    string
+		ExpectedCode int
+	}{
+		{URI: probe, UserAgent: "kube-probe/1.10", ExpectedCode: http.StatusOK},
+		{URI: probe, UserAgent: "ELB-HealthChecker/2.0", ExpectedCode: http.StatusOK},
+		{URI: probe, UserAgent: "curl/7.54.0", ExpectedCode: http.StatusTemporaryRedirect},
+		{URI: probe + "/other", UserAgent: "kube-probe/1.10", ExpectedCode: http.StatusTemporaryRedirect},
+		{URI: fakeAuthAllURL, UserAgent: "kube-probe/1.10", ExpectedCode: http.StatusTemporaryRedirect},
+	}
+	cfg := newFakeKeycloakConfig()
+	cfg.ProbePaths = []string{probe}
+	cfg.ProbeUserAgents = []string{"kube-probe/", "ELB-HealthChecker/"}
+	_, _, svc := newTestProxyService(cfg)
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", svc+c.URI, nil)
+		req.Header.Set("User-Agent", c.UserAgent)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d", i)
+	}
+}
+
+func TestTrustedIssuers(t *testing.T) {
+	sts := newFakeOAuthServer()
+	if err := sts.rotateKey("sts-kid"); !assert.NoError(t, err) {
+		return
+	}
+	cfg := newFakeKeycloakConfig()
+	cfg.TrustedIssuers = map[string]string{
+		sts.getLocation(): sts.getLocation() + "/protocol/openid-connect/certs",
+	}
+	_, idp, svc := newTestProxyService(cfg)
+
+	cs := []struct {
+		Issuer       string
+		Signer       *fakeOAuthServer
+		ExpectedCode int
+	}{
+		{Issuer: idp.getLocation(), Signer: idp, ExpectedCode: http.StatusOK},
+		{Issuer: sts.getLocation(), Signer: sts, ExpectedCode: http.StatusOK},
+		{Issuer: sts.getLocation(), Signer: idp, ExpectedCode: http.StatusForbidden},
+		{Issuer: idp.getLocation(), Signer: sts, ExpectedCode: http.StatusForbidden},
+		{Issuer: "https://untrusted.example.com", Signer: idp, ExpectedCode: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		claims := jose.Claims{}
+		for k, v := range newTestToken(idp.getLocation()).claims {
+			claims[k] = v
+		}
+		claims["iss"] = c.Issuer
+		signed, _ := c.Signer.signToken(claims)
+		req, _ := http.NewRequest("GET", svc+fakeAuthAllURL, nil)
+		req.Header.Set("Authorization", "Bearer "+signed.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d", i)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	_, idp, svc := newTestProxyService(cfg)
+	claims := jose.Claims{}
+	for k, v := range newTestToken(idp.getLocation()).claims {
+		claims[k] = v
+	}
+	refresh, _ := idp.signToken(claims)
+	claims["exp"] = float64(time.Now().Add(-time.Hour).Unix())
+	expired, _ := idp.signToken(claims)
+
+	getWithRefreshToken := func(refresh string) (*http.Response, error) {
+		encrypted, _ := encodeText(refresh, cfg.EncryptionKey.Value(), "")
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL, nil)
+		req.AddCookie(&http.Cookie{Name: cfg.CookieAccessName, Value: expired.Encode()})
+		req.AddCookie(&http.Cookie{Name: cfg.CookieRefreshName, Value: encrypted})
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	// step: every refresh is made with the refresh token rotated by the last
+	current := refresh.Encode()
+	for i := 0; i < 3; i++ {
+		resp, err := getWithRefreshToken(current)
+		if !assert.NoError(t, err, "case %d", i) {
+			return
+		}
+		resp.Body.Close()
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode, "case %d", i) {
+			return
+		}
+		var rotated string
+		for _, x := range resp.Cookies() {
+			if x.Name == cfg.CookieRefreshName {
+				rotated, _ = decodeText(x.Value, cfg.EncryptionKey.Value())
+			}
+		}
+		assert.NotEmpty(t, rotated, "case %d", i)
+		assert.NotEqual(t, current, rotated, "case %d", i)
+		current = rotated
+	}
+
+	// step: the refresh token rotated away is stale
+	resp, err := getWithRefreshToken(refresh.Encode())
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+}
+
+func TestRefreshTokenEncryptionKeyRotation(t *testing.T) {
+	previous, current := "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j", "ZS8fwi3wVZvsKQLRFBo3vDGNm1dQCbzE"
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = ""
+	cfg.EncryptionKeys = []Secret{Secret(current), Secret(previous)}
+	_, idp, svc := newTestProxyService(cfg)
+	claims := jose.Claims{}
+	for k, v := range newTestToken(idp.getLocation()).claims {
+		claims[k] = v
+	}
+	refresh, _ := idp.signToken(claims)
+	claims["exp"] = float64(time.Now().Add(-time.Hour).Unix())
+	expired, _ := idp.signToken(claims)
+
+	// step: the refresh token encrypted by the previous key is still accepted
+	encrypted, _ := encodeText(refresh.Encode(), previous, "")
+	req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL, nil)
+	req.AddCookie(&http.Cookie{Name: cfg.CookieAccessName, Value: expired.Encode()})
+	req.AddCookie(&http.Cookie{Name: cfg.CookieRefreshName, Value: encrypted})
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// step: the rotated refresh token is encrypted by the current key
+	var rotated string
+	for _, x := range resp.Cookies() {
+		if x.Name == cfg.CookieRefreshName {
+			rotated = x.Value
+		}
+	}
+	if !assert.NotEmpty(t, rotated) {
+		return
+	}
+	_, err = decodeText(rotated, previous)
+	assert.Equal(t, ErrInvalidSession, err)
+	decoded, err := decodeText(rotated, current)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, decoded)
+}
+
+func TestRefreshTokenThrottled(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.OpenIDProviderThrottleCooldown = time.Second
+	_, idp, svc := newTestProxyService(cfg)
+	claims := jose.Claims{}
+	for k, v := range newTestToken(idp.getLocation()).claims {
+		claims[k] = v
+	}
+	refresh, _ := idp.signToken(claims)
+	claims["exp"] = float64(time.Now().Add(-time.Hour).Unix())
+	expired, _ := idp.signToken(claims)
+	encrypted, _ := encodeText(refresh.Encode(), cfg.EncryptionKey.Value(), "")
+	idp.rateLimit = "30"
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL, nil)
+		req.AddCookie(&http.Cookie{Name: cfg.CookieAccessName, Value: expired.Encode()})
+		req.AddCookie(&http.Cookie{Name: cfg.CookieRefreshName, Value: encrypted})
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			return
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "case %d", i)
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		assert.True(t, retryAfter > 0 && retryAfter <= 30, "case %d, retry after: %d", i, retryAfter)
+		assert.Empty(t, resp.Cookies(), "case %d", i)
+	}
+	// step: the second refresh backed off without troubling the provider
+	assert.Equal(t, 1, idp.rateLimited)
+}
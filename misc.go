@@ -17,9 +17,13 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -30,7 +34,7 @@ import (
 // accessForbidden redirects the user to the forbidden page
 func (r *oauthProxy) accessForbidden(cx *gin.Context) {
 	if r.config.hasCustomForbiddenPage() {
-		cx.HTML(http.StatusForbidden, path.Base(r.config.ForbiddenPage), r.config.Tags)
+		r.renderPage(cx, http.StatusForbidden, path.Base(r.config.ForbiddenPage), r.getTemplateModel(nil))
 		cx.Abort()
 		return
 	}
@@ -38,6 +42,55 @@ func (r *oauthProxy) accessForbidden(cx *gin.Context) {
 	cx.AbortWithStatus(http.StatusForbidden)
 }
 
+// writeResponse writes the content of an endpoint served by the proxy, preventing the browsers from sniffing
+// the content type and any cache from holding the response
+func writeResponse(cx *gin.Context, code int, contentType string, content []byte) {
+	cx.Writer.Header().Set("X-Content-Type-Options", "nosniff")
+	cx.Writer.Header().Set("Cache-Control", "no-store")
+	writeBody(cx, code, contentType, content)
+}
+
+// writeBody writes the response, leaving out the body where the status or method forbid one; the net/http writer
+// refuses the body of a 204 or 304, which gin turns into a panic, and drops the body of a HEAD without saying
+// how long it would have been
+func writeBody(cx *gin.Context, code int, contentType string, content []byte) {
+	if !bodyAllowedForStatus(code) {
+		cx.Status(code)
+		cx.Writer.WriteHeaderNow()
+		return
+	}
+	cx.Writer.Header().Set("Content-Type", contentType)
+	cx.Writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	cx.Status(code)
+	cx.Writer.WriteHeaderNow()
+	if cx.Request.Method != http.MethodHead {
+		cx.Writer.Write(content)
+	}
+}
+
+// bodyAllowedForStatus checks the status permits a response body, rfc 7230 section 3.3.3
+func bodyAllowedForStatus(code int) bool {
+	switch {
+	case code >= 100 && code < 200:
+		return false
+	case code == http.StatusNoContent, code == http.StatusNotModified:
+		return false
+	}
+
+	return true
+}
+
+// writeJSON encodes the value as the json response of an endpoint served by the proxy
+func writeJSON(cx *gin.Context, code int, value interface{}) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		cx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	writeResponse(cx, code, jsonContentType, content)
+}
+
 // redirectToURL redirects the user and aborts the context
 func (r *oauthProxy) redirectToURL(url string, cx *gin.Context) {
 	cx.Redirect(http.StatusTemporaryRedirect, url)
@@ -46,6 +99,18 @@ func (r *oauthProxy) redirectToURL(url string, cx *gin.Context) {
 
 // redirectToAuthorization redirects the user to authorization handler
 func (r *oauthProxy) redirectToAuthorization(cx *gin.Context) {
+	r.redirectToAuthorizationWithPrompt(cx, "")
+}
+
+// redirectToLogin clears the cookies of a session which has expired with no refresh token and redirects the user
+// to login with the expired session prompt, rather than reusing a session the provider may keep handing back
+func (r *oauthProxy) redirectToLogin(cx *gin.Context) {
+	r.clearAllCookies(cx)
+	r.redirectToAuthorizationWithPrompt(cx, r.config.ExpiredSessionPrompt)
+}
+
+// redirectToAuthorizationWithPrompt redirects the user to authorization handler, passing on the prompt if any
+func (r *oauthProxy) redirectToAuthorizationWithPrompt(cx *gin.Context, prompt string) {
 	if r.config.NoRedirects {
 		cx.AbortWithStatus(http.StatusUnauthorized)
 		return
@@ -53,6 +118,9 @@ func (r *oauthProxy) redirectToAuthorization(cx *gin.Context) {
 
 	// step: add a state referrer to the authorization page
 	authQuery := fmt.Sprintf("?state=%s", base64.StdEncoding.EncodeToString([]byte(cx.Request.URL.RequestURI())))
+	if prompt != "" {
+		authQuery += "&prompt=" + url.QueryEscape(prompt)
+	}
 
 	// step: if verification is switched off, we can't authorization
 	if r.config.SkipTokenVerification {
@@ -62,7 +130,137 @@ func (r *oauthProxy) redirectToAuthorization(cx *gin.Context) {
 		return
 	}
 
-	r.redirectToURL(oauthURL+authorizationURL+authQuery, cx)
+	// step: are we going round in circles?
+	if !r.countLoginRedirect(cx) {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"path":      cx.Request.URL.Path,
+			"redirects": r.config.MaxLoginRedirects,
+		}).Errorf("breaking the redirect loop, the requests are not authenticated after the login")
+
+		cx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	r.redirectToURL(r.config.withOAuthURI(authorizationURL)+authQuery, cx)
+}
+
+// redirectToReauthentication redirects the user to re-enter their credentials, returning to the request
+func (r *oauthProxy) redirectToReauthentication(cx *gin.Context) {
+	if r.config.NoRedirects {
+		cx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	r.redirectToURL(fmt.Sprintf("%s?redirect=%s", r.config.withOAuthURI(reauthURL), url.QueryEscape(cx.Request.URL.RequestURI())), cx)
+}
+
+// getProviderURLs returns the provider endpoints useful to templates and upstreams
+func (r *oauthProxy) getProviderURLs() map[string]string {
+	provider := r.getProviderConfig()
+	urls := make(map[string]string, 0)
+	if provider.Issuer != nil {
+		urls["account_url"] = strings.TrimSuffix(provider.Issuer.String(), "/") + "/account"
+	}
+	logoutURL := r.config.RevocationEndpoint
+	if logoutURL == "" && provider.EndSessionEndpoint != nil {
+		logoutURL = provider.EndSessionEndpoint.String()
+	}
+	if logoutURL != "" {
+		urls["logout_url"] = logoutURL
+	}
+
+	return urls
+}
+
+// getTemplateModel returns the variables passed to the custom templates
+func (r *oauthProxy) getTemplateModel(model map[string]string) map[string]string {
+	if model == nil {
+		model = make(map[string]string, 0)
+	}
+	for k, v := range r.getProviderURLs() {
+		model[k] = v
+	}
+	model["oauth_uri"] = r.config.withOAuthURI("")
+
+	return mergeMaps(model, r.config.Tags)
+}
+
+// getAuthorizationParams returns the custom authorization parameters for the requested url
+func (r *oauthProxy) getAuthorizationParams(host, requestURL string) map[string]string {
+	params := make(map[string]string, 0)
+	// step: ask the provider to enforce the authentication age as well
+	if r.config.MaxAuthenticationAge > 0 {
+		params["max_age"] = fmt.Sprintf("%d", int64(r.config.MaxAuthenticationAge.Seconds()))
+	}
+	for k, v := range r.config.AuthRequestParams {
+		params[k] = v
+	}
+	// step: find the resource being requested, resource parameters take precedence
+	requestPath, query := splitRequestURI(requestURL)
+	for _, resource := range r.getResources() {
+		if resource.matches(host, requestPath, query) {
+			for k, v := range resource.AuthParams {
+				params[k] = v
+			}
+			break
+		}
+	}
+
+	return params
+}
+
+// getPassthroughParams returns the permitted authorization parameters given on the request
+func (r *oauthProxy) getPassthroughParams(cx *gin.Context) map[string]string {
+	params := make(map[string]string, 0)
+	for _, name := range r.config.AuthRequestPassthrough {
+		if value := cx.Query(name); value != "" {
+			params[name] = value
+		}
+	}
+
+	return params
+}
+
+// addAuthorizationParams adds the custom parameters to the authorization url
+func addAuthorizationParams(authURL string, params map[string]string) string {
+	if len(params) <= 0 {
+		return authURL
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return authURL
+	}
+	query := u.Query()
+	for k, v := range params {
+		query.Set(k, v)
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// getRequestState decodes the state parameter, defaulting to the root
+func getRequestState(cx *gin.Context) string {
+	return decodeState(cx.Request.URL.Query().Get("state"))
+}
+
+// decodeState decodes the state parameter, defaulting to the root
+func decodeState(state string) string {
+	if state == "" {
+		return "/"
+	}
+	decoded, err := base64.StdEncoding.DecodeString(state)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"state": state,
+			"error": err.Error(),
+		}).Warnf("unable to decode the state parameter")
+
+		return "/"
+	}
+
+	return string(decoded)
 }
 
 // getAccessCookieExpiration calucates the expiration of the access token cookie
@@ -70,10 +268,67 @@ func (r *oauthProxy) getAccessCookieExpiration(token jose.JWT, refresh string) t
 	// notes: by default the duration of the access token will be the configuration option, if
 	// however we can decode the refresh token, we will set the duration to the duraction of the
 	// refresh token
+	// step: an offline token has no expiration, the session lasts as long as we're told
+	if isOfflineToken(refresh) {
+		return r.config.OfflineSessionDuration
+	}
 	duration := r.config.AccessTokenDuration
-	if _, ident, err := parseToken(refresh); err == nil {
+	if _, ident, err := parseToken(refresh, r.decryptionKey); err == nil {
 		duration = ident.ExpiresAt.Sub(time.Now())
 	}
 
 	return duration
 }
+
+// getRefreshCookieExpiration returns the expiration of the refresh token cookie
+func (r *oauthProxy) getRefreshCookieExpiration(refresh string) time.Duration {
+	// notes: not all idp refresh tokens are readable, google for example, so we attempt to decode into
+	// a jwt and if possible extract the expiration, else we default to 10 days
+	if isOfflineToken(refresh) {
+		return r.config.OfflineSessionDuration
+	}
+	if _, ident, err := parseToken(refresh, r.decryptionKey); err == nil {
+		return ident.ExpiresAt.Sub(time.Now())
+	}
+
+	return time.Duration(240) * time.Hour
+}
+
+// isProbeRequest checks if the request is a health check probe, by the user agent, of one of the probe paths
+func (r *oauthProxy) isProbeRequest(req *http.Request) bool {
+	if len(r.config.ProbePaths) == 0 || !containedIn(req.URL.Path, r.config.ProbePaths) {
+		return false
+	}
+	agent := req.UserAgent()
+	for _, x := range r.config.ProbeUserAgents {
+		if strings.HasPrefix(agent, x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authDecision is the snapshot of the authorization decision passed to the upstream
+type authDecision struct {
+	// the url of the matched resource
+	Resource string `json:"resource"`
+	// the roles of the resource satisfied by the user
+	Roles []string `json:"roles"`
+	// the authentication context class of the token, if any
+	ACR string `json:"acr,omitempty"`
+}
+
+// getAuthDecision returns the json of the decision permitting the user on the resource
+func getAuthDecision(resource *Resource, user *userContext) string {
+	decision := authDecision{Resource: resource.URL, Roles: []string{}}
+	for _, role := range resource.Roles {
+		if containedIn(role, user.roles) {
+			decision.Roles = append(decision.Roles, role)
+		}
+	}
+	decision.ACR, _, _ = user.claims.StringClaim(claimAuthContext)
+	encoded, _ := json.Marshal(decision)
+
+	return string(encoded)
+}
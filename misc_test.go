@@ -49,3 +49,59 @@ func TestRedirectToAuthorizationSkipToken(t *testing.T) {
 	resp, _ := resty.New().SetRedirectPolicy(resty.NoRedirectPolicy()).R().Get(svc + "/admin")
 	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
 }
+
+func TestAuthorizationParams(t *testing.T) {
+	p, _, svc := newTestProxyService(nil)
+	p.config.AuthRequestParams = map[string]string{"kc_idp_hint": "google", "audience": "default"}
+	p.config.Resources[0].AuthParams = map[string]string{"audience": "admin"}
+
+	assert.Equal(t, map[string]string{"kc_idp_hint": "google", "audience": "admin"}, p.getAuthorizationParams("", "/admin/test"))
+	assert.Equal(t, map[string]string{"kc_idp_hint": "google", "audience": "default"}, p.getAuthorizationParams("", "/other"))
+
+	resp, _ := resty.New().SetRedirectPolicy(resty.NoRedirectPolicy()).R().Get(svc + oauthURL + authorizationURL + "?state=L2FkbWlu")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	assert.Contains(t, resp.Header().Get("Location"), "kc_idp_hint=google")
+	assert.Contains(t, resp.Header().Get("Location"), "audience=admin")
+}
+
+func TestAuthorizationPassthroughParams(t *testing.T) {
+	p, _, svc := newTestProxyService(nil)
+	p.config.AuthRequestParams = map[string]string{"kc_idp_hint": "google"}
+	p.config.AuthRequestPassthrough = []string{"kc_idp_hint", "login_hint"}
+	client := resty.New().SetRedirectPolicy(resty.NoRedirectPolicy())
+
+	resp, _ := client.R().Get(svc + oauthURL + authorizationURL + "?state=L2FkbWlu&kc_idp_hint=saml&other=a")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode())
+	location := resp.Header().Get("Location")
+	assert.Contains(t, location, "kc_idp_hint=saml")
+	assert.NotContains(t, location, "kc_idp_hint=google")
+	assert.NotContains(t, location, "other=a")
+
+	resp, _ = client.R().Get(svc + oauthURL + authorizationURL + "?state=L2FkbWlu")
+	assert.Contains(t, resp.Header().Get("Location"), "kc_idp_hint=google")
+}
+
+func TestAddAuthorizationParams(t *testing.T) {
+	assert.Equal(t, "http://idp/auth?state=x", addAuthorizationParams("http://idp/auth?state=x", nil))
+	assert.Equal(t, "http://idp/auth?kc_action=UPDATE_PASSWORD&state=x",
+		addAuthorizationParams("http://idp/auth?state=x", map[string]string{"kc_action": "UPDATE_PASSWORD"}))
+}
+
+func TestGetProviderURLs(t *testing.T) {
+	p, idp, _ := newTestProxyService(nil)
+	urls := p.getProviderURLs()
+	assert.Equal(t, idp.getLocation()+"/account", urls["account_url"])
+	assert.Equal(t, idp.getRevocationURL(), urls["logout_url"])
+
+	p.config.Tags = map[string]string{"title": "test"}
+	model := p.getTemplateModel(map[string]string{"redirect": "/"})
+	assert.Equal(t, "/", model["redirect"])
+	assert.Equal(t, "test", model["title"])
+	assert.Equal(t, urls["account_url"], model["account_url"])
+	assert.Equal(t, "/oauth", model["oauth_uri"])
+}
+
+func TestGetProviderURLsNoProvider(t *testing.T) {
+	p := &oauthProxy{config: newFakeKeycloakConfig()}
+	assert.Empty(t, p.getProviderURLs())
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// pkceMethodS256 is the only code challenge method accepted from the mobile apps, rfc 7636
+	pkceMethodS256 = "S256"
+)
+
+//
+// mobileAuthorizationHandler starts the login of a native mobile app; the app's pkce code challenge is passed
+// on to the provider, so only the app holding the verifier can redeem the code returned to its redirect uri
+//
+func (r *oauthProxy) mobileAuthorizationHandler(cx *gin.Context) {
+	if len(r.config.MobileRedirectURIs) == 0 {
+		cx.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+	redirectURI := cx.Query("redirect_uri")
+	if !containedIn(redirectURI, r.config.MobileRedirectURIs) {
+		log.WithFields(log.Fields{
+			"client_ip":    cx.ClientIP(),
+			"redirect_uri": redirectURI,
+		}).Warnf("the redirect uri of the mobile authorization is not permitted")
+
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if cx.Query("code_challenge") == "" || cx.Query("code_challenge_method") != pkceMethodS256 {
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	client, err := r.getOAuthClient(r.getMobileRedirectionURL(cx))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to create a oauth2 client")
+
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		cx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	state := base64.RawURLEncoding.EncodeToString(value)
+
+	// step: the app's redirect uri and state are held in the signed cookie until the provider returns
+	app := url.Values{"redirect_uri": {redirectURI}, "state": {cx.Query("state")}}
+	r.dropPathCookie(cx, r.config.getMobileStateCookieName(), r.signState(state, app.Encode()),
+		r.config.withOAuthURI(""), authorizationCookieDuration)
+
+	params := map[string]string{
+		"code_challenge":        cx.Query("code_challenge"),
+		"code_challenge_method": pkceMethodS256,
+	}
+	r.redirectToURL(addAuthorizationParams(client.AuthCodeURL(state, r.config.getAccessType(), ""), params), cx)
+}
+
+//
+// mobileCallbackHandler returns the authorization code, or the error, of the provider to the redirect uri
+// of the mobile app, the code is redeemed by the app at the token endpoint
+//
+func (r *oauthProxy) mobileCallbackHandler(cx *gin.Context) {
+	if len(r.config.MobileRedirectURIs) == 0 {
+		cx.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+	app, err := r.verifyMobileState(cx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"error":     err.Error(),
+		}).Errorf("unable to verify the state of the mobile callback")
+
+		r.accessForbidden(cx)
+		return
+	}
+	redirect, err := url.Parse(app.Get("redirect_uri"))
+	if err != nil || !containedIn(redirect.String(), r.config.MobileRedirectURIs) {
+		r.accessForbidden(cx)
+		return
+	}
+
+	query := redirect.Query()
+	for _, name := range []string{"code", "error", "error_description"} {
+		if value := cx.Query(name); value != "" {
+			query.Set(name, value)
+		}
+	}
+	if state := app.Get("state"); state != "" {
+		query.Set("state", state)
+	}
+	redirect.RawQuery = query.Encode()
+
+	r.redirectToURL(redirect.String(), cx)
+}
+
+//
+// mobileTokenHandler redeems the authorization code of a mobile app, with its pkce code verifier, or refreshes
+// its tokens at the provider, returning the response of the provider as is
+//
+func (r *oauthProxy) mobileTokenHandler(cx *gin.Context) {
+	if len(r.config.MobileRedirectURIs) == 0 {
+		cx.AbortWithStatus(http.StatusNotImplemented)
+		return
+	}
+	values := url.Values{}
+	values.Set("client_id", r.config.ClientID)
+
+	switch grantType := cx.Request.PostFormValue("grant_type"); grantType {
+	case oauth2.GrantTypeAuthCode:
+		code := cx.Request.PostFormValue("code")
+		verifier := cx.Request.PostFormValue("code_verifier")
+		if code == "" || verifier == "" || !containedIn(cx.Request.PostFormValue("redirect_uri"), r.config.MobileRedirectURIs) {
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		values.Set("grant_type", grantType)
+		values.Set("code", code)
+		values.Set("code_verifier", verifier)
+		values.Set("redirect_uri", r.getMobileRedirectionURL(cx))
+	case oauth2.GrantTypeRefreshToken:
+		token := cx.Request.PostFormValue("refresh_token")
+		if token == "" {
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		values.Set("grant_type", grantType)
+		values.Set("refresh_token", token)
+	default:
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	code, content, err := r.postProviderForm(r.getProviderConfig().TokenEndpoint.String(), values)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to request the tokens of the mobile app")
+
+		cx.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+
+	writeResponse(cx, code, jsonContentType, content)
+}
+
+// verifyMobileState checks the state of the callback matches the mobile state cookie, clearing the cookie
+// and returning the redirect uri and state of the app
+func (r *oauthProxy) verifyMobileState(cx *gin.Context) (url.Values, error) {
+	state, value, err := r.getSignedStateCookie(cx.Request, r.config.getMobileStateCookieName())
+	if err != nil {
+		return nil, err
+	}
+	r.dropPathCookie(cx, r.config.getMobileStateCookieName(), "", r.config.withOAuthURI(""), -10*time.Hour)
+
+	if subtle.ConstantTimeCompare([]byte(state), []byte(cx.Query("state"))) != 1 {
+		return nil, errors.New("the state of the callback does not match the request")
+	}
+
+	return url.ParseQuery(value)
+}
+
+// getMobileRedirectionURL returns the url the provider returns the mobile logins to
+func (r *oauthProxy) getMobileRedirectionURL(cx *gin.Context) string {
+	return r.getRedirectionBaseURL(cx) + r.config.withOAuthURI(mobileReturnURL)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+const testMobileRedirectURI = "com.example.app:/callback"
+
+// makeTestMobileLogin performs the mobile authorization, returning the redirect to the app
+func makeTestMobileLogin(svc string, params url.Values) (*http.Response, error) {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "http" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+
+	return client.Get(svc + oauthURL + mobileAuthURL + "?" + params.Encode())
+}
+
+func getTestCodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestMobileHandlersDisabled(t *testing.T) {
+	_, _, svc := newTestProxyService(nil)
+	resp, err := resty.New().R().Get(svc + oauthURL + mobileAuthURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode())
+	resp, err = resty.New().R().Post(svc + oauthURL + mobileTokenURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode())
+}
+
+func TestMobileAuthorizationBadRequests(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.MobileRedirectURIs = []string{testMobileRedirectURI}
+	_, _, svc := newTestProxyService(cfg)
+
+	cs := []url.Values{
+		{"code_challenge": {"abc"}, "code_challenge_method": {"S256"}},
+		{"redirect_uri": {"com.evil.app:/callback"}, "code_challenge": {"abc"}, "code_challenge_method": {"S256"}},
+		{"redirect_uri": {testMobileRedirectURI}, "code_challenge_method": {"S256"}},
+		{"redirect_uri": {testMobileRedirectURI}, "code_challenge": {"abc"}, "code_challenge_method": {"plain"}},
+	}
+	for i, c := range cs {
+		resp, err := makeTestMobileLogin(svc, c)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "case %d", i)
+	}
+}
+
+func TestMobileLogin(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.MobileRedirectURIs = []string{testMobileRedirectURI}
+	_, _, svc := newTestProxyService(cfg)
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+	resp, err := makeTestMobileLogin(svc, url.Values{
+		"redirect_uri":          {testMobileRedirectURI},
+		"state":                 {"app-state"},
+		"code_challenge":        {getTestCodeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "com.example.app", location.Scheme)
+	assert.Equal(t, "app-state", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	assert.NotEmpty(t, code)
+
+	// step: the code cannot be redeemed without the verifier
+	cs := []struct {
+		Verifier     string
+		RedirectURI  string
+		ExpectedCode int
+	}{
+		{Verifier: "wrong", RedirectURI: testMobileRedirectURI, ExpectedCode: http.StatusBadRequest},
+		{Verifier: verifier, RedirectURI: "com.evil.app:/callback", ExpectedCode: http.StatusBadRequest},
+		{Verifier: verifier, RedirectURI: testMobileRedirectURI, ExpectedCode: http.StatusOK},
+	}
+	for i, c := range cs {
+		var token tokenResponse
+		resp, err := resty.New().R().
+			SetFormData(map[string]string{
+				"grant_type":    "authorization_code",
+				"code":          code,
+				"code_verifier": c.Verifier,
+				"redirect_uri":  c.RedirectURI,
+			}).
+			SetResult(&token).
+			Post(svc + oauthURL + mobileTokenURL)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode(), "case %d", i)
+		if c.ExpectedCode == http.StatusOK {
+			assert.NotEmpty(t, token.AccessToken, "case %d", i)
+		}
+	}
+}
+
+func TestMobileCallbackState(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.MobileRedirectURIs = []string{testMobileRedirectURI}
+	_, _, svc := newTestProxyService(cfg)
+
+	req, _ := http.NewRequest(http.MethodGet, svc+oauthURL+mobileReturnURL+"?code=abc&state=forged", nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// confirmationCertificate is the confirmation member of the thumbprint of the certificate a token is bound to
+	confirmationCertificate = "x5t#S256"
+)
+
+// getCertificateThumbprint returns the sha-256 thumbprint of the der encoding of the certificate, rfc 8705
+func getCertificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// getCertificateBinding returns the thumbprint of the certificate the access token is bound to, if any
+func getCertificateBinding(claims jose.Claims) string {
+	if confirmation, found := claims[claimConfirmation].(map[string]interface{}); found {
+		if thumbprint, found := confirmation[confirmationCertificate].(string); found {
+			return thumbprint
+		}
+	}
+
+	return ""
+}
+
+// invalidTokenChallenge rejects the request with a bearer challenge of an invalid token, rfc 6750
+func (r *oauthProxy) invalidTokenChallenge(cx *gin.Context, description string) {
+	cx.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description="%s"`, description))
+	cx.AbortWithStatus(http.StatusUnauthorized)
+}
+
+// certificateBoundMiddleware permits the tokens bound to a certificate only on a connection authenticated by the
+// certificate, and requires the bound tokens on the resources with the certificate-bound option
+func (r *oauthProxy) certificateBoundMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if cx.IsAborted() || !r.config.EnableCertificateBoundTokens {
+			return
+		}
+		v, found := cx.Get(cxEnforce)
+		if !found {
+			return
+		}
+		resource := v.(*Resource)
+		user := cx.MustGet(userContextName).(*userContext)
+		fields := log.Fields{
+			"client_ip": cx.ClientIP(),
+			"resource":  cx.Request.URL.Path,
+			"username":  user.name,
+		}
+
+		thumbprint := getCertificateBinding(user.claims)
+		if thumbprint == "" {
+			if resource.CertificateBound {
+				log.WithFields(fields).Warnf("rejecting the request, the resource requires a certificate bound token")
+				r.invalidTokenChallenge(cx, "the resource requires a certificate bound token")
+			}
+			return
+		}
+		// step: the client certificate was verified by the listener, we only need to check it's the one bound
+		if cx.Request.TLS == nil || len(cx.Request.TLS.PeerCertificates) == 0 {
+			log.WithFields(fields).Warnf("rejecting the request, the certificate bound token was presented without a client certificate")
+			r.invalidTokenChallenge(cx, "the token is bound to a client certificate")
+			return
+		}
+		presented := getCertificateThumbprint(cx.Request.TLS.PeerCertificates[0])
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(thumbprint)) != 1 {
+			fields["subject"] = cx.Request.TLS.PeerCertificates[0].Subject.String()
+			log.WithFields(fields).Warnf("rejecting the request, the token is bound to another client certificate")
+			r.invalidTokenChallenge(cx, "the token is bound to another client certificate")
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestClientCertificate returns a self-signed client certificate of the name
+func newTestClientCertificate(t *testing.T, name string) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create the certificate, error: %s", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestGetCertificateBinding(t *testing.T) {
+	assert.Equal(t, "bwcK0esc3ACC3DB2Y5_lESsXE8o9ltc05O89jdN-dg2",
+		getCertificateBinding(jose.Claims{"cnf": map[string]interface{}{"x5t#S256": "bwcK0esc3ACC3DB2Y5_lESsXE8o9ltc05O89jdN-dg2"}}))
+	assert.Empty(t, getCertificateBinding(jose.Claims{"cnf": map[string]interface{}{"jkt": "0ZcOCORZNYy-DWpqq30jZyJGHTN0d2HglBV3uiguA4I"}}))
+	assert.Empty(t, getCertificateBinding(jose.Claims{"cnf": "x5t#S256"}))
+	assert.Empty(t, getCertificateBinding(jose.Claims{}))
+}
+
+func TestCertificateBoundMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableCertificateBoundTokens = true
+	cfg.Resources = append([]*Resource{{URL: "/api", Methods: []string{"ANY"}, CertificateBound: true}}, cfg.Resources...)
+	proxy, idp, plain := newTestProxyService(cfg)
+	// step: the listener of the proxy verifies the client certificates, here we only request them
+	service := httptest.NewUnstartedServer(proxy.router)
+	service.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	service.StartTLS()
+	defer service.Close()
+
+	alice, bob := newTestClientCertificate(t, "alice"), newTestClientCertificate(t, "bob")
+	getToken := func(cert *tls.Certificate) string {
+		claims := jose.Claims{}
+		for k, v := range newTestToken(idp.getLocation()).claims {
+			claims[k] = v
+		}
+		if cert != nil {
+			claims["cnf"] = map[string]interface{}{"x5t#S256": getCertificateThumbprint(cert.Leaf)}
+		}
+		signed, _ := idp.signToken(claims)
+		return signed.Encode()
+	}
+	bound, unbound := getToken(&alice), getToken(nil)
+
+	cs := []struct {
+		Location     string
+		Certificate  *tls.Certificate
+		Token        string
+		URI          string
+		ExpectedCode int
+	}{
+		{Location: service.URL, Certificate: &alice, Token: bound, URI: "/api", ExpectedCode: http.StatusOK},
+		{Location: service.URL, Certificate: &alice, Token: bound, URI: fakeAuthAllURL, ExpectedCode: http.StatusOK},
+		{Location: service.URL, Certificate: &bob, Token: bound, URI: "/api", ExpectedCode: http.StatusUnauthorized},
+		{Location: service.URL, Certificate: &bob, Token: bound, URI: fakeAuthAllURL, ExpectedCode: http.StatusUnauthorized},
+		{Location: service.URL, Token: bound, URI: fakeAuthAllURL, ExpectedCode: http.StatusUnauthorized},
+		{Location: plain, Token: bound, URI: fakeAuthAllURL, ExpectedCode: http.StatusUnauthorized},
+		// step: the unbound tokens are only rejected on the certificate bound resources
+		{Location: service.URL, Certificate: &alice, Token: unbound, URI: "/api", ExpectedCode: http.StatusUnauthorized},
+		{Location: service.URL, Certificate: &alice, Token: unbound, URI: fakeAuthAllURL, ExpectedCode: http.StatusOK},
+		{Location: plain, Token: unbound, URI: fakeAuthAllURL, ExpectedCode: http.StatusOK},
+	}
+	for i, c := range cs {
+		transport := service.Client().Transport.(*http.Transport).Clone()
+		if c.Certificate != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*c.Certificate}
+		}
+		req, _ := http.NewRequest(http.MethodGet, c.Location+c.URI, nil)
+		req.Header.Set(authorizationHeader, "Bearer "+c.Token)
+		resp, err := transport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d", i)
+		if c.ExpectedCode == http.StatusUnauthorized {
+			assert.True(t, strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), `Bearer error="invalid_token"`), "case %d", i)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// authorizationCookieDuration is how long the user has to complete the login at the provider
+	authorizationCookieDuration = 10 * time.Minute
+)
+
+// newAuthorizationNonce generates the nonce of the authorization request, the random value is held in a
+// cookie and its hash is sent to the provider, so the id token can only be used by the browser which
+// started the login
+func (r *oauthProxy) newAuthorizationNonce(cx *gin.Context) (string, error) {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(value)
+	r.dropPathCookie(cx, r.config.getNonceCookieName(), encoded, r.config.withOAuthURI(""), authorizationCookieDuration)
+
+	return hashNonce(encoded), nil
+}
+
+// verifyNonce checks the nonce of the id token matches the nonce cookie, clearing the cookie
+func (r *oauthProxy) verifyNonce(cx *gin.Context, token jose.JWT) error {
+	cookie, err := cx.Request.Cookie(r.config.getNonceCookieName())
+	if err != nil || cookie.Value == "" {
+		return errors.New("no nonce cookie found in the request")
+	}
+	r.dropPathCookie(cx, r.config.getNonceCookieName(), "", r.config.withOAuthURI(""), -10*time.Hour)
+
+	claims, err := token.Claims()
+	if err != nil {
+		return err
+	}
+	nonce, found, err := claims.StringClaim(claimNonce)
+	if err != nil || !found {
+		return errors.New("the id token has no nonce claim")
+	}
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(hashNonce(cookie.Value))) != 1 {
+		return errors.New("the nonce of the id token does not match the request")
+	}
+
+	return nil
+}
+
+// hashNonce returns the nonce sent to the provider for the cookie value
+func hashNonce(value string) string {
+	hash := sha256.Sum256([]byte(value))
+
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
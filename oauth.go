@@ -16,7 +16,10 @@ limitations under the License.
 package main
 
 import (
+	"crypto/rsa"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -27,14 +30,16 @@ import (
 
 // getOAuthClient returns a oauth2 client from the openid client
 func (r *oauthProxy) getOAuthClient(redirectionURL string) (*oauth2.Client, error) {
+	provider := r.getProviderConfig()
+
 	return oauth2.NewClient(r.idpClient, oauth2.Config{
 		Credentials: oauth2.ClientCredentials{
 			ID:     r.config.ClientID,
-			Secret: r.config.ClientSecret,
+			Secret: r.config.ClientSecret.Value(),
 		},
 		RedirectURL: redirectionURL,
-		AuthURL:     r.idp.AuthEndpoint.String(),
-		TokenURL:    r.idp.TokenEndpoint.String(),
+		AuthURL:     provider.AuthEndpoint.String(),
+		TokenURL:    provider.TokenEndpoint.String(),
 		Scope:       append(r.config.Scopes, oidc.DefaultScope...),
 		AuthMethod:  oauth2.AuthMethodClientSecretBasic,
 	})
@@ -54,28 +59,34 @@ func verifyToken(client *oidc.Client, token jose.JWT) error {
 	return nil
 }
 
-// getRefreshedToken attempts to refresh the access token, returning the parsed token and the time it expires or a error
-func getRefreshedToken(client *oidc.Client, t string) (jose.JWT, time.Time, error) {
+// getRefreshedToken attempts to refresh the access token, returning the parsed token, the refresh token and the time
+// it expires or a error; the refresh token is a new one if the provider rotates them, else the one we used
+func getRefreshedToken(client *oidc.Client, t string, key *rsa.PrivateKey) (jose.JWT, string, time.Time, error) {
 	// step: retrieve the client
 	cl, err := client.OAuthClient()
 	if err != nil {
-		return jose.JWT{}, time.Time{}, err
+		return jose.JWT{}, "", time.Time{}, err
 	}
 	response, err := getToken(cl, oauth2.GrantTypeRefreshToken, t)
 	if err != nil {
 		if strings.Contains(err.Error(), "token expired") {
-			return jose.JWT{}, time.Time{}, ErrRefreshTokenExpired
+			return jose.JWT{}, "", time.Time{}, ErrRefreshTokenExpired
 		}
-		return jose.JWT{}, time.Time{}, err
+		return jose.JWT{}, "", time.Time{}, err
 	}
 
 	// step: parse the access token
-	token, identity, err := parseToken(response.AccessToken)
+	token, identity, err := parseToken(response.AccessToken, key)
 	if err != nil {
-		return jose.JWT{}, time.Time{}, err
+		return jose.JWT{}, "", time.Time{}, err
+	}
+	// step: with revoke refresh token the provider issues a new refresh token, the old one is no longer usable
+	refresh := t
+	if response.RefreshToken != "" {
+		refresh = response.RefreshToken
 	}
 
-	return token, identity.ExpiresAt, nil
+	return token, refresh, identity.ExpiresAt, nil
 }
 
 // exchangeAuthenticationCode exchanges the authentication code with the oauth server for a access token
@@ -109,8 +120,27 @@ func getToken(client *oauth2.Client, grantType, code string) (oauth2.TokenRespon
 	return client.RequestToken(grantType, code)
 }
 
-// parseToken retrieve the user identity from the token
-func parseToken(t string) (jose.JWT, *oidc.Identity, error) {
+// isOfflineToken checks if the refresh token is an offline token, keycloak marks them with a typ of Offline
+func isOfflineToken(t string) bool {
+	token, err := jose.ParseJWT(t)
+	if err != nil {
+		return false
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return false
+	}
+	kind, _, _ := claims.StringClaim(claimType)
+
+	return strings.EqualFold(kind, "Offline")
+}
+
+// parseToken retrieve the user identity from the token, decrypting it with the key if encrypted
+func parseToken(t string, key *rsa.PrivateKey) (jose.JWT, *oidc.Identity, error) {
+	t, err := decryptToken(t, key)
+	if err != nil {
+		return jose.JWT{}, nil, err
+	}
 	// step: parse and return the token
 	token, err := jose.ParseJWT(t)
 	if err != nil {
@@ -131,3 +161,27 @@ func parseToken(t string) (jose.JWT, *oidc.Identity, error) {
 
 	return token, identity, nil
 }
+
+// postProviderForm posts the form to the provider, authenticating as the client when confidential
+func (r *oauthProxy) postProviderForm(endpoint string, values url.Values) (int, []byte, error) {
+	request, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return 0, nil, err
+	}
+	if r.config.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(r.config.ClientID), url.QueryEscape(r.config.ClientSecret.Value()))
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := r.idpClient.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return response.StatusCode, content, nil
+}
@@ -16,14 +16,21 @@ limitations under the License.
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -31,6 +38,7 @@ import (
 	"github.com/coreos/go-oidc/jose"
 	"github.com/coreos/go-oidc/oauth2"
 	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
 )
 
 type fakeOAuthServer struct {
@@ -43,8 +51,43 @@ type fakeOAuthServer struct {
 	key jose.JWK
 	// the signer
 	signer jose.Signer
+	// the ec and eddsa keys
+	ecKey *ecdsa.PrivateKey
+	edKey ed25519.PrivateKey
 	// the claims
 	claims jose.Claims
+	// the nonce of the authorization requests keyed by code
+	nonces map[string]string
+	// the pkce code challenges of the authorization requests keyed by code
+	challenges map[string]string
+	// the tokens reported by the introspection, the inactive ones with no claims
+	introspected map[string]jose.Claims
+	// the number of introspections made
+	introspections int
+	// the permissions granted by the authorization services, path#method
+	permissions map[string]bool
+	// the number of authorization decisions made
+	decisions int
+	// the number of token exchanges made
+	exchanges int
+	// the access tokens revoked
+	revoked []string
+	// the refresh tokens used, they're rotated on every refresh
+	refreshed map[string]bool
+	// the number of service account tokens issued
+	serviceAccountTokens int
+	// the realm roles of the users the service account can impersonate, keyed by subject, the others being disabled
+	users map[string][]string
+	// the number of requests for the keys
+	keyRequests int
+	// the cache-control header of the keys
+	keysCacheControl string
+	// the retry-after of the token endpoint when rate limiting the requests
+	rateLimit string
+	// the number of requests rejected by the rate limit
+	rateLimited int
+	// the time the token endpoint takes to respond
+	delay time.Duration
 }
 
 const fakePrivateKey = `
@@ -80,6 +123,9 @@ Ka0WPQGKjQJhZRtqDAT3sfnrEEUa34+MkXQeKFCu6Yi0dRFic4iqOYU=
 const (
 	validUsername = "test"
 	validPassword = "test"
+	// the device codes authorized and pending at the fake provider
+	fakeDeviceCode        = "device-code"
+	fakePendingDeviceCode = "pending-device-code"
 )
 
 type fakeDiscoveryResponse struct {
@@ -113,6 +159,12 @@ func newFakeOAuthServer() *fakeOAuthServer {
 	}
 
 	service := &fakeOAuthServer{
+		nonces:       make(map[string]string),
+		challenges:   make(map[string]string),
+		introspected: make(map[string]jose.Claims),
+		permissions:  make(map[string]bool),
+		refreshed:    make(map[string]bool),
+		users:        make(map[string][]string),
 		claims: jose.Claims{
 			"jti":                "4ee75b8e-3ee6-4382-92d4-3390b4b4937b",
 			"exp":                int(time.Now().Add(time.Duration(10) * time.Hour).Unix()),
@@ -140,8 +192,11 @@ func newFakeOAuthServer() *fakeOAuthServer {
 			Modulus:  privateKey.PublicKey.N,
 			Secret:   block.Bytes,
 		},
-		signer: jose.NewSignerRSA("test-kid", *privateKey),
+		signer:           jose.NewSignerRSA("test-kid", *privateKey),
+		keysCacheControl: "max-age=300",
 	}
+	service.ecKey, _ = ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	_, service.edKey, _ = ed25519.GenerateKey(crand.Reader)
 
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
@@ -150,7 +205,10 @@ func newFakeOAuthServer() *fakeOAuthServer {
 	r.GET("auth/realms/hod-test/protocol/openid-connect/token", service.tokenHandler)
 	r.POST("auth/realms/hod-test/protocol/openid-connect/token", service.tokenHandler)
 	r.GET("auth/realms/hod-test/protocol/openid-connect/auth", service.authHandler)
+	r.POST("auth/realms/hod-test/protocol/openid-connect/auth/device", service.deviceHandler)
 	r.POST("auth/realms/hod-test/protocol/openid-connect/logout", service.logoutHandler)
+	r.POST("auth/realms/hod-test/protocol/openid-connect/revoke", service.revokeHandler)
+	r.POST("auth/realms/hod-test/protocol/openid-connect/token/introspect", service.introspectionHandler)
 	r.GET("auth/realms/hod-test/protocol/openid-connect/userinfo", service.userinfoHandler)
 
 	location, err := url.Parse(httptest.NewServer(r).URL)
@@ -172,9 +230,55 @@ func (r *fakeOAuthServer) getRevocationURL() string {
 }
 
 func (r *fakeOAuthServer) signToken(claims jose.Claims) (*jose.JWT, error) {
+	r.Lock()
+	defer r.Unlock()
 	return jose.NewSignedJWT(claims, r.signer)
 }
 
+// signEllipticToken signs the claims with the ES256 or EdDSA key
+func (r *fakeOAuthServer) signEllipticToken(alg string, claims jose.Claims) (*jose.JWT, error) {
+	kid := "test-ec-kid"
+	if alg == "EdDSA" {
+		kid = "test-ed-kid"
+	}
+	token, err := jose.NewJWT(jose.JOSEHeader{"alg": alg, "kid": kid}, claims)
+	if err != nil {
+		return nil, err
+	}
+	data := []byte(token.Data())
+	if alg == "EdDSA" {
+		token.Signature = ed25519.Sign(r.edKey, data)
+		return &token, nil
+	}
+	hash := sha256.Sum256(data)
+	sr, ss, err := ecdsa.Sign(crand.Reader, r.ecKey, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	token.Signature = append(sr.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+
+	return &token, nil
+}
+
+// signPSSToken signs the claims with the rsa key and the PS256, PS384 or PS512 algorithm
+func (r *fakeOAuthServer) signPSSToken(alg string, claims jose.Claims) (*jose.JWT, error) {
+	r.Lock()
+	defer r.Unlock()
+	token, err := jose.NewJWT(jose.JOSEHeader{"alg": alg, "kid": r.key.ID}, claims)
+	if err != nil {
+		return nil, err
+	}
+	hash := signatureAlgorithms[alg].hash
+	h := hash.New()
+	h.Write([]byte(token.Data()))
+	token.Signature, err = rsa.SignPSS(crand.Reader, r.privateKey, hash, h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
 func (r *fakeOAuthServer) setUserRealmRoles(roles []string) *fakeOAuthServer {
 	r.claims["realm_access"] = map[string]interface{}{
 		"roles": roles,
@@ -205,8 +309,63 @@ func (r *fakeOAuthServer) discoveryHandler(cx *gin.Context) {
 	})
 }
 
+// rotateKey replaces the rsa key of the realm, as a key rotation in keycloak would
+func (r *fakeOAuthServer) rotateKey(kid string) error {
+	privateKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.privateKey = privateKey
+	r.key = jose.JWK{
+		ID:       kid,
+		Type:     "RSA",
+		Alg:      "RS256",
+		Use:      "sig",
+		Exponent: privateKey.PublicKey.E,
+		Modulus:  privateKey.PublicKey.N,
+	}
+	r.signer = jose.NewSignerRSA(kid, *privateKey)
+
+	return nil
+}
+
+func (r *fakeOAuthServer) getKeyRequests() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.keyRequests
+}
+
 func (r *fakeOAuthServer) keysHandler(cx *gin.Context) {
-	cx.JSON(http.StatusOK, jose.JWKSet{Keys: []jose.JWK{r.key}})
+	r.Lock()
+	defer r.Unlock()
+	r.keyRequests++
+	if r.keysCacheControl != "" {
+		cx.Header("Cache-Control", r.keysCacheControl)
+	}
+	cx.JSON(http.StatusOK, gin.H{
+		"keys": []interface{}{
+			&r.key,
+			gin.H{
+				"kid": "test-ec-kid",
+				"kty": "EC",
+				"alg": "ES256",
+				"use": "sig",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(r.ecKey.X.Bytes()),
+				"y":   base64.RawURLEncoding.EncodeToString(r.ecKey.Y.Bytes()),
+			},
+			gin.H{
+				"kid": "test-ed-kid",
+				"kty": "OKP",
+				"alg": "EdDSA",
+				"use": "sig",
+				"crv": "Ed25519",
+				"x":   base64.RawURLEncoding.EncodeToString(r.edKey.Public().(ed25519.PublicKey)),
+			},
+		},
+	})
 }
 
 func (r *fakeOAuthServer) authHandler(cx *gin.Context) {
@@ -221,7 +380,12 @@ func (r *fakeOAuthServer) authHandler(cx *gin.Context) {
 		state = "/"
 	}
 	// step: generate a random authentication code
-	redirectionURL := fmt.Sprintf("%s?state=%s&code=%s", redirect, state, getRandomString(32))
+	code := getRandomString(32)
+	r.Lock()
+	r.nonces[code] = cx.Query("nonce")
+	r.challenges[code] = cx.Query("code_challenge")
+	r.Unlock()
+	redirectionURL := fmt.Sprintf("%s?state=%s&code=%s", redirect, state, code)
 
 	cx.Redirect(http.StatusTemporaryRedirect, redirectionURL)
 }
@@ -235,6 +399,118 @@ func (r *fakeOAuthServer) logoutHandler(cx *gin.Context) {
 	cx.AbortWithStatus(http.StatusNoContent)
 }
 
+func (r *fakeOAuthServer) revokeHandler(cx *gin.Context) {
+	token := cx.PostForm("token")
+	if hint := cx.PostForm("token_type_hint"); token == "" || (hint != "access_token" && hint != "refresh_token") {
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.revoked = append(r.revoked, token)
+
+	cx.AbortWithStatus(http.StatusOK)
+}
+
+// getRevoked returns the access tokens revoked
+func (r *fakeOAuthServer) getRevoked() []string {
+	r.Lock()
+	defer r.Unlock()
+	return r.revoked
+}
+
+// setIntrospection sets the claims reported for the token by the introspection, nil being inactive
+func (r *fakeOAuthServer) setIntrospection(token string, claims jose.Claims) *fakeOAuthServer {
+	r.Lock()
+	defer r.Unlock()
+	r.introspected[token] = claims
+	return r
+}
+
+// getIntrospections returns the number of introspections made
+func (r *fakeOAuthServer) getIntrospections() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.introspections
+}
+
+// grantPermission grants the permission, path#method, via the authorization services
+func (r *fakeOAuthServer) grantPermission(permission string) *fakeOAuthServer {
+	r.Lock()
+	defer r.Unlock()
+	r.permissions[permission] = true
+	return r
+}
+
+// setDelay sets the time the token endpoint takes to respond
+func (r *fakeOAuthServer) setDelay(delay time.Duration) *fakeOAuthServer {
+	r.Lock()
+	defer r.Unlock()
+	r.delay = delay
+	return r
+}
+
+// getServiceAccountTokens returns the number of service account tokens issued
+func (r *fakeOAuthServer) getServiceAccountTokens() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.serviceAccountTokens
+}
+
+// setUser enables the user to be impersonated with the realm roles, nil roles disabling the user
+func (r *fakeOAuthServer) setUser(subject string, roles []string) *fakeOAuthServer {
+	r.Lock()
+	defer r.Unlock()
+	if roles == nil {
+		delete(r.users, subject)
+		return r
+	}
+	r.users[subject] = roles
+	return r
+}
+
+// getExchanges returns the number of token exchanges made
+func (r *fakeOAuthServer) getExchanges() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.exchanges
+}
+
+// getDecisions returns the number of authorization decisions made
+func (r *fakeOAuthServer) getDecisions() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.decisions
+}
+
+func (r *fakeOAuthServer) introspectionHandler(cx *gin.Context) {
+	if _, _, found := cx.Request.BasicAuth(); !found {
+		cx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	token := cx.PostForm("token")
+	r.Lock()
+	r.introspections++
+	claims, found := r.introspected[token]
+	r.Unlock()
+	// step: unless told otherwise, any parsable token is active
+	if !found {
+		if jwt, err := jose.ParseJWT(token); err == nil {
+			claims, _ = jwt.Claims()
+		}
+	}
+	if claims == nil {
+		cx.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+	response := gin.H{"active": true}
+	for k, v := range claims {
+		response[k] = v
+	}
+
+	cx.JSON(http.StatusOK, response)
+}
+
 func (r *fakeOAuthServer) userinfoHandler(cx *gin.Context) {
 	cx.JSON(http.StatusOK, map[string]string{
 		"sub":                "0d69648e-380f-48c0-90cd-91e55fe68452",
@@ -247,8 +523,35 @@ func (r *fakeOAuthServer) userinfoHandler(cx *gin.Context) {
 	})
 }
 
+func (r *fakeOAuthServer) deviceHandler(cx *gin.Context) {
+	if cx.PostForm("client_id") == "" {
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	cx.JSON(http.StatusOK, deviceAuthorizationResponse{
+		DeviceCode:      fakeDeviceCode,
+		UserCode:        "ABCD-EFGH",
+		VerificationURI: fmt.Sprintf("http://%s/auth/realms/hod-test/device", r.location.Host),
+		ExpiresIn:       600,
+		Interval:        5,
+	})
+}
+
 func (r *fakeOAuthServer) tokenHandler(cx *gin.Context) {
 	expiration := time.Now().Add(time.Duration(1) * time.Hour)
+	r.Lock()
+	retryAfter := r.rateLimit
+	if retryAfter != "" {
+		r.rateLimited++
+	}
+	delay := r.delay
+	r.Unlock()
+	time.Sleep(delay)
+	if retryAfter != "" {
+		cx.Header("Retry-After", retryAfter)
+		cx.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
 
 	token, err := jose.NewSignedJWT(r.claims, r.signer)
 	if err != nil {
@@ -277,13 +580,159 @@ func (r *fakeOAuthServer) tokenHandler(cx *gin.Context) {
 			"error":             "invalid_grant",
 			"error_description": "Invalid user credentials",
 		})
+	case oauth2.GrantTypeRefreshToken:
+		// step: the refresh tokens are rotated, as keycloak does with revoke refresh token, so a used one is stale
+		refresh := cx.PostForm("refresh_token")
+		r.Lock()
+		stale := r.refreshed[refresh]
+		r.refreshed[refresh] = true
+		claims := jose.Claims{}
+		for k, v := range r.claims {
+			claims[k] = v
+		}
+		r.Unlock()
+		if refresh == "" || stale {
+			cx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant", "error_description": "Stale token"})
+			return
+		}
+		claims["jti"] = getRandomString(32)
+		rotated, err := jose.NewSignedJWT(claims, r.signer)
+		if err != nil {
+			cx.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		cx.JSON(http.StatusOK, tokenResponse{
+			IDToken:      token.Encode(),
+			AccessToken:  token.Encode(),
+			RefreshToken: rotated.Encode(),
+			ExpiresIn:    expiration.Second(),
+		})
+	case oauth2.GrantTypeClientCreds:
+		if _, _, found := cx.Request.BasicAuth(); !found {
+			cx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		r.Lock()
+		r.serviceAccountTokens++
+		r.Unlock()
+		// step: the service account of the client has no email or username
+		claims := jose.Claims{
+			"iss":          r.claims["iss"],
+			"aud":          "test",
+			"sub":          "0a3f5e37-service-account",
+			"azp":          "test",
+			"clientId":     "test",
+			"exp":          float64(expiration.Unix()),
+			"iat":          float64(time.Now().Unix()),
+			"realm_access": map[string]interface{}{"roles": []string{"api"}},
+		}
+		token, err := jose.NewSignedJWT(claims, r.signer)
+		if err != nil {
+			cx.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		cx.JSON(http.StatusOK, tokenResponse{
+			AccessToken: token.Encode(),
+			ExpiresIn:   3600,
+			TokenType:   "Bearer",
+		})
+	case deviceCodeGrantType:
+		switch cx.PostForm("device_code") {
+		case fakeDeviceCode:
+			cx.JSON(http.StatusOK, tokenResponse{
+				IDToken:      token.Encode(),
+				AccessToken:  token.Encode(),
+				RefreshToken: token.Encode(),
+				ExpiresIn:    expiration.Second(),
+			})
+		case fakePendingDeviceCode:
+			cx.JSON(http.StatusBadRequest, gin.H{"error": "authorization_pending"})
+		default:
+			cx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+		}
 	case oauth2.GrantTypeAuthCode:
+		// step: the id token carries the nonce of the authorization request
+		r.Lock()
+		nonce := r.nonces[cx.PostForm("code")]
+		challenge := r.challenges[cx.PostForm("code")]
+		r.Unlock()
+		// step: the code of a pkce authorization can only be redeemed with the verifier
+		if challenge != "" {
+			verifier := sha256.Sum256([]byte(cx.PostForm("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(verifier[:]) != challenge {
+				cx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+				return
+			}
+		}
+		if nonce != "" {
+			claims := jose.Claims{"nonce": nonce}
+			for k, v := range r.claims {
+				claims[k] = v
+			}
+			if token, err = jose.NewSignedJWT(claims, r.signer); err != nil {
+				cx.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
 		cx.JSON(http.StatusOK, tokenResponse{
 			IDToken:      token.Encode(),
 			AccessToken:  token.Encode(),
 			RefreshToken: token.Encode(),
 			ExpiresIn:    expiration.Second(),
 		})
+	case tokenExchangeGrantType:
+		if _, _, found := cx.Request.BasicAuth(); !found || cx.PostForm("subject_token") == "" {
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		// step: only the upstream audience is permitted to be exchanged for, or the client impersonating a user
+		subject := cx.PostForm("requested_subject")
+		if subject == "" && cx.PostForm("audience") != "upstream" {
+			cx.JSON(http.StatusForbidden, gin.H{"error": "access_denied", "error_description": "Client not allowed to exchange"})
+			return
+		}
+		r.Lock()
+		r.exchanges++
+		claims := jose.Claims{}
+		for k, v := range r.claims {
+			claims[k] = v
+		}
+		roles, enabled := r.users[subject]
+		r.Unlock()
+		if subject != "" {
+			if !enabled {
+				cx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_token", "error_description": "requested_subject not found"})
+				return
+			}
+			claims["sub"] = subject
+			claims["realm_access"] = map[string]interface{}{"roles": roles}
+		}
+		claims["aud"] = cx.PostForm("audience")
+		exchanged, err := jose.NewSignedJWT(claims, r.signer)
+		if err != nil {
+			cx.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		cx.JSON(http.StatusOK, gin.H{
+			"access_token":      exchanged.Encode(),
+			"expires_in":        3600,
+			"issued_token_type": accessTokenType,
+			"token_type":        "Bearer",
+		})
+	case umaGrantType:
+		if !strings.HasPrefix(cx.Request.Header.Get(authorizationHeader), "Bearer ") || cx.PostForm("response_mode") != "decision" {
+			cx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		r.Lock()
+		r.decisions++
+		granted := r.permissions[cx.PostForm("permission")]
+		r.Unlock()
+		if !granted {
+			cx.JSON(http.StatusForbidden, gin.H{"error": "access_denied", "error_description": "not_authorized"})
+			return
+		}
+		cx.JSON(http.StatusOK, gin.H{"result": true})
 	default:
 		cx.AbortWithStatus(http.StatusBadRequest)
 	}
@@ -332,3 +781,20 @@ func getRandomString(n int) string {
 	}
 	return string(b)
 }
+
+func TestIsOfflineToken(t *testing.T) {
+	cs := []struct {
+		Claims   jose.Claims
+		Expected bool
+	}{
+		{Claims: jose.Claims{"typ": "Offline"}, Expected: true},
+		{Claims: jose.Claims{"typ": "offline"}, Expected: true},
+		{Claims: jose.Claims{"typ": "Refresh"}},
+		{Claims: jose.Claims{}},
+	}
+	for i, c := range cs {
+		token, _ := jose.NewJWT(jose.JOSEHeader{"alg": "HS256"}, c.Claims)
+		assert.Equal(t, c.Expected, isOfflineToken(token.Encode()), "case %d", i)
+	}
+	assert.False(t, isOfflineToken("not a token"))
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// providerRetryBackoff is the initial delay between the retries of a provider request
+	providerRetryBackoff = 100 * time.Millisecond
+	// discoveryRetryBackoff is the initial delay between the attempts to discover the provider
+	discoveryRetryBackoff = time.Second
+	// discoveryMaxBackoff is the maximum delay between the attempts to discover the provider
+	discoveryMaxBackoff = 30 * time.Second
+	// providerMaxThrottle caps the retry-after honoured from a rate limiting provider
+	providerMaxThrottle = 5 * time.Minute
+)
+
+// providerTransport wraps the transport to the openid provider, retrying the idempotent requests and
+// opening a circuit on repeated failures of the token endpoint, so a hung provider fails fast rather
+// than stranding the requests. A rate limited token endpoint is left alone for the retry-after given
+type providerTransport struct {
+	sync.Mutex
+	// the underlining transport
+	transport http.RoundTripper
+	// the retries of the idempotent requests
+	retries int
+	// the consecutive failures which open the circuit, zero disables the breaker
+	threshold int
+	// how long the circuit stays open
+	cooldown time.Duration
+	// the token endpoint of the provider
+	tokenEndpoint string
+	// the consecutive failures of the token endpoint
+	failures int
+	// when the circuit was opened
+	openedAt time.Time
+	// how long we back off a rate limiting token endpoint which gave no retry-after, zero disables
+	throttleCooldown time.Duration
+	// when the token endpoint may be tried again
+	throttledUntil time.Time
+	// the retries made
+	retried prometheus.Counter
+	// the state of the circuit
+	open prometheus.Gauge
+	// the rate limited responses of the token endpoint
+	throttled prometheus.Counter
+}
+
+// newProviderTransport creates a transport with the retries and circuit breaker
+func newProviderTransport(transport http.RoundTripper, retries, threshold int, cooldown, throttle time.Duration) *providerTransport {
+	retried := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "openid_provider_retries_total",
+		Help: "The retries of the idempotent requests to the openid provider",
+	})
+	open := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "openid_provider_circuit_open",
+		Help: "Indicates the circuit to the token endpoint is open",
+	})
+	throttled := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "openid_provider_throttled_total",
+		Help: "The rate limited responses of the token endpoint of the openid provider",
+	})
+
+	return &providerTransport{
+		transport:        transport,
+		retries:          retries,
+		threshold:        threshold,
+		cooldown:         cooldown,
+		throttleCooldown: throttle,
+		retried:          prometheus.MustRegisterOrGet(retried).(prometheus.Counter),
+		open:             prometheus.MustRegisterOrGet(open).(prometheus.Gauge),
+		throttled:        prometheus.MustRegisterOrGet(throttled).(prometheus.Counter),
+	}
+}
+
+// setTokenEndpoint sets the endpoint guarded by the circuit breaker
+func (r *providerTransport) setTokenEndpoint(endpoint string) {
+	r.Lock()
+	defer r.Unlock()
+	r.tokenEndpoint = endpoint
+}
+
+// RoundTrip makes the request to the provider
+func (r *providerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	guarded := r.isTokenEndpoint(req)
+	breaker := guarded && r.threshold > 0
+	if guarded && r.throttledFor() > 0 {
+		return nil, ErrProviderThrottled
+	}
+	if breaker && !r.allow() {
+		return nil, ErrProviderUnavailable
+	}
+	attempts := 1
+	if isIdempotent(req.Method) {
+		attempts += r.retries
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		resp, err = r.transport.RoundTrip(req)
+		if !isProviderFailure(resp, err) || attempt+1 >= attempts {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		// step: back off exponentially with jitter, giving up if the request is cancelled
+		backoff := providerRetryBackoff << uint(attempt)
+		backoff += time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		r.retried.Inc()
+	}
+	if guarded && err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		r.throttle(parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+	}
+	if breaker {
+		r.record(isProviderFailure(resp, err))
+	}
+
+	return resp, err
+}
+
+// isTokenEndpoint checks if the request is to the token endpoint
+func (r *providerTransport) isTokenEndpoint(req *http.Request) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.tokenEndpoint != "" && req.URL.String() == r.tokenEndpoint
+}
+
+// allow checks if the circuit is closed, or has cooled down enough to try again
+func (r *providerTransport) allow() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.failures < r.threshold || time.Since(r.openedAt) >= r.cooldown
+}
+
+// record updates the circuit with the outcome of a request to the token endpoint
+func (r *providerTransport) record(failed bool) {
+	r.Lock()
+	defer r.Unlock()
+	if !failed {
+		if r.failures >= r.threshold {
+			log.Infof("the token endpoint has recovered, closing the circuit")
+		}
+		r.failures = 0
+		r.open.Set(0)
+		return
+	}
+	r.failures++
+	if r.failures >= r.threshold {
+		if r.failures == r.threshold {
+			log.WithFields(log.Fields{
+				"failures": r.failures,
+				"cooldown": r.cooldown.String(),
+			}).Errorf("the token endpoint is failing, opening the circuit")
+		}
+		r.openedAt = time.Now()
+		r.open.Set(1)
+	}
+}
+
+// throttle backs off the token endpoint for the retry-after given by the provider, else the cooldown
+func (r *providerTransport) throttle(retryAfter time.Duration) {
+	if r.throttleCooldown <= 0 {
+		return
+	}
+	r.throttled.Inc()
+	if retryAfter <= 0 {
+		retryAfter = r.throttleCooldown
+	}
+	if retryAfter > providerMaxThrottle {
+		retryAfter = providerMaxThrottle
+	}
+	r.Lock()
+	defer r.Unlock()
+	until := time.Now().Add(retryAfter)
+	if until.After(r.throttledUntil) {
+		log.WithFields(log.Fields{
+			"retry_after": retryAfter.String(),
+		}).Warnf("the token endpoint is rate limiting the requests, backing off")
+
+		r.throttledUntil = until
+	}
+}
+
+// throttledFor returns how long is left before the rate limiting token endpoint may be tried again
+func (r *providerTransport) throttledFor() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	if remaining := time.Until(r.throttledUntil); remaining > 0 {
+		return remaining
+	}
+
+	return 0
+}
+
+// parseRetryAfter parses the retry-after header, either the delay in seconds or a http date, returning
+// zero when not given or invalid
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil && when.After(now) {
+		return when.Sub(now)
+	}
+
+	return 0
+}
+
+// isIdempotent checks if the request method can be safely retried
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	return false
+}
+
+// isProviderFailure checks if the request failed or the provider is in error
+func isProviderFailure(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// fetchProviderConfig retrieves the provider configuration from the discovery url, retrying with a jittered
+// exponential backoff until the timeout, so the proxy can start ahead of the provider
+func fetchProviderConfig(hc *http.Client, discoveryURL string, timeout time.Duration) (oidc.ProviderConfig, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := discoveryRetryBackoff
+	for {
+		log.Infof("attempting to retrieve openid configuration from discovery url: %s", discoveryURL)
+		config, err := oidc.FetchProviderConfig(hc, discoveryURL)
+		if err == nil {
+			return config, nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return config, fmt.Errorf("failed to retrieve the provider configuration from discovery url: %s, error: %s", discoveryURL, err)
+		}
+		delay := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+			"retry": delay.String(),
+		}).Warnf("failed to get provider configuration from discovery url: %s", discoveryURL)
+
+		time.Sleep(delay)
+		if backoff *= 2; backoff > discoveryMaxBackoff {
+			backoff = discoveryMaxBackoff
+		}
+	}
+}
+
+// getProviderConfig returns the current configuration of the provider
+func (r *oauthProxy) getProviderConfig() oidc.ProviderConfig {
+	r.idpLock.RLock()
+	defer r.idpLock.RUnlock()
+
+	return r.idp
+}
+
+// setProviderConfig replaces the configuration of the provider, updating the endpoints derived from it
+func (r *oauthProxy) setProviderConfig(config oidc.ProviderConfig) {
+	r.idpLock.Lock()
+	defer r.idpLock.Unlock()
+	r.idp = config
+	if transport, ok := r.idpClient.Transport.(*providerTransport); ok && config.TokenEndpoint != nil {
+		transport.setTokenEndpoint(config.TokenEndpoint.String())
+	}
+	if r.keys != nil && config.KeysEndpoint != nil {
+		r.keys.setLocation(config.KeysEndpoint.String())
+	}
+}
+
+// getProviderThrottle returns how long the rate limiting token endpoint has asked us to back off, if at all
+func (r *oauthProxy) getProviderThrottle() time.Duration {
+	if r.idpClient == nil {
+		return 0
+	}
+	if transport, ok := r.idpClient.Transport.(*providerTransport); ok {
+		return transport.throttledFor()
+	}
+
+	return 0
+}
+
+// syncProviderConfig refreshes the configuration of the provider from the discovery url, the issuer of the
+// document is checked against the url by the openid library
+func (r *oauthProxy) syncProviderConfig() error {
+	config, err := oidc.FetchProviderConfig(r.idpClient, r.config.DiscoveryURL)
+	if err != nil {
+		return err
+	}
+	r.setProviderConfig(config)
+
+	return nil
+}
+
+// refreshProviderConfig periodically refreshes the configuration of the provider, so changes to the
+// endpoints are picked up without a restart
+func (r *oauthProxy) refreshProviderConfig(interval time.Duration) {
+	refreshed := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "openid_provider_config_refreshes_total",
+			Help: "The refreshes of the openid provider configuration partitioned by result",
+		},
+		[]string{"result"},
+	)
+	refreshed = prometheus.MustRegisterOrGet(refreshed).(*prometheus.CounterVec)
+
+	go func() {
+		for range time.Tick(interval) {
+			if err := r.syncProviderConfig(); err != nil {
+				log.WithFields(log.Fields{
+					"discovery_url": r.config.DiscoveryURL,
+					"error":         err.Error(),
+				}).Warnf("unable to refresh the openid provider configuration, keeping the current")
+
+				refreshed.WithLabelValues("error").Inc()
+				continue
+			}
+			refreshed.WithLabelValues("refreshed").Inc()
+		}
+	}()
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderTransportRetries(t *testing.T) {
+	var requests int32
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer provider.Close()
+	client := &http.Client{Transport: newProviderTransport(http.DefaultTransport, 2, 0, 0, 0)}
+
+	resp, err := client.Get(provider.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// step: the posts are not idempotent and should not be retried
+	atomic.StoreInt32(&requests, 0)
+	resp, err = client.Post(provider.URL, "text/plain", nil)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestProviderTransportBreaker(t *testing.T) {
+	var requests int32
+	failing := int32(1)
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer provider.Close()
+	transport := newProviderTransport(http.DefaultTransport, 0, 2, 50*time.Millisecond, 0)
+	transport.setTokenEndpoint(provider.URL + "/token")
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(provider.URL+"/token", "text/plain", nil)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+	}
+	// step: the circuit is open, so we should fail without a request
+	_, err := client.Post(provider.URL+"/token", "text/plain", nil)
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// step: the other endpoints are not guarded
+	resp, err := client.Get(provider.URL + "/userinfo")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+
+	// step: after the cooldown the endpoint is tried again and closes the circuit
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		resp, err := client.Post(provider.URL+"/token", "text/plain", nil)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}
+}
+
+type testRoundTripper func(*http.Request) (*http.Response, error)
+
+func (r testRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return r(req)
+}
+
+func TestFetchProviderConfigRetry(t *testing.T) {
+	idp := newFakeOAuthServer()
+	var requests int32
+	client := &http.Client{Transport: testRoundTripper(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+
+	config, err := fetchProviderConfig(client, idp.getLocation(), time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	if assert.NotNil(t, config.Issuer) {
+		assert.Equal(t, idp.getLocation(), config.Issuer.String())
+	}
+}
+
+func TestFetchProviderConfigTimeout(t *testing.T) {
+	var requests int32
+	client := &http.Client{Transport: testRoundTripper(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		return nil, errors.New("connection refused")
+	})}
+
+	_, err := fetchProviderConfig(client, "http://127.0.0.1:1/auth/realms/test", 0)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestSyncProviderConfig(t *testing.T) {
+	proxy, idp, _ := newTestProxyService(nil)
+	stale := proxy.getProviderConfig()
+	stale.TokenEndpoint, _ = url.Parse("http://127.0.0.1/stale/token")
+	stale.KeysEndpoint, _ = url.Parse("http://127.0.0.1/stale/certs")
+	proxy.setProviderConfig(stale)
+
+	assert.NoError(t, proxy.syncProviderConfig())
+	assert.Equal(t, idp.getLocation()+"/protocol/openid-connect/token", proxy.getProviderConfig().TokenEndpoint.String())
+	assert.Equal(t, idp.getLocation()+"/protocol/openid-connect/certs", proxy.keys.location)
+	assert.Equal(t, idp.getLocation()+"/protocol/openid-connect/token", proxy.idpClient.Transport.(*providerTransport).tokenEndpoint)
+
+	// step: a failed refresh keeps the current configuration
+	proxy.config.DiscoveryURL = "http://127.0.0.1:1/auth/realms/missing"
+	assert.Error(t, proxy.syncProviderConfig())
+	assert.Equal(t, idp.getLocation()+"/protocol/openid-connect/token", proxy.getProviderConfig().TokenEndpoint.String())
+}
+
+func TestProviderTransportThrottle(t *testing.T) {
+	var requests int32
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer provider.Close()
+	transport := newProviderTransport(http.DefaultTransport, 0, 0, 0, 50*time.Millisecond)
+	transport.setTokenEndpoint(provider.URL + "/token")
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Post(provider.URL+"/token", "text/plain", nil)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	}
+	assert.True(t, transport.throttledFor() > 0)
+
+	// step: we back off without making a request
+	_, err = client.Post(provider.URL+"/token", "text/plain", nil)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// step: the other endpoints are not throttled
+	resp, err = client.Get(provider.URL + "/userinfo")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+
+	// step: after the cooldown the token endpoint is tried again
+	time.Sleep(60 * time.Millisecond)
+	resp, err = client.Post(provider.URL+"/token", "text/plain", nil)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, time.Duration(0), transport.throttledFor())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Now()
+	cs := []struct {
+		Value    string
+		Expected time.Duration
+	}{
+		{Value: "", Expected: 0},
+		{Value: "30", Expected: 30 * time.Second},
+		{Value: "-1", Expected: 0},
+		{Value: "soon", Expected: 0},
+		{Value: now.Add(-time.Minute).UTC().Format(http.TimeFormat), Expected: 0},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, parseRetryAfter(c.Value, now), "case %d, value: %s", i, c.Value)
+	}
+	later := parseRetryAfter(now.Add(time.Minute).UTC().Format(http.TimeFormat), now)
+	assert.True(t, later > 58*time.Second && later <= time.Minute, "retry after: %s", later)
+}
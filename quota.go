@@ -0,0 +1,187 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// quotaStorePrefix prefixes the counters of the quotas in the store
+	quotaStorePrefix = "quota:"
+)
+
+// quotaWindow is a period the requests are counted over
+type quotaWindow struct {
+	// the name of the window, i.e. daily
+	name string
+	// the requests permitted in the window
+	limit int64
+	// returns the id of the window the time falls in and when it resets
+	period func(now time.Time) (string, time.Time)
+}
+
+// quotaUsage is the usage of the most exhausted window of a subject
+type quotaUsage struct {
+	// the requests permitted in the window
+	limit int64
+	// the requests remaining in the window
+	remaining int64
+	// when the window resets
+	reset time.Time
+	// the window exhausted, if any
+	exhausted string
+}
+
+// quotaTracker counts the requests of the users and api keys in the store, so the quotas are shared
+// by the instances of the proxy
+type quotaTracker struct {
+	// the counters in the store
+	counter storageCounter
+	// the windows the requests are counted over
+	windows []quotaWindow
+	// the requests rejected partitioned by window
+	exhausted *prometheus.CounterVec
+}
+
+// newQuotaTracker creates the tracker of the daily and monthly quotas and registers the metrics
+func newQuotaTracker(store storage, daily, monthly int) (*quotaTracker, error) {
+	counter, ok := getStorageCounter(store)
+	if !ok {
+		return nil, errors.New("the store does not support the counters of the quotas")
+	}
+	exhausted := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quota_exhausted_total",
+			Help: "The requests rejected for exceeding the quota partitioned by window",
+		},
+		[]string{"window"},
+	)
+
+	tracker := &quotaTracker{
+		counter:   counter,
+		exhausted: prometheus.MustRegisterOrGet(exhausted).(*prometheus.CounterVec),
+	}
+	if daily > 0 {
+		tracker.windows = append(tracker.windows, quotaWindow{name: "daily", limit: int64(daily), period: dailyPeriod})
+	}
+	if monthly > 0 {
+		tracker.windows = append(tracker.windows, quotaWindow{name: "monthly", limit: int64(monthly), period: monthlyPeriod})
+	}
+
+	return tracker, nil
+}
+
+// consume counts a request of the subject in each window, stopping at the first window exhausted, and
+// returns the usage of the window with the fewest requests remaining
+func (r *quotaTracker) consume(subject string, now time.Time) (quotaUsage, error) {
+	var usage quotaUsage
+	sum := sha256.Sum256([]byte(subject))
+	hash := hex.EncodeToString(sum[:])
+
+	for i, window := range r.windows {
+		id, reset := window.period(now)
+		key := fmt.Sprintf("%s%s:%s:%s", quotaStorePrefix, window.name, id, hash)
+		count, err := r.counter.Increment(key, reset.Sub(now))
+		if err != nil {
+			return usage, err
+		}
+		remaining := window.limit - count
+		if remaining < 0 {
+			remaining = 0
+		}
+		if i == 0 || remaining < usage.remaining {
+			usage = quotaUsage{limit: window.limit, remaining: remaining, reset: reset}
+		}
+		if count > window.limit {
+			usage = quotaUsage{limit: window.limit, reset: reset, exhausted: window.name}
+			r.exhausted.WithLabelValues(window.name).Inc()
+			break
+		}
+	}
+
+	return usage, nil
+}
+
+// dailyPeriod returns the utc day of the time and the following midnight
+func dailyPeriod(now time.Time) (string, time.Time) {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+}
+
+// monthlyPeriod returns the utc month of the time and the start of the following month
+func monthlyPeriod(now time.Time) (string, time.Time) {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	return start.Format("2006-01"), start.AddDate(0, 1, 0)
+}
+
+// quotaMiddleware counts the requests of the users and api keys against the quotas, adding the usage
+// headers to the response and rejecting the requests beyond the quota with a 429
+func (r *oauthProxy) quotaMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if r.quotas == nil || cx.IsAborted() {
+			return
+		}
+		if _, found := cx.Get(cxEnforce); !found {
+			return
+		}
+		user := cx.MustGet(userContextName).(*userContext)
+		// step: the api keys are counted separately from their owner
+		subject := user.id
+		if user.apiKey != "" {
+			subject = user.apiKey
+		}
+
+		now := time.Now()
+		usage, err := r.quotas.consume(subject, now)
+		if err != nil {
+			// step: we fail open, a store outage shouldn't take down the upstream
+			log.WithFields(log.Fields{
+				"error":    err.Error(),
+				"username": user.name,
+			}).Errorf("unable to count the request against the quota")
+			return
+		}
+		cx.Header("X-RateLimit-Limit", strconv.FormatInt(usage.limit, 10))
+		cx.Header("X-RateLimit-Remaining", strconv.FormatInt(usage.remaining, 10))
+		cx.Header("X-RateLimit-Reset", strconv.FormatInt(usage.reset.Unix(), 10))
+
+		if usage.exhausted != "" {
+			log.WithFields(log.Fields{
+				"client_ip": cx.ClientIP(),
+				"username":  user.name,
+				"window":    usage.exhausted,
+			}).Warnf("rejecting the request, the %s quota has been exhausted", usage.exhausted)
+
+			cx.Header("Retry-After", strconv.Itoa(int(usage.reset.Sub(now).Seconds())+1))
+			cx.AbortWithStatus(http.StatusTooManyRequests)
+		}
+	}
+}
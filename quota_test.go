@@ -0,0 +1,98 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaPeriods(t *testing.T) {
+	now := time.Date(2016, time.December, 31, 23, 30, 0, 0, time.UTC)
+	id, reset := dailyPeriod(now)
+	assert.Equal(t, "2016-12-31", id)
+	assert.Equal(t, time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC), reset)
+	id, reset = monthlyPeriod(now)
+	assert.Equal(t, "2016-12", id)
+	assert.Equal(t, time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC), reset)
+}
+
+func TestQuotaConsume(t *testing.T) {
+	store := &fakeStore{items: make(map[string]string)}
+	quotas, err := newQuotaTracker(store, 3, 5)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Date(2016, time.December, 1, 12, 0, 0, 0, time.UTC)
+	for i := int64(2); i >= 0; i-- {
+		usage, err := quotas.consume("user", now)
+		assert.NoError(t, err)
+		assert.Equal(t, i, usage.remaining)
+		assert.Equal(t, int64(3), usage.limit)
+		assert.Empty(t, usage.exhausted)
+	}
+	usage, _ := quotas.consume("user", now)
+	assert.Equal(t, "daily", usage.exhausted)
+
+	// step: the next day the monthly quota is the most exhausted
+	now = now.AddDate(0, 0, 1)
+	usage, _ = quotas.consume("user", now)
+	assert.Equal(t, int64(1), usage.remaining)
+	assert.Equal(t, int64(5), usage.limit)
+	usage, _ = quotas.consume("user", now)
+	assert.Equal(t, int64(0), usage.remaining)
+	usage, _ = quotas.consume("user", now)
+	assert.Equal(t, "monthly", usage.exhausted)
+
+	// step: the subjects are counted separately
+	usage, _ = quotas.consume("other", now)
+	assert.Empty(t, usage.exhausted)
+}
+
+func TestQuotaMiddleware(t *testing.T) {
+	proxy, idp, svc := newTestProxyService(nil)
+	proxy.quotas, _ = newQuotaTracker(&fakeStore{items: make(map[string]string)}, 2, 0)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	for i := 1; i <= 3; i++ {
+		resp, err := resty.New().SetAuthToken(signed.Encode()).R().Get(svc + fakeAuthAllURL)
+		if !assert.NoError(t, err, "request %d", i) {
+			continue
+		}
+		assert.Equal(t, "2", resp.Header().Get("X-RateLimit-Limit"), "request %d", i)
+		assert.NotEmpty(t, resp.Header().Get("X-RateLimit-Reset"), "request %d", i)
+		if i <= 2 {
+			assert.Equal(t, http.StatusOK, resp.StatusCode(), "request %d", i)
+			assert.Equal(t, strconv.Itoa(2-i), resp.Header().Get("X-RateLimit-Remaining"), "request %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+		assert.Equal(t, "0", resp.Header().Get("X-RateLimit-Remaining"))
+		assert.NotEmpty(t, resp.Header().Get("Retry-After"))
+	}
+
+	// step: the unprotected resources are not counted
+	resp, err := resty.New().R().Get(svc + fakeTestWhitelistedURL)
+	if assert.NoError(t, err) {
+		assert.Empty(t, resp.Header().Get("X-RateLimit-Limit"))
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// isValid validates the provider
+func (r *Provider) isValid() error {
+	if r.Name == "" {
+		return errors.New("the provider has no name")
+	}
+	if r.DiscoveryURL == "" {
+		return fmt.Errorf("the provider: %s has no discovery url", r.Name)
+	}
+	if r.ClientID == "" {
+		return fmt.Errorf("the provider: %s has no client id", r.Name)
+	}
+	if len(r.Hostnames) == 0 && r.PathPrefix == "" {
+		return fmt.Errorf("the provider: %s must be selected by either hostnames or a path prefix", r.Name)
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+		return fmt.Errorf("the provider: %s path prefix must start with a /", r.Name)
+	}
+	for _, resource := range r.Resources {
+		if err := resource.valid(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matches checks if the request host and path select the provider
+func (r *Provider) matches(host, path string) bool {
+	if len(r.Hostnames) > 0 && !isAllowedHost(host, r.Hostnames) {
+		return false
+	}
+
+	return r.PathPrefix == "" || strings.HasPrefix(path, r.PathPrefix)
+}
+
+// getConfig returns the proxy configuration of the provider, the cookies are suffixed with the
+// provider name so the sessions of the realms can't collide
+func (r *Provider) getConfig(config *Config) *Config {
+	cfg := *config
+	cfg.Providers = nil
+	cfg.DiscoveryURL = r.DiscoveryURL
+	cfg.ClientID = r.ClientID
+	cfg.ClientSecret = r.ClientSecret
+	cfg.RedirectionURL = r.RedirectionURL
+	cfg.CookieAccessName = config.CookieAccessName + "-" + r.Name
+	cfg.CookieRefreshName = config.CookieRefreshName + "-" + r.Name
+	// step: the revocation endpoint of the default provider doesn't apply
+	cfg.RevocationEndpoint = ""
+	// step: the store and control plane are shared with the default provider, the store being handed to
+	// the proxy of the provider
+	cfg.StoreURL = ""
+	cfg.ControlPlaneURL = ""
+	if len(r.Resources) > 0 {
+		cfg.Resources = r.Resources
+	}
+
+	return &cfg
+}
+
+// providerRoute is the proxy handling the requests of a provider
+type providerRoute struct {
+	// the provider
+	provider *Provider
+	// the proxy of the provider
+	proxy *oauthProxy
+}
+
+// providerRouter dispatches the requests to the proxy of the provider selected by the host or path
+// prefix, falling back to the default provider
+type providerRouter struct {
+	// the handler of the default provider
+	handler http.Handler
+	// the path of the oauth endpoints
+	oauthURI string
+	// the providers in the order of selection
+	routes []*providerRoute
+}
+
+// newProviderRouter creates a proxy for each of the providers, in front of the default
+func newProviderRouter(svc *oauthProxy) (*providerRouter, error) {
+	router := &providerRouter{handler: svc.router, oauthURI: svc.config.withOAuthURI("")}
+	for _, provider := range svc.config.Providers {
+		log.WithFields(log.Fields{
+			"provider":    provider.Name,
+			"hostnames":   strings.Join(provider.Hostnames, ","),
+			"path-prefix": provider.PathPrefix,
+		}).Infof("adding the openid provider: %s", provider.DiscoveryURL)
+
+		proxy, err := newProxyWithStore(provider.getConfig(svc.config), svc.store)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create the provider: %s, error: %s", provider.Name, err)
+		}
+		router.routes = append(router.routes, &providerRoute{provider: provider, proxy: proxy})
+	}
+
+	return router, nil
+}
+
+// ServeHTTP dispatches the request to the proxy of the provider
+func (r *providerRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.getHandler(req).ServeHTTP(w, req)
+}
+
+// getHandler selects the provider of the request; the oauth endpoints are shared, so the provider
+// is taken from the provider parameter, the state cookie of the provider or the path held in the state
+func (r *providerRouter) getHandler(req *http.Request) http.Handler {
+	path := req.URL.Path
+	if strings.HasPrefix(path, r.oauthURI) {
+		if name := req.URL.Query().Get("provider"); name != "" {
+			for _, route := range r.routes {
+				if route.provider.Name == name {
+					return route.proxy.router
+				}
+			}
+		}
+		if state := req.URL.Query().Get("state"); state != "" {
+			for _, route := range r.routes {
+				if found, _, err := route.proxy.getStateCookie(req); err == nil && found == state {
+					return route.proxy.router
+				}
+			}
+			// step: the authorization endpoint is passed the path being requested
+			if decoded, err := base64.StdEncoding.DecodeString(state); err == nil {
+				path = string(decoded)
+			}
+		}
+	}
+	for _, route := range r.routes {
+		if route.provider.matches(req.Host, path) {
+			return route.proxy.router
+		}
+	}
+
+	return r.handler
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderIsValid(t *testing.T) {
+	cs := []struct {
+		Provider *Provider
+		Ok       bool
+	}{
+		{Provider: &Provider{}},
+		{Provider: &Provider{Name: "a", DiscoveryURL: "http://a"}},
+		{Provider: &Provider{Name: "a", DiscoveryURL: "http://a", ClientID: "a"}},
+		{Provider: &Provider{Name: "a", DiscoveryURL: "http://a", ClientID: "a", PathPrefix: "a"}},
+		{Provider: &Provider{Name: "a", DiscoveryURL: "http://a", ClientID: "a", PathPrefix: "/a"}, Ok: true},
+		{Provider: &Provider{Name: "a", DiscoveryURL: "http://a", ClientID: "a", Hostnames: []string{"a"}}, Ok: true},
+	}
+	for i, c := range cs {
+		err := c.Provider.isValid()
+		if c.Ok {
+			assert.NoError(t, err, "case %d", i)
+		} else {
+			assert.Error(t, err, "case %d", i)
+		}
+	}
+}
+
+func TestProviderMatches(t *testing.T) {
+	provider := &Provider{Hostnames: []string{"a.example.com"}, PathPrefix: "/a"}
+	assert.True(t, provider.matches("a.example.com", "/a/b"))
+	assert.True(t, provider.matches("a.example.com:443", "/a"))
+	assert.False(t, provider.matches("b.example.com", "/a"))
+	assert.False(t, provider.matches("a.example.com", "/b"))
+	provider = &Provider{PathPrefix: "/a"}
+	assert.True(t, provider.matches("b.example.com", "/a"))
+}
+
+func TestProviderConfig(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.StoreURL = "boltdb:///tmp/store"
+	provider := &Provider{Name: "second", DiscoveryURL: "http://second", ClientID: "second", PathPrefix: "/second"}
+	cfg := provider.getConfig(config)
+	assert.Equal(t, "http://second", cfg.DiscoveryURL)
+	assert.Equal(t, "second", cfg.ClientID)
+	assert.Equal(t, config.CookieAccessName+"-second", cfg.CookieAccessName)
+	assert.Empty(t, cfg.StoreURL)
+	assert.Equal(t, config.Resources, cfg.Resources)
+
+	provider.Resources = []*Resource{{URL: "/second"}}
+	assert.Equal(t, provider.Resources, provider.getConfig(config).Resources)
+}
+
+func TestProviderRouter(t *testing.T) {
+	second := newFakeOAuthServer()
+	cfg := newFakeKeycloakConfig()
+	cfg.Providers = []*Provider{
+		{
+			Name:         "second",
+			DiscoveryURL: second.getLocation(),
+			ClientID:     fakeClientID,
+			Hostnames:    []string{"second.example.com"},
+		},
+	}
+	proxy, idp, svc := newTestProxyService(cfg)
+	for _, route := range proxy.router.(*providerRouter).routes {
+		route.proxy.upstream = new(testReverseProxy)
+	}
+	request := func(host string, issuer *fakeOAuthServer) int {
+		token := newTestToken(issuer.getLocation())
+		signed, _ := issuer.signToken(token.claims)
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL+"/test", nil)
+		req.Host = host
+		req.Header.Set("Authorization", "Bearer "+signed.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, request("second.example.com", second))
+	assert.Equal(t, http.StatusForbidden, request("second.example.com", idp))
+	assert.Equal(t, http.StatusForbidden, request("", second))
+
+	// step: the oauth endpoints should be routed by the state or provider parameter
+	router := proxy.router.(*providerRouter)
+	secondRouter := router.routes[0].proxy.router
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1"+oauthURL+callbackURL+"?provider=second", nil)
+	assert.Equal(t, secondRouter, router.getHandler(req))
+	req, _ = http.NewRequest(http.MethodGet, "http://127.0.0.1"+oauthURL+callbackURL, nil)
+	assert.NotEqual(t, secondRouter, router.getHandler(req))
+	cfg.Providers[0].PathPrefix = "/second"
+	cfg.Providers[0].Hostnames = nil
+	req, _ = http.NewRequest(http.MethodGet, "http://127.0.0.1"+oauthURL+callbackURL+"?state="+
+		base64.StdEncoding.EncodeToString([]byte("/second/page")), nil)
+	assert.Equal(t, secondRouter, router.getHandler(req))
+}
+
+func TestProviderRouterStore(t *testing.T) {
+	defer os.Remove("/tmp/bolt-providers")
+	second := newFakeOAuthServer()
+	cfg := newFakeKeycloakConfig()
+	cfg.StoreURL = "boltdb:////tmp/bolt-providers"
+	cfg.DailyQuota = 2
+	cfg.Providers = []*Provider{
+		{
+			Name:         "second",
+			DiscoveryURL: second.getLocation(),
+			ClientID:     fakeClientID,
+			Hostnames:    []string{"second.example.com"},
+			Resources: []*Resource{
+				{URL: "/payments", Methods: []string{"ANY"}, ReplayProtection: true},
+				{URL: "/", Methods: []string{"ANY"}},
+			},
+		},
+	}
+	proxy, _, svc := newTestProxyService(cfg)
+	defer proxy.store.Close()
+	route := proxy.router.(*providerRouter).routes[0]
+	route.proxy.upstream = new(testReverseProxy)
+
+	// step: the provider shares the store and builds the trackers over it
+	assert.Equal(t, proxy.store, route.proxy.store)
+	assert.NotNil(t, route.proxy.quotas)
+	assert.NotNil(t, route.proxy.replays)
+
+	claims := jose.Claims{}
+	for k, v := range newTestToken(second.getLocation()).claims {
+		claims[k] = v
+	}
+	claims["jti"] = "8f2d61c4"
+	signed, _ := second.signToken(claims)
+	request := func() *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, svc+"/payments", nil)
+		req.Host = "second.example.com"
+		req.Header.Set("Authorization", "Bearer "+signed.Encode())
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp.Body.Close()
+
+		return resp
+	}
+	resp := request()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", resp.Header.Get("X-RateLimit-Remaining"))
+	// step: the token is refused on the replay protected resource of the provider
+	assert.Equal(t, http.StatusForbidden, request().StatusCode)
+}
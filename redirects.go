@@ -0,0 +1,81 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loginRedirectWindow is how long the redirects for authorization are counted, the redirects of a loop follow one
+// another in quick succession
+const loginRedirectWindow = 5 * time.Minute
+
+// getRedirectsCookieName returns the name of the cookie counting the redirects for authorization
+func (r *oauthProxy) getRedirectsCookieName(req *http.Request) string {
+	name, _ := r.config.getCookieNames(r.getSessionName(req))
+
+	return name + "-redirects"
+}
+
+// getLoginRedirectState returns a digest of the url the user is returned to after the login, distinguishing the
+// redirects of a loop from those of the other pages being opened
+func getLoginRedirectState(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.URL.RequestURI()))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// countLoginRedirect counts the repeated redirects for authorization of the same return url in a cookie, i.e.
+// <state>.<count>, returning false once they exceed the max login redirects without an authenticated request;
+// a redirect for another url starts the count afresh. The cookie is the browser's to keep, so there's nothing
+// to gain from tampering with it bar a redirect loop
+func (r *oauthProxy) countLoginRedirect(cx *gin.Context) bool {
+	if r.config.MaxLoginRedirects <= 0 {
+		return true
+	}
+	name := r.getRedirectsCookieName(cx.Request)
+	state := getLoginRedirectState(cx.Request)
+	var count int
+	if cookie, err := cx.Request.Cookie(name); err == nil {
+		if items := strings.SplitN(cookie.Value, ".", 2); len(items) == 2 && items[0] == state {
+			count, _ = strconv.Atoi(items[1])
+		}
+	}
+	if count >= r.config.MaxLoginRedirects {
+		return false
+	}
+	r.dropCookie(cx, name, state+"."+strconv.Itoa(count+1), loginRedirectWindow)
+
+	return true
+}
+
+// clearLoginRedirects clears the count of the redirects for authorization, if any
+func (r *oauthProxy) clearLoginRedirects(cx *gin.Context) {
+	if r.config.MaxLoginRedirects <= 0 {
+		return
+	}
+	name := r.getRedirectsCookieName(cx.Request)
+	if _, err := cx.Request.Cookie(name); err == nil {
+		r.dropCookie(cx, name, "", time.Duration(-10*time.Hour))
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedirectsToken(t *testing.T, idp *fakeOAuthServer, expires time.Time) string {
+	signed, err := idp.signToken(jose.Claims{
+		"iss":   idp.getLocation(),
+		"aud":   fakeClientID,
+		"sub":   "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"email": "user@example.com",
+		"iat":   float64(time.Now().Add(-time.Hour).Unix()),
+		"exp":   float64(expires.Unix()),
+	})
+	if err != nil {
+		t.Fatalf("unable to sign the token, error: %s", err)
+	}
+
+	return signed.Encode()
+}
+
+func TestExpiredSessionRedirectsToLogin(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.ExpiredSessionPrompt = "login"
+	_, idp, svc := newTestProxyService(cfg)
+
+	req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL+"/test", nil)
+	req.AddCookie(&http.Cookie{Name: cfg.CookieAccessName, Value: newTestRedirectsToken(t, idp, time.Now().Add(-time.Minute))})
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, oauthURL+authorizationURL, location.Path)
+		assert.Equal(t, "login", location.Query().Get("prompt"))
+	}
+	// step: the cookies of the expired session are cleared
+	var cleared bool
+	for _, x := range resp.Cookies() {
+		if x.Name == cfg.CookieAccessName && x.Value == "" {
+			cleared = true
+		}
+	}
+	assert.True(t, cleared)
+}
+
+func TestAuthorizationHandlerPrompt(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.ExpiredSessionPrompt = "consent"
+	_, _, svc := newTestProxyService(cfg)
+
+	cs := []struct {
+		Prompt   string
+		Expected string
+	}{
+		{Prompt: "login", Expected: "login"},
+		{Prompt: "consent", Expected: "consent"},
+		{Prompt: "select_account"},
+		{Prompt: "none"},
+		{},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest(http.MethodGet, svc+oauthURL+authorizationURL+"?prompt="+c.Prompt, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "case %d", i)
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, c.Expected, location.Query().Get("prompt"), "case %d", i)
+		}
+	}
+}
+
+func TestLoginRedirectLoop(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.MaxLoginRedirects = 3
+	_, idp, svc := newTestProxyService(cfg)
+
+	var count string
+	request := func(path, token string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL+path, nil)
+		if count != "" {
+			req.AddCookie(&http.Cookie{Name: cfg.CookieAccessName + "-redirects", Value: count})
+		}
+		if token != "" {
+			req.Header.Set(authorizationHeader, "Bearer "+token)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		for _, x := range resp.Cookies() {
+			if x.Name == cfg.CookieAccessName+"-redirects" {
+				count = x.Value
+			}
+		}
+
+		return resp
+	}
+	for i := 1; i <= cfg.MaxLoginRedirects; i++ {
+		assert.Equal(t, http.StatusTemporaryRedirect, request("/test", "").StatusCode)
+		assert.True(t, strings.HasSuffix(count, "."+strconv.Itoa(i)), "redirect %d, count: %s", i, count)
+	}
+	// step: the loop is broken once the redirects are exceeded
+	assert.Equal(t, http.StatusUnauthorized, request("/test", "").StatusCode)
+
+	// step: the redirect of another page isn't a loop and starts the count afresh
+	assert.Equal(t, http.StatusTemporaryRedirect, request("/other", "").StatusCode)
+	assert.True(t, strings.HasSuffix(count, ".1"), "count: %s", count)
+
+	// step: an authenticated request clears the count
+	assert.Equal(t, http.StatusOK, request("/test", newTestRedirectsToken(t, idp, time.Now().Add(time.Hour))).StatusCode)
+	assert.Empty(t, count)
+	assert.Equal(t, http.StatusTemporaryRedirect, request("/test", "").StatusCode)
+	assert.True(t, strings.HasSuffix(count, ".1"), "count: %s", count)
+}
+
+func TestLoginRedirectLoopDisabled(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	_, _, svc := newTestProxyService(cfg)
+
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL+"/test", nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Set-Cookie"))
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// refreshStorePrefix prefixes the refresh telemetry of the sessions in the store
+	refreshStorePrefix = "refreshes:"
+)
+
+// refreshUsage is the refresh telemetry of a session
+type refreshUsage struct {
+	// the refreshes of the session in the current window
+	count int64
+	// when the session was last refreshed, zero if never
+	last time.Time
+	// indicates the session has just exceeded the threshold of the window
+	anomalous bool
+}
+
+// refreshTracker records the refreshes of the sessions in the store, so the telemetry is shared by the instances
+// of the proxy, and reports the sessions refreshing anomalously often, which is usually down to misconfigured
+// token lifetimes or a client stuck in a loop
+type refreshTracker struct {
+	// the store holding the time of the last refresh
+	store storage
+	// the counters in the store
+	counter storageCounter
+	// the refreshes permitted in a window before the session is reported
+	threshold int64
+	// the window the refreshes are counted over
+	window time.Duration
+	// the time between the refreshes of the sessions
+	interval prometheus.Histogram
+	// the sessions reported as refreshing anomalously
+	anomalies prometheus.Counter
+}
+
+// newRefreshTracker creates the tracker of the session refreshes and registers the metrics
+func newRefreshTracker(store storage, threshold int, window time.Duration) (*refreshTracker, error) {
+	counter, ok := getStorageCounter(store)
+	if !ok {
+		return nil, errors.New("the store does not support the counters of the refresh telemetry")
+	}
+	interval := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "session_refresh_interval_seconds",
+			Help:    "The time between the refreshes of the access token of a session",
+			Buckets: []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 14400},
+		},
+	)
+	anomalies := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "session_refresh_anomalies_total",
+			Help: "The sessions refreshing more often than the refresh anomaly threshold permits in the window",
+		},
+	)
+
+	return &refreshTracker{
+		store:     store,
+		counter:   counter,
+		threshold: int64(threshold),
+		window:    window,
+		interval:  prometheus.MustRegisterOrGet(interval).(prometheus.Histogram),
+		anomalies: prometheus.MustRegisterOrGet(anomalies).(prometheus.Counter),
+	}, nil
+}
+
+// record counts the refresh of the session in the current window and updates the time of the last refresh, held
+// for the lifetime of the session
+func (r *refreshTracker) record(session string, now time.Time, lifetime time.Duration) (refreshUsage, error) {
+	var usage refreshUsage
+	sum := sha256.Sum256([]byte(session))
+	hash := hex.EncodeToString(sum[:])
+
+	// step: the refreshes are counted over fixed windows, else a session refreshing steadily would never reset
+	start := now.Truncate(r.window)
+	key := fmt.Sprintf("%scount:%d:%s", refreshStorePrefix, start.Unix(), hash)
+	count, err := r.counter.Increment(key, start.Add(r.window).Sub(now))
+	if err != nil {
+		return usage, err
+	}
+	usage.count = count
+
+	// step: retrieve and replace the time of the last refresh
+	key = refreshStorePrefix + "last:" + hash
+	if value, err := r.store.Get(key); err == nil && value != "" {
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+			usage.last = time.Unix(seconds, 0)
+			r.interval.Observe(now.Sub(usage.last).Seconds())
+		}
+	}
+	value := strconv.FormatInt(now.Unix(), 10)
+	if store, ok := getStorageExpiration(r.store); ok && lifetime > 0 {
+		err = store.SetWithExpiration(key, value, lifetime)
+	} else {
+		err = r.store.Set(key, value)
+	}
+	if err != nil {
+		return usage, err
+	}
+
+	// step: the session is only reported once a window, a client stuck in a loop would flood the logs
+	if count == r.threshold+1 {
+		r.anomalies.Inc()
+		usage.anomalous = true
+	}
+
+	return usage, nil
+}
+
+// recordRefresh records the refresh of the session of the user, if enabled, logging the sessions refreshing
+// anomalously; a failure of the store is logged but never fails the request
+func (r *oauthProxy) recordRefresh(user *userContext, clientIP string, lifetime time.Duration) {
+	if r.refreshes == nil {
+		return
+	}
+	session := getSessionID(user)
+	usage, err := r.refreshes.record(session, time.Now(), lifetime)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to record the refresh of the session")
+		return
+	}
+	if usage.anomalous {
+		fields := log.Fields{
+			"client_ip": clientIP,
+			"email":     user.email,
+			"session":   session,
+			"refreshes": usage.count,
+			"window":    r.config.RefreshAnomalyWindow.String(),
+		}
+		if !usage.last.IsZero() {
+			fields["last_refresh"] = usage.last.Format(time.RFC3339)
+		}
+		log.WithFields(fields).Warnf("the session is refreshing anomalously often, check the token lifetimes and the client")
+	}
+}
+
+// getSessionID returns the id of the session at the provider, else the subject where the tokens carry no session
+func getSessionID(user *userContext) string {
+	if sessionID, found, _ := user.claims.StringClaim(claimSessionID); found && sessionID != "" {
+		return sessionID
+	}
+	if sessionID, found, _ := user.claims.StringClaim(claimSessionState); found && sessionID != "" {
+		return sessionID
+	}
+
+	return user.id
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshTrackerRecord(t *testing.T) {
+	tracker, err := newRefreshTracker(&fakeStore{items: make(map[string]string)}, 2, time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	anomalies := getMetricValue(t, tracker.anomalies)
+	now := time.Now().Truncate(time.Hour).Add(time.Minute)
+
+	usage, err := tracker.record("session", now, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), usage.count)
+	assert.True(t, usage.last.IsZero())
+	assert.False(t, usage.anomalous)
+
+	usage, err = tracker.record("session", now.Add(time.Minute), time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), usage.count)
+	assert.Equal(t, now.Unix(), usage.last.Unix())
+	assert.False(t, usage.anomalous)
+
+	// step: the session is reported once on exceeding the threshold
+	usage, err = tracker.record("session", now.Add(2*time.Minute), time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, usage.anomalous)
+	usage, err = tracker.record("session", now.Add(3*time.Minute), time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), usage.count)
+	assert.False(t, usage.anomalous)
+	assert.Equal(t, anomalies+1, getMetricValue(t, tracker.anomalies))
+
+	// step: the sessions are counted separately
+	usage, err = tracker.record("another", now.Add(3*time.Minute), time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), usage.count)
+
+	// step: the count resets in the next window, the last refresh is kept
+	usage, err = tracker.record("session", now.Add(time.Hour), time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), usage.count)
+	assert.Equal(t, now.Add(3*time.Minute).Unix(), usage.last.Unix())
+}
+
+func TestGetSessionID(t *testing.T) {
+	cs := []struct {
+		Claims   jose.Claims
+		Expected string
+	}{
+		{Claims: jose.Claims{"sid": "sid", "session_state": "state"}, Expected: "sid"},
+		{Claims: jose.Claims{"session_state": "state"}, Expected: "state"},
+		{Claims: jose.Claims{}, Expected: "subject"},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, getSessionID(&userContext{id: "subject", claims: c.Claims}), "case %d", i)
+	}
+}
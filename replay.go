@@ -0,0 +1,133 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// replayStorePrefix prefixes the token ids seen in the store
+	replayStorePrefix = "jti:"
+)
+
+// replayGuard records the ids of the tokens used on the replay protected resources in the store, so a token
+// is only accepted once by any of the instances of the proxy
+type replayGuard struct {
+	// the counters in the store
+	counter storageCounter
+	// the replays rejected
+	replays prometheus.Counter
+}
+
+// newReplayGuard creates the guard of the token ids and registers the metrics
+func newReplayGuard(store storage) (*replayGuard, error) {
+	counter, ok := getStorageCounter(store)
+	if !ok {
+		return nil, errors.New("the store does not support the counters of the replay protection")
+	}
+	replays := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "token_replays_total",
+			Help: "The requests rejected for replaying a token on a replay protected resource, or a dpop proof",
+		},
+	)
+
+	return &replayGuard{
+		counter: counter,
+		replays: prometheus.MustRegisterOrGet(replays).(prometheus.Counter),
+	}, nil
+}
+
+// seen records the use of the token id of the issuer, held until the token expires, and checks if it has been
+// used before
+func (r *replayGuard) seen(issuer, id string, ttl time.Duration) (bool, error) {
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	sum := sha256.Sum256([]byte(issuer + "|" + id))
+	count, err := r.counter.Increment(replayStorePrefix+hex.EncodeToString(sum[:]), ttl)
+	if err != nil {
+		return false, err
+	}
+	if count > 1 {
+		r.replays.Inc()
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// replayMiddleware permits each token only once on the replay protected resources, rejecting the replays
+func (r *oauthProxy) replayMiddleware() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if cx.IsAborted() {
+			return
+		}
+		v, found := cx.Get(cxEnforce)
+		if !found || !v.(*Resource).ReplayProtection {
+			return
+		}
+		user := cx.MustGet(userContextName).(*userContext)
+		fields := log.Fields{
+			"client_ip": cx.ClientIP(),
+			"resource":  cx.Request.URL.Path,
+			"username":  user.name,
+		}
+
+		id, _, _ := user.claims.StringClaim(claimTokenID)
+		if id == "" || user.apiKey != "" {
+			log.WithFields(fields).Warnf("rejecting the request, the token has no jti for the replay protection")
+
+			r.accessForbidden(cx)
+			return
+		}
+		issuer, _, _ := user.claims.StringClaim(claimIssuer)
+		// step: the token can't be used once expired, so we only need to remember it until then
+		ttl := user.expiresAt.Sub(time.Now()) + r.config.ClockSkew
+
+		// step: we fail closed, the replay protection isn't worth much if a store outage turns it off
+		if r.replays == nil {
+			log.WithFields(fields).Errorf("rejecting the request, the replay protection requires a store")
+
+			cx.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+		replayed, err := r.replays.seen(issuer, id, ttl)
+		if err != nil {
+			fields["error"] = err.Error()
+			log.WithFields(fields).Errorf("rejecting the request, unable to record the jti of the token")
+
+			cx.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+		if replayed {
+			fields["jti"] = id
+			log.WithFields(fields).Warnf("rejecting the request, the token has already been used")
+
+			r.accessForbidden(cx)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayGuardSeen(t *testing.T) {
+	replays, err := newReplayGuard(&fakeStore{items: make(map[string]string)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	seen, err := replays.seen("https://idp", "1", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, seen)
+	seen, _ = replays.seen("https://idp", "1", time.Minute)
+	assert.True(t, seen)
+	// step: the ids are unique per issuer
+	seen, _ = replays.seen("https://other", "1", time.Minute)
+	assert.False(t, seen)
+}
+
+func TestReplayMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = append([]*Resource{{URL: "/payments", Methods: []string{"ANY"}, ReplayProtection: true}}, cfg.Resources...)
+	proxy, idp, svc := newTestProxyService(cfg)
+	proxy.replays, _ = newReplayGuard(&fakeStore{items: make(map[string]string)})
+
+	getToken := func(id string) string {
+		claims := jose.Claims{}
+		for k, v := range newTestToken(idp.getLocation()).claims {
+			claims[k] = v
+		}
+		delete(claims, "jti")
+		if id != "" {
+			claims["jti"] = id
+		}
+		signed, _ := idp.signToken(claims)
+		return signed.Encode()
+	}
+	first, second := getToken("a0d4a7b6"), getToken("5c1e0f93")
+
+	cs := []struct {
+		Token        string
+		URI          string
+		ExpectedCode int
+	}{
+		{Token: first, URI: "/payments", ExpectedCode: http.StatusOK},
+		{Token: first, URI: "/payments", ExpectedCode: http.StatusForbidden},
+		{Token: second, URI: "/payments", ExpectedCode: http.StatusOK},
+		{Token: getToken(""), URI: "/payments", ExpectedCode: http.StatusForbidden},
+		// step: the tokens are reusable on the other resources
+		{Token: first, URI: fakeAuthAllURL, ExpectedCode: http.StatusOK},
+		{Token: first, URI: fakeAuthAllURL, ExpectedCode: http.StatusOK},
+	}
+	for i, c := range cs {
+		resp, err := resty.New().SetAuthToken(c.Token).R().Get(svc + c.URI)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode(), "case %d", i)
+	}
+
+	// step: without the store we fail closed
+	proxy.replays = nil
+	resp, err := resty.New().SetAuthToken(getToken("9b8f27d1")).R().Get(svc + "/payments")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode())
+	}
+}
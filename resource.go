@@ -18,10 +18,15 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
+// sessionNameRegex is the permitted characters of a session name
+var sessionNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
 func newResource() *Resource {
 	return &Resource{}
 }
@@ -35,7 +40,7 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 	for _, x := range strings.Split(resource, "|") {
 		kp := strings.Split(x, "=")
 		if len(kp) != 2 {
-			return nil, errors.New("invalid resource keypair, should be (uri|roles|methods|white-listed)=comma_values")
+			return nil, errors.New("invalid resource keypair, should be (uri|roles|methods|white-listed|auth-params|session|max-upload-size|case-insensitive|ignore-trailing-slash|query|hosts|webhook|basic-auth|replay-protection|dpop|certificate-bound)=comma_values")
 		}
 		switch kp[0] {
 		case "uri":
@@ -50,6 +55,68 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 				return nil, errors.New("the value of whitelisted must be true|TRUE|T or it's false equivalent")
 			}
 			r.WhiteListed = value
+		case "case-insensitive":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of case-insensitive must be true|TRUE|T or it's false equivalent")
+			}
+			r.CaseInsensitive = value
+		case "ignore-trailing-slash":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of ignore-trailing-slash must be true|TRUE|T or it's false equivalent")
+			}
+			r.IgnoreTrailingSlash = value
+		case "replay-protection":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of replay-protection must be true|TRUE|T or it's false equivalent")
+			}
+			r.ReplayProtection = value
+		case "dpop":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of dpop must be true|TRUE|T or it's false equivalent")
+			}
+			r.DPoP = value
+		case "certificate-bound":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of certificate-bound must be true|TRUE|T or it's false equivalent")
+			}
+			r.CertificateBound = value
+		case "session":
+			r.Session = kp[1]
+		case "max-upload-size":
+			value, err := strconv.ParseInt(kp[1], 10, 64)
+			if err != nil {
+				return nil, errors.New("the max-upload-size should be the number of bytes")
+			}
+			r.MaxUploadSize = value
+		case "hosts":
+			r.Hosts = strings.Split(kp[1], ",")
+		case "webhook":
+			r.Webhook = kp[1]
+		case "basic-auth":
+			r.BasicAuth = strings.Split(kp[1], ",")
+		case "query":
+			r.Query = make(map[string]string, 0)
+			for _, param := range strings.Split(kp[1], ",") {
+				items := strings.SplitN(param, ":", 2)
+				if len(items) != 2 {
+					return nil, errors.New("the query should be comma separated name:value pairs")
+				}
+				r.Query[items[0]] = items[1]
+			}
+		case "auth-params":
+			r.AuthParams = make(map[string]string, 0)
+			for _, param := range strings.Split(kp[1], ",") {
+				items := strings.SplitN(param, ":", 2)
+				if len(items) != 2 {
+					return nil, errors.New("the auth-params should be comma separated name:value pairs")
+				}
+				r.AuthParams[items[0]] = items[1]
+			}
 		default:
 			return nil, errors.New("invalid identifier, should be roles, uri or methods")
 		}
@@ -88,9 +155,62 @@ func (r *Resource) valid() error {
 		}
 	}
 
+	// step: check the session name is safe to use in a cookie name
+	if r.Session != "" && !sessionNameRegex.MatchString(r.Session) {
+		return fmt.Errorf("the session name: %s must be alphanumeric, dashes or underscores", r.Session)
+	}
+
+	// step: check the authorization parameters do not override the protocol
+	if err := isValidAuthParams(r.AuthParams); err != nil {
+		return err
+	}
+
+	if r.MaxUploadSize < 0 {
+		return errors.New("the max-upload-size cannot be negative")
+	}
+
+	for name := range r.Query {
+		if name == "" {
+			return errors.New("the query parameters must be named")
+		}
+	}
+
+	for _, host := range r.Hosts {
+		if host == "" {
+			return errors.New("the resource hosts cannot be empty")
+		}
+	}
+
+	for _, user := range r.BasicAuth {
+		if user == "" {
+			return errors.New("the resource basic auth users cannot be empty")
+		}
+	}
+
 	return nil
 }
 
+// matches checks if the path falls under the resource and the host and query are those required
+func (r Resource) matches(host, path string, query url.Values) bool {
+	if len(r.Hosts) > 0 && !isAllowedHost(host, r.Hosts) {
+		return false
+	}
+	for name, value := range r.Query {
+		if _, found := query[name]; !found || (value != "*" && !containedIn(value, query[name])) {
+			return false
+		}
+	}
+	uri := r.URL
+	if r.CaseInsensitive {
+		uri, path = strings.ToLower(uri), strings.ToLower(path)
+	}
+	if r.IgnoreTrailingSlash && uri != "/" && path == strings.TrimSuffix(uri, "/") {
+		return true
+	}
+
+	return strings.HasPrefix(path, uri)
+}
+
 // getRoles returns a list of roles for this resource
 func (r Resource) getRoles() string {
 	return strings.Join(r.Roles, ",")
@@ -66,6 +66,113 @@ func TestDecodeResource(t *testing.T) {
 				WhiteListed: true,
 			},
 		},
+		{
+			Option: "uri=/account|auth-params=kc_action:UPDATE_PASSWORD,audience:api",
+			Ok:     true,
+			Resource: &Resource{
+				URL:        "/account",
+				AuthParams: map[string]string{"kc_action": "UPDATE_PASSWORD", "audience": "api"},
+			},
+		},
+		{
+			Option: "uri=/account|auth-params=kc_action",
+		},
+		{
+			Option: "uri=/app-a|session=app-a",
+			Ok:     true,
+			Resource: &Resource{
+				URL:     "/app-a",
+				Session: "app-a",
+			},
+		},
+		{
+			Option: "uri=/upload|max-upload-size=1048576",
+			Ok:     true,
+			Resource: &Resource{
+				URL:           "/upload",
+				MaxUploadSize: 1048576,
+			},
+		},
+		{
+			Option: "uri=/upload|max-upload-size=1MB",
+		},
+		{
+			Option: "uri=/Admin/|case-insensitive=true|ignore-trailing-slash=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:                 "/Admin/",
+				CaseInsensitive:     true,
+				IgnoreTrailingSlash: true,
+			},
+		},
+		{
+			Option: "uri=/admin|case-insensitive=yes",
+		},
+		{
+			Option: "uri=/export|query=format:full,user:*",
+			Ok:     true,
+			Resource: &Resource{
+				URL:   "/export",
+				Query: map[string]string{"format": "full", "user": "*"},
+			},
+		},
+		{
+			Option: "uri=/export|query=format",
+		},
+		{
+			Option: "uri=/admin|hosts=a.example.com,b.example.com",
+			Ok:     true,
+			Resource: &Resource{
+				URL:   "/admin",
+				Hosts: []string{"a.example.com", "b.example.com"},
+			},
+		},
+		{
+			Option: "uri=/hooks/github|webhook=github",
+			Ok:     true,
+			Resource: &Resource{
+				URL:     "/hooks/github",
+				Webhook: "github",
+			},
+		},
+		{
+			Option: "uri=/admin|basic-auth=ops,oncall",
+			Ok:     true,
+			Resource: &Resource{
+				URL:       "/admin",
+				BasicAuth: []string{"ops", "oncall"},
+			},
+		},
+		{
+			Option: "uri=/payments|replay-protection=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:              "/payments",
+				ReplayProtection: true,
+			},
+		},
+		{
+			Option: "uri=/payments|replay-protection=maybe",
+		},
+		{
+			Option: "uri=/api|dpop=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:  "/api",
+				DPoP: true,
+			},
+		},
+		{
+			Option: "uri=/api|dpop=maybe",
+		},
+		{
+			Option: "uri=/api|certificate-bound=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:              "/api",
+				CertificateBound: true,
+			},
+		},
 		{
 			Option: "",
 		},
@@ -116,6 +223,44 @@ func TestIsValid(t *testing.T) {
 	}
 }
 
+func TestResourceMatches(t *testing.T) {
+	cs := []struct {
+		Resource Resource
+		Host     string
+		Path     string
+		Expected bool
+	}{
+		{Resource: Resource{URL: "/admin"}, Path: "/admin", Expected: true},
+		{Resource: Resource{URL: "/admin"}, Path: "/admin/users", Expected: true},
+		{Resource: Resource{URL: "/admin"}, Path: "/ADMIN", Expected: false},
+		{Resource: Resource{URL: "/admin", CaseInsensitive: true}, Path: "/ADMIN", Expected: true},
+		{Resource: Resource{URL: "/Admin", CaseInsensitive: true}, Path: "/aDmIn/users", Expected: true},
+		{Resource: Resource{URL: "/admin", CaseInsensitive: true}, Path: "/public", Expected: false},
+		{Resource: Resource{URL: "/admin/"}, Path: "/admin", Expected: false},
+		{Resource: Resource{URL: "/admin/", IgnoreTrailingSlash: true}, Path: "/admin", Expected: true},
+		{Resource: Resource{URL: "/admin/", IgnoreTrailingSlash: true}, Path: "/admin/users", Expected: true},
+		{Resource: Resource{URL: "/admin/", IgnoreTrailingSlash: true}, Path: "/administrator", Expected: false},
+		{Resource: Resource{URL: "/admin/", IgnoreTrailingSlash: true, CaseInsensitive: true}, Path: "/ADMIN", Expected: true},
+		{Resource: Resource{URL: "/", IgnoreTrailingSlash: true}, Path: "", Expected: false},
+		{Resource: Resource{URL: "/export", Query: map[string]string{"format": "full"}}, Path: "/export?format=full", Expected: true},
+		{Resource: Resource{URL: "/export", Query: map[string]string{"format": "full"}}, Path: "/export?a=b&format=full", Expected: true},
+		{Resource: Resource{URL: "/export", Query: map[string]string{"format": "full"}}, Path: "/export?format=summary&format=full", Expected: true},
+		{Resource: Resource{URL: "/export", Query: map[string]string{"format": "full"}}, Path: "/export?format=summary", Expected: false},
+		{Resource: Resource{URL: "/export", Query: map[string]string{"format": "full"}}, Path: "/export", Expected: false},
+		{Resource: Resource{URL: "/export", Query: map[string]string{"format": "*"}}, Path: "/export?format=", Expected: true},
+		{Resource: Resource{URL: "/export", Query: map[string]string{"format": "*"}}, Path: "/export?other=1", Expected: false},
+		{Resource: Resource{URL: "/export", Query: map[string]string{"format": "full", "user": "*"}}, Path: "/export?format=full", Expected: false},
+		{Resource: Resource{URL: "/admin", Hosts: []string{"a.example.com"}}, Host: "a.example.com", Path: "/admin", Expected: true},
+		{Resource: Resource{URL: "/admin", Hosts: []string{"a.example.com"}}, Host: "A.example.com:8443", Path: "/admin", Expected: true},
+		{Resource: Resource{URL: "/admin", Hosts: []string{"a.example.com"}}, Host: "b.example.com", Path: "/admin", Expected: false},
+		{Resource: Resource{URL: "/admin", Hosts: []string{"a.example.com"}}, Path: "/admin", Expected: false},
+	}
+	for i, c := range cs {
+		path, query := splitRequestURI(c.Path)
+		assert.Equal(t, c.Expected, c.Resource.matches(c.Host, path, query), "case %d, resource: %s, path: %s", i, c.Resource.URL, c.Path)
+	}
+}
+
 func TestResourceString(t *testing.T) {
 	resource := &Resource{
 		Roles: []string{"1", "2", "3"},
@@ -0,0 +1,275 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// revocationWorkers is the number of workers revoking the tokens
+	revocationWorkers = 4
+	// revocationRetryBackoff is the initial delay between the attempts of a revocation
+	revocationRetryBackoff = 500 * time.Millisecond
+	// shutdownRevocationTimeout is the time we wait on the revocation of the cached tokens on shutdown
+	shutdownRevocationTimeout = 10 * time.Second
+)
+
+// revocationRequest is a token to be revoked at the provider
+type revocationRequest struct {
+	// the refresh or identity token
+	token string
+	// the user the token belongs to
+	user string
+}
+
+// revocationQueue revokes the tokens of the logouts in the background, so a sluggish provider
+// doesn't hold up the logout of the user
+type revocationQueue struct {
+	// the pending revocations
+	requests chan *revocationRequest
+	// the retries of a failed revocation
+	retries int
+	// the initial delay between the attempts
+	backoff time.Duration
+	// revokes the token at the provider
+	revoke func(token string) error
+	// the pending revocations
+	depth prometheus.Gauge
+	// the revocations partitioned by result
+	total *prometheus.CounterVec
+}
+
+// newRevocationQueue creates a queue holding at most size revocations and starts the workers
+func newRevocationQueue(size, retries int, revoke func(string) error) *revocationQueue {
+	depth := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "logout_revocation_queue_depth",
+		Help: "The token revocations waiting to be sent to the provider",
+	})
+	total := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "logout_revocations_total",
+			Help: "The token revocations of the logouts partitioned by result",
+		},
+		[]string{"result"},
+	)
+	queue := &revocationQueue{
+		requests: make(chan *revocationRequest, size),
+		retries:  retries,
+		backoff:  revocationRetryBackoff,
+		revoke:   revoke,
+		depth:    prometheus.MustRegisterOrGet(depth).(prometheus.Gauge),
+		total:    prometheus.MustRegisterOrGet(total).(*prometheus.CounterVec),
+	}
+	for i := 0; i < revocationWorkers; i++ {
+		go queue.run()
+	}
+
+	return queue
+}
+
+// add queues the revocation of the token, returning false if the queue is full
+func (r *revocationQueue) add(token, user string) bool {
+	select {
+	case r.requests <- &revocationRequest{token: token, user: user}:
+		r.depth.Inc()
+		return true
+	default:
+		r.total.WithLabelValues("dropped").Inc()
+		log.WithFields(log.Fields{
+			"user": user,
+		}).Errorf("the revocation queue is full, unable to revoke the token at the provider")
+
+		return false
+	}
+}
+
+// run revokes the queued tokens
+func (r *revocationQueue) run() {
+	for request := range r.requests {
+		r.depth.Dec()
+		r.process(request)
+	}
+}
+
+// process revokes the token, retrying with a backoff on failure
+func (r *revocationQueue) process(request *revocationRequest) {
+	var err error
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(r.backoff << uint(attempt-1))
+		}
+		if err = r.revoke(request.token); err == nil {
+			r.total.WithLabelValues("success").Inc()
+			log.WithFields(log.Fields{
+				"user": request.user,
+			}).Infof("successfully logged out of the endpoint")
+
+			return
+		}
+	}
+	r.total.WithLabelValues("failed").Inc()
+	log.WithFields(log.Fields{
+		"attempts": r.retries + 1,
+		"error":    err.Error(),
+		"user":     request.user,
+	}).Errorf("unable to revoke the token at the provider")
+}
+
+// revokeToken revokes the refresh or identity token at the revocation endpoint, an offline token at the
+// token revocation endpoint
+func (r *oauthProxy) revokeToken(token string) error {
+	if isOfflineToken(token) {
+		return r.revokeOAuthToken(token, "refresh_token")
+	}
+	revocationURL := defaultTo(r.config.RevocationEndpoint, r.getProviderConfig().EndSessionEndpoint.String())
+	client, err := r.client.OAuthClient()
+	if err != nil {
+		return err
+	}
+
+	// step: construct the url for revocation
+	// @TODO need to add the authenticated request to go-oidc
+	request, err := http.NewRequest(http.MethodPost, revocationURL,
+		bytes.NewBufferString(fmt.Sprintf("refresh_token=%s", token)))
+	if err != nil {
+		return err
+	}
+
+	// step: add the authentication headers and content-type
+	request.SetBasicAuth(url.QueryEscape(r.config.ClientID), url.QueryEscape(r.config.ClientSecret.Value()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := client.HttpClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		content, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("invalid response from revocation endpoint, status: %d, response: %s", response.StatusCode, content)
+	}
+
+	return nil
+}
+
+// revokeCachedTokens wipes the service account and exchanged tokens held in memory on shutdown, revoking
+// those yet to expire at the provider, waiting at most the timeout
+func (r *oauthProxy) revokeCachedTokens(timeout time.Duration) {
+	var tokens []string
+	if r.apiKeys != nil {
+		if token, valid := r.apiKeys.wipe(); valid {
+			tokens = append(tokens, token)
+		}
+		tokens = append(tokens, r.apiKeys.owners.wipe()...)
+	}
+	if r.exchanger != nil {
+		tokens = append(tokens, r.exchanger.wipe()...)
+	}
+	if len(tokens) == 0 {
+		return
+	}
+	log.WithFields(log.Fields{
+		"tokens": len(tokens),
+	}).Infof("revoking the cached tokens at the provider")
+
+	requests := make(chan string, len(tokens))
+	for _, x := range tokens {
+		requests <- x
+	}
+	close(requests)
+
+	var failed int
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for i := 0; i < revocationWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for token := range requests {
+				if err := r.revokeOAuthToken(token, "access_token"); err != nil {
+					lock.Lock()
+					failed++
+					lock.Unlock()
+					// step: the error is logged, never the token
+					log.WithFields(log.Fields{
+						"error": err.Error(),
+					}).Warnf("unable to revoke the cached token at the provider")
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.WithFields(log.Fields{
+			"failed": failed,
+			"tokens": len(tokens),
+		}).Infof("revoked the cached tokens at the provider")
+	case <-time.After(timeout):
+		log.Warnf("timed out revoking the cached tokens at the provider")
+	}
+}
+
+// revokeOAuthToken revokes the access or refresh token at the token revocation endpoint, rfc 7009
+func (r *oauthProxy) revokeOAuthToken(token, hint string) error {
+	values := url.Values{}
+	values.Set("token", token)
+	values.Set("token_type_hint", hint)
+
+	request, err := http.NewRequest(http.MethodPost, r.getTokenRevocationURL(), strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(url.QueryEscape(r.config.ClientID), url.QueryEscape(r.config.ClientSecret.Value()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := r.idpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid response from token revocation endpoint, status: %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// getTokenRevocationURL returns the token revocation endpoint, the token endpoint of the provider with
+// /token replaced by /revoke unless configured
+func (r *oauthProxy) getTokenRevocationURL() string {
+	if r.config.TokenRevocationURL != "" {
+		return r.config.TokenRevocationURL
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(r.getProviderConfig().TokenEndpoint.String(), "/"), "/token") + "/revoke"
+}
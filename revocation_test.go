@@ -0,0 +1,94 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevocationQueueRetries(t *testing.T) {
+	var count int32
+	attempts := make(chan string, 10)
+	queue := newRevocationQueue(10, 2, func(token string) error {
+		attempts <- token
+		if atomic.AddInt32(&count, 1) < 2 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	queue.backoff = time.Millisecond
+	assert.True(t, queue.add("token", "user"))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case token := <-attempts:
+			assert.Equal(t, "token", token)
+		case <-time.After(time.Second):
+			t.Fatalf("attempt %d of the revocation was not made", i)
+		}
+	}
+}
+
+func TestRevocationQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	queue := newRevocationQueue(1, 0, func(string) error {
+		<-block
+		return nil
+	})
+	// step: occupy the workers, then fill the queue
+	for i := 0; i < revocationWorkers; i++ {
+		assert.True(t, queue.add("token", "user"))
+		for len(queue.requests) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	assert.True(t, queue.add("token", "user"))
+	assert.False(t, queue.add("token", "user"))
+}
+
+func TestRevokeCachedTokens(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.TokenExchangeAudience = "upstream"
+	proxy, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+	resp, err := resty.New().SetAuthToken(signed.Encode()).R().Get(svc + fakeAuthAllURL)
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode()) {
+		return
+	}
+	account, _ := jose.NewJWT(jose.JOSEHeader{"alg": "RS256"}, jose.Claims{"sub": "1", "exp": float64(time.Now().Add(time.Hour).Unix())})
+	proxy.apiKeys = newServiceAccountToken(func() (jose.JWT, error) { return account, nil }, nil)
+	proxy.apiKeys.getToken()
+
+	proxy.revokeCachedTokens(time.Second)
+	revoked := idp.getRevoked()
+	assert.Len(t, revoked, 2)
+	assert.Contains(t, revoked, account.Encode())
+	assert.Empty(t, proxy.exchanger.cache)
+
+	// step: the tokens have been wiped, there's nothing left to revoke
+	proxy.revokeCachedTokens(time.Second)
+	assert.Len(t, idp.getRevoked(), 2)
+}
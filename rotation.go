@@ -17,7 +17,10 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"path"
 	"sync"
 
@@ -25,6 +28,11 @@ import (
 	"github.com/fsnotify/fsnotify"
 )
 
+const (
+	// kubernetesDataLink is the symlink kubernetes swaps when updating a mounted secret
+	kubernetesDataLink = "..data"
+)
+
 type certificationRotation struct {
 	sync.RWMutex
 	// certificate holds the current issuing certificate
@@ -33,6 +41,10 @@ type certificationRotation struct {
 	certificateFile string
 	// the privateKeyFile is the path of the private key
 	privateKeyFile string
+	// authority is the current certificate authority the peers are verified with, if any
+	authority *x509.CertPool
+	// authorityFile is the path of the certificate authority
+	authorityFile string
 }
 
 // newCertificateRotator creates a new certificate
@@ -50,6 +62,20 @@ func newCertificateRotator(cert, key string) (*certificationRotation, error) {
 	}, nil
 }
 
+// withAuthority loads the certificate authority the peers are verified with, which is reloaded along with the
+// certificate once watched
+func (c *certificationRotation) withAuthority(filename string) error {
+	pool, err := loadCertificateAuthority(filename)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.authority, c.authorityFile = pool, filename
+
+	return nil
+}
+
 // watch is responsible for adding a file notification and watch on the files for changes
 func (c *certificationRotation) watch() error {
 	log.Infof("adding a file watch on the certificates, certificate: %s, key: %s", c.certificateFile, c.privateKeyFile)
@@ -57,23 +83,28 @@ func (c *certificationRotation) watch() error {
 	if err != nil {
 		return err
 	}
+	// step: are we watching the certificate authority as well?
+	filewatchPaths := []string{c.certificateFile, c.privateKeyFile}
+	if c.authorityFile != "" {
+		filewatchPaths = append(filewatchPaths, c.authorityFile)
+	}
 	// add the files to the watch list
-	for _, x := range []string{c.certificateFile, c.privateKeyFile} {
+	for _, x := range filewatchPaths {
 		if err := watcher.Add(path.Dir(x)); err != nil {
 			return fmt.Errorf("unable to add watch on directory: %s, error: %s", path.Dir(x), err)
 		}
 	}
 
 	// step: watching for events
-	filewatchPaths := []string{c.certificateFile, c.privateKeyFile}
 	go func() {
 		log.Info("starting to watch changes to the tls certificate files")
 		for {
 			select {
 			case event := <-watcher.Events:
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					// step: does the change effect our files?
-					if !containedIn(event.Name, filewatchPaths) {
+				if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					// step: does the change effect our files? - note kubernetes secrets are updated by
+					// swapping the ..data symlink, so the files themselves never see a write
+					if !containedIn(event.Name, filewatchPaths) && path.Base(event.Name) != kubernetesDataLink {
 						continue
 					}
 					// step: reload the certificate
@@ -83,11 +114,30 @@ func (c *certificationRotation) watch() error {
 							"filename": event.Name,
 							"error":    err.Error(),
 						}).Error("unable to load the updated certificate")
+
+						continue
 					}
 					// step: load the new certificate
 					c.storeCertificate(certificate)
 					// step: print a debug message for us
-					log.Infof("replacing the server certifacte with updated version")
+					log.WithFields(log.Fields{
+						"certificate": c.certificateFile,
+					}).Info("replacing the certificate with the updated version")
+
+					// step: reload the certificate authority
+					if c.authorityFile != "" {
+						if err := c.reloadAuthority(); err != nil {
+							log.WithFields(log.Fields{
+								"filename": c.authorityFile,
+								"error":    err.Error(),
+							}).Error("unable to load the updated certificate authority")
+
+							continue
+						}
+						log.WithFields(log.Fields{
+							"authority": c.authorityFile,
+						}).Info("replacing the certificate authority with the updated version")
+					}
 				}
 			case err := <-watcher.Errors:
 				log.WithFields(log.Fields{
@@ -100,6 +150,19 @@ func (c *certificationRotation) watch() error {
 	return nil
 }
 
+// reloadAuthority reloads the certificate authority from its file, the current one is kept on a failure
+func (c *certificationRotation) reloadAuthority() error {
+	pool, err := loadCertificateAuthority(c.authorityFile)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.authority = pool
+
+	return nil
+}
+
 // storeCertificate provides entrypoint to update the certificate
 func (c *certificationRotation) storeCertificate(certifacte tls.Certificate) error {
 	c.Lock()
@@ -116,3 +179,48 @@ func (c *certificationRotation) GetCertificate(hello *tls.ClientHelloInfo) (*tls
 
 	return &c.certificate, nil
 }
+
+// GetClientCertificate is responsible for retrieving the certificate presented to an upstream
+func (c *certificationRotation) GetClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	return &c.certificate, nil
+}
+
+// VerifyConnection verifies the certificate chain and name of the peer against the current certificate authority,
+// in place of the verification of the tls package, which holds onto the authority it was handed
+func (c *certificationRotation) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("the peer presented no certificate")
+	}
+	c.RLock()
+	authority := c.authority
+	c.RUnlock()
+
+	options := x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Intermediates: x509.NewCertPool(),
+		Roots:         authority,
+	}
+	for _, x := range state.PeerCertificates[1:] {
+		options.Intermediates.AddCert(x)
+	}
+	_, err := state.PeerCertificates[0].Verify(options)
+
+	return err
+}
+
+// loadCertificateAuthority reads the certificates of the authority from the file
+func loadCertificateAuthority(filename string) (*x509.CertPool, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("unable to parse the certificate authority: %s", filename)
+	}
+
+	return pool, nil
+}
@@ -73,3 +73,10 @@ func TestWatchCertificate(t *testing.T) {
 	err := c.watch()
 	assert.NoError(t, err)
 }
+
+func TestGetClientCertificate(t *testing.T) {
+	c := newTestCertificateRotator(t)
+	crt, err := c.GetClientCertificate(nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, crt)
+}
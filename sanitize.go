@@ -0,0 +1,92 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gambol99/goproxy"
+)
+
+const (
+	// maxErrorBodyDrained is the maximum amount of an upstream error body read to measure it
+	maxErrorBodyDrained = 4096
+	// defaultUpstreamErrorBody is used when no custom error page is given
+	defaultUpstreamErrorBody = "the upstream service was unable to handle the request\n"
+)
+
+// createErrorSanitizer creates a response handler which replaces the bodies of upstream server errors,
+// preventing stack traces or internal hostnames from leaking to the client
+func (r *oauthProxy) createErrorSanitizer() (func(*http.Response, *goproxy.ProxyCtx) *http.Response, error) {
+	var page *template.Template
+	if r.config.UpstreamErrorPage != "" {
+		log.Debugf("loading the custom upstream error page: %s", r.config.UpstreamErrorPage)
+		tmpl, err := template.ParseFiles(r.config.UpstreamErrorPage)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the upstream error page, error: %s", err)
+		}
+		page = tmpl
+	}
+
+	return func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil || resp.StatusCode < http.StatusInternalServerError {
+			return resp
+		}
+		// step: log the length and type of the original body but never the body, which may hold the very
+		// secrets, hostnames or user data being sanitized
+		length, _ := io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxErrorBodyDrained))
+		resp.Body.Close()
+		if resp.ContentLength > length {
+			length = resp.ContentLength
+		}
+
+		log.WithFields(log.Fields{
+			"status":           resp.StatusCode,
+			"path":             resp.Request.URL.Path,
+			"length":           length,
+			"content_type":     resp.Header.Get("Content-Type"),
+			"content_encoding": resp.Header.Get(contentEncodingHeader),
+		}).Errorf("sanitizing the upstream error response")
+
+		// step: render the replacement body
+		body := bytes.NewBufferString(defaultUpstreamErrorBody)
+		contentType := "text/plain; charset=utf-8"
+		if page != nil {
+			body.Reset()
+			model := r.getTemplateModel(map[string]string{"status": strconv.Itoa(resp.StatusCode)})
+			if err := page.Execute(body, model); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to render the upstream error page")
+				body = bytes.NewBufferString(defaultUpstreamErrorBody)
+			} else {
+				contentType = "text/html; charset=utf-8"
+			}
+		}
+		resp.Header.Del(contentEncodingHeader)
+		resp.Header.Set("Content-Type", contentType)
+		resp.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+		resp.ContentLength = int64(body.Len())
+		resp.Body = ioutil.NopCloser(body)
+
+		return resp
+	}, nil
+}
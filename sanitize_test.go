@@ -0,0 +1,102 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeUpstreamResponse(code int, body string) *http.Response {
+	req, _ := http.NewRequest("GET", "http://127.0.0.1/test", nil)
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Encoding": []string{"identity"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Request:    req,
+	}
+}
+
+func TestErrorSanitizer(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	sanitizer, err := p.createErrorSanitizer()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Nil(t, sanitizer(nil, nil))
+
+	resp := sanitizer(newFakeUpstreamResponse(http.StatusNotFound, "not found"), nil)
+	content, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "not found", string(content))
+
+	resp = sanitizer(newFakeUpstreamResponse(http.StatusInternalServerError, "panic at internal.host:8080"), nil)
+	content, _ = ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, defaultUpstreamErrorBody, string(content))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, int64(len(defaultUpstreamErrorBody)), resp.ContentLength)
+}
+
+func TestErrorSanitizerLogging(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	sanitizer, err := p.createErrorSanitizer()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	output := &bytes.Buffer{}
+	log.SetOutput(output)
+	defer log.SetOutput(ioutil.Discard)
+
+	upstream := newFakeUpstreamResponse(http.StatusInternalServerError, "panic at internal.host:8080, password=secret")
+	upstream.Header.Set("Content-Type", "text/plain")
+	sanitizer(upstream, nil)
+	assert.NotContains(t, output.String(), "internal.host")
+	assert.NotContains(t, output.String(), "secret")
+	assert.Contains(t, output.String(), "length=44")
+	assert.Contains(t, output.String(), `content_type="text/plain"`)
+}
+
+func TestErrorSanitizerPage(t *testing.T) {
+	page, err := ioutil.TempFile("", "error-page")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.Remove(page.Name())
+	page.WriteString(`<p>error {{ .status }}, {{ .title }}</p>`)
+	page.Close()
+
+	p, _, _ := newTestProxyService(nil)
+	p.config.UpstreamErrorPage = page.Name()
+	p.config.Tags = map[string]string{"title": "my site"}
+	sanitizer, err := p.createErrorSanitizer()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	resp := sanitizer(newFakeUpstreamResponse(http.StatusBadGateway, "stack trace"), nil)
+	content, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "<p>error 502, my site</p>", string(content))
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	p.config.UpstreamErrorPage = "/does/not/exist"
+	_, err = p.createErrorSanitizer()
+	assert.Error(t, err)
+}
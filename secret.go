@@ -0,0 +1,87 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// redacted is printed in place of a secret
+const redacted = "[redacted]"
+
+// Secret is a client secret, key, password or token which is never printed, whatever the verb, so it
+// can't leak into the logs, panics or debug output; the value is only had by asking for it
+type Secret string
+
+// Value returns the secret itself
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// String returns the redacted secret
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+
+	return redacted
+}
+
+// GoString returns the redacted secret for the %#v verb
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// Format writes the redacted secret for any verb
+func (s Secret) Format(f fmt.State, verb rune) {
+	io.WriteString(f, s.String())
+}
+
+// redactCommandLine returns the arguments with the values of the secret options redacted, i.e. for the
+// pprof cmdline endpoint
+func redactCommandLine(args []string) []string {
+	secrets := make(map[string]bool)
+	for i := 0; i < reflect.TypeOf(Config{}).NumField(); i++ {
+		if field := reflect.TypeOf(Config{}).Field(i); field.Type == reflect.TypeOf(Secret("")) || field.Type == reflect.TypeOf([]Secret{}) {
+			secrets[field.Tag.Get("yaml")] = true
+		}
+	}
+	redactedArgs := make([]string, len(args))
+	for i := 0; i < len(args); i++ {
+		redactedArgs[i] = args[i]
+		name := strings.TrimLeft(args[i], "-")
+		if name == args[i] {
+			continue
+		}
+		if kp := strings.SplitN(name, "=", 2); len(kp) == 2 {
+			if secrets[kp[0]] {
+				redactedArgs[i] = args[i][:len(args[i])-len(kp[1])] + redacted
+			}
+			continue
+		}
+		// step: the value is the following argument
+		if secrets[name] && i+1 < len(args) {
+			redactedArgs[i+1] = redacted
+			i++
+		}
+	}
+
+	return redactedArgs
+}
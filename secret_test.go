@@ -0,0 +1,85 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretFormat(t *testing.T) {
+	secret := Secret("my-client-secret")
+	for _, verb := range []string{"%s", "%v", "%+v", "%#v", "%q", "%x", "%d"} {
+		assert.Equal(t, redacted, fmt.Sprintf(verb, secret), "verb: %s", verb)
+	}
+	cfg := &Config{ClientSecret: secret, EncryptionKey: "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"}
+	for _, verb := range []string{"%v", "%+v", "%#v"} {
+		printed := fmt.Sprintf(verb, cfg)
+		assert.NotContains(t, printed, "my-client-secret", "verb: %s", verb)
+		assert.NotContains(t, printed, "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j", "verb: %s", verb)
+	}
+	assert.Equal(t, "my-client-secret", secret.Value())
+	assert.Equal(t, "", Secret("").String())
+}
+
+func TestUserContextFormat(t *testing.T) {
+	token := newTestToken("https://keycloak.example.com")
+	user, err := extractIdentity(token.getToken())
+	if !assert.NoError(t, err) {
+		return
+	}
+	user.opaqueToken = Secret("opaque-token")
+	encoded := user.token.Encode()
+	for _, verb := range []string{"%v", "%+v", "%#v", "%d"} {
+		printed := fmt.Sprintf(verb, user)
+		assert.NotContains(t, printed, encoded, "verb: %s", verb)
+		assert.NotContains(t, printed, "opaque-token", "verb: %s", verb)
+	}
+}
+
+func TestRedactCommandLine(t *testing.T) {
+	cs := []struct {
+		Args     []string
+		Expected []string
+	}{
+		{
+			Args:     []string{"keycloak-proxy", "--client-id=test", "--client-secret=secret"},
+			Expected: []string{"keycloak-proxy", "--client-id=test", "--client-secret=" + redacted},
+		},
+		{
+			Args:     []string{"keycloak-proxy", "--encryption-key", "key", "--listen", ":3000"},
+			Expected: []string{"keycloak-proxy", "--encryption-key", redacted, "--listen", ":3000"},
+		},
+		{
+			Args:     []string{"keycloak-proxy", "--encryption-keys=new", "--encryption-keys=old"},
+			Expected: []string{"keycloak-proxy", "--encryption-keys=" + redacted, "--encryption-keys=" + redacted},
+		},
+		{
+			Args:     []string{"keycloak-proxy", "-forwarding-password", "password"},
+			Expected: []string{"keycloak-proxy", "-forwarding-password", redacted},
+		},
+		{
+			Args:     []string{"keycloak-proxy", "--client-secret"},
+			Expected: []string{"keycloak-proxy", "--client-secret"},
+		},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, redactCommandLine(c.Args), "case %d", i)
+	}
+}
@@ -16,6 +16,9 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -24,8 +27,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	httplog "log"
@@ -45,8 +50,10 @@ type oauthProxy struct {
 	router http.Handler
 	// the opened client
 	client *oidc.Client
-	// the openid provider configuration
+	// the openid provider configuration, refreshed from the discovery url
 	idp oidc.ProviderConfig
+	// the lock protecting the provider configuration
+	idpLock sync.RWMutex
 	// the provider http client
 	idpClient *http.Client
 	// the proxy client
@@ -57,6 +64,50 @@ type oauthProxy struct {
 	store storage
 	// the prometheus handler
 	prometheusHandler http.Handler
+	// the fault injector, if enabled
+	faults *faultInjector
+	// the maintenance mode, if enabled
+	maintenance *maintenanceMode
+	// the auth flow recorder, if enabled
+	recorder *flowRecorder
+	// the session statistics, if enabled
+	stats *sessionStats
+	// the cache of the provider keys
+	keys *providerKeys
+	// the caches of the keys of the trusted issuers, keyed by issuer
+	issuers map[string]*providerKeys
+	// the key the encrypted tokens are decrypted with, if any
+	decryptionKey *rsa.PrivateKey
+	// the queue revoking the tokens of the logouts
+	revoker *revocationQueue
+	// the pool bounding the token verifications, if enabled
+	verifier *verificationPool
+	// the introspector validating the access tokens, if enabled
+	introspector *tokenIntrospector
+	// the exchanger of the tokens forwarded upstream, if enabled
+	exchanger *tokenExchanger
+	// the authorizer of the authorization services, if enabled
+	authorizer *umaAuthorizer
+	// the service account token the api keys are exchanged for, if enabled
+	apiKeys *serviceAccountToken
+	// the tracker of the request quotas, if enabled
+	quotas *quotaTracker
+	// the guard of the token ids on the replay protected resources, if any
+	replays *replayGuard
+	// the deliveries of the signed webhooks seen, rejecting the replays
+	webhooks *webhookReplays
+	// the tracker of the session refreshes, if enabled
+	refreshes *refreshTracker
+	// the sessions logged out via the back-channel, if enabled
+	revocations *sessionRevocations
+	// the registry of the active sessions, if enabled
+	actives *activeSessions
+	// the key signing the state cookies
+	stateKey []byte
+	// the previous keys still verifying the state cookies, while the encryption keys are rotated
+	previousStateKeys [][]byte
+	// the lock protecting the resources and headers updated by the control plane
+	policyLock sync.RWMutex
 }
 
 func init() {
@@ -68,6 +119,12 @@ func init() {
 
 // newProxy create's a new proxy from configuration
 func newProxy(config *Config) (*oauthProxy, error) {
+	return newProxyWithStore(config, nil)
+}
+
+// newProxyWithStore creates a new proxy from configuration, using the store given rather than the store url,
+// the proxies of the providers sharing the store of the default provider
+func newProxyWithStore(config *Config, store storage) (*oauthProxy, error) {
 	var err error
 	// step: set the logger
 	httplog.SetOutput(ioutil.Discard)
@@ -91,23 +148,160 @@ func newProxy(config *Config) (*oauthProxy, error) {
 		prometheusHandler: prometheus.Handler(),
 	}
 
+	// step: are we injecting faults?
+	if config.EnableFaultInjection {
+		log.Warnf("fault injection has been enabled on %s - FOR TESTING ONLY", config.withOAuthURI(adminURL+faultsURL))
+		svc.faults = newFaultInjector()
+	}
+
+	// step: can we be put into maintenance mode?
+	if config.EnableMaintenanceMode {
+		maintenance, err := newMaintenanceMode(config.MaintenancePage)
+		if err != nil {
+			return nil, err
+		}
+		svc.maintenance = maintenance
+	}
+
+	// step: are we capturing the auth flows?
+	if config.EnableFlowCapture {
+		svc.recorder = newFlowRecorder()
+	}
+
+	// step: are we recording the session statistics?
+	if config.EnableSessionStats {
+		svc.stats = newSessionStats()
+	}
+
+	// step: are we bounding the token verifications?
+	if config.MaxVerifyConcurrency > 0 {
+		svc.verifier = newVerificationPool(config.MaxVerifyConcurrency, config.MaxVerifyQueue)
+	}
+
+	// step: sign the state with a key shared by the instances, falling back to a random one
+	svc.stateKey = []byte(defaultTo(config.getEncryptionKey(), config.ClientSecret.Value()))
+	if keys := config.getEncryptionKeys(); len(keys) > 1 {
+		for _, x := range keys[1:] {
+			svc.previousStateKeys = append(svc.previousStateKeys, []byte(x))
+		}
+	}
+	if len(svc.stateKey) == 0 {
+		svc.stateKey = make([]byte, 32)
+		if _, err := rand.Read(svc.stateKey); err != nil {
+			return nil, err
+		}
+	}
+	if config.DecryptionKey != "" {
+		if svc.decryptionKey, err = loadDecryptionKey(config.DecryptionKey); err != nil {
+			return nil, err
+		}
+	}
+	if config.TokenExchangeAudience != "" {
+		svc.exchanger = newTokenExchanger(svc.exchangeToken)
+	}
+	if config.EnableAPIKeys {
+		svc.apiKeys = newServiceAccountToken(svc.requestServiceAccountToken, svc.impersonateOwner)
+	}
+	// step: the service account and exchanged tokens are held in memory, keep them out of the core dumps
+	if svc.exchanger != nil || svc.apiKeys != nil {
+		if err := disableCoreDumps(); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to disable the core dumps")
+		}
+	}
+	if config.EnableUMA {
+		svc.authorizer = newUMAAuthorizer(config.UMACacheTTL, svc.requestDecision)
+	}
+	if config.EnableTokenIntrospection {
+		svc.introspector = newTokenIntrospector(config.IntrospectionCacheTTL, svc.introspectToken)
+	}
+
+	// step: create the queue revoking the tokens on logout
+	svc.revoker = newRevocationQueue(config.RevocationQueueSize, config.RevocationRetries, svc.revokeToken)
+
+	// step: are we accepting the back-channel logouts or the revocations of the admins?
+	if config.EnableBackchannelLogout || config.EnableSessionRevocation {
+		svc.revocations = newSessionRevocations()
+	}
+
 	// step: parse the upstream endpoint
 	if svc.endpoint, err = url.Parse(config.Upstream); err != nil {
 		return nil, err
 	}
 
 	// step: initialize the store if any
-	if config.StoreURL != "" {
+	svc.store = store
+	if svc.store == nil && config.StoreURL != "" {
 		if svc.store, err = createStorage(config.StoreURL); err != nil {
 			return nil, err
 		}
+		// step: are we instrumenting the store?
+		if config.EnableMetrics {
+			u, _ := url.Parse(config.StoreURL)
+			svc.store = newMetricsStore(u.Scheme, svc.store)
+		}
 	}
+	if svc.store != nil {
+		// step: are we counting the requests against the quotas?
+		if config.DailyQuota > 0 || config.MonthlyQuota > 0 {
+			if svc.quotas, err = newQuotaTracker(svc.store, config.DailyQuota, config.MonthlyQuota); err != nil {
+				return nil, err
+			}
+		}
+		// step: are we recording the refreshes of the sessions?
+		if config.RefreshAnomalyThreshold > 0 {
+			if svc.refreshes, err = newRefreshTracker(svc.store, config.RefreshAnomalyThreshold, config.RefreshAnomalyWindow); err != nil {
+				return nil, err
+			}
+		}
+		// step: are the revocations shared through the store?
+		if svc.revocations != nil {
+			if err := svc.revocations.share(svc.store); err != nil {
+				return nil, err
+			}
+		}
+		// step: are we listing the active sessions?
+		if config.EnableActiveSessions {
+			if svc.actives, err = newActiveSessions(svc.store); err != nil {
+				return nil, err
+			}
+		}
+		// step: are we recording the token ids of the replay protected resources?
+		for _, resource := range config.Resources {
+			if resource.ReplayProtection {
+				if svc.replays, err = newReplayGuard(svc.store); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		// step: the dpop proofs are single use when we have a store
+		if svc.replays == nil && config.EnableDPoP {
+			if svc.replays, err = newReplayGuard(svc.store); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// step: the signed webhooks are accepted once, shared through the store if we have one
+	svc.webhooks = newWebhookReplays(svc.store)
 
 	// step: initialize the openid client
 	if !config.SkipTokenVerification {
 		if svc.client, svc.idp, svc.idpClient, err = newOpenIDClient(config); err != nil {
 			return nil, err
 		}
+		// step: the tokens are verified against our cache of the provider keys
+		if svc.idp.KeysEndpoint != nil {
+			svc.keys = newProviderKeys(svc.idpClient, svc.idp.KeysEndpoint.String())
+		}
+		// step: the tokens of the trusted issuers are verified against their own keys
+		svc.issuers = make(map[string]*providerKeys)
+		for issuer, location := range config.TrustedIssuers {
+			svc.issuers[issuer] = newProviderKeys(svc.idpClient, location)
+		}
+		// step: are we refreshing the discovery document?
+		if config.OpenIDProviderRefreshInterval > 0 {
+			svc.refreshProviderConfig(config.OpenIDProviderRefreshInterval)
+		}
 	} else {
 		log.Warnf("TESTING ONLY CONFIG - the verification of the token have been disabled")
 	}
@@ -126,11 +320,77 @@ func newProxy(config *Config) (*oauthProxy, error) {
 		if err := svc.createReverseProxy(); err != nil {
 			return nil, err
 		}
+		// step: are we fronting multiple providers?
+		if len(config.Providers) > 0 {
+			if svc.router, err = newProviderRouter(svc); err != nil {
+				return nil, err
+			}
+		}
+		// step: are we pulling the policy from a control plane?
+		if config.ControlPlaneURL != "" {
+			controlPlane, err := newControlPlane(svc)
+			if err != nil {
+				return nil, err
+			}
+			go controlPlane.run()
+		}
 	}
 
 	return svc, nil
 }
 
+// endpointNames are the oauth endpoints whose path can be overridden by the endpoint-paths option
+var endpointNames = []string{"authorize", "callback", "health", "version", "token", "expired", "logout", "backchannel-logout",
+	"frontchannel-logout", "login", "account", "password", "totp", "reauthenticate", "metrics",
+	"device", "device/token", "mobile/authorize", "mobile/callback", "mobile/token",
+	"api-keys", "api-keys/revoke"}
+
+// defaultMiddlewares is the default order of the cross-cutting middlewares, these run ahead of the
+// authentication, admission and proxying of the request, which are always last
+var defaultMiddlewares = []string{"timeout", "timing", "logging", "metrics", "capture", "security", "cors"}
+
+// getMiddlewares returns the cross-cutting middlewares in the order of the middlewares option, or else the
+// default order; a middleware only runs if listed and its feature is enabled
+func (r *oauthProxy) getMiddlewares(cors Cors) []gin.HandlerFunc {
+	enabled := r.config.getEnabledMiddlewares()
+	names := defaultMiddlewares
+	if len(r.config.Middlewares) > 0 {
+		names = r.config.Middlewares
+	}
+
+	var list []gin.HandlerFunc
+	for _, name := range names {
+		if !enabled[name] {
+			continue
+		}
+		switch name {
+		case "timeout":
+			list = append(list, r.requestTimeoutMiddleware())
+		case "timing":
+			if r.config.EnableServerTiming {
+				log.Warn("Enabling the Server-Timing header, the internal timings are exposed to the clients")
+			}
+			list = append(list, r.timingMiddleware())
+		case "logging":
+			list = append(list, r.loggingMiddleware())
+		case "metrics":
+			list = append(list, r.metricsMiddleware())
+		case "capture":
+			list = append(list, r.captureMiddleware())
+		case "security":
+			list = append(list, r.securityMiddleware())
+		case "cors":
+			log.Info("enabling CORs header injection globally")
+			list = append(list, r.corsMiddleware(cors))
+		}
+	}
+	if len(r.config.Middlewares) > 0 {
+		log.Infof("using the middlewares in the order: %s", strings.Join(r.config.Middlewares, ","))
+	}
+
+	return list
+}
+
 // createReverseProxy creates a reverse proxy
 func (r *oauthProxy) createReverseProxy() error {
 	log.Infof("enabled reverse proxy mode, upstream url: %s", r.config.Upstream)
@@ -150,27 +410,31 @@ func (r *oauthProxy) createReverseProxy() error {
 	if err := r.createUpstreamProxy(r.endpoint); err != nil {
 		return err
 	}
+	// step: respond with a 413 for uploads exceeding the resource limit
+	r.upstream.(*goproxy.ProxyHttpServer).OnResponse().DoFunc(uploadResponseFilter)
+	// step: classify the upstream failures
+	r.upstream.(*goproxy.ProxyHttpServer).OnResponse().DoFunc(r.createUpstreamErrorFilter())
+	// step: are we sanitizing the upstream errors?
+	if r.config.EnableUpstreamErrorSanitization {
+		sanitizer, err := r.createErrorSanitizer()
+		if err != nil {
+			return err
+		}
+		r.upstream.(*goproxy.ProxyHttpServer).OnResponse().DoFunc(sanitizer)
+	}
 
 	// step: create the gin router
 	engine := gin.New()
-	engine.Use(gin.Recovery())
+	engine.Use(r.recoveryMiddleware(), r.hopByHopMiddleware(), r.normalizeMiddleware())
+	// step: hide the internal paths on the public listeners
+	if len(r.config.InternalPaths) > 0 {
+		engine.Use(r.internalPathsMiddleware())
+	}
 	// step: is profiling enabled?
 	if r.config.EnableProfiling {
 		log.Warn("Enabling the debug profiling on /debug/pprof")
 		engine.Any("/debug/pprof/:name", r.debugHandler)
 	}
-	// step: are we logging the traffic?
-	if r.config.LogRequests {
-		engine.Use(r.loggingMiddleware())
-	}
-	// step: enabling the metrics?
-	if r.config.EnableMetrics {
-		engine.Use(r.metricsMiddleware())
-	}
-	// step: enabling the security filter?
-	if r.config.EnableSecurityFilter {
-		engine.Use(r.securityMiddleware())
-	}
 	cors := Cors{
 		Origins:        r.config.CorsOrigins,
 		Methods:        r.config.CorsMethods,
@@ -179,31 +443,87 @@ func (r *oauthProxy) createReverseProxy() error {
 		Credentials:    r.config.CorsCredentials,
 		MaxAge:         r.config.CorsMaxAge,
 	}
-	// step: enabling globaling?
-	if r.config.EnableCorsGlobal {
-		log.Info("enabling CORs header injection globally")
-		engine.Use(r.corsMiddleware(cors))
-	}
+	// step: add the cross-cutting middlewares in the configured order
+	engine.Use(r.getMiddlewares(cors)...)
 	// step: add the routing and cors middleware
-	oauth := engine.Group(oauthURL)
+	oauth := engine.Group(r.config.BaseURI + r.config.getOAuthURI())
+	endpoint := r.config.getEndpointPath
 	if !r.config.EnableCorsGlobal {
 		oauth.Use(r.corsMiddleware(cors))
 	}
-	oauth.GET(authorizationURL, r.oauthAuthorizationHandler)
-	oauth.GET(callbackURL, r.oauthCallbackHandler)
-	oauth.GET(healthURL, r.healthHandler)
-	oauth.GET(tokenURL, r.tokenHandler)
-	oauth.GET(expiredURL, r.expirationHandler)
-	oauth.GET(logoutURL, r.logoutHandler)
-	oauth.POST(loginURL, r.loginHandler)
+	oauth.GET(endpoint(authorizationURL), r.oauthAuthorizationHandler)
+	oauth.GET(endpoint(callbackURL), r.oauthCallbackHandler)
+	oauth.GET(endpoint(healthURL), r.healthHandler)
+	oauth.GET(endpoint(versionURL), r.versionHandler)
+	oauth.GET(endpoint(tokenURL), r.tokenHandler)
+	oauth.GET(endpoint(expiredURL), r.expirationHandler)
+	// step: the read only endpoints answer a HEAD, i.e. the load balancer health checks
+	oauth.HEAD(endpoint(healthURL), r.healthHandler)
+	oauth.HEAD(endpoint(versionURL), r.versionHandler)
+	oauth.HEAD(endpoint(tokenURL), r.tokenHandler)
+	oauth.HEAD(endpoint(expiredURL), r.expirationHandler)
+	oauth.GET(endpoint(logoutURL), r.logoutHandler)
+	oauth.POST(endpoint(backchannelURL), r.backchannelLogoutHandler)
+	oauth.GET(endpoint(frontchannelURL), r.frontchannelLogoutHandler)
+	oauth.POST(endpoint(loginURL), r.loginHandler)
+	oauth.POST(endpoint(deviceURL), r.deviceAuthorizationHandler)
+	oauth.POST(endpoint(deviceTokenURL), r.deviceTokenHandler)
+	oauth.GET(endpoint(mobileAuthURL), r.mobileAuthorizationHandler)
+	oauth.GET(endpoint(mobileReturnURL), r.mobileCallbackHandler)
+	oauth.POST(endpoint(mobileTokenURL), r.mobileTokenHandler)
+	oauth.POST(endpoint(apiKeysURL), r.apiKeyHandler)
+	oauth.POST(endpoint(apiKeysRevokeURL), r.apiKeyRevokeHandler)
+	oauth.GET(endpoint(accountURL), r.accountHandler)
+	oauth.GET(endpoint(passwordURL), r.requiredActionHandler("UPDATE_PASSWORD"))
+	oauth.GET(endpoint(totpURL), r.requiredActionHandler("CONFIGURE_TOTP"))
+	oauth.GET(endpoint(reauthURL), r.reauthenticateHandler)
 	// step: enable the metric page?
 	if r.config.EnableMetrics {
-		oauth.GET(metricsURL, r.metricsHandler)
+		oauth.GET(endpoint(metricsURL), r.metricsHandler)
+	}
+	// step: enable the admin endpoints?
+	admin := oauth.Group(adminURL, r.adminMiddleware())
+	if len(r.config.AdminRoles) > 0 {
+		admin.GET(echoURL, r.echoHandler)
+		admin.GET(featuresURL, r.featuresHandler)
+	}
+	if r.config.EnableFaultInjection {
+		admin.GET(faultsURL, r.faultsHandler)
+		admin.PUT(faultsURL, r.faultsHandler)
+		admin.DELETE(faultsURL, r.faultsHandler)
+		engine.Use(r.faultInjectionMiddleware())
+	}
+	if r.config.EnableMaintenanceMode {
+		admin.GET(maintenanceURL, r.maintenanceHandler)
+		admin.PUT(maintenanceURL, r.maintenanceHandler)
+		admin.DELETE(maintenanceURL, r.maintenanceHandler)
+		engine.Use(r.maintenanceMiddleware())
+	}
+	if r.config.EnableFlowCapture {
+		admin.GET(capturesURL, r.capturesHandler)
+		admin.POST(capturesURL, r.capturesHandler)
+		admin.GET(capturesURL+"/:id", r.captureHandler)
+		admin.DELETE(capturesURL+"/:id", r.captureHandler)
+	}
+	if r.config.EnableSessionStats {
+		admin.GET(sessionsURL, r.sessionsHandler)
+	}
+	if r.config.EnableSessionRevocation {
+		admin.DELETE(sessionsURL+"/:id", r.revokeSessionHandler)
+	}
+	if r.config.EnableActiveSessions {
+		admin.GET(sessionsURL+activeURL, r.activeSessionsHandler)
+	}
+
+	// step: add the synthetic endpoints, served ahead of the authentication
+	for _, x := range r.config.SyntheticEndpoints {
+		engine.Any(x.Path, x.handler())
 	}
 
 	// step: add the middleware
-	engine.Use(r.entrypointMiddleware(), r.authenticationMiddleware(), r.admissionMiddleware(),
-		r.headersMiddleware(r.config.AddClaims), r.reverseProxyMiddleware())
+	engine.Use(r.entrypointMiddleware(), r.authenticationMiddleware(), r.dpopMiddleware(), r.certificateBoundMiddleware(),
+		r.admissionMiddleware(), r.replayMiddleware(), r.quotaMiddleware(), r.headersMiddleware(r.config.AddClaims),
+		r.uploadMiddleware(), r.reverseProxyMiddleware())
 
 	// step: set the handler
 	r.router = engine
@@ -295,14 +615,21 @@ func (r *oauthProxy) Run() error {
 		ca:            r.config.TLSCaCertificate,
 		clientCert:    r.config.TLSClientCertificate,
 		proxyProtocol: r.config.EnableProxyProtocol,
+		metrics:       r.config.EnableMetrics,
+		validation:    r.config.EnableRequestValidation,
+		maxHeaderSize: r.config.MaxHeaderSize,
+		keepalive:     r.config.ListenKeepalive,
 	})
 	if err != nil {
 		return err
 	}
 	// step: create the http server
 	server := &http.Server{
-		Addr:    r.config.Listen,
-		Handler: r.router,
+		Addr:           r.config.Listen,
+		Handler:        r.router,
+		MaxHeaderBytes: r.config.MaxHeaderSize,
+		IdleTimeout:    r.config.ServerIdleTimeout,
+		ConnContext:    withConnection,
 	}
 
 	go func() {
@@ -320,13 +647,20 @@ func (r *oauthProxy) Run() error {
 		httpListener, err := createHTTPListener(listenerConfig{
 			listen:        r.config.ListenHTTP,
 			proxyProtocol: r.config.EnableProxyProtocol,
+			metrics:       r.config.EnableMetrics,
+			validation:    r.config.EnableRequestValidation,
+			maxHeaderSize: r.config.MaxHeaderSize,
+			keepalive:     r.config.ListenKeepalive,
 		})
 		if err != nil {
 			return err
 		}
 		httpsvc := &http.Server{
-			Addr:    r.config.ListenHTTP,
-			Handler: r.router,
+			Addr:           r.config.ListenHTTP,
+			Handler:        r.router,
+			MaxHeaderBytes: r.config.MaxHeaderSize,
+			IdleTimeout:    r.config.ServerIdleTimeout,
+			ConnContext:    withConnection,
 		}
 		go func() {
 			if err := httpsvc.Serve(httpListener); err != nil {
@@ -337,17 +671,50 @@ func (r *oauthProxy) Run() error {
 		}()
 	}
 
+	// step: are we running the internal listener?
+	if r.config.ListenAdmin != "" {
+		log.Infof("keycloak proxy internal service starting on %s", r.config.ListenAdmin)
+		adminListener, err := createHTTPListener(listenerConfig{
+			listen:        r.config.ListenAdmin,
+			metrics:       r.config.EnableMetrics,
+			validation:    r.config.EnableRequestValidation,
+			maxHeaderSize: r.config.MaxHeaderSize,
+			keepalive:     r.config.ListenKeepalive,
+		})
+		if err != nil {
+			return err
+		}
+		adminsvc := &http.Server{
+			Addr:           r.config.ListenAdmin,
+			Handler:        r.router,
+			MaxHeaderBytes: r.config.MaxHeaderSize,
+			IdleTimeout:    r.config.ServerIdleTimeout,
+			ConnContext:    withInternalConnection,
+		}
+		go func() {
+			if err := adminsvc.Serve(adminListener); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Fatalf("failed to start the internal service")
+			}
+		}()
+	}
+
 	return nil
 }
 
 // listenerConfig encapsulate listener options
 type listenerConfig struct {
-	listen        string // the interface to bind the listener to
-	certificate   string // the path to the certificate if any
-	privateKey    string // the path to the private key if any
-	ca            string // the path to a certificate authority
-	clientCert    string // the path to a client certificate to use for mutual tls
-	proxyProtocol bool   // whether to enable proxy protocol on the listen
+	listen        string        // the interface to bind the listener to
+	certificate   string        // the path to the certificate if any
+	privateKey    string        // the path to the private key if any
+	ca            string        // the path to a certificate authority
+	clientCert    string        // the path to a client certificate to use for mutual tls
+	proxyProtocol bool          // whether to enable proxy protocol on the listen
+	metrics       bool          // whether to record the connection and tls handshake metrics
+	validation    bool          // whether to validate the framing of the requests
+	maxHeaderSize int           // the maximum size of the request headers
+	keepalive     time.Duration // the tcp keepalive period of the connections, negative disables
 }
 
 // createHTTPListener is responsible for creating a listening socket
@@ -355,8 +722,12 @@ func createHTTPListener(config listenerConfig) (net.Listener, error) {
 	var listener net.Listener
 	var err error
 
-	// step: are we create a unix socket or tcp listener?
-	if strings.HasPrefix(config.listen, "unix://") {
+	// step: are we create a unix socket, tcp listener or using a socket passed by systemd?
+	if strings.HasPrefix(config.listen, systemdListenPrefix) {
+		if listener, err = createSystemdListener(config.listen); err != nil {
+			return nil, err
+		}
+	} else if strings.HasPrefix(config.listen, "unix://") {
 		socket := strings.Trim(config.listen, "unix://")
 		// step: delete the socket if it exists
 		if exists := fileExists(socket); exists {
@@ -369,11 +740,17 @@ func createHTTPListener(config listenerConfig) (net.Listener, error) {
 			return nil, err
 		}
 	} else {
-		if listener, err = net.Listen("tcp", config.listen); err != nil {
+		lc := net.ListenConfig{KeepAlive: config.keepalive}
+		if listener, err = lc.Listen(context.Background(), "tcp", config.listen); err != nil {
 			return nil, err
 		}
 	}
 
+	// step: are we recording the connection metrics?
+	if config.metrics {
+		listener = newMetricsListener(listener, config.listen)
+	}
+
 	// step: does the socket require TLS?
 	if config.certificate != "" && config.privateKey != "" {
 		log.Infof("tls enabled, certificate: %s, key: %s", config.certificate, config.privateKey)
@@ -390,7 +767,11 @@ func createHTTPListener(config listenerConfig) (net.Listener, error) {
 			PreferServerCipherSuites: true,
 			GetCertificate:           rotate.GetCertificate,
 		}
-		listener = tls.NewListener(listener, tlsConfig)
+		if config.metrics {
+			listener = newTLSMetricsListener(listener, config.listen, tlsConfig)
+		} else {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
 
 		// step: are we doing mutual tls?
 		if config.clientCert != "" {
@@ -411,6 +792,11 @@ func createHTTPListener(config listenerConfig) (net.Listener, error) {
 		listener = &proxyproto.Listener{Listener: listener}
 	}
 
+	// step: are we validating the framing of the requests?
+	if config.validation {
+		listener = newRequestValidationListener(listener, config.maxHeaderSize)
+	}
+
 	return listener, nil
 }
 
@@ -455,6 +841,13 @@ func (r *oauthProxy) createUpstreamProxy(upstream *url.URL) error {
 		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
 
+	// step: are we loading the upstream client certificate from a secret directory?
+	if r.config.TLSUpstreamSecretDir != "" {
+		if err := createUpstreamCertificates(r.config.TLSUpstreamSecretDir, tlsConfig); err != nil {
+			return err
+		}
+	}
+
 	// step: create the forwarding proxy
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Logger = httplog.New(ioutil.Discard, "", 0)
@@ -462,14 +855,44 @@ func (r *oauthProxy) createUpstreamProxy(upstream *url.URL) error {
 
 	// step: update the tls configuration of the reverse proxy
 	r.upstream.(*goproxy.ProxyHttpServer).Tr = &http.Transport{
-		Dial:              dialer,
-		TLSClientConfig:   tlsConfig,
-		DisableKeepAlives: !r.config.UpstreamKeepalives,
+		Dial:               dialer,
+		TLSClientConfig:    tlsConfig,
+		DisableKeepAlives:  !r.config.UpstreamKeepalives,
+		IdleConnTimeout:    r.config.UpstreamIdleTimeout,
+		DisableCompression: true,
 	}
+	// step: pass the content encoding negotiation of the client through to the upstream
+	proxy.OnRequest().DoFunc(encodingPassthroughFilter(proxy))
 
 	return nil
 }
 
+// createUpstreamCertificates loads the upstream client certificate and certificate authority from a directory
+// and watches for changes, i.e. kubernetes rotating the contents of a mounted secret
+func createUpstreamCertificates(directory string, tlsConfig *tls.Config) error {
+	log.Infof("loading the upstream client certificates from directory: %s", directory)
+
+	rotate, err := newCertificateRotator(filepath.Join(directory, tlsSecretCertificate), filepath.Join(directory, tlsSecretPrivateKey))
+	if err != nil {
+		return err
+	}
+	tlsConfig.GetClientCertificate = rotate.GetClientCertificate
+
+	// step: do we have a certificate authority to verify the upstream with? the tls package holds onto the
+	// roots it's handed, so the upstream is verified by the rotator against the authority as last reloaded
+	if caFile := filepath.Join(directory, tlsSecretCA); fileExists(caFile) {
+		if err := rotate.withAuthority(caFile); err != nil {
+			return err
+		}
+		if !tlsConfig.InsecureSkipVerify {
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyConnection = rotate.VerifyConnection
+		}
+	}
+
+	return rotate.watch()
+}
+
 //
 // createTemplates loads the custom template
 //
@@ -481,6 +904,11 @@ func (r *oauthProxy) createTemplates() error {
 		list = append(list, r.config.SignInPage)
 	}
 
+	if r.config.SignOutPage != "" {
+		log.Debugf("loading the custom sign out page: %s", r.config.SignOutPage)
+		list = append(list, r.config.SignOutPage)
+	}
+
 	if r.config.ForbiddenPage != "" {
 		log.Debugf("loading the custom sign forbidden page: %s", r.config.ForbiddenPage)
 		list = append(list, r.config.ForbiddenPage)
@@ -0,0 +1,118 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+const (
+	// serverSessionPrefix prefixes the server side sessions in the store
+	serverSessionPrefix = "session:"
+)
+
+// serverSession is the token set of a session held in the store, the cookie only carries the random id
+type serverSession struct {
+	// the access token of the session
+	AccessToken string `json:"access_token"`
+	// the refresh token of the session, if any
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// getServerSessionStoreKey returns the key of the session in the store, the id itself is never stored
+func getServerSessionStoreKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return serverSessionPrefix + hex.EncodeToString(sum[:])
+}
+
+// createServerSession saves the tokens of a new session in the store, returning the id of the session
+func (r *oauthProxy) createServerSession(token jose.JWT, refresh string, expiration time.Duration) (string, error) {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(value)
+
+	return id, r.updateServerSession(id, token, refresh, expiration)
+}
+
+// updateServerSession replaces the tokens of the session in the store, encrypted with the encryption key
+func (r *oauthProxy) updateServerSession(id string, token jose.JWT, refresh string, expiration time.Duration) error {
+	encoded, err := json.Marshal(&serverSession{AccessToken: token.Encode(), RefreshToken: refresh})
+	if err != nil {
+		return err
+	}
+	encrypted, err := r.encryptSessionState(string(encoded))
+	if err != nil {
+		return err
+	}
+	if err := r.indexStoredSession(token, getServerSessionStoreKey(id), expiration); err != nil {
+		return err
+	}
+	if store, ok := getStorageExpiration(r.store); ok && expiration > 0 {
+		return store.SetWithExpiration(getServerSessionStoreKey(id), encrypted, expiration)
+	}
+
+	return r.store.Set(getServerSessionStoreKey(id), encrypted)
+}
+
+// getServerSession retrieves the tokens of the session from the store
+func (r *oauthProxy) getServerSession(id string) (*serverSession, error) {
+	encrypted, err := r.store.Get(getServerSessionStoreKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if encrypted == "" {
+		return nil, ErrSessionNotFound
+	}
+	decoded, err := r.decryptSessionState(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	session := &serverSession{}
+	if err := json.Unmarshal([]byte(decoded), session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// deleteServerSession removes the session from the store, revoking it
+func (r *oauthProxy) deleteServerSession(id string) error {
+	return r.store.Delete(getServerSessionStoreKey(id))
+}
+
+// deleteStoredSession removes the server side session of the user from the store, else the refresh token, and
+// the session from the active sessions
+func (r *oauthProxy) deleteStoredSession(user *userContext) error {
+	if r.actives != nil {
+		if err := r.actives.remove(getSessionID(user)); err != nil {
+			return err
+		}
+	}
+	if user.serverSession != "" {
+		return r.deleteServerSession(user.serverSession)
+	}
+
+	return r.DeleteRefreshToken(user.token)
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServerSessionService(t *testing.T) (*oauthProxy, *fakeOAuthServer, *fakeStore, string) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EnableServerSideSessions = true
+	px, idp, svc := newTestProxyService(cfg)
+	store := &fakeStore{items: make(map[string]string)}
+	px.store = store
+
+	return px, idp, store, svc
+}
+
+func getWithSessionCookie(t *testing.T, location, name, value string) *http.Response {
+	req, _ := http.NewRequest(http.MethodGet, location, nil)
+	req.AddCookie(&http.Cookie{Name: name, Value: value})
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+
+	return resp
+}
+
+func TestServerSideSessionLogin(t *testing.T) {
+	px, _, store, svc := newTestServerSessionService(t)
+	resp, err := makeTestCodeFlowLogin(svc + fakeAuthAllURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var session string
+	for _, x := range resp.Cookies() {
+		assert.NotEqual(t, px.config.CookieRefreshName, x.Name)
+		if x.Name == px.config.CookieAccessName {
+			session = x.Value
+		}
+	}
+	// step: the cookie only carries the id, the tokens are in the store
+	if !assert.NotEmpty(t, session) {
+		return
+	}
+	assert.False(t, strings.Contains(session, "."))
+	assert.Equal(t, 1, store.size())
+	stored, err := px.getServerSession(session)
+	if assert.NoError(t, err) {
+		assert.NotEmpty(t, stored.AccessToken)
+		assert.NotEmpty(t, stored.RefreshToken)
+	}
+
+	resp = getWithSessionCookie(t, svc+fakeAuthAllURL, px.config.CookieAccessName, session)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// step: a token in the cookie is never accepted
+	resp = getWithSessionCookie(t, svc+fakeAuthAllURL, px.config.CookieAccessName, stored.AccessToken)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+	// step: removing the session from the store revokes it
+	assert.NoError(t, px.deleteServerSession(session))
+	resp = getWithSessionCookie(t, svc+fakeAuthAllURL, px.config.CookieAccessName, session)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+}
+
+func TestServerSideSessionRefresh(t *testing.T) {
+	px, idp, _, svc := newTestServerSessionService(t)
+	claims := jose.Claims{}
+	for k, v := range newTestToken(idp.getLocation()).claims {
+		claims[k] = v
+	}
+	refresh, _ := idp.signToken(claims)
+	claims["exp"] = float64(time.Now().Add(-time.Hour).Unix())
+	expired, _ := idp.signToken(claims)
+	session, err := px.createServerSession(*expired, refresh.Encode(), time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	resp := getWithSessionCookie(t, svc+fakeAuthAllURL, px.config.CookieAccessName, session)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// step: the session is updated in place, without touching the cookies
+	assert.Empty(t, resp.Cookies())
+	stored, err := px.getServerSession(session)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, expired.Encode(), stored.AccessToken)
+		assert.NotEqual(t, refresh.Encode(), stored.RefreshToken)
+	}
+}
+
+func TestServerSideSessionRefreshClientGone(t *testing.T) {
+	px, idp, _, svc := newTestServerSessionService(t)
+	claims := jose.Claims{}
+	for k, v := range newTestToken(idp.getLocation()).claims {
+		claims[k] = v
+	}
+	refresh, _ := idp.signToken(claims)
+	claims["exp"] = float64(time.Now().Add(-time.Hour).Unix())
+	expired, _ := idp.signToken(claims)
+	session, err := px.createServerSession(*expired, refresh.Encode(), time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	idp.setDelay(200 * time.Millisecond)
+
+	// step: the client gives up while the provider is rotating the refresh token
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL, nil)
+	req.AddCookie(&http.Cookie{Name: px.config.CookieAccessName, Value: session})
+	_, err = http.DefaultTransport.RoundTrip(req.WithContext(ctx))
+	assert.Error(t, err)
+
+	// step: the refresh is seen through and the rotated token kept
+	var stored *serverSession
+	for i := 0; i < 50; i++ {
+		if stored, err = px.getServerSession(session); err == nil && stored.RefreshToken != refresh.Encode() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, refresh.Encode(), stored.RefreshToken)
+	}
+}
+
+func TestServerSideSessionLogout(t *testing.T) {
+	px, _, store, svc := newTestServerSessionService(t)
+	resp, err := makeTestCodeFlowLogin(svc + fakeAuthAllURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var session string
+	for _, x := range resp.Cookies() {
+		if x.Name == px.config.CookieAccessName {
+			session = x.Value
+		}
+	}
+	resp = getWithSessionCookie(t, svc+px.config.withOAuthURI(logoutURL)+"?local=true", px.config.CookieAccessName, session)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// step: the session is removed from the store in the background
+	for i := 0; i < 50 && store.size() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, store.size())
+}
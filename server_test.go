@@ -18,6 +18,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,12 +27,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/coreos/go-oidc/jose"
+	"github.com/gambol99/goproxy"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -311,6 +315,131 @@ func TestNewKeycloakProxy(t *testing.T) {
 	assert.NotNil(t, proxy.endpoint)
 }
 
+func TestBaseURI(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.BaseURI = "/myapp"
+	_, _, svc := newTestProxyService(cfg)
+
+	req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL, nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		assert.True(t, strings.HasPrefix(resp.Header.Get("Location"), "/myapp/oauth/authorize?state="))
+	}
+
+	resp, err = http.Get(svc + "/myapp" + oauthURL + healthURL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// step: the login should complete under the base uri with the cookies scoped to it
+	resp, err = makeTestCodeFlowLogin(svc + fakeAuthAllURL)
+	if assert.NoError(t, err) {
+		var found bool
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == cfg.CookieAccessName {
+				found = true
+				assert.Equal(t, "/myapp", cookie.Path)
+			}
+		}
+		assert.True(t, found)
+	}
+}
+
+func TestEndpointPaths(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.OAuthURI = "/oauth2"
+	cfg.EndpointPaths = map[string]string{"callback": "/redirect_uri"}
+	_, _, svc := newTestProxyService(cfg)
+
+	req, _ := http.NewRequest(http.MethodGet, svc+"/oauth2"+authorizationURL, nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Location"), "redirect_uri="+url.QueryEscape(svc+"/oauth2/redirect_uri"))
+	}
+
+	resp, err = makeTestCodeFlowLogin(svc + fakeAuthAllURL)
+	if assert.NoError(t, err) {
+		assert.NotEmpty(t, resp.Cookies())
+	}
+}
+
+func TestCreateUpstreamCertificates(t *testing.T) {
+	directory, err := ioutil.TempDir("", "upstream")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(directory)
+
+	tlsConfig := &tls.Config{}
+	assert.Error(t, createUpstreamCertificates(directory, tlsConfig))
+
+	for filename, source := range map[string]string{
+		tlsSecretCertificate: testCertificateFile,
+		tlsSecretPrivateKey:  testPrivateKeyFile,
+		tlsSecretCA:          "./tests/ca.pem",
+	} {
+		content, _ := ioutil.ReadFile(source)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(directory, filename), content, 0600))
+	}
+	assert.NoError(t, createUpstreamCertificates(directory, tlsConfig))
+	assert.NotNil(t, tlsConfig.GetClientCertificate)
+	assert.NotNil(t, tlsConfig.VerifyConnection)
+}
+
+func TestUpstreamCertificateAuthorityReload(t *testing.T) {
+	directory, err := ioutil.TempDir("", "upstream")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(directory)
+
+	// step: the upstream is signed by one authority, the secret holding another
+	upstreamConfig, upstreamCA := newTestRedisTLS(t)
+	defer os.Remove(upstreamCA)
+	_, otherCA := newTestRedisTLS(t)
+	defer os.Remove(otherCA)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.TLS = upstreamConfig
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	for filename, source := range map[string]string{
+		tlsSecretCertificate: testCertificateFile,
+		tlsSecretPrivateKey:  testPrivateKeyFile,
+		tlsSecretCA:          otherCA,
+	} {
+		content, _ := ioutil.ReadFile(source)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(directory, filename), content, 0600))
+	}
+	tlsConfig := &tls.Config{}
+	if !assert.NoError(t, createUpstreamCertificates(directory, tlsConfig)) {
+		return
+	}
+	request := func() error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}}
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	assert.Error(t, request())
+
+	// step: the rotated authority is picked up without a restart
+	content, _ := ioutil.ReadFile(upstreamCA)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(directory, tlsSecretCA), content, 0600))
+	for i := 0; i < 50 && request() != nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NoError(t, request())
+}
+
 func newFakeResponse() *fakeResponse {
 	return &fakeResponse{
 		status:  http.StatusOK,
@@ -370,13 +499,17 @@ func makeTestCodeFlowLogin(location string) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	// step: get the redirect
+	// step: get the redirect, carrying the cookies like a browser would i.e. the nonce
 	var resp *http.Response
+	cookies := make(map[string]*http.Cookie)
 	for count := 0; count < 4; count++ {
 		req, err := http.NewRequest("GET", location, nil)
 		if err != nil {
 			return nil, err
 		}
+		for _, x := range cookies {
+			req.AddCookie(x)
+		}
 		// step: make the request
 		resp, err = http.DefaultTransport.RoundTrip(req)
 		if err != nil {
@@ -385,6 +518,9 @@ func makeTestCodeFlowLogin(location string) (*http.Response, error) {
 		if resp.StatusCode != http.StatusTemporaryRedirect {
 			return nil, errors.New("no redirection found in resp")
 		}
+		for _, x := range resp.Cookies() {
+			cookies[x.Name] = x
+		}
 		location = resp.Header.Get("Location")
 		if !strings.HasPrefix(location, "http") {
 			location = fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, location)
@@ -453,3 +589,15 @@ func (r *fakeResponse) Write(content []byte) (int, error)            { return le
 func (r *fakeResponse) WriteString(s string) (int, error)            { return len(s), nil }
 func (r *fakeResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) { return nil, nil, nil }
 func (r *fakeResponse) CloseNotify() <-chan bool                     { return make(chan bool, 0) }
+
+func TestUpstreamIdleTimeout(t *testing.T) {
+	proxy, _, _ := newTestProxyService(nil)
+	proxy.config.UpstreamKeepalives = true
+	proxy.config.UpstreamIdleTimeout = 45 * time.Second
+	if !assert.NoError(t, proxy.createUpstreamProxy(nil)) {
+		return
+	}
+	transport := proxy.upstream.(*goproxy.ProxyHttpServer).Tr
+	assert.False(t, transport.DisableKeepAlives)
+	assert.Equal(t, 45*time.Second, transport.IdleConnTimeout)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli"
+)
+
+// serviceState is the coordination between the proxy and the service manager it is running under, if any
+type serviceState struct {
+	// ready is closed once the proxy is serving
+	ready chan struct{}
+	// stop is closed when the service manager asks the proxy to stop
+	stop chan struct{}
+	// readyOnce and stopOnce guard closing the channels
+	readyOnce, stopOnce sync.Once
+}
+
+// service is the state of the service the proxy is running as
+var service = &serviceState{ready: make(chan struct{}), stop: make(chan struct{})}
+
+// started marks the proxy as serving
+func (r *serviceState) started() {
+	r.readyOnce.Do(func() { close(r.ready) })
+}
+
+// shutdown asks the proxy to stop
+func (r *serviceState) shutdown() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// getServiceCommand returns the command managing the proxy as a windows service
+func getServiceCommand() cli.Command {
+	return cli.Command{
+		Name:  "service",
+		Usage: "install, uninstall, start and stop the proxy as a windows service",
+		Subcommands: []cli.Command{
+			{
+				Name:            "install",
+				Usage:           "install the service, i.e. service install [name] --config=C:\\proxy\\config.yml",
+				ArgsUsage:       "[name] [options]",
+				SkipFlagParsing: true,
+				Action: func(cx *cli.Context) error {
+					name, args := getServiceName(cx.Args())
+					return serviceError(installService(name, args))
+				},
+			},
+			{
+				Name:      "uninstall",
+				Usage:     "stop and uninstall the service",
+				ArgsUsage: "[name]",
+				Action: func(cx *cli.Context) error {
+					name, _ := getServiceName(cx.Args())
+					return serviceError(removeService(name))
+				},
+			},
+			{
+				Name:      "start",
+				Usage:     "start the service",
+				ArgsUsage: "[name]",
+				Action: func(cx *cli.Context) error {
+					name, _ := getServiceName(cx.Args())
+					return serviceError(startService(name))
+				},
+			},
+			{
+				Name:      "stop",
+				Usage:     "stop the service",
+				ArgsUsage: "[name]",
+				Action: func(cx *cli.Context) error {
+					name, _ := getServiceName(cx.Args())
+					return serviceError(stopService(name))
+				},
+			},
+			{
+				Name:            "run",
+				Usage:           "run the proxy under the service control manager, used by the installed service",
+				ArgsUsage:       "[name] [options]",
+				Hidden:          true,
+				SkipFlagParsing: true,
+				Action: func(cx *cli.Context) error {
+					name, args := getServiceName(cx.Args())
+					return serviceError(runService(name, args))
+				},
+			},
+		},
+	}
+}
+
+// getServiceName returns the name of the service, defaulting to the program name, and the options following it
+func getServiceName(args []string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return prog, args
+	}
+
+	return args[0], args[1:]
+}
+
+// serviceError converts the error of a service command into an exit error
+func serviceError(err error) error {
+	if err != nil {
+		return printError(err.Error())
+	}
+
+	return nil
+}
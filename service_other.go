@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "errors"
+
+// errServiceUnsupported indicates the service commands are only available on windows
+var errServiceUnsupported = errors.New("the service commands are only supported on windows")
+
+// installService is unsupported outside of windows, use the init system instead
+func installService(name string, args []string) error {
+	return errServiceUnsupported
+}
+
+// removeService is unsupported outside of windows
+func removeService(name string) error {
+	return errServiceUnsupported
+}
+
+// startService is unsupported outside of windows
+func startService(name string) error {
+	return errServiceUnsupported
+}
+
+// stopService is unsupported outside of windows
+func stopService(name string) error {
+	return errServiceUnsupported
+}
+
+// runService is unsupported outside of windows
+func runService(name string, args []string) error {
+	return errServiceUnsupported
+}
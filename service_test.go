@@ -0,0 +1,55 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetServiceName(t *testing.T) {
+	cs := []struct {
+		Args     []string
+		Name     string
+		Expected []string
+	}{
+		{Name: prog},
+		{Args: []string{"--config=C:\\proxy\\config.yml"}, Name: prog, Expected: []string{"--config=C:\\proxy\\config.yml"}},
+		{Args: []string{"intranet"}, Name: "intranet", Expected: []string{}},
+		{Args: []string{"intranet", "--listen=:80"}, Name: "intranet", Expected: []string{"--listen=:80"}},
+	}
+	for i, c := range cs {
+		name, args := getServiceName(c.Args)
+		assert.Equal(t, c.Name, name, "case %d", i)
+		assert.Equal(t, c.Expected, args, "case %d", i)
+	}
+}
+
+func TestServiceState(t *testing.T) {
+	s := &serviceState{ready: make(chan struct{}), stop: make(chan struct{})}
+	s.started()
+	s.started()
+	s.shutdown()
+	s.shutdown()
+	for _, x := range []chan struct{}{s.ready, s.stop} {
+		select {
+		case <-x:
+		default:
+			t.Error("the channel should have been closed")
+		}
+	}
+}
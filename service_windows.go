@@ -0,0 +1,362 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	serviceWin32OwnProcess    = 0x10
+	serviceAutoStart          = 2
+	serviceErrorNormal        = 1
+	serviceManagerAllAccess   = 0xf003f
+	serviceAllAccess          = 0xf01ff
+	serviceStopped            = 1
+	serviceStartPending       = 2
+	serviceStopPending        = 3
+	serviceRunning            = 4
+	serviceAcceptStop         = 0x1
+	serviceAcceptShutdown     = 0x4
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	errorCallNotImplemented   = 120
+	errorServiceSpecific      = 1066
+	eventLogErrorType         = 0x1
+	eventLogWarningType       = 0x2
+	eventLogInformationType   = 0x4
+	// the event source registry key of the application log
+	eventLogKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+	// eventCreateMessageFile is the message file of the eventcreate tool, formatting any text given
+	eventCreateMessageFile = `%SystemRoot%\System32\EventCreate.exe`
+)
+
+var (
+	modadvapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procOpenSCManagerW                = modadvapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW                = modadvapi32.NewProc("CreateServiceW")
+	procOpenServiceW                  = modadvapi32.NewProc("OpenServiceW")
+	procDeleteService                 = modadvapi32.NewProc("DeleteService")
+	procStartServiceW                 = modadvapi32.NewProc("StartServiceW")
+	procControlService                = modadvapi32.NewProc("ControlService")
+	procCloseServiceHandle            = modadvapi32.NewProc("CloseServiceHandle")
+	procStartServiceCtrlDispatcherW   = modadvapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = modadvapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = modadvapi32.NewProc("SetServiceStatus")
+	procRegisterEventSourceW          = modadvapi32.NewProc("RegisterEventSourceW")
+	procDeregisterEventSource         = modadvapi32.NewProc("DeregisterEventSource")
+	procReportEventW                  = modadvapi32.NewProc("ReportEventW")
+	procRegCreateKeyExW               = modadvapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueExW                = modadvapi32.NewProc("RegSetValueExW")
+	procRegDeleteKeyW                 = modadvapi32.NewProc("RegDeleteKeyW")
+)
+
+// serviceStatus is the SERVICE_STATUS reported to the service control manager
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// serviceTableEntry is the SERVICE_TABLE_ENTRYW passed to the dispatcher
+type serviceTableEntry struct {
+	ServiceName *uint16
+	ServiceProc uintptr
+}
+
+// windowsService is the proxy running under the service control manager
+type windowsService struct {
+	sync.Mutex
+	// the name of the service
+	name string
+	// the options of the proxy
+	args []string
+	// the status handle of the service
+	handle uintptr
+	// the error running the service
+	err error
+}
+
+// installService installs the proxy as an automatically started service, running with the options given, and
+// registers the service as a source of the application event log
+func installService(name string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	command := append([]string{exe, "service", "run", name}, args...)
+	for i, x := range command {
+		command[i] = syscall.EscapeArg(x)
+	}
+	manager, err := openServiceManager()
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(manager)
+
+	serviceName, binaryPath := syscall.StringToUTF16Ptr(name), syscall.StringToUTF16Ptr(strings.Join(command, " "))
+	handle, _, err := procCreateServiceW.Call(manager, uintptr(unsafe.Pointer(serviceName)), uintptr(unsafe.Pointer(serviceName)),
+		serviceAllAccess, serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal, uintptr(unsafe.Pointer(binaryPath)), 0, 0, 0, 0, 0)
+	if handle == 0 {
+		return fmt.Errorf("unable to create the service: %s, error: %s", name, err)
+	}
+	procCloseServiceHandle.Call(handle)
+
+	return installEventSource(name)
+}
+
+// removeService stops and removes the service and its event source
+func removeService(name string) error {
+	stopService(name)
+
+	handle, err := openService(name)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(handle)
+
+	if ok, _, err := procDeleteService.Call(handle); ok == 0 {
+		return fmt.Errorf("unable to delete the service: %s, error: %s", name, err)
+	}
+	key := syscall.StringToUTF16Ptr(eventLogKey + name)
+	procRegDeleteKeyW.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(key)))
+
+	return nil
+}
+
+// startService asks the service control manager to start the service
+func startService(name string) error {
+	handle, err := openService(name)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(handle)
+
+	if ok, _, err := procStartServiceW.Call(handle, 0, 0); ok == 0 {
+		return fmt.Errorf("unable to start the service: %s, error: %s", name, err)
+	}
+
+	return nil
+}
+
+// stopService asks the service control manager to stop the service
+func stopService(name string) error {
+	handle, err := openService(name)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(handle)
+
+	var status serviceStatus
+	if ok, _, err := procControlService.Call(handle, serviceControlStop, uintptr(unsafe.Pointer(&status))); ok == 0 {
+		return fmt.Errorf("unable to stop the service: %s, error: %s", name, err)
+	}
+
+	return nil
+}
+
+// runService runs the proxy under the service control manager, logging to the application event log
+func runService(name string, args []string) error {
+	serviceName := syscall.StringToUTF16Ptr(name)
+	if source, _, _ := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(serviceName))); source != 0 {
+		defer procDeregisterEventSource.Call(source)
+		log.AddHook(&eventLogHook{source: source})
+	}
+	s := &windowsService{name: name, args: args}
+	table := []serviceTableEntry{
+		{ServiceName: serviceName, ServiceProc: syscall.NewCallback(s.serviceMain)},
+		{},
+	}
+	if ok, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0]))); ok == 0 {
+		return fmt.Errorf("unable to connect to the service control manager, error: %s", err)
+	}
+
+	return s.err
+}
+
+// serviceMain is the entrypoint of the service, running the proxy and reporting its state until it exits
+func (s *windowsService) serviceMain(argc uint32, argv uintptr) uintptr {
+	name := syscall.StringToUTF16Ptr(s.name)
+	handle, _, err := procRegisterServiceCtrlHandlerExW.Call(uintptr(unsafe.Pointer(name)), syscall.NewCallback(s.controlHandler), 0)
+	if handle == 0 {
+		s.err = fmt.Errorf("unable to register the service control handler, error: %s", err)
+		return 0
+	}
+	s.handle = handle
+	s.setStatus(serviceStartPending, 0)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runProxyApp(s.args)
+	}()
+	select {
+	case <-service.ready:
+		s.setStatus(serviceRunning, 0)
+		s.err = <-done
+	case s.err = <-done:
+	}
+
+	var code uint32
+	if s.err != nil {
+		log.WithFields(log.Fields{"error": s.err.Error()}).Errorf("the service has failed")
+		code = 1
+		if coder, ok := s.err.(cli.ExitCoder); ok {
+			code = uint32(coder.ExitCode())
+		}
+	}
+	s.setStatus(serviceStopped, code)
+
+	return 0
+}
+
+// controlHandler handles the requests of the service control manager, a stop or shutdown stops the proxy
+// in the same manner as a ctrl+c or ctrl+break in a console
+func (s *windowsService) controlHandler(control, eventType uint32, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		s.setStatus(serviceStopPending, 0)
+		service.shutdown()
+	case serviceControlInterrogate:
+	default:
+		return errorCallNotImplemented
+	}
+
+	return 0
+}
+
+// setStatus reports the state of the service to the service control manager
+func (s *windowsService) setStatus(state, code uint32) {
+	s.Lock()
+	defer s.Unlock()
+
+	status := serviceStatus{ServiceType: serviceWin32OwnProcess, CurrentState: state}
+	if state == serviceRunning {
+		status.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	}
+	if code != 0 {
+		status.Win32ExitCode = errorServiceSpecific
+		status.ServiceSpecificExitCode = code
+	}
+	procSetServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&status)))
+}
+
+// runProxyApp runs the proxy with the options, returning rather than exiting on an error
+func runProxyApp(args []string) error {
+	cli.OsExiter = func(int) {}
+	app := newOauthProxyApp()
+	app.ErrWriter = ioutil.Discard
+
+	return app.Run(append([]string{os.Args[0]}, args...))
+}
+
+// eventLogHook writes the log entries to the application event log
+type eventLogHook struct {
+	// the handle of the event source
+	source uintptr
+}
+
+// Levels returns the levels written to the event log
+func (h *eventLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire writes the entry to the event log, the event id is the type, as the eventcreate message file expects
+func (h *eventLogHook) Fire(entry *log.Entry) error {
+	message, err := entry.String()
+	if err != nil {
+		return err
+	}
+	kind := uint32(eventLogInformationType)
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel, log.ErrorLevel:
+		kind = eventLogErrorType
+	case log.WarnLevel:
+		kind = eventLogWarningType
+	}
+	text := syscall.StringToUTF16Ptr(strings.TrimSpace(message))
+	if ok, _, err := procReportEventW.Call(h.source, uintptr(kind), 0, uintptr(kind), 0, 1, 0, uintptr(unsafe.Pointer(&text)), 0); ok == 0 {
+		return err
+	}
+
+	return nil
+}
+
+// installEventSource registers the service as a source of the application event log
+func installEventSource(name string) error {
+	var key syscall.Handle
+	var disposition uint32
+	path := syscall.StringToUTF16Ptr(eventLogKey + name)
+	if code, _, _ := procRegCreateKeyExW.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(path)), 0, 0, 0,
+		syscall.KEY_ALL_ACCESS, 0, uintptr(unsafe.Pointer(&key)), uintptr(unsafe.Pointer(&disposition))); code != 0 {
+		return fmt.Errorf("unable to register the event source, error: %s", syscall.Errno(code))
+	}
+	defer syscall.RegCloseKey(key)
+
+	file, value := syscall.StringToUTF16(eventCreateMessageFile), syscall.StringToUTF16Ptr("EventMessageFile")
+	if code, _, _ := procRegSetValueExW.Call(uintptr(key), uintptr(unsafe.Pointer(value)), 0, syscall.REG_EXPAND_SZ,
+		uintptr(unsafe.Pointer(&file[0])), uintptr(len(file)*2)); code != 0 {
+		return fmt.Errorf("unable to register the event source, error: %s", syscall.Errno(code))
+	}
+	types, value := uint32(eventLogErrorType|eventLogWarningType|eventLogInformationType), syscall.StringToUTF16Ptr("TypesSupported")
+	if code, _, _ := procRegSetValueExW.Call(uintptr(key), uintptr(unsafe.Pointer(value)), 0, syscall.REG_DWORD,
+		uintptr(unsafe.Pointer(&types)), 4); code != 0 {
+		return fmt.Errorf("unable to register the event source, error: %s", syscall.Errno(code))
+	}
+
+	return nil
+}
+
+// openServiceManager opens the service control manager of the host
+func openServiceManager() (uintptr, error) {
+	manager, _, err := procOpenSCManagerW.Call(0, 0, serviceManagerAllAccess)
+	if manager == 0 {
+		return 0, fmt.Errorf("unable to open the service control manager, error: %s", err)
+	}
+
+	return manager, nil
+}
+
+// openService opens the service by name
+func openService(name string) (uintptr, error) {
+	manager, err := openServiceManager()
+	if err != nil {
+		return 0, err
+	}
+	defer procCloseServiceHandle.Call(manager)
+
+	serviceName := syscall.StringToUTF16Ptr(name)
+	handle, _, err := procOpenServiceW.Call(manager, uintptr(unsafe.Pointer(serviceName)), serviceAllAccess)
+	if handle == 0 {
+		return 0, fmt.Errorf("unable to open the service: %s, error: %s", name, err)
+	}
+
+	return handle, nil
+}
@@ -27,39 +27,141 @@ import (
 func (r *oauthProxy) getIdentity(req *http.Request) (*userContext, error) {
 	var isBearer bool
 
+	// step: an api key is exchanged for a token of the user who minted it
+	if key := req.Header.Get(apiKeyHeader); key != "" && r.apiKeys != nil {
+		return r.getAPIKeyIdentity(key)
+	}
+
 	// step: check for a bearer token or cookie with jwt token
-	access, isBearer, err := getTokenInRequest(req, r.config.CookieAccessName)
+	accessName, _ := r.config.getCookieNames(r.getSessionName(req))
+	access, isBearer, err := getTokenInRequest(req, accessName)
 	if err != nil {
 		return nil, err
 	}
-	// step: parse the access token
+	// step: the cookie of a server side session only carries the id, the tokens are in the store
+	var sessionID string
+	if !isBearer && r.config.EnableServerSideSessions {
+		session, err := r.getServerSession(access)
+		if err != nil {
+			return nil, ErrSessionNotFound
+		}
+		sessionID, access = access, session.AccessToken
+	}
+	// step: parse the access token, decrypting it if encrypted
+	if access, err = decryptToken(access, r.decryptionKey); err != nil {
+		return nil, err
+	}
 	token, err := jose.ParseJWT(access)
 	if err != nil {
-		return nil, err
+		// step: an opaque bearer token can only be validated by introspection
+		if !isBearer || r.introspector == nil {
+			return nil, err
+		}
+		return r.getOpaqueIdentity(access)
 	}
 
 	// step: parse the access token and extract the user identity
-	user, err := extractIdentity(token)
+	user, err := r.extractTokenIdentity(token)
 	if err != nil {
 		return nil, err
 	}
 
 	user.bearerToken = isBearer
+	user.serverSession = sessionID
 
 	// step: add some logging for debug purposed
 	log.WithFields(log.Fields{
-		"id":    user.id,
-		"name":  user.name,
-		"email": user.email,
-		"roles": strings.Join(user.roles, ","),
+		"id":              user.id,
+		"name":            user.name,
+		"email":           user.email,
+		"roles":           strings.Join(user.roles, ","),
+		"service_account": user.serviceAccount,
 	}).Debugf("found the user identity: %s in the request", user.email)
 
 	return user, nil
 }
 
+// extractTokenIdentity extracts the identity of the access token, or of the service account when accepted
+func (r *oauthProxy) extractTokenIdentity(token jose.JWT) (*userContext, error) {
+	claims, err := token.Claims()
+	if err != nil {
+		return nil, err
+	}
+	if clientID, found := getServiceAccountClientID(claims); found {
+		if !r.config.EnableServiceAccounts {
+			return nil, ErrServiceAccountToken
+		}
+		return extractServiceAccount(token, clientID, r.config.ClientID)
+	}
+
+	return extractIdentity(token)
+}
+
+// getOpaqueIdentity retrieves the user identity of an opaque bearer token from the introspection endpoint
+func (r *oauthProxy) getOpaqueIdentity(access string) (*userContext, error) {
+	claims, err := r.introspector.getClaims(access)
+	if err != nil {
+		return nil, err
+	}
+	if claims == nil {
+		return nil, ErrTokenInactive
+	}
+	token, err := jose.NewJWT(jose.JOSEHeader{jose.HeaderKeyAlgorithm: "none"}, claims)
+	if err != nil {
+		return nil, err
+	}
+	user, err := r.extractTokenIdentity(token)
+	if err != nil {
+		return nil, err
+	}
+	user.bearerToken = true
+	user.opaque = true
+	user.opaqueToken = Secret(access)
+
+	return user, nil
+}
+
+// getSessionName returns the session the request belongs to, the oauth handlers use the session
+// parameter or the url held in the state
+func (r *oauthProxy) getSessionName(req *http.Request) string {
+	if req.URL == nil {
+		return ""
+	}
+	requestPath, query := req.URL.Path, req.URL.Query()
+	if strings.HasPrefix(requestPath, r.config.withOAuthURI("")) {
+		if name := query.Get("session"); name != "" {
+			return name
+		}
+		requestPath, query = splitRequestURI(r.getStateRedirect(req))
+	}
+	for _, resource := range r.getResources() {
+		if resource.matches(req.Host, requestPath, query) {
+			return resource.Session
+		}
+	}
+
+	return ""
+}
+
+// encryptSessionState seals the refresh token or server side session with the current encryption key
+func (r *oauthProxy) encryptSessionState(value string) (string, error) {
+	return encodeText(value, r.config.getEncryptionKey(), r.config.EncryptionKeyID)
+}
+
+// decryptSessionState decrypts the refresh token or server side session, refusing the values of the legacy
+// unauthenticated format unless permitted
+func (r *oauthProxy) decryptSessionState(value string) (string, error) {
+	if !r.config.EnableLegacyDecryption && !isSealedText(value) {
+		return "", ErrInvalidSession
+	}
+
+	return decodeText(value, r.config.getEncryptionKeys()...)
+}
+
 // getRefreshTokenFromCookie returns the refresh token from the cookie if any
 func (r *oauthProxy) getRefreshTokenFromCookie(req *http.Request) (string, error) {
-	token, err := getTokenInCookie(req, r.config.CookieRefreshName)
+	_, refreshName := r.config.getCookieNames(r.getSessionName(req))
+	token, err := getTokenInCookie(req, refreshName)
 	if err != nil {
 		return "", err
 	}
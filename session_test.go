@@ -161,3 +161,44 @@ func TestGetRefreshTokenFromCookie(t *testing.T) {
 		}
 	}
 }
+
+func TestGetSessionName(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{URL: "/app-a", Session: "app-a"},
+		{URL: "/app-b"},
+	}
+	p, _, _ := newTestProxyService(cfg)
+	cs := []struct {
+		URL      string
+		Expected string
+	}{
+		{URL: "/app-a/test", Expected: "app-a"},
+		{URL: "/app-b/test", Expected: ""},
+		{URL: "/", Expected: ""},
+		{URL: "/oauth/callback?state=L2FwcC1hL3Rlc3Q=", Expected: "app-a"},
+		{URL: "/oauth/logout?session=app-a", Expected: "app-a"},
+		{URL: "/oauth/logout", Expected: ""},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", c.URL, nil)
+		assert.Equal(t, c.Expected, p.getSessionName(req), "case %d, url: %s", i, c.URL)
+	}
+}
+
+func TestSessionPartitionLogin(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = append(cfg.Resources, &Resource{URL: "/app-a", Methods: []string{"GET"}, Session: "app-a"})
+	_, _, svc := newTestProxyService(cfg)
+
+	resp, err := makeTestCodeFlowLogin(svc + "/app-a")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var names []string
+	for _, c := range resp.Cookies() {
+		names = append(names, c.Name)
+	}
+	assert.Contains(t, names, "kc-access-app-a")
+	assert.NotContains(t, names, "kc-access")
+}
@@ -0,0 +1,409 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxChunkLineSize is the maximum size of a chunk size line
+	maxChunkLineSize = 4096
+	// requestRejectedResponse is written to the client of a rejected request before the connection is closed
+	requestRejectedResponse = "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+	// requestRejectedTimeout is the longest we wait on the client to take the response of a rejected request
+	requestRejectedTimeout = time.Second
+)
+
+// the framing states of the request stream
+const (
+	stateHead = iota
+	stateBody
+	stateChunkSize
+	stateChunkData
+	stateTrailers
+	statePassthrough
+)
+
+// requestRejectedError is returned when a request fails the validation; the connection answers with a 400
+// and is closed, whether the request was rejected in the head or the body
+type requestRejectedError struct {
+	reason string
+}
+
+func (e *requestRejectedError) Error() string {
+	return fmt.Sprintf("request rejected, reason: %s", e.reason)
+}
+
+// requestValidator follows the framing of the requests on a connection, rejecting those which could be
+// interpreted differently by another hop, i.e. conflicting Transfer-Encoding and Content-Length, obsolete
+// line folding and abnormal request targets. The net/http server normalizes these away before we see
+// the request, so the validation must happen on the raw stream.
+type requestValidator struct {
+	// the framing state
+	state int
+	// the maximum size of a request head
+	limit int
+	// the current line being read
+	line []byte
+	// the size of the head read so far
+	size int
+	// the method and version of the current request, empty until the request line is read
+	method  string
+	version string
+	// the framing headers of the current request
+	contentLength    []string
+	transferEncoding []string
+	// the bytes remaining of the body or chunk
+	remaining int64
+}
+
+// newRequestValidator creates a validator with the maximum head size
+func newRequestValidator(limit int) *requestValidator {
+	if limit <= 0 {
+		limit = http.DefaultMaxHeaderBytes
+	}
+
+	return &requestValidator{limit: limit + 4096}
+}
+
+// inspect validates the next bytes read from the connection
+func (r *requestValidator) inspect(b []byte) error {
+	for len(b) > 0 {
+		switch r.state {
+		case statePassthrough:
+			return nil
+		case stateBody, stateChunkData:
+			n := int64(len(b))
+			if n > r.remaining {
+				n = r.remaining
+			}
+			r.remaining -= n
+			b = b[n:]
+			if r.remaining == 0 {
+				if r.state == stateBody {
+					r.reset()
+				} else {
+					r.state = stateChunkSize
+				}
+			}
+		default:
+			i := bytes.IndexByte(b, '\n')
+			chunk := b
+			if i >= 0 {
+				chunk = b[:i]
+			}
+			r.line = append(r.line, chunk...)
+			r.size += len(chunk)
+			b = b[len(chunk):]
+			switch {
+			case r.state == stateChunkSize && len(r.line) > maxChunkLineSize:
+				return &requestRejectedError{reason: "invalid_chunk"}
+			case r.state != stateChunkSize && r.size > r.limit:
+				return &requestRejectedError{reason: "header_too_large"}
+			}
+			if i < 0 {
+				continue
+			}
+			// step: skip the newline
+			b = b[1:]
+			line := strings.TrimSuffix(string(r.line), "\r")
+			r.line = r.line[:0]
+			if err := r.inspectLine(line); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// inspectLine validates a complete line of the head, chunk size or trailers
+func (r *requestValidator) inspectLine(line string) error {
+	switch r.state {
+	case stateChunkSize:
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil || size < 0 {
+			return &requestRejectedError{reason: "invalid_chunk"}
+		}
+		if size == 0 {
+			r.state = stateTrailers
+			return nil
+		}
+		// step: the chunk data is followed by a crlf
+		r.remaining = size + 2
+		r.state = stateChunkData
+	case stateTrailers:
+		if line == "" {
+			r.reset()
+		}
+	default:
+		// step: ignore any empty lines preceding the request line
+		if r.method == "" && line == "" {
+			return nil
+		}
+		if r.method == "" {
+			return r.inspectRequestLine(line)
+		}
+		if line == "" {
+			return r.endOfHead()
+		}
+		return r.inspectHeader(line)
+	}
+
+	return nil
+}
+
+// inspectRequestLine validates the method, target and version of the request
+func (r *requestValidator) inspectRequestLine(line string) error {
+	items := strings.Split(line, " ")
+	if len(items) != 3 {
+		return &requestRejectedError{reason: "invalid_request_line"}
+	}
+	if !isValidRequestTarget(items[0], items[1]) {
+		return &requestRejectedError{reason: "invalid_request_target"}
+	}
+	r.method = items[0]
+	r.version = items[2]
+
+	return nil
+}
+
+// inspectHeader validates a header line, recording those related to the framing
+func (r *requestValidator) inspectHeader(line string) error {
+	if line[0] == ' ' || line[0] == '\t' {
+		return &requestRejectedError{reason: "obsolete_line_folding"}
+	}
+	i := strings.IndexByte(line, ':')
+	if i <= 0 {
+		return &requestRejectedError{reason: "invalid_header"}
+	}
+	name := line[:i]
+	if strings.TrimSpace(name) != name {
+		return &requestRejectedError{reason: "invalid_header"}
+	}
+	value := strings.TrimSpace(line[i+1:])
+	switch strings.ToLower(name) {
+	case "content-length":
+		r.contentLength = append(r.contentLength, value)
+	case "transfer-encoding":
+		r.transferEncoding = append(r.transferEncoding, value)
+	}
+
+	return nil
+}
+
+// endOfHead checks the framing of the request and moves on to the body, if any
+func (r *requestValidator) endOfHead() error {
+	r.size = 0
+	if len(r.transferEncoding) > 0 && len(r.contentLength) > 0 {
+		return &requestRejectedError{reason: "conflicting_length"}
+	}
+	if len(r.contentLength) > 1 {
+		return &requestRejectedError{reason: "multiple_content_length"}
+	}
+	switch {
+	case len(r.transferEncoding) > 0:
+		if r.version != "HTTP/1.1" || len(r.transferEncoding) != 1 || !strings.EqualFold(r.transferEncoding[0], "chunked") {
+			return &requestRejectedError{reason: "invalid_transfer_encoding"}
+		}
+		r.state = stateChunkSize
+	case len(r.contentLength) > 0:
+		length, err := strconv.ParseInt(r.contentLength[0], 10, 64)
+		if err != nil || length < 0 || strings.HasPrefix(r.contentLength[0], "+") {
+			return &requestRejectedError{reason: "invalid_content_length"}
+		}
+		r.remaining = length
+		r.state = stateBody
+		if length == 0 {
+			r.state = stateHead
+		}
+	}
+	// step: the connection is hijacked for a connect, it's no longer http from here; upgraded
+	// connections are handled by skipValidation, as the upgrade may be refused
+	if r.method == http.MethodConnect {
+		r.state = statePassthrough
+		return nil
+	}
+	if r.state == stateHead {
+		r.reset()
+	}
+
+	return nil
+}
+
+// reset prepares for the next request on the connection
+func (r *requestValidator) reset() {
+	*r = requestValidator{limit: r.limit, line: r.line[:0]}
+}
+
+// isValidRequestTarget checks the request target is in origin, absolute, authority or asterisk form
+func isValidRequestTarget(method, target string) bool {
+	if target == "" || strings.ContainsAny(target, "#\\") {
+		return false
+	}
+	for _, c := range target {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	switch {
+	case method == http.MethodConnect:
+		_, _, err := net.SplitHostPort(target)
+		return err == nil
+	case target == "*":
+		return method == http.MethodOptions
+	case strings.HasPrefix(target, "/"):
+		return true
+	default:
+		u, err := url.Parse(target)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+	}
+}
+
+// skipRequestValidation stops the validation of the connection the request was read from
+func skipRequestValidation(req *http.Request) {
+	if conn, ok := req.Context().Value(connectionContextKey).(interface {
+		skipValidation()
+	}); ok {
+		conn.skipValidation()
+	}
+}
+
+// requestValidationListener validates the framing of the requests on the accepted connections
+type requestValidationListener struct {
+	net.Listener
+	// the maximum size of a request head
+	limit int
+	// the requests rejected
+	rejected *prometheus.CounterVec
+}
+
+// newRequestValidationListener wraps the listener, validating the requests read from the connections
+func newRequestValidationListener(listener net.Listener, limit int) net.Listener {
+	rejected := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_request_rejected_total",
+			Help: "The requests rejected by the request validation partitioned by reason",
+		},
+		[]string{"reason"},
+	)
+
+	return &requestValidationListener{
+		Listener: listener,
+		limit:    limit,
+		rejected: prometheus.MustRegisterOrGet(rejected).(*prometheus.CounterVec),
+	}
+}
+
+// Accept waits for and returns the next connection
+func (r *requestValidationListener) Accept() (net.Conn, error) {
+	conn, err := r.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	validated := &validatedConn{Conn: conn, validator: newRequestValidator(r.limit), rejected: r.rejected}
+	// step: the http server treats a connection with a connection state as tls
+	if _, ok := conn.(tlsConnection); ok {
+		return &validatedTLSConn{validatedConn: validated}, nil
+	}
+
+	return validated, nil
+}
+
+// validatedConn is a connection validating the requests read from it
+type validatedConn struct {
+	net.Conn
+	// the validator following the requests
+	validator *requestValidator
+	// the requests rejected
+	rejected *prometheus.CounterVec
+	// the error once a request has been rejected
+	err error
+	// set once the connection has been upgraded
+	skip int32
+}
+
+// skipValidation stops the validation, the connection has been upgraded
+func (r *validatedConn) skipValidation() {
+	atomic.StoreInt32(&r.skip, 1)
+}
+
+// Read reads and validates the data from the connection
+func (r *validatedConn) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.Conn.Read(b)
+	if n > 0 && atomic.LoadInt32(&r.skip) == 0 {
+		if e := r.validator.inspect(b[:n]); e != nil {
+			r.err = e
+			r.rejected.WithLabelValues(e.(*requestRejectedError).reason).Inc()
+			log.WithFields(log.Fields{
+				"client_ip": r.Conn.RemoteAddr().String(),
+				"error":     e.Error(),
+			}).Warnf("rejecting the request, it failed validation")
+
+			// step: the http server only answers a request failing in the head, a body failing is left to the
+			// handler, so we answer the client ourselves; the response of the server then fails on the closed
+			// connection
+			r.Conn.SetWriteDeadline(time.Now().Add(requestRejectedTimeout))
+			r.Conn.Write([]byte(requestRejectedResponse))
+			r.Conn.Close()
+
+			return 0, e
+		}
+	}
+
+	return n, err
+}
+
+// tlsConnection is the interface the http server uses to handle a tls connection
+type tlsConnection interface {
+	ConnectionState() tls.ConnectionState
+	HandshakeContext(ctx context.Context) error
+}
+
+// validatedTLSConn is a validated tls connection
+type validatedTLSConn struct {
+	*validatedConn
+}
+
+// ConnectionState returns the state of the tls connection
+func (r *validatedTLSConn) ConnectionState() tls.ConnectionState {
+	return r.Conn.(tlsConnection).ConnectionState()
+}
+
+// HandshakeContext runs the tls handshake
+func (r *validatedTLSConn) HandshakeContext(ctx context.Context) error {
+	return r.Conn.(tlsConnection).HandshakeContext(ctx)
+}
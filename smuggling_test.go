@@ -0,0 +1,173 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestValidator(t *testing.T) {
+	cs := []struct {
+		Request string
+		Reason  string
+	}{
+		{Request: "GET / HTTP/1.1\r\nHost: a\r\n\r\n"},
+		{Request: "\r\nGET /path?q=1 HTTP/1.1\r\nHost: a\r\n\r\n"},
+		{Request: "OPTIONS * HTTP/1.1\r\nHost: a\r\n\r\n"},
+		{Request: "GET http://a/b HTTP/1.1\r\nHost: a\r\n\r\n"},
+		{Request: "CONNECT a:443 HTTP/1.1\r\nHost: a\r\n\r\nnot http from here"},
+		{Request: "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhelloGET / HTTP/1.1\r\n\r\n"},
+		{Request: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n0\r\nTrailer: x\r\n\r\nGET / HTTP/1.1\r\n\r\n"},
+		{
+			Request: "POST / HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			Reason:  "conflicting_length",
+		},
+		{
+			Request: "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+			Reason:  "multiple_content_length",
+		},
+		{
+			Request: "POST / HTTP/1.1\r\nContent-Length: +5\r\n\r\nhello",
+			Reason:  "invalid_content_length",
+		},
+		{
+			Request: "POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n",
+			Reason:  "invalid_transfer_encoding",
+		},
+		{
+			Request: "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n",
+			Reason:  "invalid_transfer_encoding",
+		},
+		{
+			Request: "GET / HTTP/1.1\r\nX-Test: a\r\n b\r\n\r\n",
+			Reason:  "obsolete_line_folding",
+		},
+		{
+			Request: "GET / HTTP/1.1\r\nTransfer-Encoding : chunked\r\n\r\n",
+			Reason:  "invalid_header",
+		},
+		{
+			Request: "GET /a#b HTTP/1.1\r\n\r\n",
+			Reason:  "invalid_request_target",
+		},
+		{
+			Request: "GET * HTTP/1.1\r\n\r\n",
+			Reason:  "invalid_request_target",
+		},
+		{
+			Request: "GET ftp://a/b HTTP/1.1\r\n\r\n",
+			Reason:  "invalid_request_target",
+		},
+		{
+			Request: "GET /  HTTP/1.1\r\n\r\n",
+			Reason:  "invalid_request_line",
+		},
+		{
+			Request: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+			Reason:  "invalid_chunk",
+		},
+		{
+			Request: "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhelloGET / HTTP/1.1\r\nX-Test: a\r\n\tb\r\n\r\n",
+			Reason:  "obsolete_line_folding",
+		},
+	}
+	for i, c := range cs {
+		// step: check the request whole and a byte at a time
+		for _, size := range []int{len(c.Request), 1} {
+			validator := newRequestValidator(0)
+			var err error
+			for b := []byte(c.Request); len(b) > 0 && err == nil; {
+				n := size
+				if n > len(b) {
+					n = len(b)
+				}
+				err = validator.inspect(b[:n])
+				b = b[n:]
+			}
+			if c.Reason == "" {
+				assert.NoError(t, err, "case %d, size: %d", i, size)
+				continue
+			}
+			if assert.Error(t, err, "case %d, size: %d", i, size) {
+				assert.Equal(t, c.Reason, err.(*requestRejectedError).reason, "case %d, size: %d", i, size)
+			}
+		}
+	}
+}
+
+func TestRequestValidatorHeaderSize(t *testing.T) {
+	validator := newRequestValidator(10)
+	err := validator.inspect([]byte("GET / HTTP/1.1\r\nX-Test: " + strings.Repeat("a", 5000) + "\r\n\r\n"))
+	if assert.Error(t, err) {
+		assert.Equal(t, "header_too_large", err.(*requestRejectedError).reason)
+	}
+}
+
+func TestRequestValidationListener(t *testing.T) {
+	listener, err := createHTTPListener(listenerConfig{
+		listen:     "127.0.0.1:0",
+		validation: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.Write([]byte("ok"))
+	}))
+
+	send := func(parts ...string) int {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer conn.Close()
+		for i, x := range parts {
+			if i > 0 {
+				time.Sleep(50 * time.Millisecond)
+			}
+			conn.Write([]byte(x))
+		}
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		if resp.StatusCode == http.StatusBadRequest {
+			// step: the rejected request is the last on the connection
+			assert.True(t, resp.Close)
+			_, err := http.ReadResponse(reader, nil)
+			assert.Error(t, err)
+		}
+
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, send("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello"))
+	assert.Equal(t, http.StatusBadRequest,
+		send("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	assert.Equal(t, http.StatusBadRequest, send("GET / HTTP/1.1\r\nHost: a\r\nX-Test: a\r\n b\r\n\r\n"))
+	// step: the requests rejected in the body are answered with a 400 as well, not the response of the handler
+	assert.Equal(t, http.StatusBadRequest, send("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n", "zz\r\n\r\n"))
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/gin-gonic/gin"
+)
+
+// newAuthorizationURL generates the url of the authorization request; the state sent to the provider is a
+// random value bound to the browser by a signed cookie, which also carries the url to return the user to
+func (r *oauthProxy) newAuthorizationURL(cx *gin.Context, client *oauth2.Client, redirect string, params map[string]string) (string, error) {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+	state := base64.RawURLEncoding.EncodeToString(value)
+	r.dropPathCookie(cx, r.config.getStateCookieName(), r.signState(state, sanitizeRedirect(redirect)),
+		r.config.withOAuthURI(""), authorizationCookieDuration)
+
+	nonce, err := r.newAuthorizationNonce(cx)
+	if err != nil {
+		return "", err
+	}
+	params = mergeMaps(map[string]string{"nonce": nonce}, params)
+
+	return addAuthorizationParams(client.AuthCodeURL(state, r.config.getAccessType(), ""), params), nil
+}
+
+// verifyState checks the state of the callback matches the state cookie, clearing the cookie and
+// returning the url the user was heading to
+func (r *oauthProxy) verifyState(cx *gin.Context) (string, error) {
+	state, redirect, err := r.getStateCookie(cx.Request)
+	if err != nil {
+		return "", err
+	}
+	r.dropPathCookie(cx, r.config.getStateCookieName(), "", r.config.withOAuthURI(""), -10*time.Hour)
+
+	if subtle.ConstantTimeCompare([]byte(state), []byte(cx.Query("state"))) != 1 {
+		return "", errors.New("the state of the callback does not match the request")
+	}
+
+	return redirect, nil
+}
+
+// getStateCookie returns the state and redirect held in the state cookie, verifying the signature
+func (r *oauthProxy) getStateCookie(req *http.Request) (string, string, error) {
+	state, redirect, err := r.getSignedStateCookie(req, r.config.getStateCookieName())
+	if err != nil {
+		return "", "", err
+	}
+
+	return state, sanitizeRedirect(redirect), nil
+}
+
+// getSignedStateCookie returns the state and value held in a signed state cookie, verifying the signature
+func (r *oauthProxy) getSignedStateCookie(req *http.Request, name string) (string, string, error) {
+	cookie, err := req.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return "", "", errors.New("no state cookie found in the request")
+	}
+	items := strings.Split(cookie.Value, ".")
+	if len(items) != 3 {
+		return "", "", errors.New("the state cookie is malformed")
+	}
+	if !r.isSignedState(cookie.Value, items[0], decodeStateItem(items[1])) {
+		return "", "", errors.New("the signature of the state cookie is invalid")
+	}
+
+	return items[0], decodeStateItem(items[1]), nil
+}
+
+// getStateRedirect returns the url held in the state cookie when it matches the state of the request,
+// else the url passed in the state to the authorization endpoint
+func (r *oauthProxy) getStateRedirect(req *http.Request) string {
+	state := req.URL.Query().Get("state")
+	if found, redirect, err := r.getStateCookie(req); err == nil && found == state {
+		return redirect
+	}
+
+	return decodeState(state)
+}
+
+// signState encodes the state and redirect with their signature for the state cookie
+func (r *oauthProxy) signState(state, redirect string) string {
+	return signStateWithKey(r.stateKey, state, redirect)
+}
+
+// isSignedState checks the signature of the state cookie against the current and previous keys
+func (r *oauthProxy) isSignedState(value, state, redirect string) bool {
+	for _, key := range append([][]byte{r.stateKey}, r.previousStateKeys...) {
+		if hmac.Equal([]byte(value), []byte(signStateWithKey(key, state, redirect))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// signStateWithKey encodes the state and redirect with their signature by the key
+func signStateWithKey(key []byte, state, redirect string) string {
+	value := state + "." + base64.RawURLEncoding.EncodeToString([]byte(redirect))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// decodeStateItem decodes an item of the state cookie
+func decodeStateItem(item string) string {
+	decoded, err := base64.RawURLEncoding.DecodeString(item)
+	if err != nil {
+		return ""
+	}
+
+	return string(decoded)
+}
+
+// sanitizeRedirect ensures the user is only ever returned to a path of the proxy, defaulting to the root
+func sanitizeRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	// step: the browsers strip the tabs and newlines from a url, so /\t/evil.com is taken as //evil.com
+	for i := 0; i < len(redirect); i++ {
+		if redirect[i] < 0x20 || redirect[i] == 0x7f {
+			return "/"
+		}
+	}
+
+	return redirect
+}
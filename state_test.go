@@ -0,0 +1,100 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeRedirect(t *testing.T) {
+	cs := []struct {
+		Redirect string
+		Expected string
+	}{
+		{Redirect: "", Expected: "/"},
+		{Redirect: "/admin?a=b", Expected: "/admin?a=b"},
+		{Redirect: "http://evil.com/", Expected: "/"},
+		{Redirect: "//evil.com/", Expected: "/"},
+		{Redirect: "/\\evil.com/", Expected: "/"},
+		{Redirect: "admin", Expected: "/"},
+		{Redirect: "/\t/evil.com/", Expected: "/"},
+		{Redirect: "/\n/evil.com/", Expected: "/"},
+		{Redirect: "/\r\n/evil.com/", Expected: "/"},
+		{Redirect: "/admin\x00", Expected: "/"},
+		{Redirect: "/admin\x7f", Expected: "/"},
+		{Redirect: "/admin%09", Expected: "/admin%09"},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, sanitizeRedirect(c.Redirect), "case %d", i)
+	}
+}
+
+func TestGetStateCookie(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.previousStateKeys = [][]byte{[]byte("a previous encryption key")}
+	cs := []struct {
+		Value    string
+		Redirect string
+		Ok       bool
+	}{
+		{Value: p.signState("abc", "/admin"), Redirect: "/admin", Ok: true},
+		{Value: p.signState("abc", "//evil.com"), Redirect: "/", Ok: true},
+		{Value: signStateWithKey([]byte("a previous encryption key"), "abc", "/admin"), Redirect: "/admin", Ok: true},
+		{Value: signStateWithKey([]byte("another encryption key"), "abc", "/admin")},
+		{Value: "abc.L2FkbWlu.bad"},
+		{Value: "abc.L2FkbWlu"},
+		{Value: ""},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest(http.MethodGet, "/oauth/callback?state=abc", nil)
+		req.AddCookie(&http.Cookie{Name: "kc-access-state", Value: c.Value})
+		state, redirect, err := p.getStateCookie(req)
+		if !c.Ok {
+			assert.Error(t, err, "case %d, expected an error", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, "abc", state, "case %d", i)
+		assert.Equal(t, c.Redirect, redirect, "case %d", i)
+	}
+}
+
+func TestCallbackState(t *testing.T) {
+	p, _, u := newTestProxyService(nil)
+	cs := []struct {
+		State        string
+		Cookie       string
+		ExpectedCode int
+	}{
+		{State: "abc", ExpectedCode: http.StatusForbidden},
+		{State: "abc", Cookie: p.signState("xyz", "/admin"), ExpectedCode: http.StatusForbidden},
+		{State: "abc", Cookie: "abc.L2FkbWlu.forged", ExpectedCode: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest(http.MethodGet, u+oauthURL+callbackURL+"?code=test&state="+c.State, nil)
+		if c.Cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "kc-access-state", Value: c.Cookie})
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d", i)
+	}
+}
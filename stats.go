@@ -0,0 +1,184 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// sessionStatsRetention is the number of hourly buckets held by the session statistics
+	sessionStatsRetention = 24
+)
+
+// sessionStatsHour are the anonymized session statistics of an hour
+type sessionStatsHour struct {
+	// Hour is the start of the hour
+	Hour time.Time `json:"hour"`
+	// Logins is the number of logins
+	Logins int `json:"logins"`
+	// UniqueUsers is the number of distinct users logging in
+	UniqueUsers int `json:"unique-users"`
+	// RefreshFailures is the number of failed token refreshes
+	RefreshFailures int `json:"refresh-failures"`
+	// Logouts is the number of sessions ended by a logout
+	Logouts int `json:"logouts"`
+	// AverageSessionLength is the average length of the sessions ended in seconds
+	AverageSessionLength float64 `json:"average-session-length"`
+}
+
+// sessionStatsBucket holds the statistics of an hour as they are recorded
+type sessionStatsBucket struct {
+	// the start of the hour
+	hour time.Time
+	// the number of logins
+	logins int
+	// the hashed user ids, so we never hold the identity of a user
+	users map[[sha256.Size]byte]bool
+	// the failed refreshes
+	refreshFailures int
+	// the sessions ended
+	logouts int
+	// the total length of the sessions ended
+	sessionLength time.Duration
+}
+
+// sessionStats records the anonymized usage of the proxy, it's safe to use from multiple goroutines and a
+// nil stats records nothing
+type sessionStats struct {
+	sync.Mutex
+	// the hourly buckets, oldest first
+	buckets []*sessionStatsBucket
+	// the logins made
+	logins prometheus.Counter
+	// the failed refreshes
+	refreshFailures prometheus.Counter
+	// the length of the sessions ended by a logout
+	sessionLength prometheus.Summary
+}
+
+// newSessionStats creates the session statistics and registers the metrics
+func newSessionStats() *sessionStats {
+	logins := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "session_logins_total",
+		Help: "The number of logins to the proxy",
+	})
+	refreshFailures := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "session_refresh_failures_total",
+		Help: "The number of failed access token refreshes",
+	})
+	sessionLength := prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "session_length_seconds",
+		Help: "The length of the sessions ended by a logout",
+	})
+
+	return &sessionStats{
+		logins:          prometheus.MustRegisterOrGet(logins).(prometheus.Counter),
+		refreshFailures: prometheus.MustRegisterOrGet(refreshFailures).(prometheus.Counter),
+		sessionLength:   prometheus.MustRegisterOrGet(sessionLength).(prometheus.Summary),
+	}
+}
+
+// login records a login of the user
+func (r *sessionStats) login(userID string) {
+	if r == nil {
+		return
+	}
+	r.logins.Inc()
+	r.Lock()
+	defer r.Unlock()
+	bucket := r.current(time.Now())
+	bucket.logins++
+	bucket.users[sha256.Sum256([]byte(userID))] = true
+}
+
+// refreshFailed records a failed refresh of an access token
+func (r *sessionStats) refreshFailed() {
+	if r == nil {
+		return
+	}
+	r.refreshFailures.Inc()
+	r.Lock()
+	defer r.Unlock()
+	r.current(time.Now()).refreshFailures++
+}
+
+// logout records the end of a session started at the time given
+func (r *sessionStats) logout(started time.Time) {
+	if r == nil {
+		return
+	}
+	length := time.Since(started)
+	if started.IsZero() || length < 0 {
+		return
+	}
+	r.sessionLength.Observe(length.Seconds())
+	r.Lock()
+	defer r.Unlock()
+	bucket := r.current(time.Now())
+	bucket.logouts++
+	bucket.sessionLength += length
+}
+
+// current returns the bucket for the hour, expiring the old buckets
+func (r *sessionStats) current(now time.Time) *sessionStatsBucket {
+	hour := now.Truncate(time.Hour)
+	if size := len(r.buckets); size > 0 && r.buckets[size-1].hour.Equal(hour) {
+		return r.buckets[size-1]
+	}
+	bucket := &sessionStatsBucket{hour: hour, users: make(map[[sha256.Size]byte]bool)}
+	r.buckets = append(r.buckets, bucket)
+	// step: drop the buckets outside the retention
+	for len(r.buckets) > 0 && now.Sub(r.buckets[0].hour) >= sessionStatsRetention*time.Hour {
+		r.buckets = r.buckets[1:]
+	}
+
+	return bucket
+}
+
+// hours returns the statistics of the hours retained, newest first
+func (r *sessionStats) hours() []sessionStatsHour {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	list := make([]sessionStatsHour, 0)
+	for _, bucket := range r.buckets {
+		if now.Sub(bucket.hour) >= sessionStatsRetention*time.Hour {
+			continue
+		}
+		hour := sessionStatsHour{
+			Hour:            bucket.hour,
+			Logins:          bucket.logins,
+			UniqueUsers:     len(bucket.users),
+			RefreshFailures: bucket.refreshFailures,
+			Logouts:         bucket.logouts,
+		}
+		if bucket.logouts > 0 {
+			hour.AverageSessionLength = (bucket.sessionLength / time.Duration(bucket.logouts)).Seconds()
+		}
+		list = append(list, hour)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Hour.After(list[j].Hour)
+	})
+
+	return list
+}
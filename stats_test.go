@@ -0,0 +1,86 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionStats(t *testing.T) {
+	var empty *sessionStats
+	empty.login("a")
+	empty.refreshFailed()
+	empty.logout(time.Now())
+
+	stats := newSessionStats()
+	stats.login("a")
+	stats.login("a")
+	stats.login("b")
+	stats.refreshFailed()
+	stats.logout(time.Now().Add(-time.Minute))
+	stats.logout(time.Now().Add(-3 * time.Minute))
+	stats.logout(time.Time{})
+
+	hours := stats.hours()
+	if assert.Len(t, hours, 1) {
+		assert.Equal(t, time.Now().Truncate(time.Hour), hours[0].Hour)
+		assert.Equal(t, 3, hours[0].Logins)
+		assert.Equal(t, 2, hours[0].UniqueUsers)
+		assert.Equal(t, 1, hours[0].RefreshFailures)
+		assert.Equal(t, 2, hours[0].Logouts)
+		assert.InDelta(t, 120, hours[0].AverageSessionLength, 1)
+	}
+}
+
+func TestSessionStatsRetention(t *testing.T) {
+	stats := newSessionStats()
+	now := time.Now()
+	stats.current(now.Add(-30*time.Hour)).logins++
+	stats.current(now.Add(-2*time.Hour)).logins++
+	stats.current(now).logins++
+
+	hours := stats.hours()
+	if assert.Len(t, hours, 2) {
+		assert.True(t, hours[0].Hour.After(hours[1].Hour))
+	}
+}
+
+func TestSessionsHandler(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableSessionStats = true
+	config.AdminRoles = []string{fakeAdminRole}
+	_, idp, svc := newTestProxyService(config)
+
+	_, err := makeTestOauthLogin(svc + "/admin")
+	assert.NoError(t, err)
+
+	token := newTestToken(idp.getLocation())
+	token.setRealmsRoles([]string{fakeAdminRole})
+	signed, _ := idp.signToken(token.claims)
+	var hours []sessionStatsHour
+	resp, err := resty.New().SetAuthToken(signed.Encode()).R().SetResult(&hours).Get(svc + oauthURL + adminURL + sessionsURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	if assert.Len(t, hours, 1) {
+		assert.Equal(t, 1, hours[0].Logins)
+		assert.Equal(t, 1, hours[0].UniqueUsers)
+	}
+}
@@ -17,16 +17,31 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
 	dbName = "keycloak"
+	// dbExpiryName is the bucket holding the time the keys expire, as boltdb has no expiration of the keys
+	dbExpiryName = "keycloak-expiry"
+	// boltdbTimeout is how long we wait for the lock on the file
+	boltdbTimeout = 10 * time.Second
+	// boltdbExpiryInterval is the default interval the expired keys are removed
+	boltdbExpiryInterval = time.Minute
+	// boltdbCompactionInterval is the default interval the file is checked for compaction
+	boltdbCompactionInterval = time.Hour
+	// boltdbCompactionMinSize is the size below which the file isn't worth compacting
+	boltdbCompactionMinSize = 1 << 20
 )
 
 var (
@@ -34,63 +49,226 @@ var (
 	ErrNoBoltdbBucket = errors.New("the boltdb bucket does not exists")
 )
 
-// A local file store used to hold the refresh tokens
+// A local file store used to hold the refresh tokens. The keys added with an expiration are removed once expired
+// by a background reaper, and the file is compacted once it's mostly free pages, as boltdb never shrinks the file
 type boltdbStore struct {
+	// the lock protecting the client while it's replaced by a compaction
+	sync.RWMutex
+	// the client of the file
 	client *bolt.DB
+	// the path of the file
+	path string
+	// the interval the file is checked for compaction, zero disables
+	compaction time.Duration
+	// the metrics of the store
+	metrics *boltdbMetrics
+	// closed to stop the maintenance of the store
+	stop chan struct{}
+	// closed once the maintenance has stopped
+	done chan struct{}
 }
 
+// boltdbMetrics are the metrics of the boltdb stores
+type boltdbMetrics struct {
+	// the keys in the store
+	keys prometheus.Gauge
+	// the size of the file
+	size prometheus.Gauge
+	// the bytes of the file in free pages
+	free prometheus.Gauge
+	// the keys removed once expired
+	expired prometheus.Counter
+	// the compactions of the file
+	compactions *prometheus.CounterVec
+}
+
+// newBoltDBStore creates the store in the file of the path, with the query options the expiry-interval the
+// expired keys are removed and the compaction-interval the file is checked for compaction, zero disabling it
 func newBoltDBStore(location *url.URL) (storage, error) {
 	// step: drop the initial slash
 	path := strings.TrimPrefix(location.Path, "/")
 
+	query := location.Query()
+	expiry := boltdbExpiryInterval
+	if v := query.Get("expiry-interval"); v != "" {
+		var err error
+		if expiry, err = time.ParseDuration(v); err != nil || expiry <= 0 {
+			return nil, fmt.Errorf("the boltdb expiry interval: %s must be a positive duration", v)
+		}
+	}
+	compaction := boltdbCompactionInterval
+	if v := query.Get("compaction-interval"); v != "" {
+		var err error
+		if compaction, err = time.ParseDuration(v); err != nil || compaction < 0 {
+			return nil, fmt.Errorf("the boltdb compaction interval: %s must be a duration", v)
+		}
+	}
+
 	log.Infof("creating the bolddb store, file: %s", path)
-	db, err := bolt.Open(path, 0600, &bolt.Options{
-		Timeout: time.Duration(10 * time.Second),
+	db, err := openBoltDB(path)
+	if err != nil {
+		return nil, err
+	}
+	store := &boltdbStore{
+		client:     db,
+		path:       path,
+		compaction: compaction,
+		metrics:    newBoltDBMetrics(),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go store.maintain(expiry)
+
+	return store, nil
+}
+
+// newBoltDBMetrics creates and registers the metrics of the boltdb stores
+func newBoltDBMetrics() *boltdbMetrics {
+	keys := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "store_boltdb_keys",
+		Help: "The keys held in the boltdb store",
 	})
+	size := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "store_boltdb_size_bytes",
+		Help: "The size of the file of the boltdb store",
+	})
+	free := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "store_boltdb_free_bytes",
+		Help: "The bytes of the file of the boltdb store in free pages, reclaimed by a compaction",
+	})
+	expired := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "store_boltdb_expired_keys_total",
+		Help: "The keys removed from the boltdb store once expired",
+	})
+	compactions := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "store_boltdb_compactions_total",
+			Help: "The compactions of the file of the boltdb store partitioned by result",
+		},
+		[]string{"result"},
+	)
+
+	return &boltdbMetrics{
+		keys:        prometheus.MustRegisterOrGet(keys).(prometheus.Gauge),
+		size:        prometheus.MustRegisterOrGet(size).(prometheus.Gauge),
+		free:        prometheus.MustRegisterOrGet(free).(prometheus.Gauge),
+		expired:     prometheus.MustRegisterOrGet(expired).(prometheus.Counter),
+		compactions: prometheus.MustRegisterOrGet(compactions).(*prometheus.CounterVec),
+	}
+}
+
+// openBoltDB opens the file and creates the buckets
+func openBoltDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltdbTimeout})
 	if err != nil {
 		return nil, err
 	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{dbName, dbExpiryName} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	// step: create the bucket
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, e := tx.CreateBucketIfNotExists([]byte(dbName))
-		return e
+	return db, nil
+}
+
+// getBoltDBBuckets returns the bucket of the keys and the bucket of their expiration
+func getBoltDBBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
+	bucket, expiry := tx.Bucket([]byte(dbName)), tx.Bucket([]byte(dbExpiryName))
+	if bucket == nil || expiry == nil {
+		return nil, nil, ErrNoBoltdbBucket
+	}
+
+	return bucket, expiry, nil
+}
+
+// isBoltDBKeyExpired checks if the key has expired
+func isBoltDBKeyExpired(expiry *bolt.Bucket, key []byte, now time.Time) bool {
+	value := expiry.Get(key)
+	if value == nil {
+		return false
+	}
+	expires, err := strconv.ParseInt(string(value), 10, 64)
+
+	return err == nil && now.UnixNano() >= expires
+}
+
+// update runs the writable transaction against the buckets
+func (r *boltdbStore) update(fn func(bucket, expiry *bolt.Bucket) error) error {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.client.Update(func(tx *bolt.Tx) error {
+		bucket, expiry, err := getBoltDBBuckets(tx)
+		if err != nil {
+			return err
+		}
+		return fn(bucket, expiry)
 	})
+}
 
-	return &boltdbStore{
-		client: db,
-	}, err
+// view runs the read only transaction against the buckets
+func (r *boltdbStore) view(fn func(bucket, expiry *bolt.Bucket) error) error {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.client.View(func(tx *bolt.Tx) error {
+		bucket, expiry, err := getBoltDBBuckets(tx)
+		if err != nil {
+			return err
+		}
+		return fn(bucket, expiry)
+	})
 }
 
 // Set adds a token to the store
-func (r boltdbStore) Set(key, value string) error {
+func (r *boltdbStore) Set(key, value string) error {
 	log.WithFields(log.Fields{
-		"key":   key,
-		"value": value,
+		"key": key,
 	}).Debugf("adding the key: %s in store", key)
 
-	return r.client.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(dbName))
-		if bucket == nil {
-			return ErrNoBoltdbBucket
+	return r.update(func(bucket, expiry *bolt.Bucket) error {
+		if err := expiry.Delete([]byte(key)); err != nil {
+			return err
 		}
 		return bucket.Put([]byte(key), []byte(value))
 	})
 }
 
-// Get retrieves a token from the store
-func (r boltdbStore) Get(key string) (string, error) {
+// SetWithExpiration adds a token to the store, removed by the reaper once expired
+func (r *boltdbStore) SetWithExpiration(key, value string, expiration time.Duration) error {
+	log.WithFields(log.Fields{
+		"key":        key,
+		"expiration": expiration.String(),
+	}).Debugf("adding the key: %s in store", key)
+
+	expires := strconv.FormatInt(time.Now().Add(expiration).UnixNano(), 10)
+
+	return r.update(func(bucket, expiry *bolt.Bucket) error {
+		if err := expiry.Put([]byte(key), []byte(expires)); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), []byte(value))
+	})
+}
+
+// Get retrieves a token from the store, the keys expired but yet to be removed are not found
+func (r *boltdbStore) Get(key string) (string, error) {
 	log.WithFields(log.Fields{
 		"key": key,
 	}).Debugf("retrieving the key: %s from store", key)
 
 	var value string
-	err := r.client.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(dbName))
-		if bucket == nil {
-			return ErrNoBoltdbBucket
+	err := r.view(func(bucket, expiry *bolt.Bucket) error {
+		if !isBoltDBKeyExpired(expiry, []byte(key), time.Now()) {
+			value = string(bucket.Get([]byte(key)))
 		}
-		value = string(bucket.Get([]byte(key)))
 		return nil
 	})
 
@@ -98,22 +276,216 @@ func (r boltdbStore) Get(key string) (string, error) {
 }
 
 // Delete removes the key from the bucket
-func (r boltdbStore) Delete(key string) error {
+func (r *boltdbStore) Delete(key string) error {
 	log.WithFields(log.Fields{
 		"key": key,
 	}).Debugf("deleting the key: %s from store", key)
 
-	return r.client.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(dbName))
-		if bucket == nil {
-			return ErrNoBoltdbBucket
+	return r.update(func(bucket, expiry *bolt.Bucket) error {
+		if err := expiry.Delete([]byte(key)); err != nil {
+			return err
 		}
 		return bucket.Delete([]byte(key))
 	})
 }
 
+// Increment adds one to the counter, an expired counter starting again, and expires it after the duration
+func (r *boltdbStore) Increment(key string, expiration time.Duration) (int64, error) {
+	var count int64
+	err := r.update(func(bucket, expiry *bolt.Bucket) error {
+		now := time.Now()
+		if !isBoltDBKeyExpired(expiry, []byte(key), now) {
+			count, _ = strconv.ParseInt(string(bucket.Get([]byte(key))), 10, 64)
+		}
+		count++
+		if err := expiry.Put([]byte(key), []byte(strconv.FormatInt(now.Add(expiration).UnixNano(), 10))); err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(key), []byte(strconv.FormatInt(count, 10)))
+	})
+
+	return count, err
+}
+
+// List returns the keys with the prefix and their values, the keys are ordered so the cursor starts at the prefix
+func (r *boltdbStore) List(prefix string) (map[string]string, error) {
+	items := make(map[string]string)
+	err := r.view(func(bucket, expiry *bolt.Bucket) error {
+		now := time.Now()
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = cursor.Next() {
+			if !isBoltDBKeyExpired(expiry, k, now) {
+				items[string(k)] = string(v)
+			}
+		}
+		return nil
+	})
+
+	return items, err
+}
+
 // Close closes of any open resources
-func (r boltdbStore) Close() error {
+func (r *boltdbStore) Close() error {
 	log.Infof("closing the resourcese for boltdb store")
+	close(r.stop)
+	<-r.done
+	r.Lock()
+	defer r.Unlock()
+
 	return r.client.Close()
 }
+
+// maintain removes the expired keys on the interval, compacting the file when due, until the store is closed
+func (r *boltdbStore) maintain(interval time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastCompaction := time.Now()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			if err := r.expire(now); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to remove the expired keys from the boltdb store")
+			}
+			if r.compaction > 0 && now.Sub(lastCompaction) >= r.compaction {
+				lastCompaction = now
+				if r.shouldCompact() {
+					r.compact()
+				}
+			}
+			r.updateMetrics()
+		}
+	}
+}
+
+// expire removes the keys expired by now
+func (r *boltdbStore) expire(now time.Time) error {
+	var removed int
+	err := r.update(func(bucket, expiry *bolt.Bucket) error {
+		// step: the keys are collected first, as a cursor can't be relied on once we start deleting
+		var keys [][]byte
+		expiry.ForEach(func(k, v []byte) error {
+			if isBoltDBKeyExpired(expiry, k, now) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			if err := expiry.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+	if err == nil {
+		r.metrics.expired.Add(float64(removed))
+	}
+
+	return err
+}
+
+// shouldCompact checks if the file is large enough and mostly free pages, which only a compaction reclaims
+func (r *boltdbStore) shouldCompact() bool {
+	r.RLock()
+	defer r.RUnlock()
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+
+	return info.Size() >= boltdbCompactionMinSize && int64(r.client.Stats().FreeAlloc)*2 >= info.Size()
+}
+
+// compact rewrites the keys into a new file, replacing the file of the store. The store is locked throughout, so
+// the requests wait on the compaction, and on a failure the existing file is reopened
+func (r *boltdbStore) compact() error {
+	r.Lock()
+	defer r.Unlock()
+	start := time.Now()
+	err := func() error {
+		temp := r.path + ".compact"
+		os.Remove(temp)
+		if err := copyBoltDB(r.client, temp); err != nil {
+			os.Remove(temp)
+			return err
+		}
+		if err := r.client.Close(); err != nil {
+			os.Remove(temp)
+			return err
+		}
+		renamed := os.Rename(temp, r.path)
+		if renamed != nil {
+			os.Remove(temp)
+		}
+		db, err := openBoltDB(r.path)
+		if err != nil {
+			return err
+		}
+		r.client = db
+
+		return renamed
+	}()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Errorf("unable to compact the boltdb store")
+		r.metrics.compactions.WithLabelValues("error").Inc()
+		return err
+	}
+	log.WithFields(log.Fields{
+		"duration": time.Since(start).String(),
+		"file":     r.path,
+	}).Infof("compacted the boltdb store")
+	r.metrics.compactions.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+// copyBoltDB copies the buckets into a new file, filling the pages as the keys are added in order
+func copyBoltDB(db *bolt.DB, path string) error {
+	target, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltdbTimeout})
+	if err != nil {
+		return err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		return target.Update(func(ttx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, source *bolt.Bucket) error {
+				bucket, err := ttx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+				bucket.FillPercent = 1.0
+				return source.ForEach(func(k, v []byte) error {
+					return bucket.Put(k, v)
+				})
+			})
+		})
+	})
+	if closed := target.Close(); err == nil {
+		err = closed
+	}
+
+	return err
+}
+
+// updateMetrics updates the keys and file size of the store
+func (r *boltdbStore) updateMetrics() {
+	r.RLock()
+	defer r.RUnlock()
+	r.client.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(dbName)); bucket != nil {
+			r.metrics.keys.Set(float64(bucket.Stats().KeyN))
+		}
+		return nil
+	})
+	if info, err := os.Stat(r.path); err == nil {
+		r.metrics.size.Set(float64(info.Size()))
+	}
+	r.metrics.free.Set(float64(r.client.Stats().FreeAlloc))
+}
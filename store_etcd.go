@@ -0,0 +1,423 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// etcdTimeout is the default timeout of a request to etcd
+	etcdTimeout = 5 * time.Second
+	// etcdMaxResponseSize is the largest response read from etcd
+	etcdMaxResponseSize = 4 << 20
+)
+
+// etcdStore is a store over the json gateway of the etcd v3 api, the keys added with an expiration are attached to
+// a lease of the duration, so etcd removes them once the refresh token has expired
+type etcdStore struct {
+	sync.Mutex
+	// the client of the requests
+	client *http.Client
+	// the endpoints of the members
+	endpoints []string
+	// the index of the endpoint last used successfully
+	current int
+	// the prefix added to the keys, sharing an etcd between proxies
+	prefix string
+	// the credentials of the user, if any
+	username, password string
+	// the lock serializing the authentication of the user
+	tokenLock sync.Mutex
+	// the authentication token of the user
+	token string
+}
+
+// etcdKeyValue is a key and its value in a range response
+type etcdKeyValue struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+// etcdError is the error of a failed request
+type etcdError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Error   string `json:"error"`
+}
+
+// newEtcdStore creates a new etcd store from a comma separated list of members, over tls for etcds, with the query
+// options the prefix of the keys, the ca-certificate of the members and the timeout of the requests
+func newEtcdStore(location *url.URL) (storage, error) {
+	log.Infof("creating a etcd client for store: %s", location.Host)
+
+	query := location.Query()
+	timeout := etcdTimeout
+	if v := query.Get("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("the etcd timeout: %s must be a positive duration", v)
+		}
+	}
+	scheme := "http"
+	transport := &http.Transport{MaxIdleConnsPerHost: 10}
+	if location.Scheme == "etcds" {
+		scheme = "https"
+		// notes: the server name is taken from the endpoint by the transport
+		config, err := getStoreTLSConfig("", query.Get("ca-certificate"))
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = config
+	}
+	store := &etcdStore{
+		client: &http.Client{Transport: transport, Timeout: timeout},
+		prefix: query.Get("prefix"),
+	}
+	for _, addr := range strings.Split(location.Host, ",") {
+		if addr == "" {
+			return nil, errors.New("the etcd addresses cannot be empty")
+		}
+		store.endpoints = append(store.endpoints, scheme+"://"+addr)
+	}
+	if location.User != nil {
+		store.username = location.User.Username()
+		store.password, _ = location.User.Password()
+	}
+
+	return store, nil
+}
+
+// encodeEtcdKey encodes a key or value as the json gateway expects the bytes
+func encodeEtcdKey(v string) string {
+	return base64.StdEncoding.EncodeToString([]byte(v))
+}
+
+// Set adds a token to the store
+func (r *etcdStore) Set(key, value string) error {
+	log.WithFields(log.Fields{
+		"key": key,
+	}).Debugf("adding the key: %s to the store", key)
+
+	return r.do("/v3/kv/put", map[string]string{
+		"key":   encodeEtcdKey(r.prefix + key),
+		"value": encodeEtcdKey(value),
+	}, nil)
+}
+
+// SetWithExpiration adds a token to the store, attached to a lease expiring with it
+func (r *etcdStore) SetWithExpiration(key, value string, expiration time.Duration) error {
+	log.WithFields(log.Fields{
+		"key":        key,
+		"expiration": expiration.String(),
+	}).Debugf("adding the key: %s to the store", key)
+
+	lease, err := r.grantLease(expiration)
+	if err != nil {
+		return err
+	}
+
+	return r.do("/v3/kv/put", map[string]string{
+		"key":   encodeEtcdKey(r.prefix + key),
+		"value": encodeEtcdKey(value),
+		"lease": lease,
+	}, nil)
+}
+
+// Get retrieves a token from the store
+func (r *etcdStore) Get(key string) (string, error) {
+	log.WithFields(log.Fields{
+		"key": key,
+	}).Debugf("retrieving the key: %s from store", key)
+
+	kv, err := r.get(key)
+	if err != nil || kv == nil {
+		return "", err
+	}
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return "", fmt.Errorf("invalid value of the etcd key: %s", key)
+	}
+
+	return string(value), nil
+}
+
+// Delete remove the key
+func (r *etcdStore) Delete(key string) error {
+	log.WithFields(log.Fields{
+		"key": key,
+	}).Debugf("deleting the key: %s from store", key)
+
+	return r.do("/v3/kv/deleterange", map[string]string{"key": encodeEtcdKey(r.prefix + key)}, nil)
+}
+
+// Increment adds one to the counter, attaching it to a new lease of the expiration. etcd has no increment, so the
+// counter is updated by a transaction on the revision of the key, retried should another instance update it first
+func (r *etcdStore) Increment(key string, expiration time.Duration) (int64, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		var count int64
+		// step: an absent key has a revision of zero
+		revision := "0"
+		kv, err := r.get(key)
+		if err != nil {
+			return 0, err
+		}
+		if kv != nil {
+			value, _ := base64.StdEncoding.DecodeString(kv.Value)
+			if count, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+				return 0, fmt.Errorf("the etcd key: %s is not a counter", key)
+			}
+			revision = kv.ModRevision
+		}
+		lease, err := r.grantLease(expiration)
+		if err != nil {
+			return 0, err
+		}
+		encoded := encodeEtcdKey(r.prefix + key)
+		request := map[string]interface{}{
+			"compare": []map[string]string{
+				{"key": encoded, "target": "MOD", "result": "EQUAL", "mod_revision": revision},
+			},
+			"success": []map[string]interface{}{
+				{"request_put": map[string]string{
+					"key":   encoded,
+					"value": encodeEtcdKey(strconv.FormatInt(count+1, 10)),
+					"lease": lease,
+				}},
+			},
+		}
+		response := struct {
+			Succeeded bool `json:"succeeded"`
+		}{}
+		if err := r.do("/v3/kv/txn", request, &response); err != nil {
+			return 0, err
+		}
+		if response.Succeeded {
+			return count + 1, nil
+		}
+	}
+
+	return 0, errors.New("unable to increment the etcd counter, too much contention")
+}
+
+// List returns the keys with the prefix and their values, the range ends at the prefix with the last byte
+// incremented, which etcd takes to be every key starting with it
+func (r *etcdStore) List(prefix string) (map[string]string, error) {
+	response := struct {
+		KVs []etcdKeyValue `json:"kvs"`
+	}{}
+	if err := r.do("/v3/kv/range", map[string]string{
+		"key":       encodeEtcdKey(r.prefix + prefix),
+		"range_end": encodeEtcdKey(getEtcdRangeEnd(r.prefix + prefix)),
+	}, &response); err != nil {
+		return nil, err
+	}
+	items := make(map[string]string, len(response.KVs))
+	for _, kv := range response.KVs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return nil, errors.New("invalid key in the etcd range")
+		}
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of the etcd key: %s", key)
+		}
+		items[strings.TrimPrefix(string(key), r.prefix)] = string(value)
+	}
+
+	return items, nil
+}
+
+// getEtcdRangeEnd returns the end of the range covering the keys with the prefix; the bytes of 0xff can't be
+// incremented so are dropped, and no prefix at all is the whole keyspace, a range end of a zero byte
+func getEtcdRangeEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+
+	return "\x00"
+}
+
+// Close closes of any open resources
+func (r *etcdStore) Close() error {
+	log.Infof("closing the resources for etcd store")
+	if transport, ok := r.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+
+	return nil
+}
+
+// get retrieves the key and its revision from the store, nil if not found
+func (r *etcdStore) get(key string) (*etcdKeyValue, error) {
+	response := struct {
+		KVs []etcdKeyValue `json:"kvs"`
+	}{}
+	if err := r.do("/v3/kv/range", map[string]string{"key": encodeEtcdKey(r.prefix + key)}, &response); err != nil {
+		return nil, err
+	}
+	if len(response.KVs) == 0 {
+		return nil, nil
+	}
+
+	return &response.KVs[0], nil
+}
+
+// grantLease grants a lease of the duration, rounded up to a second
+func (r *etcdStore) grantLease(ttl time.Duration) (string, error) {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	response := struct {
+		ID string `json:"ID"`
+	}{}
+	if err := r.do("/v3/lease/grant", map[string]interface{}{"TTL": seconds}, &response); err != nil {
+		return "", err
+	}
+	if response.ID == "" {
+		return "", errors.New("etcd granted no lease")
+	}
+
+	return response.ID, nil
+}
+
+// do posts the request to the members, starting with the last to answer, and decodes the response. The token of
+// the user is acquired on the first request and again when etcd no longer accepts it
+func (r *etcdStore) do(path string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		token, err := r.getToken(false)
+		if err != nil {
+			return err
+		}
+		content, code, err := r.post(path, token, body)
+		if err != nil {
+			return err
+		}
+		if code == http.StatusOK {
+			if response == nil {
+				return nil
+			}
+			return json.Unmarshal(content, response)
+		}
+		failure := etcdError{}
+		json.Unmarshal(content, &failure)
+		message := defaultTo(failure.Message, failure.Error)
+		// step: the tokens of etcd expire, in which case we authenticate again and retry
+		if r.username != "" && attempt == 0 && (code == http.StatusUnauthorized || strings.Contains(message, "invalid auth token")) {
+			if _, err := r.getToken(true); err != nil {
+				return err
+			}
+			continue
+		}
+
+		return fmt.Errorf("etcd request: %s failed, code: %d, error: %s", path, code, defaultTo(message, string(content)))
+	}
+
+	return fmt.Errorf("etcd request: %s was not authorized", path)
+}
+
+// getToken returns the authentication token of the user, authenticating if we have none or are told to
+func (r *etcdStore) getToken(renew bool) (string, error) {
+	if r.username == "" {
+		return "", nil
+	}
+	r.tokenLock.Lock()
+	defer r.tokenLock.Unlock()
+	if r.token != "" && !renew {
+		return r.token, nil
+	}
+	body, _ := json.Marshal(map[string]string{"name": r.username, "password": r.password})
+	content, code, err := r.post("/v3/auth/authenticate", "", body)
+	if err != nil {
+		return "", err
+	}
+	response := struct {
+		Token string `json:"token"`
+	}{}
+	if code != http.StatusOK || json.Unmarshal(content, &response) != nil || response.Token == "" {
+		return "", fmt.Errorf("unable to authenticate to etcd as: %s, code: %d", r.username, code)
+	}
+	r.token = response.Token
+
+	return r.token, nil
+}
+
+// post sends the request to the members in turn until one answers, the members failing to answer or answering
+// that they are unavailable are skipped
+func (r *etcdStore) post(path, token string, body []byte) ([]byte, int, error) {
+	r.Lock()
+	current := r.current
+	r.Unlock()
+
+	var lastErr error
+	for i := 0; i < len(r.endpoints); i++ {
+		index := (current + i) % len(r.endpoints)
+		req, err := http.NewRequest(http.MethodPost, r.endpoints[index]+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set(authorizationHeader, token)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(resp.Body, etcdMaxResponseSize))
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			lastErr = fmt.Errorf("the etcd member: %s is unavailable", r.endpoints[index])
+			continue
+		}
+		r.Lock()
+		r.current = index
+		r.Unlock()
+
+		return content, resp.StatusCode, nil
+	}
+
+	return nil, 0, lastErr
+}
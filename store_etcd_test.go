@@ -0,0 +1,300 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEtcdServer serves enough of the json gateway of the etcd v3 api for the store
+type fakeEtcdServer struct {
+	sync.Mutex
+	// the keys held
+	items map[string]string
+	// the revision of the keys
+	revisions map[string]int64
+	// the lease of the keys
+	leases map[string]int64
+	// the ttl of the leases granted
+	ttls map[int64]int64
+	// the revision of the store
+	revision int64
+	// the credentials of the user, if any
+	username, password string
+	// the tokens issued
+	tokens map[string]bool
+	// the requests received
+	requests []string
+}
+
+func newFakeEtcdServer() *fakeEtcdServer {
+	return &fakeEtcdServer{
+		items:     make(map[string]string),
+		revisions: make(map[string]int64),
+		leases:    make(map[string]int64),
+		ttls:      make(map[int64]int64),
+		tokens:    make(map[string]bool),
+	}
+}
+
+func (r *fakeEtcdServer) getItem(key string) (string, int64) {
+	r.Lock()
+	defer r.Unlock()
+	lease := r.leases[key]
+
+	return r.items[key], r.ttls[lease]
+}
+
+func (r *fakeEtcdServer) put(key, value, lease string) {
+	r.revision++
+	r.items[key] = value
+	r.revisions[key] = r.revision
+	r.leases[key], _ = strconv.ParseInt(lease, 10, 64)
+}
+
+func (r *fakeEtcdServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	r.requests = append(r.requests, req.URL.Path)
+	decode := func(v string) string {
+		d, _ := base64.StdEncoding.DecodeString(v)
+		return string(d)
+	}
+	encode := func(v string) string { return base64.StdEncoding.EncodeToString([]byte(v)) }
+	request := make(map[string]interface{})
+	json.NewDecoder(req.Body).Decode(&request)
+	reply := func(code int, v interface{}) {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	if req.URL.Path == "/v3/auth/authenticate" {
+		if request["name"] != r.username || request["password"] != r.password {
+			reply(http.StatusBadRequest, map[string]interface{}{"code": 3, "message": "etcdserver: authentication failed"})
+			return
+		}
+		token := getRandomString(16)
+		r.tokens[token] = true
+		reply(http.StatusOK, map[string]string{"token": token})
+		return
+	}
+	if r.username != "" && !r.tokens[req.Header.Get(authorizationHeader)] {
+		reply(http.StatusBadRequest, map[string]interface{}{"code": 3, "message": "etcdserver: invalid auth token"})
+		return
+	}
+
+	switch req.URL.Path {
+	case "/v3/kv/put":
+		lease, _ := request["lease"].(string)
+		r.put(decode(request["key"].(string)), decode(request["value"].(string)), lease)
+		reply(http.StatusOK, map[string]interface{}{})
+	case "/v3/kv/range":
+		key := decode(request["key"].(string))
+		end, _ := request["range_end"].(string)
+		var kvs []map[string]string
+		for k, value := range r.items {
+			if k == key || (end != "" && k >= key && k < decode(end)) {
+				kvs = append(kvs, map[string]string{
+					"key":          encode(k),
+					"value":        encode(value),
+					"mod_revision": strconv.FormatInt(r.revisions[k], 10),
+				})
+			}
+		}
+		if len(kvs) == 0 {
+			reply(http.StatusOK, map[string]interface{}{})
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{"kvs": kvs})
+	case "/v3/kv/deleterange":
+		key := decode(request["key"].(string))
+		delete(r.items, key)
+		delete(r.revisions, key)
+		reply(http.StatusOK, map[string]interface{}{})
+	case "/v3/kv/txn":
+		compare := request["compare"].([]interface{})[0].(map[string]interface{})
+		key := decode(compare["key"].(string))
+		if compare["mod_revision"] != strconv.FormatInt(r.revisions[key], 10) {
+			reply(http.StatusOK, map[string]interface{}{"succeeded": false})
+			return
+		}
+		put := request["success"].([]interface{})[0].(map[string]interface{})["request_put"].(map[string]interface{})
+		r.put(key, decode(put["value"].(string)), put["lease"].(string))
+		reply(http.StatusOK, map[string]interface{}{"succeeded": true})
+	case "/v3/lease/grant":
+		id := int64(len(r.ttls) + 1)
+		r.ttls[id] = int64(request["TTL"].(float64))
+		reply(http.StatusOK, map[string]string{"ID": strconv.FormatInt(id, 10), "TTL": strconv.FormatInt(r.ttls[id], 10)})
+	default:
+		reply(http.StatusNotFound, map[string]interface{}{"code": 5, "message": "Not Found"})
+	}
+}
+
+func TestEtcdStore(t *testing.T) {
+	fake := newFakeEtcdServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	store, err := createStorage("etcd://" + u.Host + "?prefix=kc/")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer store.Close()
+
+	assert.NoError(t, store.Set("token", "refresh"))
+	value, ttl := fake.getItem("kc/token")
+	assert.Equal(t, "refresh", value)
+	assert.Equal(t, int64(0), ttl)
+	value, err = store.Get("token")
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh", value)
+
+	// step: the keys with an expiration are attached to a lease of the duration
+	assert.NoError(t, store.(storageExpiration).SetWithExpiration("expiring", "refresh", 90*time.Minute+time.Millisecond))
+	value, ttl = fake.getItem("kc/expiring")
+	assert.Equal(t, "refresh", value)
+	assert.Equal(t, int64(5401), ttl)
+
+	assert.NoError(t, store.Delete("token"))
+	value, err = store.Get("token")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+
+	for i := int64(1); i <= 3; i++ {
+		count, err := store.(storageCounter).Increment("count", time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, i, count)
+	}
+	value, ttl = fake.getItem("kc/count")
+	assert.Equal(t, "3", value)
+	assert.Equal(t, int64(60), ttl)
+
+	assert.NoError(t, store.Set("name", "value"))
+	_, err = store.(storageCounter).Increment("name", time.Minute)
+	assert.Error(t, err)
+
+	// step: the listing covers the keys with the prefix, without the prefix of the store
+	assert.NoError(t, store.Set("list/a", "1"))
+	assert.NoError(t, store.Set("list/b", "2"))
+	assert.NoError(t, store.Set("listing", "3"))
+	items, err := store.(storageLister).List("list/")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"list/a": "1", "list/b": "2"}, items)
+}
+
+func TestGetEtcdRangeEnd(t *testing.T) {
+	assert.Equal(t, "kc0", getEtcdRangeEnd("kc/"))
+	assert.Equal(t, "b", getEtcdRangeEnd("a\xff"))
+	assert.Equal(t, "\x00", getEtcdRangeEnd(""))
+}
+
+func TestEtcdStoreAuthentication(t *testing.T) {
+	fake := newFakeEtcdServer()
+	fake.username, fake.password = "proxy", "secret"
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	store, err := createStorage("etcd://proxy:secret@" + u.Host)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, store.Set("token", "refresh"))
+	// step: the token is reused until etcd rejects it
+	assert.NoError(t, store.Set("token", "refresh"))
+	fake.Lock()
+	assert.Equal(t, []string{"/v3/auth/authenticate", "/v3/kv/put", "/v3/kv/put"}, fake.requests)
+	fake.tokens = make(map[string]bool)
+	fake.Unlock()
+	value, err := store.Get("token")
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh", value)
+
+	store, _ = createStorage("etcd://proxy:wrong@" + u.Host)
+	assert.Error(t, store.Set("token", "refresh"))
+}
+
+func TestEtcdStoreEndpoints(t *testing.T) {
+	config, ca := newTestRedisTLS(t)
+	defer os.Remove(ca)
+	fake := newFakeEtcdServer()
+	secure := httptest.NewUnstartedServer(fake)
+	secure.TLS = config
+	secure.StartTLS()
+	defer secure.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	s, _ := url.Parse(secure.URL)
+	a, _ := url.Parse(unavailable.URL)
+
+	// step: the unavailable members are skipped
+	store, err := createStorage("etcds://" + a.Host + "," + s.Host + "?ca-certificate=" + url.QueryEscape(ca))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, store.Set("token", "refresh"))
+	assert.Equal(t, 1, store.(*etcdStore).current)
+
+	// step: the tls connection is verified against the certificate authority
+	store, _ = createStorage("etcds://" + s.Host)
+	assert.Error(t, store.Set("token", "refresh"))
+}
+
+func TestStoreRefreshTokenExpiration(t *testing.T) {
+	fake := newFakeEtcdServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	store, _ := createStorage("etcd://" + u.Host)
+	proxy := &oauthProxy{store: newMetricsStore("etcd", store)}
+
+	token := newTestToken("https://idp").getToken()
+	assert.NoError(t, proxy.StoreRefreshToken(token, "refresh", time.Hour))
+	_, ttl := fake.getItem(getHashKey(&token))
+	assert.Equal(t, int64(3600), ttl)
+	// step: the offline tokens without a session duration don't expire
+	assert.NoError(t, proxy.StoreRefreshToken(token, "refresh", 0))
+	_, ttl = fake.getItem(getHashKey(&token))
+	assert.Equal(t, int64(0), ttl)
+
+}
+
+func TestEtcdStoreInvalid(t *testing.T) {
+	cs := []string{
+		"etcd://127.0.0.1:2379,",
+		"etcd://127.0.0.1:2379?timeout=0s",
+		"etcd://127.0.0.1:2379?timeout=never",
+		"etcds://127.0.0.1:2379?ca-certificate=/does/not/exist",
+	}
+	for i, x := range cs {
+		_, err := createStorage(x)
+		assert.Error(t, err, "case %d, url: %s", i, x)
+	}
+}
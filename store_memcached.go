@@ -0,0 +1,414 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// memcachedPort is the default port of the memcached nodes
+	memcachedPort = "11211"
+	// memcachedTimeout is the default timeout on dialing and on the round trip of a command
+	memcachedTimeout = time.Second
+	// memcachedMaxIdle is the number of idle connections kept per node
+	memcachedMaxIdle = 8
+	// memcachedPoints is the number of points per node on the hash ring, spreading the keys evenly
+	memcachedPoints = 160
+	// memcachedMaxKeySize is the longest key memcached accepts
+	memcachedMaxKeySize = 250
+	// memcachedMaxRelativeTTL is the longest expiration memcached takes as relative, beyond it is a unix time
+	memcachedMaxRelativeTTL = 30 * 24 * time.Hour
+)
+
+// memcachedConn is a connection to a memcached node
+type memcachedConn struct {
+	net.Conn
+	// the reader of the replies
+	reader *bufio.Reader
+}
+
+// memcachedNode is a memcached server and its pool of connections
+type memcachedNode struct {
+	sync.Mutex
+	// the address of the node
+	addr string
+	// the idle connections
+	idle []*memcachedConn
+	// the connections open, idle or in use
+	open int
+}
+
+// memcachedPoint is a point of a node on the hash ring
+type memcachedPoint struct {
+	hash uint32
+	node *memcachedNode
+}
+
+// memcachedStore is a store over one or more memcached nodes, the keys spread across them by consistent hashing so
+// adding or removing a node only moves the keys of its share of the ring
+type memcachedStore struct {
+	// the nodes of the store
+	nodes []*memcachedNode
+	// the points of the nodes on the hash ring, sorted by hash
+	ring []memcachedPoint
+	// the prefix added to the keys, sharing a memcached between proxies
+	prefix string
+	// the expiration of the keys, zero leaves them to the eviction of memcached
+	ttl time.Duration
+	// the timeout of the commands
+	timeout time.Duration
+}
+
+// newMemcachedStore creates a new memcached store from a comma separated list of nodes, with the query options the
+// prefix of the keys, the ttl of the keys and the timeout of the commands
+func newMemcachedStore(location *url.URL) (storage, error) {
+	log.Infof("creating a memcached client for store: %s", location.Host)
+
+	if location.User != nil {
+		return nil, errors.New("the memcached store does not support authentication")
+	}
+	query := location.Query()
+	store := &memcachedStore{prefix: query.Get("prefix"), timeout: memcachedTimeout}
+	if v := query.Get("ttl"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("the memcached ttl: %s must be a positive duration", v)
+		}
+		store.ttl = ttl
+	}
+	if v := query.Get("timeout"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("the memcached timeout: %s must be a positive duration", v)
+		}
+		store.timeout = timeout
+	}
+	for _, addr := range strings.Split(location.Host, ",") {
+		if addr == "" {
+			return nil, errors.New("the memcached addresses cannot be empty")
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, memcachedPort)
+		}
+		node := &memcachedNode{addr: addr}
+		store.nodes = append(store.nodes, node)
+		for i := 0; i < memcachedPoints; i++ {
+			store.ring = append(store.ring, memcachedPoint{
+				hash: crc32.ChecksumIEEE([]byte(addr + "-" + strconv.Itoa(i))),
+				node: node,
+			})
+		}
+	}
+	sort.Slice(store.ring, func(i, j int) bool { return store.ring[i].hash < store.ring[j].hash })
+
+	return store, nil
+}
+
+// getKey returns the key in memcached, hashing the keys too long for memcached or holding spaces or control characters
+func (r *memcachedStore) getKey(key string) string {
+	key = r.prefix + key
+	valid := len(key) <= memcachedMaxKeySize
+	for i := 0; valid && i < len(key); i++ {
+		valid = key[i] > ' ' && key[i] != 0x7f
+	}
+	if !valid {
+		sum := sha256.Sum256([]byte(key))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	return key
+}
+
+// getNode returns the node owning the key, the first point on the ring at or after the hash of the key
+func (r *memcachedStore) getNode(key string) *memcachedNode {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.ring), func(i int) bool { return r.ring[i].hash >= hash })
+	if i == len(r.ring) {
+		i = 0
+	}
+
+	return r.ring[i].node
+}
+
+// getMemcachedExpiration returns the expiration of a key in the protocol, seconds or the unix time beyond thirty days
+func getMemcachedExpiration(ttl time.Duration) int64 {
+	switch {
+	case ttl <= 0:
+		return 0
+	case ttl > memcachedMaxRelativeTTL:
+		return time.Now().Add(ttl).Unix()
+	case ttl < time.Second:
+		return 1
+	}
+
+	return int64(ttl / time.Second)
+}
+
+// do sends the command to the node owning the key and reads the reply, the connection is dropped on any
+// error other than an error reply of memcached
+func (r *memcachedStore) do(key, command string, read func(*bufio.Reader) error) error {
+	node := r.getNode(key)
+	conn, err := node.get(r.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(r.timeout))
+	if _, err = io.WriteString(conn, command); err == nil {
+		err = read(conn.reader)
+	}
+	_, reply := err.(memcachedError)
+	node.release(conn, err == nil || reply)
+
+	return err
+}
+
+// memcachedError is an error reply of memcached
+type memcachedError string
+
+func (e memcachedError) Error() string {
+	return "memcached: " + string(e)
+}
+
+// readMemcachedLine reads a line of the reply, returning the error replies as a memcachedError
+func readMemcachedLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+		return "", memcachedError(line)
+	}
+
+	return line, nil
+}
+
+// expectMemcachedReply reads a line of the reply, which must be one of the expected
+func expectMemcachedReply(reader *bufio.Reader, expected ...string) (string, error) {
+	line, err := readMemcachedLine(reader)
+	if err != nil {
+		return "", err
+	}
+	if !containedIn(line, expected) {
+		return "", fmt.Errorf("unexpected memcached reply: %s", line)
+	}
+
+	return line, nil
+}
+
+// Set adds a token to the store
+func (r *memcachedStore) Set(key, value string) error {
+	log.WithFields(log.Fields{
+		"key": key,
+	}).Debugf("adding the key: %s to the store", key)
+
+	key = r.getKey(key)
+	command := fmt.Sprintf("set %s 0 %d %d\r\n%s\r\n", key, getMemcachedExpiration(r.ttl), len(value), value)
+
+	return r.do(key, command, func(reader *bufio.Reader) error {
+		_, err := expectMemcachedReply(reader, "STORED")
+		return err
+	})
+}
+
+// SetWithExpiration adds a token to the store, expiring with it or the ttl of the store, whichever is sooner
+func (r *memcachedStore) SetWithExpiration(key, value string, expiration time.Duration) error {
+	log.WithFields(log.Fields{
+		"key":        key,
+		"expiration": expiration.String(),
+	}).Debugf("adding the key: %s to the store", key)
+
+	if r.ttl > 0 && r.ttl < expiration {
+		expiration = r.ttl
+	}
+	key = r.getKey(key)
+	command := fmt.Sprintf("set %s 0 %d %d\r\n%s\r\n", key, getMemcachedExpiration(expiration), len(value), value)
+
+	return r.do(key, command, func(reader *bufio.Reader) error {
+		_, err := expectMemcachedReply(reader, "STORED")
+		return err
+	})
+}
+
+// Get retrieves a token from the store
+func (r *memcachedStore) Get(key string) (string, error) {
+	log.WithFields(log.Fields{
+		"key": key,
+	}).Debugf("retrieving the key: %s from store", key)
+
+	var value string
+	key = r.getKey(key)
+	err := r.do(key, "get "+key+"\r\n", func(reader *bufio.Reader) error {
+		line, err := readMemcachedLine(reader)
+		if err != nil || line == "END" {
+			return err
+		}
+		// step: the value is VALUE <key> <flags> <bytes>, the data and the END
+		items := strings.Fields(line)
+		if len(items) < 4 || items[0] != "VALUE" {
+			return fmt.Errorf("unexpected memcached reply: %s", line)
+		}
+		size, err := strconv.Atoi(items[3])
+		if err != nil || size < 0 {
+			return fmt.Errorf("unexpected memcached reply: %s", line)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return err
+		}
+		value = string(data[:size])
+		_, err = expectMemcachedReply(reader, "END")
+
+		return err
+	})
+
+	return value, err
+}
+
+// Delete remove the key
+func (r *memcachedStore) Delete(key string) error {
+	log.WithFields(log.Fields{
+		"key": key,
+	}).Debugf("deleting the key: %s from store", key)
+
+	key = r.getKey(key)
+
+	return r.do(key, "delete "+key+"\r\n", func(reader *bufio.Reader) error {
+		_, err := expectMemcachedReply(reader, "DELETED", "NOT_FOUND")
+		return err
+	})
+}
+
+// Increment adds one to the counter, resetting the expiration of the key. A missing counter is added, which can
+// race another instance adding it, in which case we increment theirs
+func (r *memcachedStore) Increment(key string, expiration time.Duration) (int64, error) {
+	key = r.getKey(key)
+	ttl := getMemcachedExpiration(expiration)
+	for attempt := 0; attempt < 2; attempt++ {
+		var count int64
+		err := r.do(key, "incr "+key+" 1\r\n", func(reader *bufio.Reader) error {
+			line, err := readMemcachedLine(reader)
+			if err != nil || line == "NOT_FOUND" {
+				return err
+			}
+			if count, err = strconv.ParseInt(line, 10, 64); err != nil {
+				return fmt.Errorf("unexpected memcached reply: %s", line)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if count > 0 {
+			err := r.do(key, fmt.Sprintf("touch %s %d\r\n", key, ttl), func(reader *bufio.Reader) error {
+				_, err := expectMemcachedReply(reader, "TOUCHED", "NOT_FOUND")
+				return err
+			})
+			return count, err
+		}
+		var added bool
+		err = r.do(key, fmt.Sprintf("add %s 0 %d 1\r\n1\r\n", key, ttl), func(reader *bufio.Reader) error {
+			line, err := expectMemcachedReply(reader, "STORED", "NOT_STORED")
+			added = line == "STORED"
+			return err
+		})
+		if err != nil || added {
+			return 1, err
+		}
+	}
+
+	return 0, errors.New("unable to increment the memcached counter")
+}
+
+// PoolConnections returns the total and free connections in the pools of the nodes
+func (r *memcachedStore) PoolConnections() (int, int) {
+	var total, free int
+	for _, node := range r.nodes {
+		node.Lock()
+		total += node.open
+		free += len(node.idle)
+		node.Unlock()
+	}
+
+	return total, free
+}
+
+// Close closes of any open resources
+func (r *memcachedStore) Close() error {
+	log.Infof("closing the resources for memcached store")
+	for _, node := range r.nodes {
+		node.Lock()
+		for _, conn := range node.idle {
+			conn.Close()
+		}
+		node.open -= len(node.idle)
+		node.idle = nil
+		node.Unlock()
+	}
+
+	return nil
+}
+
+// get returns an idle connection to the node, else dials a new one
+func (r *memcachedNode) get(timeout time.Duration) (*memcachedConn, error) {
+	r.Lock()
+	if n := len(r.idle); n > 0 {
+		conn := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.Unlock()
+		return conn, nil
+	}
+	r.open++
+	r.Unlock()
+
+	conn, err := net.DialTimeout("tcp", r.addr, timeout)
+	if err != nil {
+		r.Lock()
+		r.open--
+		r.Unlock()
+		return nil, err
+	}
+
+	return &memcachedConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// release returns the connection to the pool, closing it when broken or the pool is full
+func (r *memcachedNode) release(conn *memcachedConn, reusable bool) {
+	r.Lock()
+	defer r.Unlock()
+	if reusable && len(r.idle) < memcachedMaxIdle {
+		r.idle = append(r.idle, conn)
+		return
+	}
+	conn.Close()
+	r.open--
+}
@@ -16,18 +16,48 @@ limitations under the License.
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	redis "gopkg.in/redis.v4"
 )
 
+const (
+	// redisDialTimeout is the timeout on establishing a tls connection to redis, as the client does for tcp
+	redisDialTimeout = 5 * time.Second
+	// redisScanCount is the number of keys a scan is hinted to return a batch
+	redisScanCount = 100
+)
+
+// redisClient is the subset of the standalone, sentinel and cluster clients used by the store
+type redisClient interface {
+	Get(key string) *redis.StringCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	Del(keys ...string) *redis.IntCmd
+	Pipelined(fn func(*redis.Pipeline) error) ([]redis.Cmder, error)
+	Scan(cursor int64, match string, count int64) *redis.ScanCmd
+	PoolStats() *redis.PoolStats
+	Close() error
+}
+
 type redisStore struct {
-	client *redis.Client
+	client redisClient
+	// the prefix added to the keys, sharing a redis between proxies
+	prefix string
 }
 
-// newRedisStore creates a new redis store
+// newRedisStore creates a new redis store, the scheme of the url selects the topology; redis or rediss (tls) for
+// a standalone redis, redis+sentinel for the master named in the path and redis+cluster for a cluster, the latter
+// two with a comma separated list of addresses. The query options are the db, prefix of the keys and ca-certificate
 func newRedisStore(location *url.URL) (storage, error) {
 	log.Infof("creating a redis client for store: %s", location.Host)
 
@@ -36,45 +66,134 @@ func newRedisStore(location *url.URL) (storage, error) {
 	if location.User != nil {
 		password, _ = location.User.Password()
 	}
+	query := location.Query()
+	addrs := strings.Split(location.Host, ",")
+	for _, addr := range addrs {
+		if addr == "" {
+			return nil, errors.New("the redis addresses cannot be empty")
+		}
+	}
+	var db int64
+	if v := query.Get("db"); v != "" {
+		var err error
+		if db, err = strconv.ParseInt(v, 10, 64); err != nil || db < 0 {
+			return nil, fmt.Errorf("the redis db: %s must be a positive number", v)
+		}
+	}
 
-	// step: parse the url notation
-	client := redis.NewClient(&redis.Options{
-		Addr:     location.Host,
-		DB:       0,
-		Password: password,
-	})
+	var client redisClient
+	switch location.Scheme {
+	case "redis", "rediss":
+		if len(addrs) != 1 {
+			return nil, errors.New("a standalone redis has a single address, use redis+sentinel or redis+cluster")
+		}
+		options := &redis.Options{
+			Addr:     addrs[0],
+			DB:       db,
+			Password: password,
+		}
+		if location.Scheme == "rediss" {
+			config, err := getStoreTLSConfig(addrs[0], query.Get("ca-certificate"))
+			if err != nil {
+				return nil, err
+			}
+			options.Dialer = func() (net.Conn, error) {
+				return tls.DialWithDialer(&net.Dialer{Timeout: redisDialTimeout}, "tcp", addrs[0], config)
+			}
+		}
+		client = redis.NewClient(options)
+	case "redis+sentinel":
+		master := strings.Trim(location.Path, "/")
+		if master == "" {
+			return nil, errors.New("the redis sentinel url must have the name of the master, i.e. redis+sentinel://host:26379/mymaster")
+		}
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    master,
+			SentinelAddrs: addrs,
+			DB:            db,
+			Password:      password,
+		})
+	case "redis+cluster":
+		if db != 0 {
+			return nil, errors.New("the redis cluster only supports the db 0")
+		}
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    addrs,
+			Password: password,
+		})
+	case "rediss+sentinel", "rediss+cluster":
+		// notes: the sentinel and cluster clients dial the nodes they discover themselves, over tcp
+		return nil, errors.New("the redis client only supports tls with a standalone redis")
+	default:
+		return nil, fmt.Errorf("unsupported redis topology: %s", location.Scheme)
+	}
 
 	return redisStore{
 		client: client,
+		prefix: query.Get("prefix"),
 	}, nil
 }
 
+// getStoreTLSConfig returns the tls config for the address of a store, verified against the ca if given
+func getStoreTLSConfig(addr, ca string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: host,
+	}
+	if ca != "" {
+		content, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the store certificate authority, error: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("unable to parse the store certificate authority: %s", ca)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
 // Set adds a token to the store
 func (r redisStore) Set(key, value string) error {
 	log.WithFields(log.Fields{
-		"key":   key,
-		"value": value,
+		"key": key,
 	}).Debugf("adding the key: %s to the store", key)
 
-	if err := r.client.Set(key, value, time.Duration(0)); err.Err() != nil {
+	if err := r.client.Set(r.prefix+key, value, time.Duration(0)); err.Err() != nil {
 		return err.Err()
 	}
 
 	return nil
 }
 
+// SetWithExpiration adds a token to the store, expiring with it
+func (r redisStore) SetWithExpiration(key, value string, expiration time.Duration) error {
+	log.WithFields(log.Fields{
+		"key":        key,
+		"expiration": expiration.String(),
+	}).Debugf("adding the key: %s to the store", key)
+
+	return r.client.Set(r.prefix+key, value, expiration).Err()
+}
+
 // Get retrieves a token from the store
 func (r redisStore) Get(key string) (string, error) {
 	log.WithFields(log.Fields{
 		"key": key,
 	}).Debugf("retrieving the key: %s from store", key)
 
-	result := r.client.Get(key)
-	if result.Err() != nil {
-		return "", result.Err()
+	value, err := r.client.Get(r.prefix + key).Result()
+	if err == redis.Nil {
+		return "", nil
 	}
 
-	return result.String(), nil
+	return value, err
 }
 
 // Delete remove the key
@@ -83,7 +202,86 @@ func (r redisStore) Delete(key string) error {
 		"key": key,
 	}).Debugf("deleting the key: %s from store", key)
 
-	return r.client.Del(key).Err()
+	return r.client.Del(r.prefix + key).Err()
+}
+
+// Increment adds one to the counter, resetting the expiration of the key
+func (r redisStore) Increment(key string, expiration time.Duration) (int64, error) {
+	var count *redis.IntCmd
+	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		count = pipe.Incr(r.prefix + key)
+		pipe.Expire(r.prefix+key, expiration)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	return count.Val(), nil
+}
+
+// List returns the keys with the prefix and their values, scanning the keyspace in batches; the scan of a cluster
+// would only reach one of the nodes, so it isn't supported
+func (r redisStore) List(prefix string) (map[string]string, error) {
+	if _, ok := r.client.(*redis.ClusterClient); ok {
+		return nil, errors.New("listing the keys is not supported by a redis cluster")
+	}
+	var keys []string
+	var cursor int64
+	for {
+		var batch []string
+		var err error
+		cursor, batch, err = r.client.Scan(cursor, escapeRedisPattern(r.prefix+prefix)+"*", redisScanCount).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if cursor == 0 {
+			break
+		}
+	}
+
+	items := make(map[string]string, len(keys))
+	if len(keys) == 0 {
+		return items, nil
+	}
+	values := make([]*redis.StringCmd, len(keys))
+	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, key := range keys {
+			values[i] = pipe.Get(key)
+		}
+		return nil
+	}); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	// step: a key may have expired or been deleted since the scan
+	for i, key := range keys {
+		if value, err := values[i].Result(); err == nil {
+			items[strings.TrimPrefix(key, r.prefix)] = value
+		}
+	}
+
+	return items, nil
+}
+
+// escapeRedisPattern escapes the glob characters of a redis match pattern
+func escapeRedisPattern(v string) string {
+	var escaped []rune
+	for _, c := range v {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, c)
+	}
+
+	return string(escaped)
+}
+
+// PoolConnections returns the total and free connections in the pool
+func (r redisStore) PoolConnections() (int, int) {
+	stats := r.client.PoolStats()
+
+	return int(stats.TotalConns), int(stats.FreeConns)
 }
 
 // Close closes of any open resources
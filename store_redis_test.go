@@ -0,0 +1,312 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedisServer speaks enough of the redis protocol for the store, as a standalone, sentinel and cluster node
+type fakeRedisServer struct {
+	sync.Mutex
+	// the listener of the server
+	listener net.Listener
+	// the keys held
+	items map[string]string
+	// the expirations given with the keys, e.g. EX 60
+	expirations map[string]string
+	// the commands received
+	commands []string
+}
+
+func newFakeRedisServer(t *testing.T, config *tls.Config) *fakeRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to create the listener, error: %s", err)
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+	server := &fakeRedisServer{listener: listener, items: make(map[string]string), expirations: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (r *fakeRedisServer) addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedisServer) getCommands() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	return append([]string{}, r.commands...)
+}
+
+func (r *fakeRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readFakeRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, r.reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (r *fakeRedisServer) reply(args []string) string {
+	r.Lock()
+	defer r.Unlock()
+	command := strings.ToUpper(strings.Join(args[:1], ""))
+	r.commands = append(r.commands, command)
+	host, port, _ := net.SplitHostPort(r.addr())
+	bulk := func(v string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v) }
+
+	switch command {
+	case "PING":
+		return "+PONG\r\n"
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		r.items[args[1]] = args[2]
+		delete(r.expirations, args[1])
+		if len(args) == 5 {
+			r.expirations[args[1]] = args[3] + " " + args[4]
+		}
+		return "+OK\r\n"
+	case "GET":
+		if v, found := r.items[args[1]]; found {
+			return bulk(v)
+		}
+		return "$-1\r\n"
+	case "DEL":
+		delete(r.items, args[1])
+		return ":1\r\n"
+	case "INCR":
+		count, _ := strconv.Atoi(r.items[args[1]])
+		r.items[args[1]] = strconv.Itoa(count + 1)
+		return fmt.Sprintf(":%d\r\n", count+1)
+	case "EXPIRE":
+		return ":1\r\n"
+	case "SCAN":
+		// step: the whole keyspace is returned in the one batch, the pattern is always a prefix
+		prefix := strings.Replace(strings.TrimSuffix(args[3], "*"), "\\", "", -1)
+		var keys []string
+		for k := range r.items {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, bulk(k))
+			}
+		}
+		return "*2\r\n" + bulk("0") + fmt.Sprintf("*%d\r\n", len(keys)) + strings.Join(keys, "")
+	case "SENTINEL":
+		// step: we're the master of the sentinel, and the only sentinel
+		if strings.ToLower(args[1]) == "get-master-addr-by-name" {
+			return "*2\r\n" + bulk(host) + bulk(port)
+		}
+		return "*0\r\n"
+	case "SUBSCRIBE":
+		return "*3\r\n" + bulk("subscribe") + bulk(args[1]) + ":1\r\n"
+	case "CLUSTER":
+		// step: we're the only node of the cluster, holding all the slots
+		if strings.ToLower(args[1]) == "slots" {
+			return "*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n" + bulk(host) + ":" + port + "\r\n"
+		}
+		return bulk("cluster_state:ok")
+	}
+
+	return "-ERR unknown command\r\n"
+}
+
+func readFakeRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid command: %q", line)
+	}
+	args := make([]string, count)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+		args[i] = string(value[:size])
+	}
+
+	return args, nil
+}
+
+// newTestRedisTLS returns a server tls config for 127.0.0.1 and the file of its certificate authority
+func newTestRedisTLS(t *testing.T) (*tls.Config, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create the certificate, error: %s", err)
+	}
+	file, _ := ioutil.TempFile("", "redis-ca")
+	pem.Encode(file, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	file.Close()
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, file.Name()
+}
+
+func TestRedisStoreTopologies(t *testing.T) {
+	config, ca := newTestRedisTLS(t)
+	defer os.Remove(ca)
+	plain := newFakeRedisServer(t, nil)
+	defer plain.listener.Close()
+	secure := newFakeRedisServer(t, config)
+	defer secure.listener.Close()
+
+	cs := []struct {
+		Location string
+		Server   *fakeRedisServer
+		Commands []string
+	}{
+		{Location: "redis://:secret@" + plain.addr() + "?db=2&prefix=kc:", Server: plain, Commands: []string{"AUTH", "SELECT"}},
+		{Location: "rediss://" + secure.addr() + "?prefix=kc:&ca-certificate=" + url.QueryEscape(ca), Server: secure},
+		{Location: "redis+sentinel://" + plain.addr() + "/mymaster?prefix=kc:", Server: plain, Commands: []string{"SENTINEL"}},
+		{Location: "redis+cluster://" + plain.addr() + "?prefix=kc:", Server: plain, Commands: []string{"CLUSTER"}},
+	}
+	for i, c := range cs {
+		store, err := createStorage(c.Location)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.NoError(t, store.Set("token", "refresh"), "case %d", i)
+		c.Server.Lock()
+		assert.Equal(t, "refresh", c.Server.items["kc:token"], "case %d", i)
+		c.Server.Unlock()
+
+		// step: the keys with an expiration are set with a ttl
+		assert.NoError(t, store.(storageExpiration).SetWithExpiration("session", "tokens", time.Minute), "case %d", i)
+		c.Server.Lock()
+		assert.Equal(t, "tokens", c.Server.items["kc:session"], "case %d", i)
+		assert.Equal(t, "EX 60", c.Server.expirations["kc:session"], "case %d", i)
+		c.Server.Unlock()
+		value, err := store.Get("token")
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, "refresh", value, "case %d", i)
+
+		count, err := store.(storageCounter).Increment("count", time.Minute)
+		assert.NoError(t, err, "case %d", i)
+		assert.True(t, count > 0, "case %d", i)
+
+		assert.NoError(t, store.Delete("token"), "case %d", i)
+		value, err = store.Get("token")
+		assert.NoError(t, err, "case %d", i)
+		assert.Empty(t, value, "case %d", i)
+
+		// step: the keys are listed by a scan, bar on a cluster where the scan would only reach the one node
+		assert.NoError(t, store.Set("list/a", "1"), "case %d", i)
+		items, err := store.(storageLister).List("list/")
+		if strings.HasPrefix(c.Location, "redis+cluster") {
+			assert.Error(t, err, "case %d", i)
+		} else {
+			assert.NoError(t, err, "case %d", i)
+			assert.Equal(t, map[string]string{"list/a": "1"}, items, "case %d", i)
+		}
+		assert.NoError(t, store.Delete("list/a"), "case %d", i)
+		for _, x := range c.Commands {
+			assert.Contains(t, c.Server.getCommands(), x, "case %d", i)
+		}
+		store.Close()
+	}
+
+	// step: the tls connection is verified against the certificate authority
+	store, err := createStorage("rediss://" + secure.addr())
+	if assert.NoError(t, err) {
+		assert.Error(t, store.Set("token", "refresh"))
+		store.Close()
+	}
+}
+
+func TestEscapeRedisPattern(t *testing.T) {
+	assert.Equal(t, "kc:active/", escapeRedisPattern("kc:active/"))
+	assert.Equal(t, `a\*b\?\[c\]\\`, escapeRedisPattern(`a*b?[c]\`))
+}
+
+func TestRedisStoreInvalid(t *testing.T) {
+	cs := []string{
+		"redis://127.0.0.1:6379,127.0.0.2:6379",
+		"redis://127.0.0.1:6379?db=-1",
+		"redis://127.0.0.1:6379?db=one",
+		"redis+sentinel://127.0.0.1:26379",
+		"redis+cluster://127.0.0.1:1?db=1",
+		"redis+cluster://127.0.0.1:1,",
+		"rediss+sentinel://127.0.0.1:26379/mymaster",
+		"rediss+cluster://127.0.0.1:6379",
+		"rediss://127.0.0.1:6379?ca-certificate=/does/not/exist",
+	}
+	for i, x := range cs {
+		_, err := createStorage(x)
+		assert.Error(t, err, "case %d, url: %s", i, x)
+	}
+}
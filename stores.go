@@ -18,9 +18,12 @@ package main
 import (
 	"fmt"
 	"net/url"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/coreos/go-oidc/jose"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // createStorage creates the store client for use
@@ -33,8 +36,12 @@ func createStorage(location string) (storage, error) {
 		return nil, err
 	}
 	switch u.Scheme {
-	case "redis":
+	case "redis", "rediss", "redis+sentinel", "rediss+sentinel", "redis+cluster", "rediss+cluster":
 		store, err = newRedisStore(u)
+	case "memcached":
+		store, err = newMemcachedStore(u)
+	case "etcd", "etcds":
+		store, err = newEtcdStore(u)
 	case "boltdb":
 		store, err = newBoltDBStore(u)
 	default:
@@ -52,12 +59,37 @@ func (r *oauthProxy) useStore() bool {
 }
 
 //
-// StoreRefreshToken the token to the store
+// StoreRefreshToken the token to the store, expiring it with the refresh token where the driver can
 //
-func (r *oauthProxy) StoreRefreshToken(token jose.JWT, value string) error {
+func (r *oauthProxy) StoreRefreshToken(token jose.JWT, value string, expiration time.Duration) error {
+	if r.faults.dropStoreWrites() {
+		log.Warnf("dropping the write of the refresh token to the store, fault injected")
+		return nil
+	}
+	if err := r.indexStoredSession(token, getHashKey(&token), expiration); err != nil {
+		return err
+	}
+	if store, ok := getStorageExpiration(r.store); ok && expiration > 0 {
+		return store.SetWithExpiration(getHashKey(&token), value, expiration)
+	}
+
 	return r.store.Set(getHashKey(&token), value)
 }
 
+// indexStoredSession records the key of the tokens in the store against the user of the token when the
+// revocations are shared, so revoking the session removes the tokens
+func (r *oauthProxy) indexStoredSession(token jose.JWT, key string, expiration time.Duration) error {
+	if r.revocations == nil {
+		return nil
+	}
+	user, err := extractIdentity(token)
+	if err != nil {
+		return err
+	}
+
+	return r.revocations.index(user, key, expiration)
+}
+
 //
 // Get retrieves a token from the store, the key we are using here is the access token
 //
@@ -99,3 +131,317 @@ func (r *oauthProxy) CloseStore() error {
 
 	return nil
 }
+
+//
+// storagePool is implemented by the drivers which maintain a connection pool
+//
+type storagePool interface {
+	// PoolConnections returns the total and free connections in the pool
+	PoolConnections() (int, int)
+}
+
+//
+// storageCounter is implemented by the drivers which can atomically increment a counter
+//
+type storageCounter interface {
+	// Increment adds one to the counter, expiring it after the duration, and returns the count
+	Increment(key string, expiration time.Duration) (int64, error)
+}
+
+//
+// storageExpiration is implemented by the drivers which can expire a key
+//
+type storageExpiration interface {
+	// SetWithExpiration adds the key to the store, removing it after the duration
+	SetWithExpiration(key, value string, expiration time.Duration) error
+}
+
+//
+// storageLister is implemented by the drivers which can list the keys with a prefix
+//
+type storageLister interface {
+	// List returns the keys with the prefix and their values
+	List(prefix string) (map[string]string, error)
+}
+
+//
+// storageWrapper is implemented by the stores wrapping a driver, i.e. the metrics
+//
+type storageWrapper interface {
+	// unwrap returns the store wrapped
+	unwrap() storage
+}
+
+//
+// getStorageDriver returns the driver beneath any wrappers of the store
+//
+func getStorageDriver(store storage) storage {
+	for {
+		wrapper, ok := store.(storageWrapper)
+		if !ok {
+			return store
+		}
+		store = wrapper.unwrap()
+	}
+}
+
+//
+// getStorageCounter returns the store as a counter if the driver supports the counters
+//
+func getStorageCounter(store storage) (storageCounter, bool) {
+	if _, ok := getStorageDriver(store).(storageCounter); !ok {
+		return nil, false
+	}
+	counter, ok := store.(storageCounter)
+
+	return counter, ok
+}
+
+//
+// getStorageExpiration returns the store as an expiration if the driver supports the expiring keys
+//
+func getStorageExpiration(store storage) (storageExpiration, bool) {
+	if _, ok := getStorageDriver(store).(storageExpiration); !ok {
+		return nil, false
+	}
+	expiration, ok := store.(storageExpiration)
+
+	return expiration, ok
+}
+
+//
+// getStorageLister returns the store as a lister if the driver supports the listing of the keys
+//
+func getStorageLister(store storage) (storageLister, bool) {
+	if _, ok := getStorageDriver(store).(storageLister); !ok {
+		return nil, false
+	}
+	lister, ok := store.(storageLister)
+
+	return lister, ok
+}
+
+//
+// metricsStore wraps a storage driver, recording the latency and errors per operation; the optional operations
+// are only called by way of getStorageCounter, getStorageExpiration and getStorageLister, which check the driver
+// supports them
+//
+type metricsStore struct {
+	// the name of the driver
+	driver string
+	// the underlining store
+	store storage
+	// the latency of the operations
+	latency *prometheus.HistogramVec
+	// the errors per operation
+	errors *prometheus.CounterVec
+}
+
+//
+// newMetricsStore creates a instrumented store around the driver
+//
+func newMetricsStore(driver string, store storage) storage {
+	latency := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "store_operation_duration_seconds",
+			Help:    "The latency of the store operations partitioned by driver and operation",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		},
+		[]string{"driver", "operation"},
+	)
+	errors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "store_operation_errors_total",
+			Help: "The number of failed store operations partitioned by driver and operation",
+		},
+		[]string{"driver", "operation"},
+	)
+
+	m := &metricsStore{
+		driver:  driver,
+		store:   store,
+		latency: prometheus.MustRegisterOrGet(latency).(*prometheus.HistogramVec),
+		errors:  prometheus.MustRegisterOrGet(errors).(*prometheus.CounterVec),
+	}
+	// step: the connections of the pool are read as the metrics are scraped
+	prometheus.MustRegisterOrGet(storePools)
+	storePools.add(m)
+
+	return m
+}
+
+//
+// Set adds a token to the store
+//
+func (r *metricsStore) Set(key, value string) error {
+	return r.observe("set", func() error {
+		return r.store.Set(key, value)
+	})
+}
+
+//
+// Get retrieves a token from the store
+//
+func (r *metricsStore) Get(key string) (string, error) {
+	var value string
+	err := r.observe("get", func() error {
+		var err error
+		value, err = r.store.Get(key)
+		return err
+	})
+
+	return value, err
+}
+
+//
+// Delete removes a key from the store
+//
+func (r *metricsStore) Delete(key string) error {
+	return r.observe("delete", func() error {
+		return r.store.Delete(key)
+	})
+}
+
+//
+// Close is used to close off any resources
+//
+func (r *metricsStore) Close() error {
+	storePools.remove(r)
+
+	return r.store.Close()
+}
+
+//
+// Increment adds one to the counter of the driver
+//
+func (r *metricsStore) Increment(key string, expiration time.Duration) (int64, error) {
+	var count int64
+	err := r.observe("increment", func() error {
+		var err error
+		count, err = r.store.(storageCounter).Increment(key, expiration)
+		return err
+	})
+
+	return count, err
+}
+
+//
+// SetWithExpiration adds a token to the store, expiring it after the duration
+//
+func (r *metricsStore) SetWithExpiration(key, value string, expiration time.Duration) error {
+	return r.observe("set", func() error {
+		return r.store.(storageExpiration).SetWithExpiration(key, value, expiration)
+	})
+}
+
+//
+// List returns the keys with the prefix and their values
+//
+func (r *metricsStore) List(prefix string) (map[string]string, error) {
+	var items map[string]string
+	err := r.observe("list", func() error {
+		var err error
+		items, err = r.store.(storageLister).List(prefix)
+		return err
+	})
+
+	return items, err
+}
+
+//
+// unwrap returns the driver
+//
+func (r *metricsStore) unwrap() storage {
+	return r.store
+}
+
+//
+// observe times the operation and records the outcome
+//
+func (r *metricsStore) observe(operation string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	r.latency.WithLabelValues(r.driver, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		r.errors.WithLabelValues(r.driver, operation).Inc()
+	}
+
+	return err
+}
+
+// storePools is the collector of the connections in the pools of the stores
+var storePools = newStorePoolCollector()
+
+//
+// storePoolCollector collects the connections in the pools of the instrumented stores as the metrics are scraped,
+// rather than as the stores are used, so an idle pool is reported as it is
+//
+type storePoolCollector struct {
+	sync.RWMutex
+	// the description of the connections
+	connections *prometheus.Desc
+	// the instrumented stores
+	stores map[*metricsStore]bool
+}
+
+//
+// newStorePoolCollector creates a collector of the store pools
+//
+func newStorePoolCollector() *storePoolCollector {
+	return &storePoolCollector{
+		connections: prometheus.NewDesc(
+			"store_pool_connections",
+			"The connections in the store pool partitioned by driver and state",
+			[]string{"driver", "state"}, nil,
+		),
+		stores: make(map[*metricsStore]bool),
+	}
+}
+
+//
+// add starts collecting the pool of the store
+//
+func (r *storePoolCollector) add(store *metricsStore) {
+	r.Lock()
+	defer r.Unlock()
+	r.stores[store] = true
+}
+
+//
+// remove stops collecting the pool of the store
+//
+func (r *storePoolCollector) remove(store *metricsStore) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.stores, store)
+}
+
+//
+// Describe sends the description of the connections
+//
+func (r *storePoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.connections
+}
+
+//
+// Collect sends the total and free connections of the pools per driver
+//
+func (r *storePoolCollector) Collect(ch chan<- prometheus.Metric) {
+	r.RLock()
+	defer r.RUnlock()
+
+	totals, frees := make(map[string]int), make(map[string]int)
+	for store := range r.stores {
+		pool, ok := getStorageDriver(store).(storagePool)
+		if !ok {
+			continue
+		}
+		total, free := pool.PoolConnections()
+		totals[store.driver] += total
+		frees[store.driver] += free
+	}
+	for driver, total := range totals {
+		ch <- prometheus.MustNewConstMetric(r.connections, prometheus.GaugeValue, float64(total), driver, "total")
+		ch <- prometheus.MustNewConstMetric(r.connections, prometheus.GaugeValue, float64(frees[driver]), driver, "free")
+	}
+}
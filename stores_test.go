@@ -16,9 +16,16 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -43,3 +50,241 @@ func TestCreateStorageFail(t *testing.T) {
 	assert.Nil(t, store)
 	assert.Error(t, err)
 }
+
+type fakeStore struct {
+	sync.RWMutex
+	items map[string]string
+}
+
+func (r *fakeStore) Set(key, value string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.items[key] = value
+	return nil
+}
+
+func (r *fakeStore) Get(key string) (string, error) {
+	r.RLock()
+	defer r.RUnlock()
+	v, found := r.items[key]
+	if !found {
+		return "", errors.New("not found")
+	}
+	return v, nil
+}
+
+func (r *fakeStore) Delete(key string) error {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.items, key)
+	return nil
+}
+
+func (r *fakeStore) Close() error {
+	return nil
+}
+
+func (r *fakeStore) PoolConnections() (int, int) {
+	return 10, 4
+}
+
+func (r *fakeStore) Increment(key string, expiration time.Duration) (int64, error) {
+	r.Lock()
+	defer r.Unlock()
+	count, _ := strconv.ParseInt(r.items[key], 10, 64)
+	count++
+	r.items[key] = strconv.FormatInt(count, 10)
+	return count, nil
+}
+
+func (r *fakeStore) List(prefix string) (map[string]string, error) {
+	r.RLock()
+	defer r.RUnlock()
+	items := make(map[string]string)
+	for k, v := range r.items {
+		if strings.HasPrefix(k, prefix) {
+			items[k] = v
+		}
+	}
+	return items, nil
+}
+
+// size returns the number of items in the store, safe to call while the proxy is using the store
+func (r *fakeStore) size() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.items)
+}
+
+func TestBoltDBList(t *testing.T) {
+	store, err := createStorage("boltdb:////tmp/bolt-list")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove("/tmp/bolt-list")
+	defer store.Close()
+	for _, x := range []string{"lisa", "list/a", "list/b", "lit"} {
+		assert.NoError(t, store.Set(x, x))
+	}
+	items, err := store.(storageLister).List("list/")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"list/a": "list/a", "list/b": "list/b"}, items)
+}
+
+func TestBoltDBExpiration(t *testing.T) {
+	store, err := createStorage("boltdb:////tmp/bolt-expiration")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove("/tmp/bolt-expiration")
+	defer store.Close()
+	bolt := store.(*boltdbStore)
+
+	assert.NoError(t, bolt.SetWithExpiration("expired", "value", -time.Second))
+	assert.NoError(t, bolt.SetWithExpiration("expiring", "value", time.Hour))
+	assert.NoError(t, bolt.Set("kept", "value"))
+	// step: the expired keys are not found before the reaper removes them
+	value, err := bolt.Get("expired")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+	items, err := bolt.List("ex")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"expiring": "value"}, items)
+
+	// step: setting the key without an expiration keeps it
+	assert.NoError(t, bolt.SetWithExpiration("kept", "value", -time.Second))
+	assert.NoError(t, bolt.Set("kept", "value"))
+
+	assert.NoError(t, bolt.expire(time.Now()))
+	items, err = bolt.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"expiring": "value", "kept": "value"}, items)
+	assert.NoError(t, bolt.expire(time.Now().Add(2*time.Hour)))
+	items, err = bolt.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"kept": "value"}, items)
+}
+
+func TestBoltDBCompaction(t *testing.T) {
+	store, err := createStorage("boltdb:////tmp/bolt-compaction?compaction-interval=0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove("/tmp/bolt-compaction")
+	defer store.Close()
+	bolt := store.(*boltdbStore)
+
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < 2048; i++ {
+		assert.NoError(t, bolt.SetWithExpiration(strconv.Itoa(i), value, -time.Second))
+	}
+	assert.NoError(t, bolt.Set("kept", "value"))
+	assert.NoError(t, bolt.expire(time.Now()))
+	before, err := os.Stat("/tmp/bolt-compaction")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, bolt.shouldCompact())
+
+	assert.NoError(t, bolt.compact())
+	after, err := os.Stat("/tmp/bolt-compaction")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, after.Size() < before.Size()/4, "before: %d, after: %d", before.Size(), after.Size())
+	assert.False(t, bolt.shouldCompact())
+	value, err = bolt.Get("kept")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+}
+
+func TestBoltDBInvalid(t *testing.T) {
+	cs := []string{
+		"boltdb:////tmp/bolt-invalid?expiry-interval=0",
+		"boltdb:////tmp/bolt-invalid?expiry-interval=bad",
+		"boltdb:////tmp/bolt-invalid?compaction-interval=-1h",
+	}
+	for i, x := range cs {
+		_, err := createStorage(x)
+		assert.Error(t, err, "case %d, url: %s", i, x)
+	}
+}
+
+func TestBoltDBIncrement(t *testing.T) {
+	store, err := createStorage("boltdb:////tmp/bolt-increment")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove("/tmp/bolt-increment")
+	defer store.Close()
+	counter := store.(storageCounter)
+	for i := int64(1); i <= 3; i++ {
+		count, err := counter.Increment("counter", time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, i, count)
+	}
+
+	// step: the expired counter starts again
+	count, err := counter.Increment("expired", -time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	count, err = counter.Increment("expired", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestMetricsStore(t *testing.T) {
+	store := newMetricsStore("fake", &fakeStore{items: make(map[string]string)})
+	assert.NoError(t, store.Set("test", "value"))
+	value, err := store.Get("test")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	assert.NoError(t, store.Delete("test"))
+	_, err = store.Get("test")
+	assert.Error(t, err)
+	assert.NoError(t, store.Set("list/a", "value"))
+	items, err := store.(storageLister).List("list/")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"list/a": "value"}, items)
+
+	// step: the optional operations are only offered where the driver supports them
+	_, ok := getStorageCounter(store)
+	assert.True(t, ok)
+	_, ok = getStorageExpiration(store)
+	assert.False(t, ok)
+	plain := newMetricsStore("fake", struct{ storage }{&fakeStore{items: make(map[string]string)}})
+	_, ok = getStorageCounter(plain)
+	assert.False(t, ok)
+	_, ok = getStorageLister(plain)
+	assert.False(t, ok)
+	assert.Equal(t, store.(storageWrapper).unwrap(), getStorageDriver(store))
+
+	// step: the collectors are shared by the stores, so the plain store reads the metrics
+	metric := &dto.Metric{}
+	assert.NoError(t, plain.(*metricsStore).errors.WithLabelValues("fake", "get").Write(metric))
+	assert.Equal(t, float64(1), metric.GetCounter().GetValue())
+
+	// step: the pools are read as the metrics are collected, until the store is closed
+	collect := func() map[string]float64 {
+		ch := make(chan prometheus.Metric, 10)
+		storePools.Collect(ch)
+		close(ch)
+		values := make(map[string]float64)
+		for x := range ch {
+			metric := &dto.Metric{}
+			assert.NoError(t, x.Write(metric))
+			labels := make(map[string]string)
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			if labels["driver"] == "fake" {
+				values[labels["state"]] = metric.GetGauge().GetValue()
+			}
+		}
+		return values
+	}
+	assert.Equal(t, map[string]float64{"total": 10, "free": 4}, collect())
+	assert.NoError(t, store.Close())
+	assert.NoError(t, plain.Close())
+	assert.Empty(t, collect())
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isValid validates the synthetic endpoint
+func (r *SyntheticEndpoint) isValid() error {
+	if !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("the synthetic endpoint: %s must be absolute", r.Path)
+	}
+	if strings.ContainsAny(r.Path, ":*") {
+		return fmt.Errorf("the synthetic endpoint: %s cannot contain a wildcard", r.Path)
+	}
+	if r.Status != 0 && (r.Status < 200 || r.Status > 599) {
+		return fmt.Errorf("the synthetic endpoint: %s status: %d is invalid", r.Path, r.Status)
+	}
+	if r.Redirect != "" {
+		if r.Body != "" {
+			return fmt.Errorf("the synthetic endpoint: %s cannot have both a redirect and a body", r.Path)
+		}
+		if r.Status != 0 && (r.Status < 300 || r.Status > 308) {
+			return fmt.Errorf("the synthetic endpoint: %s redirect status must be a 3xx", r.Path)
+		}
+	}
+	if r.Body != "" && !bodyAllowedForStatus(r.Status) {
+		return fmt.Errorf("the synthetic endpoint: %s status: %d cannot have a body", r.Path, r.Status)
+	}
+	if r.Body != "" && r.ContentType == "" && !json.Valid([]byte(r.Body)) {
+		return fmt.Errorf("the synthetic endpoint: %s body is not json, set the content type", r.Path)
+	}
+
+	return nil
+}
+
+// handler returns the handler serving the response of the synthetic endpoint
+func (r *SyntheticEndpoint) handler() gin.HandlerFunc {
+	if r.Redirect != "" {
+		status := r.Status
+		if status == 0 {
+			status = http.StatusFound
+		}
+
+		return func(cx *gin.Context) {
+			cx.Redirect(status, r.Redirect)
+		}
+	}
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	contentType := defaultTo(r.ContentType, jsonContentType)
+	body := []byte(r.Body)
+
+	return func(cx *gin.Context) {
+		writeResponse(cx, status, contentType, body)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyntheticEndpointIsValid(t *testing.T) {
+	cs := []struct {
+		Endpoint *SyntheticEndpoint
+		Ok       bool
+	}{
+		{Endpoint: &SyntheticEndpoint{Path: "/.well-known/assetlinks.json", Body: `[]`}, Ok: true},
+		{Endpoint: &SyntheticEndpoint{Path: "/.well-known/security.txt", Body: "Contact: mailto:security@example.com", ContentType: "text/plain"}, Ok: true},
+		{Endpoint: &SyntheticEndpoint{Path: "/legacy", Redirect: "/new", Status: http.StatusMovedPermanently}, Ok: true},
+		{Endpoint: &SyntheticEndpoint{Path: "/stub", Status: http.StatusNoContent}, Ok: true},
+		{Endpoint: &SyntheticEndpoint{Path: "stub"}},
+		{Endpoint: &SyntheticEndpoint{Path: "/stub/:id"}},
+		{Endpoint: &SyntheticEndpoint{Path: "/stub/*all"}},
+		{Endpoint: &SyntheticEndpoint{Path: "/stub", Status: 99}},
+		{Endpoint: &SyntheticEndpoint{Path: "/stub", Body: "not json"}},
+		{Endpoint: &SyntheticEndpoint{Path: "/stub", Status: http.StatusNoContent, Body: `{}`}},
+		{Endpoint: &SyntheticEndpoint{Path: "/legacy", Redirect: "/new", Status: http.StatusOK}},
+		{Endpoint: &SyntheticEndpoint{Path: "/legacy", Redirect: "/new", Body: `{}`}},
+	}
+	for i, c := range cs {
+		err := c.Endpoint.isValid()
+		if c.Ok {
+			assert.NoError(t, err, "case %d", i)
+		} else {
+			assert.Error(t, err, "case %d", i)
+		}
+	}
+}
+
+func TestSyntheticEndpoints(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.SyntheticEndpoints = []*SyntheticEndpoint{
+		{Path: "/.well-known/assetlinks.json", Body: `[{"relation":["delegate_permission/common.handle_all_urls"]}]`},
+		{Path: "/.well-known/security.txt", Body: "Contact: mailto:security@example.com\n", ContentType: textContentType},
+		{Path: "/legacy/reports", Redirect: "https://reports.example.com/"},
+		{Path: fakeAuthAllURL + "/retired", Status: http.StatusGone, Body: `{"error":"retired"}`},
+	}
+	_, _, svc := newTestProxyService(cfg)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	cs := []struct {
+		Method      string
+		Path        string
+		Status      int
+		ContentType string
+		Location    string
+	}{
+		{Method: http.MethodGet, Path: "/.well-known/assetlinks.json", Status: http.StatusOK, ContentType: jsonContentType},
+		{Method: http.MethodGet, Path: "/.well-known/security.txt", Status: http.StatusOK, ContentType: textContentType},
+		{Method: http.MethodGet, Path: "/legacy/reports", Status: http.StatusFound, Location: "https://reports.example.com/"},
+		{Method: http.MethodPost, Path: fakeAuthAllURL + "/retired", Status: http.StatusGone, ContentType: jsonContentType},
+		// step: the other paths are still protected
+		{Method: http.MethodGet, Path: fakeAuthAllURL + "/other", Status: http.StatusTemporaryRedirect},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest(c.Method, svc+c.Path, nil)
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.Status, resp.StatusCode, "case %d", i)
+		if c.ContentType != "" {
+			assert.Equal(t, c.ContentType, resp.Header.Get("Content-Type"), "case %d", i)
+		}
+		if c.Location != "" {
+			assert.Equal(t, c.Location, resp.Header.Get("Location"), "case %d", i)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// systemdListenPrefix indicates the listener is a socket passed by systemd, i.e. systemd: or systemd:name
+	systemdListenPrefix = "systemd:"
+	// systemdFirstFD is the first of the file descriptors passed by systemd
+	systemdFirstFD = 3
+	// the states notified to systemd
+	systemdReady    = "READY=1"
+	systemdStopping = "STOPPING=1"
+	systemdWatchdog = "WATCHDOG=1"
+)
+
+// systemdSocket is a socket passed to us by systemd socket activation
+type systemdSocket struct {
+	// the file of the socket
+	file *os.File
+	// the name of the socket, from the FileDescriptorName of the socket unit
+	name string
+	// indicates the socket has been taken by a listener
+	used bool
+}
+
+var (
+	// systemdSockets are the sockets passed by systemd, read once from the environment
+	systemdSockets     []*systemdSocket
+	systemdSocketsOnce sync.Once
+	systemdSocketsLock sync.Mutex
+)
+
+// getSystemdSockets reads the sockets passed by systemd from the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES
+// environment variables, which are removed so they aren't inherited by any child process
+func getSystemdSockets() []*systemdSocket {
+	systemdSocketsOnce.Do(func() {
+		systemdSockets = parseSystemdSockets(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"),
+			os.Getenv("LISTEN_FDNAMES"), systemdFirstFD)
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+
+	return systemdSockets
+}
+
+// parseSystemdSockets returns the sockets passed from the first descriptor, provided they were passed to us
+func parseSystemdSockets(pid, fds, fdnames string, first int) []*systemdSocket {
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count <= 0 {
+		return nil
+	}
+	var sockets []*systemdSocket
+	names := strings.Split(fdnames, ":")
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", first+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		sockets = append(sockets, &systemdSocket{
+			file: os.NewFile(uintptr(first+i), name),
+			name: name,
+		})
+	}
+
+	return sockets
+}
+
+// createSystemdListener creates a listener from a socket passed by systemd, systemd: takes the next unused socket
+// and systemd:name the socket of that name
+func createSystemdListener(listen string) (net.Listener, error) {
+	name := strings.TrimPrefix(listen, systemdListenPrefix)
+	sockets := getSystemdSockets()
+	if len(sockets) == 0 {
+		return nil, errors.New("no sockets have been passed by systemd, is the service socket activated?")
+	}
+
+	systemdSocketsLock.Lock()
+	defer systemdSocketsLock.Unlock()
+	for _, socket := range sockets {
+		if socket.used || (name != "" && socket.name != name) {
+			continue
+		}
+		listener, err := net.FileListener(socket.file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to listen on the systemd socket: %s, error: %s", socket.name, err)
+		}
+		// step: the listener holds a duplicate of the descriptor
+		socket.file.Close()
+		socket.used = true
+		log.Infof("listening on the systemd socket: %s, address: %s", socket.name, listener.Addr())
+
+		return listener, nil
+	}
+	if name != "" {
+		return nil, fmt.Errorf("no unused systemd socket named: %s has been passed", name)
+	}
+
+	return nil, errors.New("all the sockets passed by systemd are in use")
+}
+
+// notifySystemd sends the state to the systemd notify socket, a noop unless running as a Type=notify service
+func notifySystemd(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// step: a leading @ denotes a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+
+	return err
+}
+
+// getSystemdWatchdogInterval returns the watchdog interval of the service, zero if the watchdog isn't enabled
+func getSystemdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startSystemdWatchdog pings the systemd watchdog at half the interval, if enabled, until the channel is closed
+func startSystemdWatchdog(stop <-chan struct{}) {
+	interval := getSystemdWatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	log.Infof("pinging the systemd watchdog every %s", interval/2)
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := notifySystemd(systemdWatchdog); err != nil {
+					log.WithFields(log.Fields{"error": err.Error()}).Warnf("unable to ping the systemd watchdog")
+				}
+			}
+		}
+	}()
+}
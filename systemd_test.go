@@ -0,0 +1,141 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSystemdSockets(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	assert.Empty(t, parseSystemdSockets("1", "2", "", 1000))
+	assert.Empty(t, parseSystemdSockets(pid, "0", "", 1000))
+	assert.Empty(t, parseSystemdSockets(pid, "bad", "", 1000))
+
+	sockets := parseSystemdSockets(pid, "2", "web", 1000)
+	if assert.Len(t, sockets, 2) {
+		assert.Equal(t, "web", sockets[0].name)
+		assert.Equal(t, uintptr(1000), sockets[0].file.Fd())
+		assert.Equal(t, "LISTEN_FD_1001", sockets[1].name)
+	}
+}
+
+func TestCreateSystemdListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	file, err := listener.(*net.TCPListener).File()
+	if !assert.NoError(t, err) {
+		return
+	}
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	listener.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+	getSystemdSockets()
+	systemdSockets = parseSystemdSockets(strconv.Itoa(os.Getpid()), "1", "web", fd)
+	defer func() { systemdSockets = nil }()
+
+	_, err = createSystemdListener("systemd:admin")
+	assert.Error(t, err)
+
+	activated, err := createHTTPListener(listenerConfig{listen: "systemd:web"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer activated.Close()
+	conn, err := net.Dial("tcp", activated.Addr().String())
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+
+	// step: the socket can only be used once
+	_, err = createSystemdListener("systemd:")
+	assert.Error(t, err)
+}
+
+func TestNotifySystemd(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	assert.NoError(t, notifySystemd(systemdReady))
+
+	dir, err := ioutil.TempDir("", "notify")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	assert.NoError(t, notifySystemd(systemdReady))
+	buffer := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, systemdReady, string(buffer[:n]))
+
+	// step: the watchdog is pinged at half the interval
+	os.Setenv("WATCHDOG_USEC", "100000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	stop := make(chan struct{})
+	startSystemdWatchdog(stop)
+	defer close(stop)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = conn.Read(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, systemdWatchdog, string(buffer[:n]))
+}
+
+func TestGetSystemdWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	cs := []struct {
+		USec     string
+		PID      string
+		Expected time.Duration
+	}{
+		{Expected: 0},
+		{USec: "30000000", Expected: 30 * time.Second},
+		{USec: "30000000", PID: strconv.Itoa(os.Getpid()), Expected: 30 * time.Second},
+		{USec: "30000000", PID: "1", Expected: 0},
+		{USec: "bad", Expected: 0},
+	}
+	for i, c := range cs {
+		os.Setenv("WATCHDOG_USEC", c.USec)
+		os.Setenv("WATCHDOG_PID", c.PID)
+		assert.Equal(t, c.Expected, getSystemdWatchdogInterval(), "case %d", i)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the phases of handling a request
+const (
+	phaseAuth              = "auth"
+	phaseRefresh           = "refresh"
+	phaseStore             = "store"
+	phaseUpstreamConnect   = "upstream_connect"
+	phaseUpstreamFirstByte = "upstream_first_byte"
+	phaseTotal             = "total"
+)
+
+// timingPhases is the order the phases are reported in
+var timingPhases = []string{phaseAuth, phaseRefresh, phaseStore, phaseUpstreamConnect, phaseUpstreamFirstByte}
+
+// requestTimings are the durations of the phases of a request, it's safe to use from multiple goroutines
+// and a nil timings ignores the observations
+type requestTimings struct {
+	sync.Mutex
+	// the durations of the phases
+	phases map[string]time.Duration
+	// when the upstream connection was requested and obtained
+	connectStart time.Time
+	connected    time.Time
+}
+
+// newRequestTimings creates an empty set of timings
+func newRequestTimings() *requestTimings {
+	return &requestTimings{phases: make(map[string]time.Duration)}
+}
+
+// observe adds the time since start to the phase
+func (r *requestTimings) observe(phase string, start time.Time) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.phases[phase] += time.Since(start)
+}
+
+// get returns the duration of the phase and whether it was observed
+func (r *requestTimings) get(phase string) (time.Duration, bool) {
+	r.Lock()
+	defer r.Unlock()
+	duration, found := r.phases[phase]
+
+	return duration, found
+}
+
+// clientTrace returns a trace recording the upstream connect and first byte phases
+func (r *requestTimings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			r.Lock()
+			defer r.Unlock()
+			r.connectStart = time.Now()
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			r.Lock()
+			defer r.Unlock()
+			r.connected = time.Now()
+			r.phases[phaseUpstreamConnect] += r.connected.Sub(r.connectStart)
+		},
+		GotFirstResponseByte: func() {
+			r.Lock()
+			defer r.Unlock()
+			r.phases[phaseUpstreamFirstByte] += time.Since(r.connected)
+		},
+	}
+}
+
+// withTimings adds the timings and upstream trace to the request context
+func withTimings(req *http.Request, timings *requestTimings) *http.Request {
+	ctx := context.WithValue(req.Context(), timingsContextKey, timings)
+
+	return req.WithContext(httptrace.WithClientTrace(ctx, timings.clientTrace()))
+}
+
+// getTimings returns the timings of the request, nil if we are not timing requests
+func getTimings(req *http.Request) *requestTimings {
+	timings, _ := req.Context().Value(timingsContextKey).(*requestTimings)
+
+	return timings
+}
+
+// serverTiming formats the timings as a Server-Timing header value, in milliseconds
+func (r *requestTimings) serverTiming(total time.Duration) string {
+	var metrics []string
+	for _, phase := range timingPhases {
+		if duration, found := r.get(phase); found {
+			metrics = append(metrics, formatServerTiming(phase, duration))
+		}
+	}
+
+	return strings.Join(append(metrics, formatServerTiming(phaseTotal, total)), ", ")
+}
+
+// formatServerTiming formats a Server-Timing metric
+func formatServerTiming(name string, duration time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(duration)/float64(time.Millisecond))
+}
+
+// serverTimingWriter adds the Server-Timing header before the response headers are written
+type serverTimingWriter struct {
+	gin.ResponseWriter
+	// when the request started
+	start time.Time
+	// the timings of the request
+	timings *requestTimings
+}
+
+// setHeader adds the Server-Timing header, unless the headers have been written
+func (r *serverTimingWriter) setHeader() {
+	if !r.Written() {
+		r.Header().Set(serverTimingHeader, r.timings.serverTiming(time.Since(r.start)))
+	}
+}
+
+// WriteHeaderNow writes the response headers
+func (r *serverTimingWriter) WriteHeaderNow() {
+	r.setHeader()
+	r.ResponseWriter.WriteHeaderNow()
+}
+
+// Write writes the response body
+func (r *serverTimingWriter) Write(b []byte) (int, error) {
+	r.setHeader()
+	return r.ResponseWriter.Write(b)
+}
+
+// WriteString writes the string to the response body
+func (r *serverTimingWriter) WriteString(s string) (int, error) {
+	r.setHeader()
+	return r.ResponseWriter.WriteString(s)
+}
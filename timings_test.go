@@ -0,0 +1,122 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestTimings(t *testing.T) {
+	timings := newRequestTimings()
+	_, found := timings.get(phaseAuth)
+	assert.False(t, found)
+
+	start := time.Now().Add(-time.Second)
+	timings.observe(phaseAuth, start)
+	timings.observe(phaseAuth, start)
+	duration, found := timings.get(phaseAuth)
+	assert.True(t, found)
+	assert.True(t, duration >= 2*time.Second)
+
+	// step: a nil timings should ignore the observations
+	var empty *requestTimings
+	empty.observe(phaseAuth, start)
+}
+
+func TestGetTimings(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Nil(t, getTimings(req))
+
+	timings := newRequestTimings()
+	req = withTimings(req, timings)
+	assert.Equal(t, timings, getTimings(req))
+}
+
+func TestRequestTimingsUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	timings := newRequestTimings()
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	resp, err := http.DefaultClient.Do(withTimings(req, timings))
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	_, found := timings.get(phaseUpstreamConnect)
+	assert.True(t, found)
+	_, found = timings.get(phaseUpstreamFirstByte)
+	assert.True(t, found)
+}
+
+func TestTimingMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.SlowRequestThreshold = time.Nanosecond
+	_, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	req, _ := http.NewRequest(http.MethodGet, svc+"/auth_all/test", nil)
+	req.Header.Set("Authorization", "Bearer "+signed.Encode())
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	timings := newRequestTimings()
+	timings.phases[phaseAuth] = 1500 * time.Microsecond
+	timings.phases[phaseUpstreamFirstByte] = 10 * time.Millisecond
+	assert.Equal(t, "auth;dur=1.500, upstream_first_byte;dur=10.000, total;dur=20.000",
+		timings.serverTiming(20*time.Millisecond))
+	assert.Equal(t, "total;dur=1.000", newRequestTimings().serverTiming(time.Millisecond))
+}
+
+func TestServerTimingHeader(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableServerTiming = true
+	_, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	req, _ := http.NewRequest(http.MethodGet, svc+"/auth_all/test", nil)
+	req.Header.Set("Authorization", "Bearer "+signed.Encode())
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get(serverTimingHeader), "auth;dur=")
+		assert.Contains(t, resp.Header.Get(serverTimingHeader), "total;dur=")
+	}
+
+	// step: check the header is added to the redirect
+	req, _ = http.NewRequest(http.MethodGet, svc+"/auth_all/test", nil)
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get(serverTimingHeader), "total;dur=")
+	}
+}
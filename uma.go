@@ -0,0 +1,165 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// umaGrantType is the grant type requesting a party token, UMA 2.0
+	umaGrantType = "urn:ietf:params:oauth:grant-type:uma-ticket"
+	// umaCacheSweep is the number of cached decisions above which the expired ones are removed
+	umaCacheSweep = 10000
+)
+
+// umaDecision is a cached authorization decision
+type umaDecision struct {
+	// whether the permission was granted
+	granted bool
+	// the time the decision expires from the cache
+	expires time.Time
+}
+
+// umaAuthorizer asks the authorization services of the provider whether the user holds the permission for
+// the path and method requested, caching the decisions; it's safe to use from multiple goroutines
+type umaAuthorizer struct {
+	sync.RWMutex
+	// the decisions keyed by the hash of the token, method and path
+	cache map[[sha256.Size]byte]*umaDecision
+	// the duration a decision is cached
+	ttl time.Duration
+	// requests the decision from the provider
+	decide func(token, path, method string) (bool, error)
+	// the decisions partitioned by result
+	total *prometheus.CounterVec
+}
+
+// newUMAAuthorizer creates the authorizer and registers the metrics
+func newUMAAuthorizer(ttl time.Duration, decide func(string, string, string) (bool, error)) *umaAuthorizer {
+	total := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uma_decisions_total",
+			Help: "The authorization services decisions partitioned by result",
+		},
+		[]string{"result"},
+	)
+
+	return &umaAuthorizer{
+		cache:  make(map[[sha256.Size]byte]*umaDecision),
+		ttl:    ttl,
+		decide: decide,
+		total:  prometheus.MustRegisterOrGet(total).(*prometheus.CounterVec),
+	}
+}
+
+// isGranted checks the user of the token holds the permission for the method on the path, the decision
+// is never cached beyond the expiration of the token
+func (r *umaAuthorizer) isGranted(user *userContext, path, method string) (bool, error) {
+	token := user.token.Encode()
+	key := sha256.Sum256([]byte(method + " " + path + " " + token))
+	now := time.Now()
+
+	r.RLock()
+	decision, found := r.cache[key]
+	r.RUnlock()
+	if found && now.Before(decision.expires) {
+		r.total.WithLabelValues("cached").Inc()
+		return decision.granted, nil
+	}
+
+	granted, err := r.decide(token, path, method)
+	if err != nil {
+		r.total.WithLabelValues("error").Inc()
+		return false, err
+	}
+	if granted {
+		r.total.WithLabelValues("granted").Inc()
+	} else {
+		r.total.WithLabelValues("denied").Inc()
+	}
+	decision = &umaDecision{granted: granted, expires: now.Add(r.ttl)}
+	if user.expiresAt.Before(decision.expires) {
+		decision.expires = user.expiresAt
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.cache[key] = decision
+	if len(r.cache) > umaCacheSweep {
+		for k, v := range r.cache {
+			if now.After(v.expires) {
+				delete(r.cache, k)
+			}
+		}
+	}
+
+	return granted, nil
+}
+
+// requestDecision asks the token endpoint whether the user holds the permission for the method on the
+// path; the path is matched against the uris of the resources and the method is the scope
+func (r *oauthProxy) requestDecision(token, path, method string) (bool, error) {
+	values := url.Values{}
+	values.Set("grant_type", umaGrantType)
+	values.Set("audience", r.config.ClientID)
+	values.Set("permission", path+"#"+method)
+	values.Set("permission_resource_format", "uri")
+	values.Set("permission_resource_matching_uri", "true")
+	values.Set("response_mode", "decision")
+
+	request, err := http.NewRequest(http.MethodPost, r.getProviderConfig().TokenEndpoint.String(), strings.NewReader(values.Encode()))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set(authorizationHeader, "Bearer "+token)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := r.idpClient.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		var decision struct {
+			Result bool `json:"result"`
+		}
+		if err := json.Unmarshal(content, &decision); err != nil {
+			return false, err
+		}
+		return decision.Result, nil
+	case http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid response from token endpoint, status: %d, response: %s", response.StatusCode, content)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/go-resty/resty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUMAAuthorizerCache(t *testing.T) {
+	calls := 0
+	authorizer := newUMAAuthorizer(time.Hour, func(token, path, method string) (bool, error) {
+		calls++
+		if path == "/error" {
+			return false, errors.New("provider down")
+		}
+		return path == "/granted", nil
+	})
+	user := &userContext{expiresAt: time.Now().Add(time.Hour)}
+
+	granted, err := authorizer.isGranted(user, "/granted", http.MethodGet)
+	assert.NoError(t, err)
+	assert.True(t, granted)
+	authorizer.isGranted(user, "/granted", http.MethodGet)
+	assert.Equal(t, 1, calls, "the decision should have been cached")
+
+	// step: the method is part of the decision
+	authorizer.isGranted(user, "/granted", http.MethodPost)
+	assert.Equal(t, 2, calls)
+
+	granted, err = authorizer.isGranted(user, "/denied", http.MethodGet)
+	assert.NoError(t, err)
+	assert.False(t, granted)
+
+	// step: the errors are not cached
+	_, err = authorizer.isGranted(user, "/error", http.MethodGet)
+	assert.Error(t, err)
+	authorizer.isGranted(user, "/error", http.MethodGet)
+	assert.Equal(t, 5, calls)
+
+	// step: the decision is never cached beyond the expiration of the token
+	expiredToken, _ := jose.NewJWT(jose.JOSEHeader{"alg": "RS256"}, jose.Claims{"sub": "expired"})
+	expired := &userContext{token: expiredToken, expiresAt: time.Now().Add(-time.Second)}
+	authorizer.isGranted(expired, "/granted", http.MethodGet)
+	authorizer.isGranted(expired, "/granted", http.MethodGet)
+	assert.Equal(t, 7, calls)
+}
+
+func TestUMAEnforcement(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableUMA = true
+	cfg.UMACacheTTL = time.Minute
+	cfg.Resources = []*Resource{
+		{URL: "/", Methods: []string{"ANY"}, Roles: []string{"not-required-by-uma"}},
+	}
+	_, idp, svc := newTestProxyService(cfg)
+	idp.grantPermission("/documents#GET")
+
+	token := newTestToken(idp.getLocation())
+	signed, err := idp.signToken(token.claims)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	cs := []struct {
+		Method       string
+		URI          string
+		ExpectedCode int
+	}{
+		{Method: http.MethodGet, URI: "/documents", ExpectedCode: http.StatusOK},
+		{Method: http.MethodGet, URI: "/documents", ExpectedCode: http.StatusOK},
+		{Method: http.MethodDelete, URI: "/documents", ExpectedCode: http.StatusForbidden},
+		{Method: http.MethodGet, URI: "/admin", ExpectedCode: http.StatusForbidden},
+	}
+	for i, c := range cs {
+		resp, err := resty.New().SetAuthToken(signed.Encode()).R().Execute(c.Method, svc+c.URI)
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode(), "case %d, %s %s", i, c.Method, c.URI)
+	}
+	assert.Equal(t, 3, idp.getDecisions(), "the repeated decision should have been cached")
+}
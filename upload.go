@@ -0,0 +1,134 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/gambol99/goproxy"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errUploadTooLarge is returned reading a request body larger than the limit
+var errUploadTooLarge = errors.New("the request body exceeds the maximum upload size")
+
+// uploadReader counts the bytes streamed from the request body, failing once the limit is exceeded
+type uploadReader struct {
+	io.ReadCloser
+	// the maximum bytes permitted, zero is unlimited
+	limit int64
+	// the bytes read so far
+	read int64
+	// indicates the limit was exceeded
+	exceeded bool
+	// the counter of bytes uploaded
+	uploaded prometheus.Counter
+}
+
+// Read reads from the request body
+func (r *uploadReader) Read(b []byte) (int, error) {
+	if r.exceeded {
+		return 0, errUploadTooLarge
+	}
+	n, err := r.ReadCloser.Read(b)
+	r.read += int64(n)
+	r.uploaded.Add(float64(n))
+	if r.limit > 0 && r.read > r.limit {
+		r.exceeded = true
+		return n, errUploadTooLarge
+	}
+
+	return n, err
+}
+
+// uploadMiddleware enforces the maximum upload size of the resource, the body is streamed to the
+// upstream and never buffered, so the limit is checked as the bytes are read
+func (r *oauthProxy) uploadMiddleware() gin.HandlerFunc {
+	uploaded := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_request_upload_bytes_total",
+			Help: "The bytes of the request bodies streamed to the upstream partitioned by resource",
+		},
+		[]string{"resource"},
+	)
+	rejected := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_request_upload_rejected_total",
+			Help: "The uploads rejected for exceeding the maximum upload size partitioned by resource",
+		},
+		[]string{"resource"},
+	)
+	uploaded = prometheus.MustRegisterOrGet(uploaded).(*prometheus.CounterVec)
+	rejected = prometheus.MustRegisterOrGet(rejected).(*prometheus.CounterVec)
+
+	return func(cx *gin.Context) {
+		if cx.IsAborted() || cx.Request.Body == nil || cx.Request.Body == http.NoBody {
+			return
+		}
+		var limit int64
+		var name string
+		if resource := r.getResource(cx.Request.Host, cx.Request.URL.Path, cx.Request.URL.Query()); resource != nil {
+			limit = resource.MaxUploadSize
+			name = resource.URL
+		}
+		// step: we can reject up front if the length is given
+		if limit > 0 && cx.Request.ContentLength > limit {
+			rejected.WithLabelValues(name).Inc()
+			cx.AbortWithStatus(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body := &uploadReader{
+			ReadCloser: cx.Request.Body,
+			limit:      limit,
+			uploaded:   uploaded.WithLabelValues(name),
+		}
+		cx.Request.Body = body
+
+		cx.Next()
+
+		if body.exceeded {
+			rejected.WithLabelValues(name).Inc()
+		}
+	}
+}
+
+// uploadResponseFilter replaces the upstream error of a request which exceeded the maximum upload size
+func uploadResponseFilter(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp != nil || ctx.Req == nil {
+		return resp
+	}
+	if body, ok := ctx.Req.Body.(*uploadReader); ok && body.exceeded {
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusRequestEntityTooLarge,
+			errUploadTooLarge.Error()+"\n")
+	}
+
+	return resp
+}
+
+// getResource returns the resource matching the host, path and query, if any
+func (r *oauthProxy) getResource(host, path string, query url.Values) *Resource {
+	for _, resource := range r.getResources() {
+		if resource.matches(host, path, query) {
+			return resource
+		}
+	}
+
+	return nil
+}
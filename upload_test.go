@@ -0,0 +1,75 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gambol99/goproxy"
+	"github.com/go-resty/resty"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = append([]*Resource{{URL: "/upload", WhiteListed: true, MaxUploadSize: 10}}, cfg.Resources...)
+	_, _, svc := newTestProxyService(cfg)
+
+	resp, err := resty.New().R().SetBody("0123456789").Post(svc + "/upload")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	resp, err = resty.New().R().SetBody("0123456789abc").Post(svc + "/upload")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode())
+}
+
+func TestUploadReader(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_upload_bytes", Help: "test"})
+	body := &uploadReader{
+		ReadCloser: ioutil.NopCloser(strings.NewReader("0123456789")),
+		limit:      5,
+		uploaded:   counter,
+	}
+	_, err := ioutil.ReadAll(body)
+	assert.Equal(t, errUploadTooLarge, err)
+	assert.True(t, body.exceeded)
+
+	body = &uploadReader{
+		ReadCloser: ioutil.NopCloser(strings.NewReader("0123456789")),
+		uploaded:   counter,
+	}
+	content, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(content))
+	assert.Equal(t, int64(10), body.read)
+}
+
+func TestUploadResponseFilter(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/upload", nil)
+	req.Body = &uploadReader{ReadCloser: ioutil.NopCloser(strings.NewReader("")), exceeded: true}
+	resp := uploadResponseFilter(nil, &goproxy.ProxyCtx{Req: req})
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+
+	req.Body = &uploadReader{ReadCloser: ioutil.NopCloser(strings.NewReader(""))}
+	assert.Nil(t, uploadResponseFilter(nil, &goproxy.ProxyCtx{Req: req}))
+}
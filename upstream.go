@@ -0,0 +1,149 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gambol99/goproxy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the classes of upstream failure
+const (
+	upstreamErrorDNS      = "dns"
+	upstreamErrorConnect  = "connect"
+	upstreamErrorTLS      = "tls"
+	upstreamErrorTimeout  = "timeout"
+	upstreamErrorReset    = "reset"
+	upstreamErrorCanceled = "canceled"
+	upstreamError5xx      = "5xx"
+	upstreamErrorOther    = "other"
+)
+
+// createUpstreamErrorFilter creates a response handler which classifies the failed upstream requests and
+// server errors, so a crashing backend can be told apart from a network issue
+func (r *oauthProxy) createUpstreamErrorFilter() func(*http.Response, *goproxy.ProxyCtx) *http.Response {
+	failures := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_errors_total",
+			Help: "The failed upstream requests partitioned by the class of error",
+		},
+		[]string{"class"},
+	)
+	failures = prometheus.MustRegisterOrGet(failures).(*prometheus.CounterVec)
+
+	return func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if ctx == nil || ctx.Req == nil {
+			return resp
+		}
+		fields := log.Fields{
+			"client_ip": ctx.Req.RemoteAddr,
+			"method":    ctx.Req.Method,
+			"path":      ctx.Req.URL.Path,
+			"upstream":  ctx.Req.URL.Host,
+		}
+		switch {
+		case resp == nil && ctx.Error != nil:
+			class := classifyUpstreamError(ctx.Error)
+			failures.WithLabelValues(class).Inc()
+			fields["error"] = ctx.Error.Error()
+			fields["error_class"] = class
+			log.WithFields(fields).Errorf("unable to proxy the request to the upstream")
+		case resp != nil && resp.StatusCode >= http.StatusInternalServerError:
+			failures.WithLabelValues(upstreamError5xx).Inc()
+			fields["error_class"] = upstreamError5xx
+			fields["status"] = resp.StatusCode
+			log.WithFields(fields).Warnf("the upstream responded with a server error")
+		}
+
+		return resp
+	}
+}
+
+// classifyUpstreamError reduces an error from the upstream transport to a class with a bounded cardinality
+func classifyUpstreamError(err error) string {
+	var dial bool
+	for err != nil {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+			continue
+		case *net.OpError:
+			if e.Op == "dial" {
+				dial = true
+			}
+			if e.Timeout() {
+				return upstreamErrorTimeout
+			}
+			err = e.Err
+			continue
+		case *os.SyscallError:
+			err = e.Err
+			continue
+		case *net.DNSError:
+			return upstreamErrorDNS
+		case tls.RecordHeaderError, *tls.CertificateVerificationError, x509.UnknownAuthorityError,
+			x509.HostnameError, x509.CertificateInvalidError:
+			return upstreamErrorTLS
+		case syscall.Errno:
+			switch e {
+			case syscall.ECONNRESET, syscall.EPIPE:
+				return upstreamErrorReset
+			case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+				return upstreamErrorConnect
+			}
+		}
+		break
+	}
+	if err == nil {
+		return upstreamErrorOther
+	}
+
+	switch {
+	case err == context.Canceled:
+		return upstreamErrorCanceled
+	case err == context.DeadlineExceeded:
+		return upstreamErrorTimeout
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return upstreamErrorTimeout
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return upstreamErrorReset
+	}
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "tls:") || strings.Contains(message, "x509:"):
+		return upstreamErrorTLS
+	case strings.Contains(message, "connection reset") || strings.Contains(message, "broken pipe"):
+		return upstreamErrorReset
+	case dial:
+		return upstreamErrorConnect
+	}
+
+	return upstreamErrorOther
+}
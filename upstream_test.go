@@ -0,0 +1,113 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/gambol99/goproxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyUpstreamError(t *testing.T) {
+	cs := []struct {
+		Error    error
+		Expected string
+	}{
+		{
+			Error:    &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "upstream"}},
+			Expected: upstreamErrorDNS,
+		},
+		{
+			Error:    &net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}},
+			Expected: upstreamErrorConnect,
+		},
+		{
+			Error:    &net.OpError{Op: "dial", Err: errors.New("unknown network")},
+			Expected: upstreamErrorConnect,
+		},
+		{
+			Error:    &net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}},
+			Expected: upstreamErrorReset,
+		},
+		{
+			Error:    &net.OpError{Op: "write", Err: &os.SyscallError{Syscall: "write", Err: syscall.EPIPE}},
+			Expected: upstreamErrorReset,
+		},
+		{Error: io.EOF, Expected: upstreamErrorReset},
+		{Error: x509.UnknownAuthorityError{}, Expected: upstreamErrorTLS},
+		{Error: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, Expected: upstreamErrorTLS},
+		{Error: errors.New("remote error: tls: handshake failure"), Expected: upstreamErrorTLS},
+		{Error: context.DeadlineExceeded, Expected: upstreamErrorTimeout},
+		{Error: &url.Error{Op: "Get", Err: context.DeadlineExceeded}, Expected: upstreamErrorTimeout},
+		{Error: context.Canceled, Expected: upstreamErrorCanceled},
+		{Error: &net.OpError{Op: "dial"}, Expected: upstreamErrorOther},
+		{Error: errors.New("unknown"), Expected: upstreamErrorOther},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, classifyUpstreamError(c.Error), "case %d, error: %v", i, c.Error)
+	}
+}
+
+func TestClassifyUpstreamErrorConnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+address, nil)
+	_, err = (&http.Transport{}).RoundTrip(req)
+	if !assert.Error(t, err) {
+		return
+	}
+	assert.Equal(t, upstreamErrorConnect, classifyUpstreamError(err))
+}
+
+func TestUpstreamErrorFilter(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	filter := p.createUpstreamErrorFilter()
+	failures := prometheus.MustRegisterOrGet(prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "upstream_errors_total", Help: "The failed upstream requests partitioned by the class of error"},
+		[]string{"class"},
+	)).(*prometheus.CounterVec)
+	failures.Reset()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1/test", nil)
+	assert.Nil(t, filter(nil, &goproxy.ProxyCtx{Req: req, Error: &net.DNSError{Err: "no such host"}}))
+	assert.Equal(t, float64(1), getMetricValue(t, failures.WithLabelValues(upstreamErrorDNS)))
+
+	resp := newFakeUpstreamResponse(http.StatusBadGateway, "bad gateway")
+	assert.Equal(t, resp, filter(resp, &goproxy.ProxyCtx{Req: req}))
+	assert.Equal(t, float64(1), getMetricValue(t, failures.WithLabelValues(upstreamError5xx)))
+
+	resp = newFakeUpstreamResponse(http.StatusNotFound, "not found")
+	assert.Equal(t, resp, filter(resp, &goproxy.ProxyCtx{Req: req}))
+	assert.Equal(t, float64(1), getMetricValue(t, failures.WithLabelValues(upstreamError5xx)))
+	assert.Nil(t, filter(nil, nil))
+}
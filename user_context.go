@@ -17,6 +17,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"strings"
 	"time"
 
@@ -42,11 +43,93 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 		// choice: set the preferredName to the Email if claim not found
 		preferredName = identity.Email
 	}
-	// step: retrieve the audience from access token
-	audience, found, err := claims.StringClaim(claimAudience)
-	if err != nil || !found {
+	// step: retrieve the audience from access token, which may be a list
+	audiences := getAudiences(claims)
+	if len(audiences) == 0 {
 		return nil, ErrNoTokenAudience
 	}
+	return &userContext{
+		id:            identity.ID,
+		name:          preferredName,
+		audience:      audiences[0],
+		audiences:     audiences,
+		preferredName: preferredName,
+		email:         identity.Email,
+		expiresAt:     identity.ExpiresAt,
+		roles:         extractRoles(claims),
+		token:         token,
+		claims:        claims,
+	}, nil
+}
+
+// extractServiceAccount extracts the identity of a token issued to a client by the client_credentials
+// grant, which carries no email or username; the client id is used as the name of the identity. The
+// audience may be a list, in which case the expected audience is used if present, and defaults to
+// the client id if the token has none
+func extractServiceAccount(token jose.JWT, clientID, expected string) (*userContext, error) {
+	claims, err := token.Claims()
+	if err != nil {
+		return nil, err
+	}
+	identity, err := oidc.IdentityFromClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+	audience := clientID
+	audiences := getAudiences(claims)
+	if len(audiences) > 0 {
+		audience = audiences[0]
+		if containedIn(expected, audiences) {
+			audience = expected
+		}
+	} else {
+		audiences = []string{clientID}
+	}
+
+	return &userContext{
+		id:             identity.ID,
+		name:           clientID,
+		audience:       audience,
+		audiences:      audiences,
+		preferredName:  clientID,
+		expiresAt:      identity.ExpiresAt,
+		roles:          extractRoles(claims),
+		token:          token,
+		claims:         claims,
+		serviceAccount: true,
+	}, nil
+}
+
+// getAudiences returns the audiences of the token, the aud claim being a string or a list
+func getAudiences(claims jose.Claims) []string {
+	if audiences, found, err := claims.StringsClaim(claimAudience); err == nil && found {
+		return audiences
+	}
+	if audience, found, err := claims.StringClaim(claimAudience); err == nil && found {
+		return []string{audience}
+	}
+
+	return nil
+}
+
+// getServiceAccountClientID returns the client id of a service account token, one without a user
+func getServiceAccountClientID(claims jose.Claims) (string, bool) {
+	for _, name := range []string{claimEmail, claimPreferredName} {
+		if _, found := claims[name]; found {
+			return "", false
+		}
+	}
+	for _, name := range []string{claimClientID, claimKeycloakClientID, claimAuthorizedParty} {
+		if clientID, found, err := claims.StringClaim(name); err == nil && found && clientID != "" {
+			return clientID, true
+		}
+	}
+
+	return "", false
+}
+
+// extractRoles extracts the realm and client roles of the token, the client roles prefixed with the client
+func extractRoles(claims jose.Claims) []string {
 	// step: extract the realm roles
 	var list []string
 	if realmRoles, found := claims[claimRealmAccess].(map[string]interface{}); found {
@@ -69,17 +152,7 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 		}
 	}
 
-	return &userContext{
-		id:            identity.ID,
-		name:          preferredName,
-		audience:      audience,
-		preferredName: preferredName,
-		email:         identity.Email,
-		expiresAt:     identity.ExpiresAt,
-		roles:         list,
-		token:         token,
-		claims:        claims,
-	}, nil
+	return list
 }
 
 // isAudience checks the audience
@@ -88,7 +161,7 @@ func (r userContext) isAudience(aud string) bool {
 		return true
 	}
 
-	return false
+	return containedIn(aud, r.audiences)
 }
 
 // getRoles returns a list of roles
@@ -96,11 +169,30 @@ func (r userContext) getRoles() string {
 	return strings.Join(r.roles, ",")
 }
 
+// getAccessToken returns the access token as given by the client
+func (r userContext) getAccessToken() string {
+	if r.opaque {
+		return r.opaqueToken.Value()
+	}
+
+	return r.token.Encode()
+}
+
 // isExpired checks if the token has expired
 func (r userContext) isExpired() bool {
 	return r.expiresAt.Before(time.Now())
 }
 
+// sessionStarted returns when the user authenticated, defaulting to the issue of the token
+func (r userContext) sessionStarted() time.Time {
+	if started, found, err := r.claims.TimeClaim(claimAuthTime); err == nil && found {
+		return started
+	}
+	issuedAt, _, _ := r.claims.TimeClaim(claimIssuedAt)
+
+	return issuedAt
+}
+
 // isBearerToken checks if the token
 func (r userContext) isBearer() bool {
 	return r.bearerToken
@@ -115,3 +207,8 @@ func (r userContext) isCookie() bool {
 func (r userContext) String() string {
 	return fmt.Sprintf("user: %s, expires: %s, roles: %s", r.preferredName, r.expiresAt.String(), strings.Join(r.roles, ","))
 }
+
+// Format writes the string representation for any verb, so the token is never printed
+func (r userContext) Format(f fmt.State, verb rune) {
+	io.WriteString(f, r.String())
+}
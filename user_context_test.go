@@ -19,6 +19,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/coreos/go-oidc/jose"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -32,6 +33,16 @@ func TestIsAudience(t *testing.T) {
 	if user.isAudience("test1") {
 		t.Error("return should not have been true")
 	}
+	user.audiences = []string{"account", "api"}
+	if !user.isAudience("api") {
+		t.Error("return should not have been false")
+	}
+}
+
+func TestGetAudiences(t *testing.T) {
+	assert.Equal(t, []string{"test"}, getAudiences(jose.Claims{"aud": "test"}))
+	assert.Equal(t, []string{"account", "api"}, getAudiences(jose.Claims{"aud": []interface{}{"account", "api"}}))
+	assert.Empty(t, getAudiences(jose.Claims{}))
 }
 
 func TestGetUserRoles(t *testing.T) {
@@ -101,3 +112,55 @@ func TestUserContextString(t *testing.T) {
 	assert.NotNil(t, context)
 	assert.NotEmpty(t, context.String())
 }
+
+func TestGetServiceAccountClientID(t *testing.T) {
+	cs := []struct {
+		Claims   jose.Claims
+		ClientID string
+		Found    bool
+	}{
+		{Claims: jose.Claims{"sub": "1", "clientId": "batch"}, ClientID: "batch", Found: true},
+		{Claims: jose.Claims{"sub": "1", "client_id": "batch", "azp": "other"}, ClientID: "batch", Found: true},
+		{Claims: jose.Claims{"sub": "1", "azp": "batch"}, ClientID: "batch", Found: true},
+		{Claims: jose.Claims{"sub": "1", "azp": "batch", "email": "user@example.com"}},
+		{Claims: jose.Claims{"sub": "1", "azp": "batch", "preferred_username": "user"}},
+		{Claims: jose.Claims{"sub": "1"}},
+	}
+	for i, c := range cs {
+		clientID, found := getServiceAccountClientID(c.Claims)
+		assert.Equal(t, c.ClientID, clientID, "case %d", i)
+		assert.Equal(t, c.Found, found, "case %d", i)
+	}
+}
+
+func TestExtractServiceAccount(t *testing.T) {
+	token, err := jose.NewJWT(jose.JOSEHeader{"alg": "RS256"}, jose.Claims{
+		"sub":          "8c1f7e6a",
+		"exp":          float64(time.Now().Add(time.Hour).Unix()),
+		"clientId":     "batch",
+		"realm_access": map[string]interface{}{"roles": []interface{}{"reporting"}},
+	})
+	assert.NoError(t, err)
+
+	_, err = extractIdentity(token)
+	assert.Equal(t, ErrNoTokenAudience, err)
+
+	user, err := extractServiceAccount(token, "batch", "test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "8c1f7e6a", user.id)
+	assert.Equal(t, "batch", user.name)
+	assert.Equal(t, "batch", user.preferredName)
+	assert.Equal(t, "batch", user.audience)
+	assert.Equal(t, []string{"reporting"}, user.roles)
+	assert.True(t, user.serviceAccount)
+
+	// step: keycloak issues the audience as a list
+	claims, _ := token.Claims()
+	claims.Add("aud", []interface{}{"account", "test"})
+	token, _ = jose.NewJWT(token.Header, claims)
+	if user, err = extractServiceAccount(token, "batch", "test"); assert.NoError(t, err) {
+		assert.Equal(t, "test", user.audience)
+	}
+}
@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
@@ -31,8 +32,10 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -51,7 +54,14 @@ import (
 
 var (
 	httpMethodRegex = regexp.MustCompile("^(ANY|GET|POST|DELETE|PATCH|HEAD|PUT|TRACE)$")
-	symbolsFilter   = regexp.MustCompilePOSIX("[_$><\\[\\].,\\+-/'%^&*()!\\\\]+")
+	// cookieNameRegex are the token characters permitted in a cookie name, rfc 6265
+	cookieNameRegex = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]+$")
+	// encryptionKeyIDRegex are the characters permitted in the key id, which sits in the sealed values
+	encryptionKeyIDRegex = regexp.MustCompile("^[A-Za-z0-9_-]*$")
+	symbolsFilter        = regexp.MustCompilePOSIX("[_$><\\[\\].,\\+-/'%^&*()!\\\\]+")
+	// hopByHopHeaders are the headers meaningful only for a single connection
+	hopByHopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+		"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
 )
 
 // readConfigFile reads and parses the configuration file
@@ -63,7 +73,7 @@ func readConfigFile(filename string, config *Config) error {
 	}
 	// step: attempt to un-marshal the data
 	switch ext := filepath.Ext(filename); ext {
-	case "json":
+	case ".json":
 		err = json.Unmarshal(content, config)
 	default:
 		err = yaml.Unmarshal(content, config)
@@ -72,7 +82,43 @@ func readConfigFile(filename string, config *Config) error {
 	return err
 }
 
-// encryptDataBlock encrypts the plaintext string with the key
+// sealDataBlock encrypts and authenticates the plaintext with the key using aes-gcm, the random nonce is
+// prefixed to the cipher text
+func sealDataBlock(plaintext, key, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return []byte{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return []byte{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return []byte{}, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// openDataBlock decrypts and verifies the cipher text sealed by sealDataBlock
+func openDataBlock(cipherText, key, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return []byte{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return []byte{}, err
+	}
+	if len(cipherText) < aead.NonceSize() {
+		return []byte{}, errors.New("failed to decrypt the ciphertext, the text is too short")
+	}
+
+	return aead.Open(nil, cipherText[:aead.NonceSize()], cipherText[aead.NonceSize():], additional)
+}
+
+// encryptDataBlock encrypts the plaintext string with the key, the legacy unauthenticated aes-cfb
 func encryptDataBlock(plaintext, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -114,18 +160,47 @@ func decryptDataBlock(cipherText, key []byte) ([]byte, error) {
 	return cipherText, nil
 }
 
-// encodeText encodes the session state information into a value for a cookie to consume
-func encodeText(plaintext string, key string) (string, error) {
-	cipherText, err := encryptDataBlock([]byte(plaintext), []byte(key))
+// isSealedText checks if the value is in the authenticated format
+func isSealedText(value string) bool {
+	return strings.HasPrefix(value, sealedTextVersion+".")
+}
+
+// encodeText encrypts and authenticates the session state into a value for a cookie or the store to consume,
+// the value is the version, key id and sealed text, i.e. v2.<key id>.<nonce|cipher text>; the key id is the
+// configured label of the key, possibly empty, and never derived from the key itself
+func encodeText(plaintext, key, keyID string) (string, error) {
+	header := sealedTextVersion + "." + keyID
+	cipherText, err := sealDataBlock([]byte(plaintext), []byte(key), []byte(header))
 	if err != nil {
 		return "", err
 	}
 
-	return base64.StdEncoding.EncodeToString(cipherText), nil
+	return header + "." + base64.RawURLEncoding.EncodeToString(cipherText), nil
 }
 
-// decodeText decodes the session state cookie value
-func decodeText(state, key string) (string, error) {
+// decodeText decodes the session state value with the key it was sealed by, the sealed values being tried
+// against each key as a wrong key fails the authentication. The values of the legacy format
+// are tried against each key in turn; the cipher isn't authenticated, a wrong key yields noise rather than
+// an error, so the key is the first giving a printable plaintext, the tokens and session state being ascii
+func decodeText(state string, keys ...string) (string, error) {
+	if isSealedText(state) {
+		items := strings.Split(state, ".")
+		if len(items) != 3 {
+			return "", ErrInvalidSession
+		}
+		cipherText, err := base64.RawURLEncoding.DecodeString(items[2])
+		if err != nil {
+			return "", ErrInvalidSession
+		}
+		for _, key := range keys {
+			if plaintext, err := openDataBlock(cipherText, []byte(key), []byte(items[0]+"."+items[1])); err == nil {
+				return string(plaintext), nil
+			}
+		}
+
+		return "", ErrInvalidSession
+	}
+
 	// step: decode the base64 encrypted cookie
 	cipherText, err := base64.StdEncoding.DecodeString(state)
 	if err != nil {
@@ -133,12 +208,25 @@ func decodeText(state, key string) (string, error) {
 	}
 
 	// step: decrypt the cookie back in the expiration|token
-	encoded, err := decryptDataBlock(cipherText, []byte(key))
-	if err != nil {
-		return "", ErrInvalidSession
+	for _, key := range keys {
+		encoded, err := decryptDataBlock(append([]byte{}, cipherText...), []byte(key))
+		if err == nil && isPrintable(encoded) {
+			return string(encoded), nil
+		}
 	}
 
-	return string(encoded), nil
+	return "", ErrInvalidSession
+}
+
+// isPrintable checks the text is printable ascii
+func isPrintable(text []byte) bool {
+	for _, x := range text {
+		if x < 0x20 || x > 0x7e {
+			return false
+		}
+	}
+
+	return true
 }
 
 // newOpenIDClient initializes the openID configuration, note: the redirection url is deliberately left blank
@@ -153,41 +241,31 @@ func newOpenIDClient(cfg *Config) (*oidc.Client, oidc.ProviderConfig, *http.Clie
 	}
 
 	// step: create a idp http client
-	hc := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: cfg.SkipOpenIDProviderTLSVerify,
-			},
+	transport := newProviderTransport(&http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: cfg.SkipOpenIDProviderTLSVerify,
 		},
-		Timeout: time.Second * 10,
+	}, cfg.OpenIDProviderRetries, cfg.OpenIDProviderBreakerThreshold, cfg.OpenIDProviderBreakerCooldown,
+		cfg.OpenIDProviderThrottleCooldown)
+	hc := &http.Client{
+		Transport: transport,
+		Timeout:   cfg.OpenIDProviderTimeout,
 	}
 
-	// step: attempt to retrieve the provider configuration
-	completeCh := make(chan bool)
-	go func() {
-		for {
-			log.Infof("attempting to retrieve openid configuration from discovery url: %s", cfg.DiscoveryURL)
-			if config, err = oidc.FetchProviderConfig(hc, cfg.DiscoveryURL); err == nil {
-				break // break and complete
-			}
-			log.Warnf("failed to get provider configuration from discovery url: %s, %s", cfg.DiscoveryURL, err)
-			time.Sleep(time.Second * 3)
-		}
-		completeCh <- true
-	}()
-	// step: wait for timeout or successful retrieval
-	select {
-	case <-time.After(30 * time.Second):
-		return nil, config, nil, errors.New("failed to retrieve the provider configuration from discovery url")
-	case <-completeCh:
-		log.Infof("successfully retrieved the openid configuration from the discovery url: %s", cfg.DiscoveryURL)
+	// step: attempt to retrieve the provider configuration, the provider may still be starting
+	if config, err = fetchProviderConfig(hc, cfg.DiscoveryURL, cfg.OpenIDProviderDiscoveryTimeout); err != nil {
+		return nil, config, nil, err
+	}
+	log.Infof("successfully retrieved the openid configuration from the discovery url: %s", cfg.DiscoveryURL)
+	if config.TokenEndpoint != nil {
+		transport.setTokenEndpoint(config.TokenEndpoint.String())
 	}
 
 	client, err := oidc.NewClient(oidc.ClientConfig{
 		ProviderConfig: config,
 		Credentials: oidc.ClientCredentials{
 			ID:     cfg.ClientID,
-			Secret: cfg.ClientSecret,
+			Secret: cfg.ClientSecret.Value(),
 		},
 		RedirectURL: fmt.Sprintf("%s/oauth/callback", cfg.RedirectionURL),
 		Scope:       append(cfg.Scopes, oidc.DefaultScope...),
@@ -223,6 +301,63 @@ func isValidHTTPMethod(method string) bool {
 	return httpMethodRegex.MatchString(method)
 }
 
+// isValidCookieName ensures the name is permitted in a cookie, the browsers drop any cookie which isn't
+func isValidCookieName(name string) bool {
+	return cookieNameRegex.MatchString(name)
+}
+
+// isPathWithin checks if the path is the prefix, or beneath it
+func isPathWithin(path, prefix string) bool {
+	if prefix == "/" || path == prefix {
+		return true
+	}
+
+	return strings.HasPrefix(path, prefix+"/")
+}
+
+// withContext runs the function, returning early with the context error if the client goes away or the
+// deadline expires; the function itself carries on as the provider and store clients do not support contexts
+func withContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isAllowedHost checks the host, with or without the port, is in the list
+func isAllowedHost(host string, allowed []string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, x := range allowed {
+		if strings.EqualFold(x, host) || strings.EqualFold(x, hostname) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isValidAuthParams ensures the custom authorization parameters do not override the protocol ones
+func isValidAuthParams(params map[string]string) error {
+	for name := range params {
+		switch name {
+		case "client_id", "redirect_uri", "response_type", "state", "scope", "nonce":
+			return fmt.Errorf("the authorization parameter: %s cannot be overridden", name)
+		}
+	}
+
+	return nil
+}
+
 // defaultTo returns the value of the default
 func defaultTo(v, d string) string {
 	if v != "" {
@@ -326,6 +461,74 @@ func isUpgradedConnection(req *http.Request) bool {
 	return false
 }
 
+// isWebsocketUpgrade checks if the headers are requesting a websocket upgrade
+func isWebsocketUpgrade(header http.Header) bool {
+	return strings.EqualFold(header.Get(headerUpgrade), "websocket")
+}
+
+// splitRequestURI splits a request uri into the path and query
+func splitRequestURI(uri string) (string, url.Values) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri, nil
+	}
+
+	return u.Path, u.Query()
+}
+
+// normalizePath removes the dot segments and duplicate slashes from the decoded path, retaining a trailing slash
+func normalizePath(p string) string {
+	normalized := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && normalized != "/" {
+		normalized += "/"
+	}
+
+	return normalized
+}
+
+// isDoubleEncoded checks if the decoded path still holds a percent-encoding, i.e. the client encoded it twice
+func isDoubleEncoded(p string) bool {
+	for i := 0; i+2 < len(p); i++ {
+		if p[i] == '%' && isHex(p[i+1]) && isHex(p[i+2]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isHex checks the character is a hexadecimal digit
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// stripHopByHopHeaders removes the hop-by-hop headers, RFC 7230 section 6.1, along with any listed in
+// the Connection header; a websocket upgrade retains the Connection and Upgrade headers
+func stripHopByHopHeaders(header http.Header) {
+	websocket := isWebsocketUpgrade(header)
+	for _, value := range header[headerConnection] {
+		for _, name := range strings.Split(value, ",") {
+			name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+			if name == "" || (websocket && name == headerUpgrade) {
+				continue
+			}
+			header.Del(name)
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	if websocket {
+		header.Set(headerConnection, headerUpgrade)
+		header.Set(headerUpgrade, "websocket")
+	}
+}
+
+// withConnection adds the connection to the request context
+func withConnection(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connectionContextKey, conn)
+}
+
 // transferBytes transfers bytes between the sink and source
 func transferBytes(src io.Reader, dest io.Writer, wg *sync.WaitGroup) (int64, error) {
 	defer wg.Done()
@@ -406,6 +609,25 @@ func toHeader(v string) string {
 	return strings.Join(list, "-")
 }
 
+// hasClaimValue checks if the claim is equal to, or is a list containing, the value
+func hasClaimValue(claims jose.Claims, name, value string) bool {
+	claim, found := claims[name]
+	if !found {
+		return false
+	}
+	switch v := claim.(type) {
+	case []interface{}:
+		for _, x := range v {
+			if fmt.Sprintf("%v", x) == value {
+				return true
+			}
+		}
+		return false
+	default:
+		return fmt.Sprintf("%v", v) == value
+	}
+}
+
 // capitalize capitalizes the first letter of a word
 func capitalize(s string) string {
 	if s == "" {
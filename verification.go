@@ -0,0 +1,104 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// verificationPool bounds the number of token verifications running at once, so a spike of requests
+// degrades the latency rather than starving the proxy of cpu; a nil pool is unbounded
+type verificationPool struct {
+	// the slots for the running verifications
+	running chan struct{}
+	// the slots for the running and waiting verifications
+	admitted chan struct{}
+	// the verifications waiting for a slot
+	waiting prometheus.Gauge
+	// the verifications in progress
+	inflight prometheus.Gauge
+	// the verifications rejected as the queue is full
+	rejected prometheus.Counter
+}
+
+// newVerificationPool creates a pool running at most concurrency verifications with queue waiting
+func newVerificationPool(concurrency, queue int) *verificationPool {
+	waiting := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "token_verification_queue_depth",
+		Help: "The token verifications waiting for a worker",
+	})
+	inflight := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "token_verification_inflight",
+		Help: "The token verifications in progress",
+	})
+	rejected := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "token_verification_rejected_total",
+		Help: "The token verifications rejected as the queue was full",
+	})
+
+	return &verificationPool{
+		running:  make(chan struct{}, concurrency),
+		admitted: make(chan struct{}, concurrency+queue),
+		waiting:  prometheus.MustRegisterOrGet(waiting).(prometheus.Gauge),
+		inflight: prometheus.MustRegisterOrGet(inflight).(prometheus.Gauge),
+		rejected: prometheus.MustRegisterOrGet(rejected).(prometheus.Counter),
+	}
+}
+
+// verify runs the verification once a slot is free, returning ErrVerificationOverloaded if the queue
+// is full or the context error if the client goes away; the slot is held until the verification
+// completes, even if the client has gone
+func (r *verificationPool) verify(ctx context.Context, fn func() error) error {
+	if r == nil {
+		return withContext(ctx, fn)
+	}
+	select {
+	case r.admitted <- struct{}{}:
+	default:
+		r.rejected.Inc()
+		return ErrVerificationOverloaded
+	}
+
+	r.waiting.Inc()
+	select {
+	case r.running <- struct{}{}:
+		r.waiting.Dec()
+	case <-ctx.Done():
+		r.waiting.Dec()
+		<-r.admitted
+		return ctx.Err()
+	}
+
+	r.inflight.Inc()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			r.inflight.Dec()
+			<-r.running
+			<-r.admitted
+		}()
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
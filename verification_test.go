@@ -0,0 +1,106 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockVerification occupies a slot of the pool until the returned function is called
+func blockVerification(pool *verificationPool) func() {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go pool.verify(context.Background(), func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	return func() { close(release) }
+}
+
+func TestVerificationPool(t *testing.T) {
+	var unbounded *verificationPool
+	assert.NoError(t, unbounded.verify(context.Background(), func() error { return nil }))
+
+	pool := newVerificationPool(1, 1)
+	expected := errors.New("failed")
+	assert.Equal(t, expected, pool.verify(context.Background(), func() error { return expected }))
+
+	release := blockVerification(pool)
+	// step: the next verification should wait for the slot
+	waited := make(chan error, 1)
+	go func() {
+		waited <- pool.verify(context.Background(), func() error { return nil })
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// step: the queue is full, so we should be rejected
+	assert.Equal(t, ErrVerificationOverloaded, pool.verify(context.Background(), func() error { return nil }))
+	release()
+	assert.NoError(t, <-waited)
+}
+
+func TestVerificationPoolContext(t *testing.T) {
+	pool := newVerificationPool(1, 1)
+	release := blockVerification(pool)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, pool.verify(ctx, func() error { return nil }))
+	// step: the cancelled verification should have given up its place in the queue
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, pool.verify(ctx, func() error { return nil }))
+}
+
+func TestVerificationOverloaded(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.MaxVerifyConcurrency = 1
+	cfg.MaxVerifyQueue = 0
+	proxy, idp, svc := newTestProxyService(cfg)
+	token := newTestToken(idp.getLocation())
+	signed, _ := idp.signToken(token.claims)
+
+	request := func() *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, svc+fakeAuthAllURL+"/test", nil)
+		req.Header.Set("Authorization", "Bearer "+signed.Encode())
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		resp.Body.Close()
+
+		return resp
+	}
+	if resp := request(); resp != nil {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	release := blockVerification(proxy.verifier)
+	if resp := request(); resp != nil {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	}
+	release()
+}
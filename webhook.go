@@ -0,0 +1,239 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookGitHubHeader carries the github style signature, sha256=<hex hmac of the body>
+	webhookGitHubHeader = "X-Hub-Signature-256"
+	// webhookGitHubDeliveryHeader carries the unique id of a github style delivery
+	webhookGitHubDeliveryHeader = "X-GitHub-Delivery"
+	// webhookStripeHeader carries the stripe style signature, t=<timestamp>,v1=<hex hmac of timestamp.body>
+	webhookStripeHeader = "Stripe-Signature"
+	// webhookMaxBodySize is the largest body we'll read to verify the signature, unless the resource says otherwise
+	webhookMaxBodySize = 10 << 20
+	// webhookTolerance is how old a timestamped signature can be, guarding against replays
+	webhookTolerance = 5 * time.Minute
+	// webhookReplayWindow is how long the deliveries and signatures without a timestamp are remembered
+	webhookReplayWindow = 24 * time.Hour
+	// webhookStorePrefix prefixes the deliveries of the webhooks seen in the store
+	webhookStorePrefix = "webhook:"
+	// webhookReplaysPrune is the size of the deliveries held in memory beyond which the expired are removed
+	webhookReplaysPrune = 1024
+)
+
+var (
+	// errWebhookSignature indicates the signature of the webhook is invalid
+	errWebhookSignature = errors.New("the webhook signature is invalid")
+	// errWebhookTimestamp indicates the timestamp of the webhook signature is outside the tolerance
+	errWebhookTimestamp = errors.New("the webhook signature timestamp is outside the tolerance")
+	// errWebhookDelivery indicates the github style webhook has no delivery id
+	errWebhookDelivery = errors.New("the webhook has no delivery id")
+	// errWebhookReplay indicates the delivery or signature of the webhook has been seen before
+	errWebhookReplay = errors.New("the webhook delivery has been replayed")
+)
+
+// webhookReplays records the deliveries and signatures of the webhooks, so a captured request can't be replayed;
+// the counters of the store are shared by the instances, else the deliveries are held in memory
+type webhookReplays struct {
+	sync.Mutex
+	// the counters in the store, if any
+	counter storageCounter
+	// the deliveries seen and when they're forgotten, without a store
+	seen map[string]time.Time
+}
+
+// newWebhookReplays creates the record of the webhook deliveries
+func newWebhookReplays(store storage) *webhookReplays {
+	replays := &webhookReplays{seen: make(map[string]time.Time)}
+	if counter, ok := getStorageCounter(store); ok {
+		replays.counter = counter
+	}
+
+	return replays
+}
+
+// isReplay records the key for the duration, checking if it has been seen before
+func (r *webhookReplays) isReplay(key string, ttl time.Duration) (bool, error) {
+	sum := sha256.Sum256([]byte(key))
+	hashed := webhookStorePrefix + hex.EncodeToString(sum[:])
+	if r.counter != nil {
+		count, err := r.counter.Increment(hashed, ttl)
+		return count > 1, err
+	}
+
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	if expires, found := r.seen[hashed]; found && now.Before(expires) {
+		return true, nil
+	}
+	if len(r.seen) >= webhookReplaysPrune {
+		for k, expires := range r.seen {
+			if now.After(expires) {
+				delete(r.seen, k)
+			}
+		}
+	}
+	r.seen[hashed] = now.Add(ttl)
+
+	return false, nil
+}
+
+// isWebhookRequest checks the request is one the webhook is configured for, the signature covering only the body;
+// the path must be that of the resource, the method one of its methods and the query no more than it requires
+func isWebhookRequest(resource *Resource, req *http.Request) bool {
+	if !containedIn("ANY", resource.Methods) && !containedIn(req.Method, resource.Methods) {
+		return false
+	}
+	uri, path := resource.URL, req.URL.Path
+	if resource.CaseInsensitive {
+		uri, path = strings.ToLower(uri), strings.ToLower(path)
+	}
+	if path != uri && !(resource.IgnoreTrailingSlash && path == strings.TrimSuffix(uri, "/")) {
+		return false
+	}
+	for name := range req.URL.Query() {
+		if _, found := resource.Query[name]; !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkWebhookReplay rejects the verified webhooks seen before; the github style signatures carry no timestamp, so
+// both the delivery id and the signature are remembered, while the stripe style are remembered for the tolerance
+func (r *oauthProxy) checkWebhookReplay(req *http.Request) error {
+	var keys []string
+	ttl := 2 * webhookTolerance
+	if signature := req.Header.Get(webhookGitHubHeader); signature != "" {
+		delivery := req.Header.Get(webhookGitHubDeliveryHeader)
+		if delivery == "" {
+			return errWebhookDelivery
+		}
+		keys = append(keys, "delivery:"+delivery, "signature:"+signature)
+		ttl = webhookReplayWindow
+	} else {
+		keys = append(keys, "signature:"+req.Header.Get(webhookStripeHeader))
+	}
+	for _, key := range keys {
+		replayed, err := r.webhooks.isReplay(key, ttl)
+		if err != nil {
+			return err
+		}
+		if replayed {
+			return errWebhookReplay
+		}
+	}
+
+	return nil
+}
+
+// hasWebhookSignature checks if the request carries a webhook signature
+func hasWebhookSignature(req *http.Request) bool {
+	return req.Header.Get(webhookGitHubHeader) != "" || req.Header.Get(webhookStripeHeader) != ""
+}
+
+// verifyWebhookSignature verifies the hmac signature of the request body against the secret, the body
+// is read and replaced, so it is still passed on to the upstream
+func verifyWebhookSignature(req *http.Request, secret []byte, limit int64) error {
+	if limit <= 0 {
+		limit = webhookMaxBodySize
+	}
+	var body []byte
+	if req.Body != nil {
+		content, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+		if err != nil {
+			return err
+		}
+		req.Body.Close()
+		if int64(len(content)) > limit {
+			return errUploadTooLarge
+		}
+		body = content
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	if signature := req.Header.Get(webhookGitHubHeader); signature != "" {
+		if !strings.HasPrefix(signature, "sha256=") {
+			return errWebhookSignature
+		}
+		if !isValidHMAC(secret, body, strings.TrimPrefix(signature, "sha256=")) {
+			return errWebhookSignature
+		}
+
+		return nil
+	}
+
+	// step: the stripe signature is over the timestamp and body, permitting several v1 signatures
+	// while the secret is rolled
+	var timestamp string
+	var signatures []string
+	for _, x := range strings.Split(req.Header.Get(webhookStripeHeader), ",") {
+		kp := strings.SplitN(strings.TrimSpace(x), "=", 2)
+		if len(kp) != 2 {
+			continue
+		}
+		switch kp[0] {
+		case "t":
+			timestamp = kp[1]
+		case "v1":
+			signatures = append(signatures, kp[1])
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return errWebhookSignature
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > webhookTolerance || age < -webhookTolerance {
+		return errWebhookTimestamp
+	}
+	payload := append([]byte(timestamp+"."), body...)
+	for _, signature := range signatures {
+		if isValidHMAC(secret, payload, signature) {
+			return nil
+		}
+	}
+
+	return errWebhookSignature
+}
+
+// isValidHMAC checks the hex encoded signature is the hmac-sha256 of the payload
+func isValidHMAC(secret, payload []byte, signature string) bool {
+	decoded, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+
+	return hmac.Equal(decoded, mac.Sum(nil))
+}
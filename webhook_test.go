@@ -0,0 +1,163 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testWebhookPayload = `{"action":"opened"}`
+
+func getTestWebhookHMAC(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func getTestStripeSignature(secret string, timestamp time.Time, payload string) string {
+	t := fmt.Sprintf("%d", timestamp.Unix())
+	return fmt.Sprintf("t=%s,v1=%s", t, getTestWebhookHMAC(secret, t+"."+payload))
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	cs := []struct {
+		Header    string
+		Signature string
+		Ok        bool
+	}{
+		{Header: webhookGitHubHeader, Signature: "sha256=" + getTestWebhookHMAC("secret", testWebhookPayload), Ok: true},
+		{Header: webhookGitHubHeader, Signature: "sha256=" + getTestWebhookHMAC("wrong", testWebhookPayload)},
+		{Header: webhookGitHubHeader, Signature: getTestWebhookHMAC("secret", testWebhookPayload)},
+		{Header: webhookGitHubHeader, Signature: "sha256=zz"},
+		{Header: webhookStripeHeader, Signature: getTestStripeSignature("secret", time.Now(), testWebhookPayload), Ok: true},
+		{
+			Header:    webhookStripeHeader,
+			Signature: getTestStripeSignature("secret", time.Now(), testWebhookPayload) + ",v1=" + getTestWebhookHMAC("old", "x"),
+			Ok:        true,
+		},
+		{Header: webhookStripeHeader, Signature: getTestStripeSignature("wrong", time.Now(), testWebhookPayload)},
+		{Header: webhookStripeHeader, Signature: getTestStripeSignature("secret", time.Now().Add(-time.Hour), testWebhookPayload)},
+		{Header: webhookStripeHeader, Signature: "v1=" + getTestWebhookHMAC("secret", testWebhookPayload)},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/hooks", strings.NewReader(testWebhookPayload))
+		req.Header.Set(c.Header, c.Signature)
+		err := verifyWebhookSignature(req, []byte("secret"), 0)
+		if !c.Ok {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d", i)
+		// step: the body is still there for the upstream
+		body, _ := ioutil.ReadAll(req.Body)
+		assert.Equal(t, testWebhookPayload, string(body), "case %d", i)
+	}
+
+	// step: the body cannot exceed the limit
+	req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/hooks", strings.NewReader(testWebhookPayload))
+	req.Header.Set(webhookGitHubHeader, "sha256="+getTestWebhookHMAC("secret", testWebhookPayload))
+	assert.Equal(t, errUploadTooLarge, verifyWebhookSignature(req, []byte("secret"), 4))
+}
+
+func TestWebhookResource(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.WebhookSecrets = map[string]string{"github": "secret"}
+	cfg.Resources = []*Resource{{URL: "/hooks/github", Methods: []string{"POST"}, Webhook: "github"}}
+	_, _, svc := newTestProxyService(cfg)
+
+	first, second := `{"action":"opened"}`, `{"action":"closed"}`
+	cs := []struct {
+		URI          string
+		Payload      string
+		Signature    string
+		Delivery     string
+		ExpectedCode int
+	}{
+		{Payload: first, Signature: getTestWebhookHMAC("secret", first), Delivery: "1", ExpectedCode: http.StatusOK},
+		{Payload: first, Signature: getTestWebhookHMAC("wrong", first), Delivery: "2", ExpectedCode: http.StatusUnauthorized},
+		// step: the deliveries and signatures are only accepted once
+		{Payload: first, Signature: getTestWebhookHMAC("secret", first), Delivery: "1", ExpectedCode: http.StatusUnauthorized},
+		{Payload: first, Signature: getTestWebhookHMAC("secret", first), Delivery: "3", ExpectedCode: http.StatusUnauthorized},
+		{Payload: second, Signature: getTestWebhookHMAC("secret", second), Delivery: "1", ExpectedCode: http.StatusUnauthorized},
+		{Payload: second, Signature: getTestWebhookHMAC("secret", second), ExpectedCode: http.StatusUnauthorized},
+		{Payload: second, Signature: getTestWebhookHMAC("secret", second), Delivery: "4", ExpectedCode: http.StatusOK},
+		// step: the signature is not accepted outside the path and query of the resource
+		{URI: "/hooks/github/other", Payload: first, Signature: getTestWebhookHMAC("secret", first), Delivery: "6", ExpectedCode: http.StatusTemporaryRedirect},
+		{URI: "/hooks/github?delete=true", Payload: first, Signature: getTestWebhookHMAC("secret", first), Delivery: "7", ExpectedCode: http.StatusTemporaryRedirect},
+		// step: without a signature the request is authenticated as usual
+		{Payload: first, ExpectedCode: http.StatusTemporaryRedirect},
+	}
+	for i, c := range cs {
+		if c.URI == "" {
+			c.URI = "/hooks/github"
+		}
+		req, _ := http.NewRequest(http.MethodPost, svc+c.URI, strings.NewReader(c.Payload))
+		if c.Signature != "" {
+			req.Header.Set(webhookGitHubHeader, "sha256="+c.Signature)
+		}
+		if c.Delivery != "" {
+			req.Header.Set(webhookGitHubDeliveryHeader, c.Delivery)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d", i)
+	}
+}
+
+func TestWebhookReplaysStripe(t *testing.T) {
+	proxy := &oauthProxy{webhooks: newWebhookReplays(nil)}
+	req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1/hooks", strings.NewReader(testWebhookPayload))
+	req.Header.Set(webhookStripeHeader, getTestStripeSignature("secret", time.Now(), testWebhookPayload))
+	assert.NoError(t, proxy.checkWebhookReplay(req))
+	assert.Equal(t, errWebhookReplay, proxy.checkWebhookReplay(req))
+
+	// step: the deliveries are shared through the counters of the store
+	proxy.webhooks = newWebhookReplays(&fakeStore{items: make(map[string]string)})
+	assert.NoError(t, proxy.checkWebhookReplay(req))
+	assert.Equal(t, errWebhookReplay, proxy.checkWebhookReplay(req))
+}
+
+func TestIsWebhookRequest(t *testing.T) {
+	resource := &Resource{URL: "/hooks/github", Methods: []string{"POST"}, Webhook: "github", Query: map[string]string{"org": "*"}}
+	cs := []struct {
+		Method   string
+		URI      string
+		Expected bool
+	}{
+		{Method: http.MethodPost, URI: "/hooks/github", Expected: true},
+		{Method: http.MethodPost, URI: "/hooks/github?org=a", Expected: true},
+		{Method: http.MethodPut, URI: "/hooks/github"},
+		{Method: http.MethodPost, URI: "/hooks/github/other"},
+		{Method: http.MethodPost, URI: "/hooks/github?org=a&delete=true"},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest(c.Method, "http://127.0.0.1"+c.URI, nil)
+		assert.Equal(t, c.Expected, isWebhookRequest(resource, req), "case %d", i)
+	}
+}